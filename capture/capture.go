@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package capture writes the NGAP and GTP-U traffic of the simulator to a pcap
+// file, wrapping the messages in synthetic IP/SCTP/UDP headers so that they
+// can be inspected in Wireshark. NAS PDUs can optionally be written in plain
+// text to a separate file so that they can be decoded without the NAS keys
+package capture
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/omec-project/gnbsim/logger"
+)
+
+const GTPU_PORT int = 2152
+
+type Config struct {
+	Enable bool `yaml:"enable" json:"enable"`
+
+	// pcap file for the NGAP and GTP-U packets
+	File string `yaml:"file" json:"file"`
+
+	// Optional pcap file for the plain text NAS PDUs
+	NasFile string `yaml:"nasFile" json:"nasFile"`
+}
+
+var (
+	pktWriter *PcapWriter
+	nasWriter *PcapWriter
+
+	// guards the synthetic header counters below
+	mu sync.Mutex
+
+	ipId uint16
+
+	// Transmission sequence numbers of the SCTP associations, keyed by the
+	// source and destination endpoints
+	tsns = make(map[string]uint32)
+)
+
+// Init opens the capture files. Capture remains disabled if cfg is nil or not
+// enabled
+func Init(cfg *Config) (err error) {
+	if cfg == nil || !cfg.Enable {
+		return nil
+	}
+	if cfg.File == "" {
+		return fmt.Errorf("capture file not configured")
+	}
+
+	pktWriter, err = NewPcapWriter(cfg.File, LINKTYPE_RAW)
+	if err != nil {
+		return err
+	}
+	logger.AppLog.Infoln("Capturing NGAP and GTP-U packets to:", cfg.File)
+
+	if cfg.NasFile != "" {
+		nasWriter, err = NewPcapWriter(cfg.NasFile, LINKTYPE_WIRESHARK_UPPER_PDU)
+		if err != nil {
+			pktWriter.Close()
+			pktWriter = nil
+			return err
+		}
+		logger.AppLog.Infoln("Capturing plain text NAS PDUs to:", cfg.NasFile)
+	}
+	return nil
+}
+
+// Close flushes and closes the capture files
+func Close() {
+	if pktWriter != nil {
+		if err := pktWriter.Close(); err != nil {
+			logger.AppLog.Errorln("Failed to close capture file:", err)
+		}
+	}
+	if nasWriter != nil {
+		if err := nasWriter.Close(); err != nil {
+			logger.AppLog.Errorln("Failed to close nas capture file:", err)
+		}
+	}
+}
+
+// Enabled returns true if NGAP and GTP-U packets are being captured
+func Enabled() bool {
+	return pktWriter != nil
+}
+
+// NasEnabled returns true if plain text NAS PDUs are being captured
+func NasEnabled() bool {
+	return nasWriter != nil
+}
+
+// Ngap captures an NGAP message exchanged between the provided SCTP endpoints
+func Ngap(srcIp string, srcPort int, dstIp string, dstPort int, pkt []byte) {
+	if pktWriter == nil {
+		return
+	}
+	src, dst := parseIp(srcIp), parseIp(dstIp)
+
+	mu.Lock()
+	key := fmt.Sprintf("%v:%v-%v:%v", srcIp, srcPort, dstIp, dstPort)
+	tsn := tsns[key]
+	tsns[key] = tsn + 1
+	ipId++
+	id := ipId
+	mu.Unlock()
+
+	sctpPkt := sctpDataPacket(uint16(srcPort), uint16(dstPort), tsn, 0,
+		NGAP_PPID, pkt)
+	write(pktWriter, ipPacket(src, dst, IP_PROTO_SCTP, id, sctpPkt))
+}
+
+// Gtpu captures a GTP-U packet exchanged between the provided UDP endpoints
+func Gtpu(srcIp string, srcPort int, dstIp string, dstPort int, pkt []byte) {
+	if pktWriter == nil {
+		return
+	}
+	src, dst := parseIp(srcIp), parseIp(dstIp)
+
+	mu.Lock()
+	ipId++
+	id := ipId
+	mu.Unlock()
+
+	udpPkt := udpPacket(src, dst, uint16(srcPort), uint16(dstPort), pkt)
+	write(pktWriter, ipPacket(src, dst, IP_PROTO_UDP, id, udpPkt))
+}
+
+// Nas captures a plain text NAS PDU, i.e. before ciphering in the uplink and
+// after deciphering in the downlink
+func Nas(pdu []byte) {
+	if nasWriter == nil {
+		return
+	}
+	write(nasWriter, exportedPdu(NAS_5GS_DISSECTOR, pdu))
+}
+
+func write(w *PcapWriter, pkt []byte) {
+	if err := w.WritePacket(pkt); err != nil {
+		logger.AppLog.Errorln("Failed to write captured packet:", err)
+	}
+}
+
+func parseIp(ip string) net.IP {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return net.IPv4zero
+	}
+	return addr
+}
@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package capture
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	IP_PROTO_UDP  uint8 = 17
+	IP_PROTO_SCTP uint8 = 132
+
+	SCTP_CHUNK_DATA uint8 = 0
+	// Beginning and Ending fragment bits of the DATA chunk
+	SCTP_DATA_FLAGS_BE uint8  = 0x03
+	NGAP_PPID          uint32 = 60
+
+	// Exported PDU tags understood by Wireshark
+	EXP_PDU_TAG_END_OF_OPT uint16 = 0
+	EXP_PDU_TAG_PROTO_NAME uint16 = 12
+	NAS_5GS_DISSECTOR      string = "nas-5gs"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// sctpDataPacket builds an SCTP packet carrying the payload in a single DATA
+// chunk, as the payload is reassembled by the socket layer
+func sctpDataPacket(srcPort, dstPort uint16, tsn uint32, stream uint16,
+	ppid uint32, payload []byte) []byte {
+
+	chunkLen := 16 + len(payload)
+	padding := (4 - chunkLen%4) % 4
+	pkt := make([]byte, 12+chunkLen+padding)
+
+	binary.BigEndian.PutUint16(pkt[0:], srcPort)
+	binary.BigEndian.PutUint16(pkt[2:], dstPort)
+	// verification tag is left zero
+
+	chunk := pkt[12:]
+	chunk[0] = SCTP_CHUNK_DATA
+	chunk[1] = SCTP_DATA_FLAGS_BE
+	binary.BigEndian.PutUint16(chunk[2:], uint16(chunkLen))
+	binary.BigEndian.PutUint32(chunk[4:], tsn)
+	binary.BigEndian.PutUint16(chunk[8:], stream)
+	// stream sequence number is left zero as messages are sent unordered
+	binary.BigEndian.PutUint32(chunk[12:], ppid)
+	copy(chunk[16:], payload)
+
+	// SCTP checksum is stored in little endian byte order (RFC 4960, App. B)
+	binary.LittleEndian.PutUint32(pkt[8:], crc32.Checksum(pkt, crc32c))
+	return pkt
+}
+
+// udpPacket builds a UDP datagram carrying the payload
+func udpPacket(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	pkt := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(pkt[0:], srcPort)
+	binary.BigEndian.PutUint16(pkt[2:], dstPort)
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)))
+	copy(pkt[8:], payload)
+
+	sum := pseudoHeaderSum(src, dst, IP_PROTO_UDP, len(pkt))
+	csum := checksum(pkt, sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(pkt[6:], csum)
+	return pkt
+}
+
+// ipPacket prepends an IPv4 or IPv6 header to the transport layer packet
+// depending upon the address family of the source address
+func ipPacket(src, dst net.IP, proto uint8, id uint16, payload []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt := make([]byte, 20+len(payload))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], id)
+		// don't fragment
+		pkt[6] = 0x40
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+		copy(pkt[20:], payload)
+		return pkt
+	}
+
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = 64
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+	copy(pkt[40:], payload)
+	return pkt
+}
+
+// pseudoHeaderSum returns the sum of the pseudo header fields used in the
+// transport layer checksum
+func pseudoHeaderSum(src, dst net.IP, proto uint8, length int) uint32 {
+	var sum uint32
+	addrs := make([]byte, 0, 32)
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		addrs = append(addrs, src4...)
+		addrs = append(addrs, dst4...)
+	} else {
+		addrs = append(addrs, src.To16()...)
+		addrs = append(addrs, dst.To16()...)
+	}
+	for i := 0; i+1 < len(addrs); i += 2 {
+		sum += uint32(addrs[i])<<8 | uint32(addrs[i+1])
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksum computes the internet checksum (RFC 1071) over data, seeded with
+// initial
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// exportedPdu wraps the payload with the tags which direct Wireshark to
+// decode it using the named dissector
+func exportedPdu(dissector string, payload []byte) []byte {
+	nameLen := (len(dissector) + 3) &^ 3
+	pkt := make([]byte, 4+nameLen+4+len(payload))
+	binary.BigEndian.PutUint16(pkt[0:], EXP_PDU_TAG_PROTO_NAME)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(nameLen))
+	copy(pkt[4:], dissector)
+	// EXP_PDU_TAG_END_OF_OPT with zero length, left zero
+	copy(pkt[4+nameLen+4:], payload)
+	return pkt
+}
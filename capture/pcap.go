@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcap link types
+const (
+	LINKTYPE_RAW                 uint32 = 101
+	LINKTYPE_WIRESHARK_UPPER_PDU uint32 = 252
+)
+
+const (
+	PCAP_MAGIC         uint32 = 0xa1b2c3d4
+	PCAP_VERSION_MAJOR uint16 = 2
+	PCAP_VERSION_MINOR uint16 = 4
+	PCAP_SNAPLEN       uint32 = 262144
+)
+
+// PcapWriter writes packets to a file in the classic pcap format
+type PcapWriter struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// NewPcapWriter creates the file at path and writes the pcap global header
+// with the provided link type
+func NewPcapWriter(path string, linkType uint32) (*PcapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %v", err)
+	}
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(hdr[6:], PCAP_VERSION_MINOR)
+	// thiszone and sigfigs are always zero
+	binary.LittleEndian.PutUint32(hdr[16:], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(hdr[20:], linkType)
+	if _, err = file.Write(hdr); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write pcap header: %v", err)
+	}
+
+	return &PcapWriter{file: file}, nil
+}
+
+// WritePacket writes a single record with the current time as the timestamp
+func (w *PcapWriter) WritePacket(pkt []byte) error {
+	now := time.Now()
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("capture file closed")
+	}
+	if _, err := w.file.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.file.Write(pkt)
+	return err
+}
+
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
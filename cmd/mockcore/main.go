@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/mockcore"
+
+	"github.com/urfave/cli"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "MOCKCORE"
+	app.Usage = "./mockcore --cfg [mock core configuration file]"
+	app.Action = action
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "cfg",
+			Usage: "Mock core config file, either standalone or a gnbsim config file with a mockCore section",
+		},
+		cli.StringFlag{
+			Name:  "logLevel",
+			Usage: "Log level: trace, debug, info, warn, error, fatal, panic",
+			Value: "info",
+		},
+	}
+
+	logger.AppLog.Infoln("App Name:", app.Name)
+
+	if err := app.Run(os.Args); err != nil {
+		logger.AppLog.Errorln("Failed to run MOCKCORE:", err)
+		os.Exit(1)
+	}
+}
+
+func action(c *cli.Context) error {
+	logger.SetLogLevel(c.String("logLevel"))
+
+	cfg, err := mockcore.LoadConfig(c.String("cfg"))
+	if err != nil {
+		logger.AppLog.Errorln("Failed to load configuration:", err)
+		return err
+	}
+
+	mockCore, err := mockcore.Start(cfg)
+	if err != nil {
+		logger.AppLog.Errorln("Failed to start mock core:", err)
+		return err
+	}
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	<-signalChannel
+	mockCore.Stop()
+	return nil
+}
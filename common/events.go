@@ -27,6 +27,13 @@ const (
 	INIT_EVENT EventType = COMMON_EVENT + 1 + iota
 	QUIT_EVENT
 	ERROR_EVENT
+
+	// Expiry of the periodic registration update timer of the UE
+	T3512_EXPIRY_EVENT
+
+	// Request to record the state of the UE for later runs, forwarded by
+	// SimUe to RealUe
+	SAVE_STATE_EVENT
 )
 
 /* Events between Profile and SimUe */
@@ -49,6 +56,17 @@ const (
 	DATA_PKT_GEN_REQUEST_EVENT EventType = SIMUE_REALUE_EVENT + 1 + iota
 	DATA_PKT_GEN_SUCCESS_EVENT
 	DATA_PKT_GEN_FAILURE_EVENT
+
+	// RealUe reports that it moved to idle state, once the NAS messages
+	// received before the connection release are handled
+	CONNECTION_RELEASED_EVENT
+
+	// RealUe reports that a PDU session was released, once the NAS messages
+	// received before the data bearer release are handled
+	PDU_SESS_RELEASED_EVENT
+
+	// RealUe reports its 5G-GUTI and PDU sessions whenever they change
+	UE_IDENTITIES_EVENT
 )
 
 /* Events between UE and GNodeB (UU) */
@@ -75,6 +93,25 @@ const (
 	// SimUe commands gNB to trigger RAN Connection release which further
 	// triggers gNB initiated UE Context Release Request
 	TRIGGER_AN_RELEASE_EVENT
+
+	// SimUe commands gNB to reset the NG connection of the UE through a gNB
+	// initiated NG Reset
+	TRIGGER_NG_RESET_EVENT
+
+	// gNB reports the Error Indication received from the network for the UE
+	ERROR_INDICATION_EVENT
+
+	// SimUe commands the source gNB to hand the UE over to a target gNB
+	TRIGGER_HANDOVER_EVENT
+
+	// Source gNB commands the UE to move to the target gNB
+	HANDOVER_COMMAND_EVENT
+
+	// UE confirms to the target gNB that it moved to it
+	HANDOVER_CONFIRM_EVENT
+
+	// Source gNB reports to the UE that the handover could not be prepared
+	HANDOVER_FAILURE_EVENT
 )
 
 /* Events betweem UE and AMF (N1)
@@ -153,17 +190,48 @@ const (
 	PDU_SESS_RESOURCE_SETUP_REQUEST_EVENT
 	PDU_SESS_RESOURCE_RELEASE_COMMAND_EVENT
 	UE_CTX_RELEASE_COMMAND_EVENT
+	PDU_SESS_RESOURCE_MODIFY_REQUEST_EVENT
+
+	// Association with the AMF serving the UE lost, the gNB releases the UE
+	// context locally
+	AMF_ASSOC_LOST_EVENT
+
+	// AMF reset the NG connection of the UE, the gNB releases the UE context
+	// locally
+	NG_RESET_EVENT
+
+	// AMF acknowledged the reset of the NG connection of the UE requested by
+	// the gNB
+	NG_RESET_ACK_EVENT
+
+	// AMF reported an error in a message sent by the gNB for the UE
+	NGAP_ERROR_INDICATION_EVENT
+
+	// AMF requests the target gNB to allocate resources for a UE handed
+	// over to it
+	NGAP_HANDOVER_REQUEST_EVENT
+
+	// AMF commands the source gNB to hand the UE over
+	NGAP_HANDOVER_COMMAND_EVENT
+
+	// AMF reports to the source gNB that the handover preparation failed
+	NGAP_HANDOVER_PREP_FAILURE_EVENT
 )
 
 // Events between GNodeB and UPF (N3)
 const (
 	DL_UE_DATA_TRANSPORT_EVENT EventType = N3_EVENT + 1 + iota
+
+	// UPF reported that it has no context for the UL TEID of the UE
+	GTPU_ERROR_INDICATION_EVENT
 )
 
 var evtStrMap map[EventType]string = map[EventType]string{
 	INIT_EVENT:                              "INIT-EVENT",
 	QUIT_EVENT:                              "QUIT-EVENT",
 	ERROR_EVENT:                             "ERROR-EVENT",
+	T3512_EXPIRY_EVENT:                      "T3512-EXPIRY-EVENT",
+	SAVE_STATE_EVENT:                        "SAVE-STATE-EVENT",
 	PROFILE_START_EVENT:                     "PROFILE-START-EVENT",
 	PROFILE_PASS_EVENT:                      "PROFILE-PASS-EVENT",
 	PROFILE_FAIL_EVENT:                      "PROFILE-FAIL-EVENT",
@@ -172,6 +240,9 @@ var evtStrMap map[EventType]string = map[EventType]string{
 	DATA_PKT_GEN_REQUEST_EVENT:              "DATA-PACKET-GENERATION-REQUEST-EVENT",
 	DATA_PKT_GEN_SUCCESS_EVENT:              "DATA-PACKET-SUCCESS-EVENT",
 	DATA_PKT_GEN_FAILURE_EVENT:              "DATA-PACKET-FAILURE-EVENT",
+	CONNECTION_RELEASED_EVENT:               "CONNECTION-RELEASED-EVENT",
+	PDU_SESS_RELEASED_EVENT:                 "PDU-SESSION-RELEASED-EVENT",
+	UE_IDENTITIES_EVENT:                     "UE-IDENTITIES-EVENT",
 	CONNECTION_REQUEST_EVENT:                "CONNECTION-REQUEST-EVENT",
 	CONNECTION_RELEASE_REQUEST_EVENT:        "CONNECTION-RELEASE-REQUEST-EVENT",
 	UL_INFO_TRANSFER_EVENT:                  "UL-INFO-TRANSFER-EVENT",
@@ -184,6 +255,12 @@ var evtStrMap map[EventType]string = map[EventType]string{
 	DATA_BEARER_RELEASE_REQUEST_EVENT:       "DATA-BEARER-RELEASE-REQUEST-EVENT",
 	CTX_RELEASE_ACKNOWLEDGEMENT_EVENT:       "CONTEXT-RELEASE-ACKNOWLEDGEMENT-EVENT",
 	TRIGGER_AN_RELEASE_EVENT:                "TRIGGER-AN-RELEASE-EVENT",
+	TRIGGER_NG_RESET_EVENT:                  "TRIGGER-NG-RESET-EVENT",
+	ERROR_INDICATION_EVENT:                  "ERROR-INDICATION-EVENT",
+	TRIGGER_HANDOVER_EVENT:                  "TRIGGER-HANDOVER-EVENT",
+	HANDOVER_COMMAND_EVENT:                  "HANDOVER-COMMAND-EVENT",
+	HANDOVER_CONFIRM_EVENT:                  "HANDOVER-CONFIRM-EVENT",
+	HANDOVER_FAILURE_EVENT:                  "HANDOVER-FAILURE-EVENT",
 	REG_REQUEST_EVENT:                       "REGESTRATION-REQUEST-EVENT",
 	REG_ACCEPT_EVENT:                        "REGESTRATION-ACCEPT-EVENT",
 	REG_COMPLETE_EVENT:                      "REGESTRATION-COMPLETE-EVENT",
@@ -231,7 +308,16 @@ var evtStrMap map[EventType]string = map[EventType]string{
 	INITIAL_CTX_SETUP_REQUEST_EVENT:         "INITIAL-CONTEXT-SETUP-REQUEST-EVENT",
 	PDU_SESS_RESOURCE_SETUP_REQUEST_EVENT:   "PDU-SESSION-RESOURCE-SETUP-REQUEST-EVENT",
 	UE_CTX_RELEASE_COMMAND_EVENT:            "UE-CONTEXT-RELEASE-COMMAND-EVENT",
+	PDU_SESS_RESOURCE_MODIFY_REQUEST_EVENT:  "PDU-SESSION-RESOURCE-MODIFY-REQUEST-EVENT",
+	AMF_ASSOC_LOST_EVENT:                    "AMF-ASSOCIATION-LOST-EVENT",
+	NG_RESET_EVENT:                          "NG-RESET-EVENT",
+	NG_RESET_ACK_EVENT:                      "NG-RESET-ACKNOWLEDGE-EVENT",
+	NGAP_ERROR_INDICATION_EVENT:             "NGAP-ERROR-INDICATION-EVENT",
+	NGAP_HANDOVER_REQUEST_EVENT:             "NGAP-HANDOVER-REQUEST-EVENT",
+	NGAP_HANDOVER_COMMAND_EVENT:             "NGAP-HANDOVER-COMMAND-EVENT",
+	NGAP_HANDOVER_PREP_FAILURE_EVENT:        "NGAP-HANDOVER-PREPARATION-FAILURE-EVENT",
 	DL_UE_DATA_TRANSPORT_EVENT:              "DL-UE-DATA-TRANSPORT-EVENT",
+	GTPU_ERROR_INDICATION_EVENT:             "GTP-U-ERROR-INDICATION-EVENT",
 	PROC_START_EVENT:                        "PROC-START-EVENT",
 	PROC_PASS_EVENT:                         "PROC-PASS-EVENT",
 	PROC_FAIL_EVENT:                         "PROC-FAIL-EVENT",
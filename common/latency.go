@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProcedureLatency holds the latency statistics computed for the executions
+// of a procedure
+type ProcedureLatency struct {
+	Count int
+	Min   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// LatencyRecorder collects procedure execution times reported by the UEs of
+// a profile, successful and failed executions are kept apart. It is safe for
+// concurrent use
+type LatencyRecorder struct {
+	mu      sync.Mutex
+	samples map[ProcedureType][]time.Duration
+	failed  map[ProcedureType][]time.Duration
+}
+
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{
+		samples: make(map[ProcedureType][]time.Duration),
+		failed:  make(map[ProcedureType][]time.Duration),
+	}
+}
+
+// Record adds the execution time of a procedure which passed
+func (r *LatencyRecorder) Record(proc ProcedureType, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[proc] = append(r.samples[proc], latency)
+}
+
+// RecordFailure adds the execution time of a procedure which failed
+func (r *LatencyRecorder) RecordFailure(proc ProcedureType, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[proc] = append(r.failed[proc], latency)
+}
+
+// Summarize computes the latency statistics for each procedure which passed
+func (r *LatencyRecorder) Summarize() map[ProcedureType]*ProcedureLatency {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return summarize(r.samples)
+}
+
+// SummarizeFailures computes the latency statistics for each procedure which
+// failed
+func (r *LatencyRecorder) SummarizeFailures() map[ProcedureType]*ProcedureLatency {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return summarize(r.failed)
+}
+
+// SortedProcedures returns the procedures of the latency statistics ordered
+// by procedure type
+func SortedProcedures(latency map[ProcedureType]*ProcedureLatency) []ProcedureType {
+	procs := make([]ProcedureType, 0, len(latency))
+	for proc := range latency {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i] < procs[j] })
+	return procs
+}
+
+func summarize(recorded map[ProcedureType][]time.Duration) map[ProcedureType]*ProcedureLatency {
+	result := make(map[ProcedureType]*ProcedureLatency)
+	for proc, samples := range recorded {
+		if len(samples) == 0 {
+			continue
+		}
+		sorted := make([]time.Duration, len(samples))
+		copy(sorted, samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		var total time.Duration
+		for _, s := range sorted {
+			total += s
+		}
+
+		result[proc] = &ProcedureLatency{
+			Count: len(sorted),
+			Min:   sorted[0],
+			Mean:  total / time.Duration(len(sorted)),
+			P50:   percentile(sorted, 50),
+			P95:   percentile(sorted, 95),
+			P99:   percentile(sorted, 99),
+			Max:   sorted[len(sorted)-1],
+		}
+	}
+	return result
+}
+
+// percentile returns the nearest-rank percentile from the sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -5,11 +5,15 @@
 package common
 
 import (
+	"net"
+	"time"
+
 	"github.com/omec-project/gnbsim/util/ngapTestpacket"
 	"github.com/omec-project/gnbsim/util/test"
 
 	"github.com/omec-project/nas"
 	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/openapi/models"
 )
 
 type InterfaceMessage interface {
@@ -45,6 +49,10 @@ type UuMessage struct {
 	DefaultMessage
 	Supi string
 
+	// 5G-S-TMSI (hex string) provided along with the initial NAS message,
+	// used by the gNB to select the AMF. Empty if the UE has no 5G-GUTI
+	FiveGSTmsi string
+
 	// Encoded NAS message
 	NasPdus  NasPduList
 	DBParams []*DataBearerParams
@@ -65,6 +73,9 @@ type ProfileMessage struct {
 	DefaultMessage
 	Supi string
 	Proc ProcedureType
+
+	// PDU sessions the procedure applies to
+	PduSessions []*PduSessionParams
 }
 
 // SummaryMessage is used to carry profile execution summary. Sent by profile
@@ -76,6 +87,18 @@ type SummaryMessage struct {
 	UePassedCount uint
 	UeFailedCount uint
 	ErrorList     []error
+
+	// Set if the profile was aborted, the summary is then partial
+	Aborted bool
+
+	// Latency statistics of successfully completed procedures
+	ProcLatency map[ProcedureType]*ProcedureLatency
+
+	// Latency statistics of failed procedures
+	ProcFailLatency map[ProcedureType]*ProcedureLatency
+
+	// Per UE execution results
+	UeResults []*UeResult
 }
 
 // DataBearerParams hold information require to setup data bearer(path) between
@@ -117,8 +140,65 @@ type UeMessage struct {
 	// Number of user data packets to be generated as directed by profile
 	UserDataPktCount int
 
+	// If set, the user data packets are sent at this interval instead of one
+	// after the reply to the previous one, and at most MaxUserDataPktLoss of
+	// them may be lost
+	UserDataPktInterval time.Duration
+	MaxUserDataPktLoss  int
+
 	// default destination of data pkt
 	DefaultAs string
 
+	// Registration type of the Registration Request to be sent. The UE is
+	// identified by its 5G-GUTI if set, by its SUCI otherwise
+	RegistrationType uint8
+
+	// PDU sessions the PDU session procedure or user data generation
+	// applies to
+	PduSessions []*PduSessionParams
+
 	CommChan chan InterfaceMessage
 }
+
+// UeIdentitiesMessage carries the 5G-GUTI and the PDU sessions held by the
+// RealUe, which only the RealUe routine may access
+type UeIdentitiesMessage struct {
+	DefaultMessage
+	Guti        string
+	PduSessions []*PduSessionInfo
+}
+
+// SaveStateMessage asks the UE to record its state for later runs
+type SaveStateMessage struct {
+	DefaultMessage
+
+	// Set by SimUe before forwarding the request to RealUe
+	Registered bool
+
+	// Closed by RealUe once the state is recorded
+	Done chan struct{}
+}
+
+// PduSessionInfo describes a PDU session established by the UE
+type PduSessionInfo struct {
+	PduSessId   int64
+	PduSessType models.PduSessionType
+	Dnn         string
+	Snssai      models.Snssai
+	PduAddress  net.IP
+	// nil until the IPv6 prefix is learnt
+	PduAddressV6 net.IP
+}
+
+// PduSessionParams describes a PDU session requested by the UE
+type PduSessionParams struct {
+	PduSessId   uint8
+	Dnn         string
+	SNssai      *models.Snssai
+	PduSessType uint8 // PDU session type value, TS 24.501 Section 9.11.4.11
+	SscMode     uint8
+
+	// destination of the user data packets sent on the PDU session, IPv4 or
+	// IPv6 address. Empty if none configured for the selected address family
+	DefaultAs string
+}
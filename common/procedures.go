@@ -21,21 +21,35 @@ const (
 	AMF_RELEASE_PROCEDURE
 	NW_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE
 	CUSTOM_PROCEDURE
+	GUTI_REGISTRATION_PROCEDURE
+	MOBILITY_REGISTRATION_UPDATE_PROCEDURE
+	PERIODIC_REGISTRATION_UPDATE_PROCEDURE
+	UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE
+	NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE
+	NG_RESET_PROCEDURE
+	N2_HANDOVER_PROCEDURE
 )
 
 var procStrMap = map[ProcedureType]string{
-	UNKNOWN_PROCEDURE:                          "UNKNOWN-PROCEDURE",
-	REGISTRATION_PROCEDURE:                     "REGISTRATION-PROCEDURE",
-	PDU_SESSION_ESTABLISHMENT_PROCEDURE:        "PDU-SESSION-ESTABLISHMENT-PROCEDURE",
-	USER_DATA_PKT_GENERATION_PROCEDURE:         "USER-DATA-PACKET-GENERATION-PROCEDURE",
-	UE_INITIATED_DEREGISTRATION_PROCEDURE:      "UE-INITIATED-DEREGISTRATION-PROCEDURE",
-	AN_RELEASE_PROCEDURE:                       "AN-RELEASE-PROCEDURE",
-	UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE:     "UE-TRIGGERED-SERVICE-REQUEST-PROCEDURE",
-	NW_TRIGGERED_UE_DEREGISTRATION_PROCEDURE:   "NW-TRIGGERED-UE-DEREGISTRATION-PROCEDURE",
-	AMF_RELEASE_PROCEDURE:                      "AMF-RELEASE-PROCEDURE",
-	UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE: "UE-REQUESTED-PDU-SESSION-RELEASE-PROCEDURE",
-	NW_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE: "NW-REQUESTED-PDU-SESSION-RELEASE-PROCEDURE",
-	CUSTOM_PROCEDURE:                           "CUSTOM-PROCEDURE",
+	UNKNOWN_PROCEDURE:                               "UNKNOWN-PROCEDURE",
+	REGISTRATION_PROCEDURE:                          "REGISTRATION-PROCEDURE",
+	PDU_SESSION_ESTABLISHMENT_PROCEDURE:             "PDU-SESSION-ESTABLISHMENT-PROCEDURE",
+	USER_DATA_PKT_GENERATION_PROCEDURE:              "USER-DATA-PACKET-GENERATION-PROCEDURE",
+	UE_INITIATED_DEREGISTRATION_PROCEDURE:           "UE-INITIATED-DEREGISTRATION-PROCEDURE",
+	AN_RELEASE_PROCEDURE:                            "AN-RELEASE-PROCEDURE",
+	UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE:          "UE-TRIGGERED-SERVICE-REQUEST-PROCEDURE",
+	NW_TRIGGERED_UE_DEREGISTRATION_PROCEDURE:        "NW-TRIGGERED-UE-DEREGISTRATION-PROCEDURE",
+	AMF_RELEASE_PROCEDURE:                           "AMF-RELEASE-PROCEDURE",
+	UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE:      "UE-REQUESTED-PDU-SESSION-RELEASE-PROCEDURE",
+	NW_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE:      "NW-REQUESTED-PDU-SESSION-RELEASE-PROCEDURE",
+	CUSTOM_PROCEDURE:                                "CUSTOM-PROCEDURE",
+	GUTI_REGISTRATION_PROCEDURE:                     "GUTI-REGISTRATION-PROCEDURE",
+	MOBILITY_REGISTRATION_UPDATE_PROCEDURE:          "MOBILITY-REGISTRATION-UPDATE-PROCEDURE",
+	PERIODIC_REGISTRATION_UPDATE_PROCEDURE:          "PERIODIC-REGISTRATION-UPDATE-PROCEDURE",
+	UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE: "UE-REQUESTED-PDU-SESSION-MODIFICATION-PROCEDURE",
+	NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE: "NW-REQUESTED-PDU-SESSION-MODIFICATION-PROCEDURE",
+	NG_RESET_PROCEDURE:                              "NG-RESET-PROCEDURE",
+	N2_HANDOVER_PROCEDURE:                           "N2-HANDOVER-PROCEDURE",
 }
 
 func (id ProcedureType) String() string {
@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/omec-project/nas/nasMessage"
+)
+
+// RejectError is the error of a procedure rejected by the network. It carries
+// the 5GMM cause and the back-off timer of the reject message
+type RejectError struct {
+	// Rejected request, e.g. "registration"
+	Request string
+	Cause   uint8
+
+	// T3346 back-off timer value, zero if not provided
+	T3346 time.Duration
+}
+
+func (e *RejectError) Error() string {
+	s := fmt.Sprintf("%v rejected, 5gmm cause:%v", e.Request, e.CauseString())
+	if e.T3346 > 0 {
+		s += fmt.Sprintf(", t3346:%v", e.T3346)
+	}
+	return s
+}
+
+// CauseString returns the name of the 5GMM cause along with its value
+func (e *RejectError) CauseString() string {
+	if s := nasMessage.Cause5GMMToString(e.Cause); s != "" {
+		return s
+	}
+	return fmt.Sprintf("Unknown cause (%d)", e.Cause)
+}
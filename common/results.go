@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package common
+
+import "time"
+
+// result status
+const (
+	STATUS_PASS    string = "PASS"
+	STATUS_FAIL    string = "FAIL"
+	STATUS_TIMEOUT string = "TIMEOUT"
+	STATUS_ABORTED string = "ABORTED"
+)
+
+// execution status of profiles and UEs which are yet to finish
+const (
+	STATUS_NOT_STARTED string = "NOT_STARTED"
+	STATUS_RUNNING     string = "RUNNING"
+)
+
+// ProcedureResult holds the outcome of a single procedure executed by a UE
+type ProcedureResult struct {
+	Name     string
+	Status   string
+	Duration time.Duration
+	Error    string
+
+	// 5GMM cause of the reject received during the procedure, if any
+	Cause string
+}
+
+// UeResult holds the outcome of all the procedures executed by a UE along
+// with the identities it acquired
+type UeResult struct {
+	Supi         string
+	Status       string
+	Duration     time.Duration
+	Error        string
+	Guti         string
+	PduAddresses []string
+	Procedures   []*ProcedureResult
+}
+
+// CountRejectCauses returns the number of rejects received per procedure and
+// 5GMM cause by the UEs, keyed by "<procedure>: <cause>"
+func CountRejectCauses(results []*UeResult) map[string]int {
+	counts := make(map[string]int)
+	for _, ueResult := range results {
+		if ueResult == nil {
+			continue
+		}
+		for _, procResult := range ueResult.Procedures {
+			if procResult.Cause != "" {
+				counts[procResult.Name+": "+procResult.Cause]++
+			}
+		}
+	}
+	return counts
+}
@@ -13,12 +13,12 @@ package factory
 import (
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
 
-	"github.com/omec-project/gnbsim/common"
+	"github.com/omec-project/gnbsim/capture"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/mockcore"
 	profctx "github.com/omec-project/gnbsim/profile/context"
+	"github.com/omec-project/gnbsim/uestate"
 )
 
 const (
@@ -45,6 +45,9 @@ type Configuration struct {
 	ExecInParallel  bool                        `yaml:"execInParallel"`
 	Server          HttpServer                  `yaml:"httpServer"`
 	GoProfile       ProfileServer               `yaml:"goProfile"`
+	Capture         *capture.Config             `yaml:"capture"`
+	MockCore        *mockcore.Config            `yaml:"mockCore"`
+	UeState         *uestate.Config             `yaml:"ueState"`
 }
 
 type ProfileServer struct {
@@ -104,54 +107,16 @@ func (c *Config) Validate() (err error) {
 		return fmt.Errorf("no profile information available")
 	}
 
+	if c.Configuration.MockCore != nil && c.Configuration.MockCore.Enable {
+		if err := c.Configuration.MockCore.Validate(); err != nil {
+			return fmt.Errorf("invalid mockCore: %v", err)
+		}
+	}
+
 	if len(c.Configuration.CustomProfiles) != 0 {
-		for _, v := range c.Configuration.CustomProfiles {
-			it := v.Iterations
-			v.PIterations = make(map[string]*profctx.PIterations)
-			for _, v1 := range it {
-				if len(v1.Next) == 0 {
-					v1.Next = "quit" // default value
-				}
-				PIter := &profctx.PIterations{Name: v1.Name, NextItr: v1.Next, Repeat: v1.Repeat}
-				PIter.ProcMap = make(map[int]common.ProcedureType)
-				PIter.WaitMap = make(map[int]int)
-				PIter.WaitMap[0] = 0
-				if len(v1.First) > 0 {
-					x := strings.Fields(v1.First)
-					PIter.ProcMap[1] = common.GetProcId(x[0])
-					PIter.WaitMap[1], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Second) > 0 {
-					x := strings.Fields(v1.Second)
-					PIter.ProcMap[2] = common.GetProcId(x[0])
-					PIter.WaitMap[2], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Third) > 0 {
-					x := strings.Fields(v1.Third)
-					PIter.ProcMap[3] = common.GetProcId(x[0])
-					PIter.WaitMap[3], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Fourth) > 0 {
-					x := strings.Fields(v1.Fourth)
-					PIter.ProcMap[4] = common.GetProcId(x[0])
-					PIter.WaitMap[4], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Fifth) > 0 {
-					x := strings.Fields(v1.Fifth)
-					PIter.ProcMap[5] = common.GetProcId(x[0])
-					PIter.WaitMap[5], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Sixth) > 0 {
-					x := strings.Fields(v1.Sixth)
-					PIter.ProcMap[6] = common.GetProcId(x[0])
-					PIter.WaitMap[6], err = strconv.Atoi(x[1])
-				}
-				if len(v1.Seventh) > 0 {
-					x := strings.Fields(v1.Seventh)
-					PIter.ProcMap[7] = common.GetProcId(x[0])
-					PIter.WaitMap[7], err = strconv.Atoi(x[1])
-				}
-				v.PIterations[v1.Name] = PIter // add iterations in the custom profile
+		for name, v := range c.Configuration.CustomProfiles {
+			if err := v.InitIterations(); err != nil {
+				return fmt.Errorf("invalid iterations in custom profile %v: %v", name, err)
 			}
 		}
 
@@ -160,6 +125,27 @@ func (c *Config) Validate() (err error) {
 		}
 	}
 
+	for _, profile := range c.Configuration.Profiles {
+		if err := profile.InitSecurityAlgorithms(); err != nil {
+			return fmt.Errorf("profile %v: %v", profile.Name, err)
+		}
+		if err := profile.InitSuci(); err != nil {
+			return fmt.Errorf("profile %v: %v", profile.Name, err)
+		}
+		if err := profile.InitPei(); err != nil {
+			return fmt.Errorf("profile %v: %v", profile.Name, err)
+		}
+		if err := profile.InitPduSessions(); err != nil {
+			return fmt.Errorf("profile %v: %v", profile.Name, err)
+		}
+		if profile.CallModel != nil {
+			if err := profile.CallModel.Validate(); err != nil {
+				return fmt.Errorf("invalid callModel in profile %v: %v",
+					profile.Name, err)
+			}
+		}
+	}
+
 	return nil
 }
 
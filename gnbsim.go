@@ -12,21 +12,28 @@ import (
 	_ "net/http/pprof" //Using package only for invoking initialization.
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
-	"time"
 
+	"github.com/omec-project/gnbsim/capture"
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/factory"
 	"github.com/omec-project/gnbsim/gnodeb"
 	"github.com/omec-project/gnbsim/httpserver"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/mockcore"
 	prof "github.com/omec-project/gnbsim/profile"
 	profctx "github.com/omec-project/gnbsim/profile/context"
+	"github.com/omec-project/gnbsim/report"
+	"github.com/omec-project/gnbsim/uestate"
 
 	"github.com/urfave/cli"
 )
 
+// runReport accumulates the execution summaries of all the profiles
+var runReport = report.NewReport()
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "GNBSIM"
@@ -38,7 +45,7 @@ func main() {
 
 	if err := app.Run(os.Args); err != nil {
 		logger.AppLog.Errorln("Failed to run GNBSIM:", err)
-		return
+		os.Exit(1)
 	}
 }
 
@@ -73,14 +80,62 @@ func action(c *cli.Context) error {
 	logger.AppLog.Infoln("Setting log level to:", lvl)
 	logger.SetLogLevel(lvl)
 
+	if err := capture.Init(config.Configuration.Capture); err != nil {
+		logger.AppLog.Errorln("Failed to initialize capture:", err)
+		return err
+	}
+	defer capture.Close()
+
+	if err := uestate.Init(config.Configuration.UeState); err != nil {
+		logger.AppLog.Errorln("Failed to initialize ue state store:", err)
+		return err
+	}
+	defer uestate.Close()
+
+	if config.Configuration.MockCore != nil && config.Configuration.MockCore.Enable {
+		mockCore, err := mockcore.Start(config.Configuration.MockCore)
+		if err != nil {
+			logger.AppLog.Errorln("Failed to start mock core:", err)
+			return err
+		}
+		defer mockCore.Stop()
+	}
+
+	// The running profiles are aborted on the first signal, which releases
+	// their UEs, and the gNodeBs stop retrying the NG Setup. A second signal
+	// terminates gnbsim right away
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signalChannel
+		logger.AppLog.Infoln("Received signal:", sig, ", shutting down")
+		profctx.Shutdown()
+		gnodeb.AbortInit()
+		if config.Configuration.Server.Enable {
+			logger.AppLog.Infoln("StopHttpServer called")
+			httpserver.StopHttpServer()
+			logger.AppLog.Infoln("StopHttpServer returned ")
+		}
+		sig = <-signalChannel
+		logger.AppLog.Errorln("Received signal:", sig, ", exiting")
+		os.Exit(1)
+	}()
+
 	prof.InitializeAllProfiles()
 	err := gnodeb.InitializeAllGnbs()
 	if err != nil {
 		logger.AppLog.Errorln("Failed to initialize gNodeBs:", err)
 		return err
 	}
+	if profctx.IsShuttingDown() {
+		return fmt.Errorf("shut down while initializing gNodeBs")
+	}
 
-	go ListenAndLogSummary()
+	summaryDone := make(chan struct{})
+	go func() {
+		defer close(summaryDone)
+		ListenAndLogSummary()
+	}()
 
 	var appWaitGrp sync.WaitGroup
 	if config.Configuration.Server.Enable {
@@ -92,15 +147,6 @@ func action(c *cli.Context) error {
 				logger.AppLog.Infoln("StartHttpServer returned :", err)
 			}
 		}()
-
-		signalChannel := make(chan os.Signal, 1)
-		signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-signalChannel
-			logger.AppLog.Infoln("StopHttpServer called")
-			httpserver.StopHttpServer()
-			logger.AppLog.Infoln("StopHttpServer returned ")
-		}()
 	}
 
 	var profileWaitGrp sync.WaitGroup
@@ -110,10 +156,16 @@ func action(c *cli.Context) error {
 		if !profile.Enable {
 			continue
 		}
-		profileWaitGrp.Add(1)
-
-		prof.InitProfile(profile, profctx.SummaryChan)
+		if profctx.IsShuttingDown() {
+			logger.AppLog.Infoln("Shutting down, not starting profile:", profile.Name)
+			break
+		}
+		if err := prof.InitProfile(profile, profctx.SummaryChan); err != nil {
+			logger.AppLog.Errorln("Failed to initialize profile:", profile.Name, ", error:", err)
+			continue
+		}
 
+		profileWaitGrp.Add(1)
 		go func(profileCtx *profctx.Profile) {
 			defer profileWaitGrp.Done()
 			prof.ExecuteProfile(profileCtx, profctx.SummaryChan)
@@ -130,8 +182,30 @@ func action(c *cli.Context) error {
 
 	appWaitGrp.Wait()
 
-	// TODO: To be removed. Allowing summary logger to dump the logs
-	time.Sleep(time.Second * 5)
+	// Profiles started over the HTTP server may still be releasing their UEs
+	for _, profile := range profctx.GetProfiles() {
+		profile.Wait()
+	}
+	for _, gnb := range config.Configuration.Gnbs {
+		gnodeb.QuitGnb(gnb)
+	}
+
+	// All the profiles have sent their summaries by now, wait for the summary
+	// logger to drain them
+	profctx.SummaryChan <- &common.DefaultMessage{Event: common.QUIT_EVENT}
+	<-summaryDone
+
+	if path := c.String("report"); path != "" {
+		if err := runReport.Write(path); err != nil {
+			logger.AppLog.Errorln("Failed to write report:", err)
+			return err
+		}
+		logger.AppLog.Infoln("Report written to:", path)
+	}
+
+	if runReport.Failed() {
+		return fmt.Errorf("one or more profiles failed")
+	}
 
 	return nil
 }
@@ -142,6 +216,24 @@ func getCliFlags() []cli.Flag {
 			Name:  "cfg",
 			Usage: "GNBSIM config file",
 		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "Write the run report in JSON (<report>.json) and JUnit XML (<report>.xml) formats",
+		},
+	}
+}
+
+// logLatency logs the latency statistics of each procedure, ordered by
+// procedure type
+func logLatency(title string, latency map[common.ProcedureType]*common.ProcedureLatency) {
+	if len(latency) == 0 {
+		return
+	}
+	logger.AppSummaryLog.Infoln(title)
+	for _, proc := range common.SortedProcedures(latency) {
+		l := latency[proc]
+		logger.AppSummaryLog.Infof("%v: count:%v, %v/%v/%v/%v/%v/%v", proc,
+			l.Count, l.Min, l.Mean, l.P50, l.P95, l.P99, l.Max)
 	}
 }
 
@@ -159,10 +251,27 @@ func ListenAndLogSummary() {
 		if !ok {
 			logger.AppLog.Fatalln("Invalid Message Type")
 		}
+		runReport.AddProfile(msg)
 
 		logger.AppSummaryLog.Infoln("Profile Name:", msg.ProfileName, ", Profile Type:", msg.ProfileType)
 		logger.AppSummaryLog.Infoln("Ue's Passed:", msg.UePassedCount, ", Ue's Failed:", msg.UeFailedCount)
 
+		logLatency("Procedure Latency (min/mean/p50/p95/p99/max):", msg.ProcLatency)
+		logLatency("Failed Procedure Latency (min/mean/p50/p95/p99/max):",
+			msg.ProcFailLatency)
+
+		if causes := common.CountRejectCauses(msg.UeResults); len(causes) != 0 {
+			logger.AppSummaryLog.Infoln("Reject Causes:")
+			keys := make([]string, 0, len(causes))
+			for key := range causes {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				logger.AppSummaryLog.Infof("%v, count:%v", key, causes[key])
+			}
+		}
+
 		if len(msg.ErrorList) != 0 {
 			result = "FAIL"
 			logger.AppSummaryLog.Infoln("Profile Errors:")
@@ -170,6 +279,9 @@ func ListenAndLogSummary() {
 				logger.AppSummaryLog.Errorln(err)
 			}
 		}
+		if msg.Aborted {
+			result = common.STATUS_ABORTED
+		}
 		logger.AppSummaryLog.Infoln("Profile Status:", result)
 	}
 }
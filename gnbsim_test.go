@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omec-project/gnbsim/common"
+	"github.com/omec-project/gnbsim/factory"
+
+	"github.com/urfave/cli"
+)
+
+// MOCKCORE_CONFIG runs every profile type against the mock core started
+// within gnbsim
+const MOCKCORE_CONFIG = "config/gnbsim-mockcore.yaml"
+
+// MOCKCORE_TEST_ENV enables the end to end run against the mock core
+const MOCKCORE_TEST_ENV = "GNBSIM_MOCKCORE_TEST"
+
+// TestMockCoreProfiles runs the profiles of MOCKCORE_CONFIG end to end and
+// fails if any of their UEs fails. It needs kernel SCTP support and the
+// loopback addresses of the configuration, and takes a few minutes, hence it
+// only runs when MOCKCORE_TEST_ENV is set
+func TestMockCoreProfiles(t *testing.T) {
+	if os.Getenv(MOCKCORE_TEST_ENV) == "" {
+		t.Skip("set " + MOCKCORE_TEST_ENV + "=1 to run the profiles against the mock core")
+	}
+
+	app := cli.NewApp()
+	app.Name = "GNBSIM"
+	app.Action = action
+	app.Flags = getCliFlags()
+	reportPath := filepath.Join(t.TempDir(), "report")
+	err := app.Run([]string{"gnbsim", "--cfg", MOCKCORE_CONFIG, "--report", reportPath})
+	if err != nil {
+		t.Errorf("gnbsim failed: %v", err)
+	}
+
+	reports := make(map[string]int)
+	for i, prof := range runReport.Profiles {
+		reports[prof.Name] = i
+	}
+	for _, profile := range factory.AppConfig.Configuration.Profiles {
+		if !profile.Enable {
+			continue
+		}
+		i, found := reports[profile.Name]
+		if !found {
+			t.Errorf("profile %v (%v): no summary", profile.Name, profile.ProfileType)
+			continue
+		}
+		prof := runReport.Profiles[i]
+		if prof.Type != profile.ProfileType {
+			t.Errorf("profile %v: type %v, want %v", profile.Name, prof.Type, profile.ProfileType)
+		}
+		if prof.Status != common.STATUS_PASS {
+			t.Errorf("profile %v (%v): status %v, errors: %v", profile.Name,
+				profile.ProfileType, prof.Status, prof.Errors)
+		}
+		if prof.UePassedCount != uint(profile.UeCount) || prof.UeFailedCount != 0 {
+			t.Errorf("profile %v (%v): %v UEs passed and %v failed, want %v passed",
+				profile.Name, profile.ProfileType, prof.UePassedCount, prof.UeFailedCount,
+				profile.UeCount)
+		}
+		for _, ue := range prof.Ues {
+			if ue.Status != common.STATUS_PASS {
+				t.Errorf("profile %v (%v): ue %v %v: %v", profile.Name,
+					profile.ProfileType, ue.Supi, ue.Status, ue.Error)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gnodeb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/omec-project/gnbsim/common"
+	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/metrics"
+)
+
+// Back-off between the attempts to set up the association with an AMF, it
+// doubles after each failed attempt up to the maximum
+const (
+	ASSOC_RETRY_MIN_BACKOFF time.Duration = time.Second
+	ASSOC_RETRY_MAX_BACKOFF time.Duration = 32 * time.Second
+)
+
+// Attempts to perform the NG Setup with the AMFs rejecting it while the
+// GNodeB initializes
+const NG_SETUP_MAX_ATTEMPTS int = 3
+
+// SuperviseAmfAssoc keeps up the association with the AMF until the GNodeB
+// quits. A lost or failed association is set up again after a back-off, or
+// after the Time To Wait of the NG Setup Failure if longer. The UEs served by
+// the AMF are released once the association is lost
+func SuperviseAmfAssoc(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf, connected bool) {
+	backoff := ASSOC_RETRY_MIN_BACKOFF
+	for {
+		if connected {
+			backoff = ASSOC_RETRY_MIN_BACKOFF
+			// Returns once the association is lost
+			gnb.CpTransport.ReceiveFromPeer(amf)
+			if gnb.IsQuitting() {
+				return
+			}
+			setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_DOWN)
+			releaseAmfUes(gnb, amf)
+		}
+
+		wait := backoff
+		if timeToWait := amf.GetTimeToWait(); timeToWait > wait {
+			wait = timeToWait
+		}
+		gnb.Log.Infoln("Connecting to AMF:", amf, "in", wait)
+		select {
+		case <-gnb.Quit:
+			return
+		case <-time.After(wait):
+		}
+
+		err := ConnectToAmf(gnb, amf)
+		connected = err == nil
+		if !connected {
+			gnb.Log.Errorln("Failed to connect to AMF:", amf, "err:", err)
+			if backoff *= 2; backoff > ASSOC_RETRY_MAX_BACKOFF {
+				backoff = ASSOC_RETRY_MAX_BACKOFF
+			}
+		}
+	}
+}
+
+// setAmfAssocState moves the association with the AMF to the given state and
+// reports the association going up or down
+func setAmfAssocState(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	state gnbctx.AssocState) {
+	prev := amf.SetAssocState(state)
+	if prev == state {
+		return
+	}
+
+	switch {
+	case state == gnbctx.ASSOC_STATE_UP:
+		gnb.Log.Infoln("Association with AMF:", amf, "up")
+		metrics.CountAmfAssocEvent(gnb.GnbName, amf.String(), metrics.ASSOC_UP)
+	case prev == gnbctx.ASSOC_STATE_UP:
+		gnb.Log.Warnln("Association with AMF:", amf, "down")
+		metrics.CountAmfAssocEvent(gnb.GnbName, amf.String(), metrics.ASSOC_DOWN)
+	default:
+		gnb.Log.Infoln("AMF:", amf, "association state:", prev, "->", state)
+	}
+}
+
+// releaseAmfUes tells the GnbCpUe contexts that the association with the AMF
+// is lost. The contexts of the UEs served by the AMF are released, the
+// procedures in progress fail
+func releaseAmfUes(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf) {
+	for _, gnbue := range gnb.GnbUes.GetGnbCpUes() {
+		msg := &gnbctx.AmfAssocLostMessage{Amf: amf}
+		msg.Event = common.AMF_ASSOC_LOST_EVENT
+		msg.Error = fmt.Errorf("association with amf %v lost", amf)
+		gnbue.PostMessage(msg)
+	}
+}
@@ -6,7 +6,12 @@ package context
 
 import (
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
 
 	amfctx "github.com/omec-project/amf/context"
@@ -17,6 +22,45 @@ import (
 
 const NGAP_SCTP_PORT int = 38412
 
+// AssocState is the state of the association of the gNB with an AMF
+type AssocState uint8
+
+const (
+	// No association, the gNB waits before connecting again
+	ASSOC_STATE_DOWN AssocState = iota
+	// SCTP association being established
+	ASSOC_STATE_CONNECTING
+	// NG Setup procedure in progress
+	ASSOC_STATE_NG_SETUP
+	// NG Setup successful, the AMF serves new UEs
+	ASSOC_STATE_UP
+)
+
+var assocStateStrMap = map[AssocState]string{
+	ASSOC_STATE_DOWN:       "DOWN",
+	ASSOC_STATE_CONNECTING: "CONNECTING",
+	ASSOC_STATE_NG_SETUP:   "NG-SETUP",
+	ASSOC_STATE_UP:         "UP",
+}
+
+func (s AssocState) String() string {
+	return assocStateStrMap[s]
+}
+
+// AmfAssocLostMessage notifies the GnbCpUe contexts of the loss of the
+// association with the AMF
+type AmfAssocLostMessage struct {
+	common.DefaultMessage
+	Amf *GnbAmf
+}
+
+// NgResetMessage notifies the GnbCpUe contexts of the reset of their NG
+// connection with the AMF
+type NgResetMessage struct {
+	common.DefaultMessage
+	Amf *GnbAmf
+}
+
 // GnbAmf holds the AMF context
 type GnbAmf struct {
 	/* Indicates wether NGSetup was successful or not*/
@@ -25,12 +69,22 @@ type GnbAmf struct {
 	AmfIp         string `yaml:"ipAddr"`
 	AmfName       string
 	AmfPort       int `yaml:"port"`
+	/* gNB N2 port of the association with the AMF. Defaults to the gNB
+	   n2Port for the first AMF, chosen by the system for the other ones */
+	LocalPort int `yaml:"localPort"`
 	/* Relative AMF Capacity */
 	RelCap          int64
 	ServedGuamiList []models.Guami
 	PlmnSupportList []factory.PlmnSupportItem
-	/*Socket Connection*/
-	Conn net.Conn
+	/* Socket connection, replaced on each association set up again */
+	conn net.Conn
+
+	/* Time To Wait of the last NG Setup Failure, zero if not provided */
+	timeToWait time.Duration
+
+	// guards conn, timeToWait and assocState
+	lock       sync.RWMutex
+	assocState AssocState
 
 	/* logger */
 	Log *logrus.Entry
@@ -45,11 +99,18 @@ func NewGnbAmf(ip string, port int) *GnbAmf {
 	return gnbAmf
 }
 
+// Init initializes the AMF context loaded from the configuration, once before
+// the first association is set up
 func (amf *GnbAmf) Init() {
 	amf.Log = logger.GNodeBLog.WithFields(logrus.Fields{"subcategory": "GnbAmf",
 		logger.FieldIp: amf.AmfIp})
 }
 
+// String returns the IP address and port of the AMF
+func (amf *GnbAmf) String() string {
+	return net.JoinHostPort(amf.AmfIp, strconv.Itoa(amf.AmfPort))
+}
+
 func (amf *GnbAmf) GetIpAddr() string {
 	return amf.AmfIp
 }
@@ -63,21 +124,95 @@ func (amf *GnbAmf) SetAMFName(name string) {
 }
 
 func (amf *GnbAmf) SetRelativeAMFCapacity(cap int64) {
+	amf.lock.Lock()
+	defer amf.lock.Unlock()
 	amf.RelCap = cap
 }
 
+func (amf *GnbAmf) GetRelativeAMFCapacity() int64 {
+	amf.lock.RLock()
+	defer amf.lock.RUnlock()
+	return amf.RelCap
+}
+
 func (amf *GnbAmf) SetNgSetupStatus(successfulOutcome bool) {
-	// TODO Access to this either should not be concurrent or should be
-	// synchronized
+	amf.lock.Lock()
+	defer amf.lock.Unlock()
 	amf.NgSetupStatus = successfulOutcome
 }
 
 func (amf *GnbAmf) GetNgSetupStatus() bool {
-	// TODO Access to this either should not be concurrent or should be
-	// synchronized
+	amf.lock.RLock()
+	defer amf.lock.RUnlock()
 	return amf.NgSetupStatus
 }
 
+// SetAssocState moves the association with the AMF to the given state and
+// returns the previous one
+func (amf *GnbAmf) SetAssocState(state AssocState) AssocState {
+	amf.lock.Lock()
+	defer amf.lock.Unlock()
+	prev := amf.assocState
+	amf.assocState = state
+	return prev
+}
+
+func (amf *GnbAmf) GetAssocState() AssocState {
+	amf.lock.RLock()
+	defer amf.lock.RUnlock()
+	return amf.assocState
+}
+
+// SetConn sets the socket connection of the association with the AMF
+func (amf *GnbAmf) SetConn(conn net.Conn) {
+	amf.lock.Lock()
+	defer amf.lock.Unlock()
+	amf.conn = conn
+}
+
+// GetConn returns the socket connection of the current association with the
+// AMF, nil if never set up
+func (amf *GnbAmf) GetConn() net.Conn {
+	amf.lock.RLock()
+	defer amf.lock.RUnlock()
+	return amf.conn
+}
+
+func (amf *GnbAmf) SetTimeToWait(timeToWait time.Duration) {
+	amf.lock.Lock()
+	defer amf.lock.Unlock()
+	amf.timeToWait = timeToWait
+}
+
+func (amf *GnbAmf) GetTimeToWait() time.Duration {
+	amf.lock.RLock()
+	defer amf.lock.RUnlock()
+	return amf.timeToWait
+}
+
+// IsAvailable returns true if the AMF can serve new UEs
+func (amf *GnbAmf) IsAvailable() bool {
+	return amf.GetAssocState() == ASSOC_STATE_UP
+}
+
+// ServesFiveGSTmsi returns true if the AMF Set ID and AMF Pointer of the
+// 5G-S-TMSI (hex string) match one of the GUAMIs served by the AMF
+func (amf *GnbAmf) ServesFiveGSTmsi(fiveGSTmsi string) bool {
+	// AMF Set ID (10 bits) and AMF Pointer (6 bits) lead the 5G-S-TMSI
+	if len(fiveGSTmsi) < 4 {
+		return false
+	}
+	setAndPtr := fiveGSTmsi[:4]
+	for _, guami := range amf.ServedGuamiList {
+		// AMF ID is the AMF Region ID (8 bits) followed by the AMF Set ID
+		// and AMF Pointer
+		if len(guami.AmfId) == 6 && strings.EqualFold(guami.AmfId[2:], setAndPtr) {
+			return true
+		}
+	}
+	return false
+}
+
 func NewServedGUAMIList() []models.Guami {
 	return make([]models.Guami, 0, amfctx.MaxNumOfServedGuamiList)
 }
@@ -5,6 +5,7 @@
 package context
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -18,9 +19,13 @@ type GnbCpUe struct {
 	Supi        string
 	GnbUeNgapId int64
 	AmfUeNgapId int64
-	Amf         *GnbAmf
 	Gnb         *GNodeB
 
+	// AMF serving the UE, selected by the GnbCpUe worker once the UE sends
+	// its initial NAS message while the AMF worker looks the UEs up by AMF
+	amf  *GnbAmf
+	lock sync.RWMutex
+
 	// TODO: Sync map is not needed as it is handled single threaded
 	GnbUpUes sync.Map
 
@@ -32,6 +37,26 @@ type GnbCpUe struct {
 	// GnbCpUe reads messages from all other workers and UE on this channel
 	ReadChan chan common.InterfaceMessage
 
+	// Ctx is cancelled once the UE stops reading messages from the GnbCpUe
+	Ctx context.Context
+
+	// Terminated is closed once the GnbCpUe worker exits
+	Terminated chan struct{}
+
+	// Target gNB of the handover prepared by the source GnbCpUe
+	HandoverTarget *GNodeB
+
+	// Set on the source GnbCpUe once the UE is commanded to move to the
+	// target gNB, the UE is no longer notified of the release of the context
+	HandedOver bool
+
+	// Source gNB of the handover the target GnbCpUe is prepared for
+	HandoverSource *GNodeB
+
+	// Data bearers the target GnbCpUe sets up with the UE once it confirms
+	// the handover
+	HandoverDBParams []*common.DataBearerParams
+
 	// logger
 	Log *logrus.Entry
 }
@@ -39,15 +64,46 @@ type GnbCpUe struct {
 func NewGnbCpUe(ngapId int64, gnb *GNodeB, amf *GnbAmf) *GnbCpUe {
 	gnbue := GnbCpUe{}
 	gnbue.GnbUeNgapId = ngapId
-	gnbue.Amf = amf
+	gnbue.amf = amf
 	gnbue.Gnb = gnb
 	gnbue.ReadChan = make(chan common.InterfaceMessage, 5)
+	gnbue.Terminated = make(chan struct{})
 	gnbue.Log = logger.GNodeBLog.WithFields(logrus.Fields{"subcategory": "GnbCpUe",
 		logger.FieldGnbUeNgapId: ngapId})
 	gnbue.Log.Traceln("Context Created")
 	return &gnbue
 }
 
+func (ctx *GnbCpUe) SetAmf(amf *GnbAmf) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.amf = amf
+}
+
+func (ctx *GnbCpUe) GetAmf() *GnbAmf {
+	ctx.lock.RLock()
+	defer ctx.lock.RUnlock()
+	return ctx.amf
+}
+
+// HandoverMessage asks the GnbCpUe serving the UE to hand it over to the
+// target gNB
+type HandoverMessage struct {
+	common.DefaultMessage
+	TargetGnb *GNodeB
+}
+
+// PostMessage hands the message over to the GnbCpUe without waiting on it, as
+// the GnbCpUe may be terminating
+func (ctx *GnbCpUe) PostMessage(msg common.InterfaceMessage) {
+	go func() {
+		select {
+		case ctx.ReadChan <- msg:
+		case <-ctx.Ctx.Done():
+		}
+	}()
+}
+
 // GetGnbUpUe returns the GnbUpUe instance corresponding to provided PDU Sess ID
 func (ctx *GnbCpUe) GetGnbUpUe(pduSessId int64) (*GnbUpUe, error) {
 	ctx.Log.Infoln("Fetching GnbUpUe for pduSessId:", pduSessId)
@@ -71,3 +127,9 @@ func (ctx *GnbCpUe) RemoveGnbUpUe(pduSessId int64) {
 	ctx.Log.Infoln("Deleting GnbUpUe for pduSessId:", pduSessId)
 	ctx.GnbUpUes.Delete(pduSessId)
 }
+
+// HandoverKey identifies the GnbCpUe to the peer gNB of a handover, it is
+// carried in the RRC containers exchanged between the gNBs
+func (ctx *GnbCpUe) HandoverKey() string {
+	return fmt.Sprintf("%v:%v", ctx.Gnb.GnbName, ctx.GnbUeNgapId)
+}
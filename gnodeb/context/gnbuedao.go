@@ -20,13 +20,17 @@ type GnbUeDao struct {
 	ngapIdGnbCpUeMap sync.Map
 	dlTeidGnbUpUeMap sync.Map
 
+	// This map is used when gNb receives an ErrorIndication Message which
+	// has an UL TEID. In which case gNb can fetch the GnbUpUe context
+	// corresponding to that UL TEID
+	ulTeidGnbUpUeMap sync.Map
+
+	// Peer GnbCpUe instances of the handovers in progress with other gNBs,
+	// keyed by the handover key of the GnbCpUe
+	hoGnbCpUeMap sync.Map
+
 	/* logger */
 	Log *logrus.Entry
-	//TODO:
-	//ulTeidGnbUpUeMap sync.Map
-	// This map will be helpful when gNb receives an ErrorIndication Message
-	// which will have an UL TEID. In which case gNb can fetch and delete the
-	// GnbUpUe context corresponding to that UL TEID
 }
 
 func NewGnbUeDao() *GnbUeDao {
@@ -53,6 +57,22 @@ func (dao *GnbUeDao) AddGnbCpUe(gnbUeNgapId int64, gnbue *GnbCpUe) {
 	dao.ngapIdGnbCpUeMap.Store(gnbUeNgapId, gnbue)
 }
 
+// RemoveGnbCpUe removes the GnbCpUe instance corresponding to provided NGAP ID
+func (dao *GnbUeDao) RemoveGnbCpUe(gnbUeNgapId int64) {
+	dao.Log.Infoln("Removing GnbCpUe for RANUENGAPID:", gnbUeNgapId)
+	dao.ngapIdGnbCpUeMap.Delete(gnbUeNgapId)
+}
+
+// GetGnbCpUes returns all the GnbCpUe instances
+func (dao *GnbUeDao) GetGnbCpUes() []*GnbCpUe {
+	var gnbues []*GnbCpUe
+	dao.ngapIdGnbCpUeMap.Range(func(key, value interface{}) bool {
+		gnbues = append(gnbues, value.(*GnbCpUe))
+		return true
+	})
+	return gnbues
+}
+
 // GetGnbUpUe returns the GnbUpUe instance corresponding to provided TEID
 func (dao *GnbUeDao) GetGnbUpUe(teid uint32, downlink bool) *GnbUpUe {
 	dao.Log.Traceln("Fetching GnbUpUe for TEID:", teid, "Downlink:", downlink)
@@ -61,8 +81,7 @@ func (dao *GnbUeDao) GetGnbUpUe(teid uint32, downlink bool) *GnbUpUe {
 	if downlink {
 		val, ok = dao.dlTeidGnbUpUeMap.Load(teid)
 	} else {
-		// TODO
-		//val, ok = dao.ulTeidGnbUpUeMap.Load(teid)
+		val, ok = dao.ulTeidGnbUpUeMap.Load(teid)
 	}
 
 	if ok {
@@ -79,7 +98,7 @@ func (dao *GnbUeDao) AddGnbUpUe(teid uint32, downlink bool, gnbue *GnbUpUe) {
 	if downlink {
 		dao.dlTeidGnbUpUeMap.Store(teid, gnbue)
 	} else {
-		//  TODO
+		dao.ulTeidGnbUpUeMap.Store(teid, gnbue)
 	}
 }
 
@@ -89,6 +108,33 @@ func (dao *GnbUeDao) RemoveGnbUpUe(teid uint32, downlink bool) {
 	if downlink {
 		dao.dlTeidGnbUpUeMap.Delete(teid)
 	} else {
-		//  TODO
+		dao.ulTeidGnbUpUeMap.Delete(teid)
 	}
 }
+
+// GetHandoverGnbCpUe returns the peer GnbCpUe instance of a handover
+// corresponding to provided handover key
+func (dao *GnbUeDao) GetHandoverGnbCpUe(key string) *GnbCpUe {
+	dao.Log.Infoln("Fetching handover GnbCpUe for key:", key)
+	val, ok := dao.hoGnbCpUeMap.Load(key)
+	if ok {
+		return val.(*GnbCpUe)
+	} else {
+		dao.Log.Warnln("key not present:", key)
+		return nil
+	}
+}
+
+// AddHandoverGnbCpUe adds the peer GnbCpUe instance of a handover
+// corresponding to provided handover key
+func (dao *GnbUeDao) AddHandoverGnbCpUe(key string, gnbue *GnbCpUe) {
+	dao.Log.Infoln("Adding handover GnbCpUe for key:", key)
+	dao.hoGnbCpUeMap.Store(key, gnbue)
+}
+
+// RemoveHandoverGnbCpUe removes the peer GnbCpUe instance of a handover
+// corresponding to provided handover key
+func (dao *GnbUeDao) RemoveHandoverGnbCpUe(key string) {
+	dao.Log.Infoln("Removing handover GnbCpUe for key:", key)
+	dao.hoGnbCpUeMap.Delete(key)
+}
@@ -7,6 +7,7 @@ package context
 import (
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
@@ -16,6 +17,10 @@ import (
 
 const GTP_U_PORT int = 2152
 
+// Minimum interval between two Error Indications sent for the same unknown
+// DL TEID
+const ERROR_INDICATION_INTERVAL = time.Second
+
 // GnbUpf holds the UPF context
 type GnbUpf struct {
 	UpfAddr     *net.UDPAddr
@@ -26,6 +31,10 @@ type GnbUpf struct {
 	// GnbUpf Reads messages from transport, GnbUpUe and GNodeB
 	ReadChan chan common.InterfaceMessage
 
+	// Time the last Error Indication was sent for each unknown DL TEID, only
+	// accessed by the GnbUpf worker
+	errIndSentAt map[uint32]time.Time
+
 	/* logger */
 	Log *logrus.Entry
 }
@@ -45,6 +54,7 @@ func NewGnbUpf(ip string) *GnbUpf {
 
 	gnbupf.ReadChan = make(chan common.InterfaceMessage, 10)
 	gnbupf.GnbUpUes = NewGnbUeDao()
+	gnbupf.errIndSentAt = make(map[uint32]time.Time)
 	gnbupf.UpfAddr = addr
 	gnbupf.UpfIpString = addr.IP.String()
 
@@ -58,3 +68,22 @@ func (upf *GnbUpf) GetIpAddr() string {
 func (upf *GnbUpf) GetPort() int {
 	return upf.UpfAddr.Port
 }
+
+// AllowErrorIndication tells whether an Error Indication can be sent for the
+// unknown DL TEID, so that a UPF still sending G-PDUs for it isn't answered
+// with one Error Indication per G-PDU
+func (upf *GnbUpf) AllowErrorIndication(teid uint32) bool {
+	now := time.Now()
+	if sentAt, ok := upf.errIndSentAt[teid]; ok &&
+		now.Sub(sentAt) < ERROR_INDICATION_INTERVAL {
+		return false
+	}
+
+	for t, sentAt := range upf.errIndSentAt {
+		if now.Sub(sentAt) >= ERROR_INDICATION_INTERVAL {
+			delete(upf.errIndSentAt, t)
+		}
+	}
+	upf.errIndSentAt[teid] = now
+	return true
+}
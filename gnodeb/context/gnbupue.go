@@ -5,6 +5,9 @@
 package context
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
 
@@ -36,6 +39,9 @@ type GnbUpUe struct {
 	// GnbUpUe reads commands from GnbCpUe on this channel
 	ReadCmdChan chan common.InterfaceMessage
 
+	// Ctx is inherited from the GnbCpUe
+	Ctx context.Context
+
 	/* logger */
 	Log *logrus.Entry
 }
@@ -70,3 +76,26 @@ func (ue *GnbUpUe) AddQosFlow(qfi int64, qosFlow *ngapType.QosFlowSetupRequestIt
 	ue.Log.Infoln("Adding new QosFlowItem corresponding to QFI:", qfi)
 	ue.QosFlows[qfi] = qosFlow
 }
+
+// ModifyQosFlow replaces the QoS parameters of an existing QoS flow
+func (ue *GnbUpUe) ModifyQosFlow(qfi int64,
+	qosParams *ngapType.QosFlowLevelQosParameters) error {
+	qosFlow, ok := ue.QosFlows[qfi]
+	if !ok {
+		return fmt.Errorf("no qos flow found corresponding to qfi:%v", qfi)
+	}
+	ue.Log.Infoln("Modifying QosFlowItem corresponding to QFI:", qfi)
+	modified := *qosFlow
+	modified.QosFlowLevelQosParameters = *qosParams
+	ue.QosFlows[qfi] = &modified
+	return nil
+}
+
+func (ue *GnbUpUe) RemoveQosFlow(qfi int64) error {
+	if _, ok := ue.QosFlows[qfi]; !ok {
+		return fmt.Errorf("no qos flow found corresponding to qfi:%v", qfi)
+	}
+	ue.Log.Infoln("Removing QosFlowItem corresponding to QFI:", qfi)
+	delete(ue.QosFlows, qfi)
+	return nil
+}
@@ -5,6 +5,8 @@
 package context
 
 import (
+	"sync"
+
 	transport "github.com/omec-project/gnbsim/transportcommon"
 
 	"github.com/omec-project/idgenerator"
@@ -34,6 +36,13 @@ type GNodeB struct {
 	/* Default AMF to connect to */
 	DefaultAmf *GnbAmf `yaml:"defaultAmf"`
 
+	/* AMFs of the AMF pool to connect to, in addition to the default AMF */
+	Amfs []*GnbAmf `yaml:"amfs"`
+
+	// State of the weighted round robin AMF selection
+	amfSelLock    sync.Mutex
+	amfSelWeights map[*GnbAmf]int64
+
 	/* Control Plane transport */
 	CpTransport transport.Transport
 
@@ -44,10 +53,80 @@ type GNodeB struct {
 	Log *logrus.Entry
 }
 
+// IsQuitting returns true once the GNodeB has been asked to shut down
+func (gnb *GNodeB) IsQuitting() bool {
+	select {
+	case <-gnb.Quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (gnb *GNodeB) GetDefaultAmf() *GnbAmf {
 	return gnb.DefaultAmf
 }
 
+// GetAmfs returns the default AMF followed by the AMFs of the AMF pool
+func (gnb *GNodeB) GetAmfs() []*GnbAmf {
+	var amfs []*GnbAmf
+	if gnb.DefaultAmf != nil {
+		amfs = append(amfs, gnb.DefaultAmf)
+	}
+	for _, amf := range gnb.Amfs {
+		if amf != nil {
+			amfs = append(amfs, amf)
+		}
+	}
+	return amfs
+}
+
+// SelectAmf returns the AMF a new UE connection is sent to, nil if no AMF is
+// available. The AMF identified by the AMF Set ID and AMF Pointer of the
+// 5G-S-TMSI provided by the UE is selected if available. Otherwise the UEs
+// are spread over the available AMFs in proportion to their relative AMF
+// capacity, TS 23.501 Section 6.3.5
+func (gnb *GNodeB) SelectAmf(fiveGSTmsi string) *GnbAmf {
+	var available []*GnbAmf
+	for _, amf := range gnb.GetAmfs() {
+		if !amf.IsAvailable() {
+			continue
+		}
+		if fiveGSTmsi != "" && amf.ServesFiveGSTmsi(fiveGSTmsi) {
+			return amf
+		}
+		available = append(available, amf)
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	// Smooth weighted round robin, so that the UEs are spread evenly over
+	// the AMFs within each round
+	gnb.amfSelLock.Lock()
+	defer gnb.amfSelLock.Unlock()
+	if gnb.amfSelWeights == nil {
+		gnb.amfSelWeights = make(map[*GnbAmf]int64)
+	}
+
+	var selected *GnbAmf
+	var total int64
+	for _, amf := range available {
+		relCap := amf.GetRelativeAMFCapacity()
+		total += relCap
+		gnb.amfSelWeights[amf] += relCap
+		if selected == nil || gnb.amfSelWeights[amf] > gnb.amfSelWeights[selected] {
+			selected = amf
+		}
+	}
+	// AMFs with a relative capacity of 0 are only selected if none has more
+	if total == 0 {
+		return available[0]
+	}
+	gnb.amfSelWeights[selected] -= total
+	return selected
+}
+
 func (gnb *GNodeB) AllocateRanUeNgapID() (int64, error) {
 	return gnb.RanUeNGAPIDGenerator.Allocate()
 }
@@ -5,9 +5,10 @@
 package gnodeb
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"sync"
+	"time"
 
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/factory"
@@ -22,6 +23,19 @@ import (
 	"github.com/omec-project/idgenerator"
 )
 
+var (
+	initAborted   = make(chan struct{})
+	abortInitOnce sync.Once
+)
+
+// AbortInit stops the GNodeBs still retrying the NG Setup with their AMFs,
+// their initialization then fails
+func AbortInit() {
+	abortInitOnce.Do(func() {
+		close(initAborted)
+	})
+}
+
 func InitializeAllGnbs() error {
 	gnbs := factory.AppConfig.Configuration.Gnbs
 	for _, gnb := range gnbs {
@@ -34,12 +48,13 @@ func InitializeAllGnbs() error {
 	return nil
 }
 
-// Init initializes the GNodeB struct var and connects to the default AMF
+// Init initializes the GNodeB struct var and connects to the configured AMFs
 func Init(gnb *gnbctx.GNodeB) error {
 	gnb.Log = logger.GNodeBLog.WithField(logger.FieldGnb, gnb.GnbName)
 	gnb.Log.Traceln("Inititializing GNodeB")
 	gnb.Log.Infoln("GNodeB IP:", gnb.GnbN2Ip, "GNodeB Port:", gnb.GnbN2Port)
 
+	gnb.Quit = make(chan int)
 	gnb.CpTransport = transport.NewGnbCpTransport(gnb)
 	gnb.UpTransport = transport.NewGnbUpTransport(gnb)
 	err := gnb.UpTransport.Init()
@@ -53,34 +68,103 @@ func Init(gnb *gnbctx.GNodeB) error {
 	gnb.RanUeNGAPIDGenerator = idgenerator.NewGenerator(int64(start), int64(end))
 	gnb.DlTeidGenerator = idgenerator.NewGenerator(int64(start), int64(end))
 
-	if gnb.DefaultAmf == nil {
-		gnb.Log.Infoln("Default AMF not configured, continuing ...")
+	amfs := gnb.GetAmfs()
+	if len(amfs) == 0 {
+		gnb.Log.Infoln("AMF not configured, continuing ...")
 		return nil
 	}
 
-	gnb.DefaultAmf.Init()
+	// The gNB keeps running as long as one of the AMFs of the pool is
+	// available. The associations failing or lost are set up again
+	if amfs[0].LocalPort == 0 {
+		amfs[0].LocalPort = gnb.GnbN2Port
+	}
+	for _, amf := range amfs {
+		amf.Init()
+	}
+	connected := make([]bool, len(amfs))
+	var count int
+	for attempt := 1; ; attempt++ {
+		var timeToWait time.Duration
+		for i, amf := range amfs {
+			if connected[i] {
+				continue
+			}
+			err = ConnectToAmf(gnb, amf)
+			if err != nil {
+				gnb.Log.Errorln("Failed to connect to AMF:", amf, "err:", err)
+				if amfTimeToWait := amf.GetTimeToWait(); amfTimeToWait > timeToWait {
+					timeToWait = amfTimeToWait
+				}
+				continue
+			}
+			connected[i] = true
+			count++
+		}
+
+		// NG Setup is tried again once the Time To Wait provided by the
+		// AMFs rejecting it is over
+		if count != 0 || timeToWait == 0 || attempt == NG_SETUP_MAX_ATTEMPTS {
+			break
+		}
+		gnb.Log.Infoln("Retrying NG Setup in", timeToWait)
+		select {
+		case <-gnb.Quit:
+			return fmt.Errorf("gnb quit while retrying ng setup")
+		case <-initAborted:
+			return fmt.Errorf("ng setup retry aborted")
+		case <-time.After(timeToWait):
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("failed to connect to amf")
+	}
+	for i, amf := range amfs {
+		go SuperviseAmfAssoc(gnb, amf, connected[i])
+	}
+
+	gnb.Log.Tracef("GNodeB Initialized %v ", gnb)
+	return nil
+}
+
+// ConnectToAmf sets up the association with the AMF and performs the NG Setup
+// procedure. The AMF serves new UEs once the NG Setup succeeded
+func ConnectToAmf(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf) error {
+	amf.SetTimeToWait(0)
 
-	err = gnb.CpTransport.ConnectToPeer(gnb.DefaultAmf)
+	setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_CONNECTING)
+	err := gnb.CpTransport.ConnectToPeer(amf)
 	if err != nil {
 		gnb.Log.Errorln("ConnectToPeer returned:", err)
+		setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_DOWN)
 		return fmt.Errorf("failed to connect to amf")
 	}
 
-	successfulOutcome, err := PerformNgSetup(gnb, gnb.DefaultAmf)
+	setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_NG_SETUP)
+	successfulOutcome, err := PerformNgSetup(gnb, amf)
 	if !successfulOutcome || err != nil {
 		gnb.Log.Errorln("PerformNgSetup returned:", err)
+		setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_DOWN)
+		if err := amf.GetConn().Close(); err != nil {
+			gnb.Log.Warnln("Failed to close AMF connection:", err)
+		}
 		return fmt.Errorf("failed to perform ng setup procedure")
 	}
 
-	go gnb.CpTransport.ReceiveFromPeer(gnb.DefaultAmf)
-
-	gnb.Log.Tracef("GNodeB Initialized %v ", gnb)
+	setAmfAssocState(gnb, amf, gnbctx.ASSOC_STATE_UP)
 	return nil
 }
 
+// QuitGnb stops the GNodeB and closes its connections with the AMF and UPF
 func QuitGnb(gnb *gnbctx.GNodeB) {
-	log.Println("Shutting Down GNodeB:", gnb.GnbName)
+	gnb.Log.Infoln("Shutting Down GNodeB")
 	close(gnb.Quit)
+	if err := gnb.CpTransport.Close(); err != nil {
+		gnb.Log.Warnln("Failed to close control plane transport:", err)
+	}
+	if err := gnb.UpTransport.Close(); err != nil {
+		gnb.Log.Warnln("Failed to close user plane transport:", err)
+	}
 }
 
 // PerformNGSetup sends the NGSetupRequest to the provided GnbAmf.
@@ -116,15 +200,50 @@ func PerformNgSetup(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf) (bool, error) {
 	return status, nil
 }
 
+// ResetAmf performs a gNB initiated NG Reset of the whole NG interface with
+// the AMF. The contexts of the UEs served by the AMF are released locally, the
+// AMF acknowledgement is handled asynchronously
+func ResetAmf(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf) error {
+	if !amf.IsAvailable() {
+		return fmt.Errorf("association with amf %v not up", amf)
+	}
+
+	ngReset, err := ngap.GetNGReset(nil)
+	if err != nil {
+		gnb.Log.Errorln("GetNGReset returned:", err)
+		return fmt.Errorf("failed to create ng reset")
+	}
+
+	for _, gnbue := range gnb.GnbUes.GetGnbCpUes() {
+		msg := &gnbctx.NgResetMessage{Amf: amf}
+		msg.Event = common.NG_RESET_EVENT
+		msg.Error = fmt.Errorf("ng interface with amf %v reset by gnb", amf)
+		gnbue.PostMessage(msg)
+	}
+
+	err = gnb.CpTransport.SendToPeer(amf, ngReset)
+	if err != nil {
+		gnb.Log.Errorln("SendToPeer returned:", err)
+		return fmt.Errorf("failed to send ng reset")
+	}
+	gnb.Log.Infoln("Sent NG Reset to AMF:", amf)
+	return nil
+}
+
 // RequestConnection should be called by UE that is willing to connect to this GNodeB
-func RequestConnection(gnb *gnbctx.GNodeB, uemsg *common.UuMessage) (chan common.InterfaceMessage, error) {
+// RequestConnection creates a new gNB UE context for the UE. The context
+// terminates once ctx is cancelled
+func RequestConnection(ctx context.Context, gnb *gnbctx.GNodeB,
+	uemsg *common.UuMessage) (chan common.InterfaceMessage, error) {
 	ranUeNgapID, err := gnb.AllocateRanUeNgapID()
 	if err != nil {
 		gnb.Log.Errorln("AllocateRanUeNgapID returned:", err)
 		return nil, fmt.Errorf("failed to allocate ran ue ngap id")
 	}
 
-	gnbUe := gnbctx.NewGnbCpUe(ranUeNgapID, gnb, gnb.DefaultAmf)
+	// AMF is selected once the UE sends its initial NAS message
+	gnbUe := gnbctx.NewGnbCpUe(ranUeNgapID, gnb, nil)
+	gnbUe.Ctx = ctx
 	gnb.GnbUes.AddGnbCpUe(ranUeNgapID, gnbUe)
 
 	// TODO: Launching a GO Routine for gNB and handling the waitgroup
@@ -11,6 +11,7 @@ import (
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
 	"github.com/omec-project/gnbsim/util/ngapTestpacket"
 
+	"github.com/omec-project/aper"
 	"github.com/omec-project/ngap"
 	"github.com/omec-project/ngap/ngapConvert"
 	"github.com/omec-project/ngap/ngapType"
@@ -85,3 +86,199 @@ func GetUEContextReleaseRequest(gnbue *gnbctx.GnbCpUe) ([]byte, error) {
 
 	return ngap.Encoder(message)
 }
+
+// GetNGReset builds a gNB initiated NG Reset. The whole NG interface is reset
+// unless the UEs whose NG connection is reset are given
+func GetNGReset(gnbues []*gnbctx.GnbCpUe) ([]byte, error) {
+	var partOfNGInterface *ngapType.UEAssociatedLogicalNGConnectionList
+	if len(gnbues) != 0 {
+		partOfNGInterface = new(ngapType.UEAssociatedLogicalNGConnectionList)
+		for _, gnbue := range gnbues {
+			item := ngapType.UEAssociatedLogicalNGConnectionItem{}
+			item.AMFUENGAPID = &ngapType.AMFUENGAPID{Value: gnbue.AmfUeNgapId}
+			item.RANUENGAPID = &ngapType.RANUENGAPID{Value: gnbue.GnbUeNgapId}
+			partOfNGInterface.List = append(partOfNGInterface.List, item)
+		}
+	}
+
+	message := ngapTestpacket.BuildNGReset(partOfNGInterface)
+
+	// Cause
+	ie := message.InitiatingMessage.Value.NGReset.ProtocolIEs.List[0]
+	ie.Value.Cause.Present = ngapType.CausePresentMisc
+	ie.Value.Cause.Nas = nil
+	ie.Value.Cause.Misc = &ngapType.CauseMisc{Value: ngapType.CauseMiscPresentOmIntervention}
+
+	return ngap.Encoder(message)
+}
+
+// GetNGResetAcknowledge builds the NG Reset Acknowledge listing the NG
+// connections reset, if the reset was not for the whole NG interface
+func GetNGResetAcknowledge(
+	lst *ngapType.UEAssociatedLogicalNGConnectionList) ([]byte, error) {
+
+	message := ngapTestpacket.BuildNGResetAcknowledge()
+
+	ies := &message.SuccessfulOutcome.Value.NGResetAcknowledge.ProtocolIEs
+	if lst == nil {
+		ies.List = nil
+	} else {
+		ies.List[0].Value.UEAssociatedLogicalNGConnectionList = lst
+	}
+
+	return ngap.Encoder(message)
+}
+
+// GetErrorIndication builds the Error Indication reporting an erroneous
+// message received from the AMF. The UE NGAP IDs, cause and criticality
+// diagnostics are included only if given
+func GetErrorIndication(amfUeNgapId *ngapType.AMFUENGAPID,
+	ranUeNgapId *ngapType.RANUENGAPID, cause *ngapType.Cause,
+	diag *ngapType.CriticalityDiagnostics) ([]byte, error) {
+
+	message := ngapTestpacket.BuildErrorIndication()
+
+	ies := &message.InitiatingMessage.Value.ErrorIndication.ProtocolIEs
+	var lst []ngapType.ErrorIndicationIEs
+	for _, ie := range ies.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			if amfUeNgapId == nil {
+				continue
+			}
+			ie.Value.AMFUENGAPID = amfUeNgapId
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			if ranUeNgapId == nil {
+				continue
+			}
+			ie.Value.RANUENGAPID = ranUeNgapId
+		case ngapType.ProtocolIEIDCause:
+			if cause == nil {
+				continue
+			}
+			ie.Value.Cause = cause
+		case ngapType.ProtocolIEIDCriticalityDiagnostics:
+			if diag == nil {
+				continue
+			}
+			ie.Value.CriticalityDiagnostics = diag
+		}
+		lst = append(lst, ie)
+	}
+	ies.List = lst
+
+	return ngap.Encoder(message)
+}
+
+// GetHandoverRequired builds the Handover Required handing the UE over to the
+// target gNB. The RRC container is passed on to the target gNB as is
+func GetHandoverRequired(gnbue *gnbctx.GnbCpUe, targetGnb *gnbctx.GNodeB,
+	pduSessions []*ngapTestpacket.PduSession, rrcContainer []byte) ([]byte, error) {
+
+	ranId := ngapConvert.RanIDToNgap(targetGnb.RanId)
+	if ranId.GlobalGNBID == nil || ranId.GlobalGNBID.GNBID.GNBID == nil {
+		return nil, fmt.Errorf("invalid global ran id of target gnb: %v",
+			targetGnb.GnbName)
+	}
+	tai, err := getTai(targetGnb)
+	if err != nil {
+		return nil, err
+	}
+
+	message := ngapTestpacket.BuildHandoverRequired(pduSessions,
+		gnbue.AmfUeNgapId, gnbue.GnbUeNgapId, *ranId.GlobalGNBID.GNBID.GNBID,
+		getNrCellIdentity(targetGnb), rrcContainer)
+
+	for _, ie := range message.InitiatingMessage.Value.HandoverRequired.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDTargetID {
+			targetRANNodeID := ie.Value.TargetID.TargetRANNodeID
+			targetRANNodeID.GlobalRANNodeID = ranId
+			targetRANNodeID.SelectedTAI = tai
+		}
+	}
+
+	return ngap.Encoder(message)
+}
+
+// GetHandoverNotify builds the Handover Notify sent by the target gNB once
+// the UE moved to it
+func GetHandoverNotify(gnbue *gnbctx.GnbCpUe) ([]byte, error) {
+	tai, err := getTai(gnbue.Gnb)
+	if err != nil {
+		return nil, err
+	}
+
+	message := ngapTestpacket.BuildHandoverNotify(gnbue.AmfUeNgapId,
+		gnbue.GnbUeNgapId)
+
+	for _, ie := range message.InitiatingMessage.Value.HandoverNotify.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDUserLocationInformation {
+			uli := ie.Value.UserLocationInformation.UserLocationInformationNR
+			uli.TAI = tai
+			uli.NRCGI.PLMNIdentity = tai.PLMNIdentity
+			uli.NRCGI.NRCellIdentity.Value = getNrCellIdentity(gnbue.Gnb)
+		}
+	}
+
+	return ngap.Encoder(message)
+}
+
+// getTai returns the first TAI supported by the gNB
+func getTai(gnb *gnbctx.GNodeB) (tai ngapType.TAI, err error) {
+	if len(gnb.SupportedTaList) == 0 {
+		return tai, fmt.Errorf("no supported ta of gnb: %v", gnb.GnbName)
+	}
+	ta := gnb.SupportedTaList[0]
+	tac, err := hex.DecodeString(ta.Tac)
+	if err != nil {
+		gnb.Log.Errorln("DecodeString returned:", err)
+		return tai, fmt.Errorf("invalid TAC")
+	}
+	tai.TAC.Value = tac
+	if len(ta.BroadcastPLMNList) != 0 {
+		tai.PLMNIdentity = ngapConvert.PlmnIdToNgap(ta.BroadcastPLMNList[0].PlmnId)
+	} else if gnb.RanId.PlmnId != nil {
+		tai.PLMNIdentity = ngapConvert.PlmnIdToNgap(*gnb.RanId.PlmnId)
+	} else {
+		return tai, fmt.Errorf("no plmn id of gnb: %v", gnb.GnbName)
+	}
+	return tai, nil
+}
+
+// getNrCellIdentity returns the 36 bit NR Cell Identity of the single cell
+// of the gNB, made of the gNB ID followed by cell ID 1
+func getNrCellIdentity(gnb *gnbctx.GNodeB) aper.BitString {
+	const nciLen = 36
+	var gnbId uint64
+	var bitLength uint64
+	ranId := ngapConvert.RanIDToNgap(gnb.RanId)
+	if ranId.GlobalGNBID != nil && ranId.GlobalGNBID.GNBID.GNBID != nil {
+		bits := ranId.GlobalGNBID.GNBID.GNBID
+		for _, b := range bits.Bytes {
+			gnbId = gnbId<<8 | uint64(b)
+		}
+		bitLength = bits.BitLength
+		gnbId >>= uint64(len(bits.Bytes)*8) - bitLength
+	}
+	nci := (gnbId<<(nciLen-bitLength) | 1) << 4
+
+	return aper.BitString{
+		Bytes: []byte{byte(nci >> 32), byte(nci >> 24), byte(nci >> 16),
+			byte(nci >> 8), byte(nci)},
+		BitLength: nciLen,
+	}
+}
+
+// GetHandoverFailure builds the Handover Failure sent by the target gNB when
+// it cannot accept the UE handed over to it
+func GetHandoverFailure(amfUeNgapId int64, cause *ngapType.Cause) ([]byte, error) {
+	message := ngapTestpacket.BuildHandoverFailure(amfUeNgapId)
+
+	for _, ie := range message.UnsuccessfulOutcome.Value.HandoverFailure.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDCause {
+			*ie.Value.Cause = *cause
+		}
+	}
+
+	return ngap.Encoder(message)
+}
@@ -10,9 +10,11 @@ import (
 	"net"
 	"syscall"
 
+	"github.com/omec-project/gnbsim/capture"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
 	"github.com/omec-project/gnbsim/gnodeb/worker/gnbamfworker"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/metrics"
 	"github.com/omec-project/gnbsim/transportcommon"
 	"github.com/omec-project/gnbsim/util/test"
 
@@ -61,12 +63,18 @@ func (cpTprt *GnbCpTransport) ConnectToPeer(peer transportcommon.TransportPeer)
 		amf.AmfIp = addrs[0]
 	}
 
-	amf.Conn, err = test.ConnectToAmf(amf.AmfIp, gnb.GnbN2Ip, int(amf.AmfPort),
-		int(gnb.GnbN2Port))
+	conn, err := test.ConnectToAmf(amf.AmfIp, gnb.GnbN2Ip, int(amf.AmfPort),
+		int(amf.LocalPort))
 	if err != nil {
 		return fmt.Errorf("failed to connect amf, ip: %v, port: %v, err: %v",
 			amf.AmfIp, amf.AmfPort, err)
 	}
+	amf.SetConn(conn)
+
+	// Port chosen by the system, required by the packet capture
+	if addr, ok := conn.LocalAddr().(*sctp.SCTPAddr); ok && addr != nil {
+		amf.LocalPort = addr.Port
+	}
 
 	cpTprt.Log.Infoln("Connected to AMF, AMF IP:", amf.AmfIp, "AMF Port:", amf.AmfPort)
 	return
@@ -88,7 +96,7 @@ func (cpTprt *GnbCpTransport) SendToPeerBlock(peer transportcommon.TransportPeer
 	amf := peer.(*gnbctx.GnbAmf)
 
 	recvMsg := make([]byte, MAX_SCTP_PKT_LEN)
-	conn := amf.Conn.(*sctp.SCTPConn)
+	conn := amf.GetConn().(*sctp.SCTPConn)
 
 	n, _, _, err := conn.SCTPRead(recvMsg)
 	if err != nil {
@@ -97,6 +105,9 @@ func (cpTprt *GnbCpTransport) SendToPeerBlock(peer transportcommon.TransportPeer
 	}
 
 	cpTprt.Log.Infof("Read %v bytes from %v\n", n, conn.RemoteAddr())
+	metrics.CountNgapMessage(cpTprt.GnbInstance.GnbName, metrics.DIR_RECEIVED,
+		recvMsg[:n])
+	cpTprt.capture(amf, false, recvMsg[:n])
 	return recvMsg[:n], nil
 }
 
@@ -120,11 +131,13 @@ func (cpTprt *GnbCpTransport) SendToPeer(peer transportcommon.TransportPeer,
 		}
 	}()
 
-	if n, err := amf.Conn.Write(pkt); err != nil || n != len(pkt) {
+	if n, err := amf.GetConn().Write(pkt); err != nil || n != len(pkt) {
 		cpTprt.Log.Errorln("Write returned:", err)
 		return fmt.Errorf("failed to write on socket")
 	} else {
 		cpTprt.Log.Infof("Wrote %v bytes\n", n)
+		metrics.CountNgapMessage(cpTprt.GnbInstance.GnbName, metrics.DIR_SENT, pkt)
+		cpTprt.capture(amf, true, pkt)
 	}
 
 	return
@@ -134,20 +147,27 @@ func (cpTprt *GnbCpTransport) SendToPeer(peer transportcommon.TransportPeer,
 // It then routes the message to the GnbAmfWorker
 func (cpTprt *GnbCpTransport) ReceiveFromPeer(peer transportcommon.TransportPeer) {
 	amf := peer.(*gnbctx.GnbAmf)
+	conn := amf.GetConn().(*sctp.SCTPConn)
 
 	defer func() {
-		if err := amf.Conn.Close(); err != nil && err != syscall.EBADF {
+		if cpTprt.GnbInstance.IsQuitting() {
+			return
+		}
+		if err := conn.Close(); err != nil && err != syscall.EBADF {
 			cpTprt.Log.Errorln("Close returned:", err)
 		}
 
 	}()
 
-	conn := amf.Conn.(*sctp.SCTPConn)
 	for {
 		recvMsg := make([]byte, MAX_SCTP_PKT_LEN)
 		//TODO Handle notification, info
 		n, _, _, err := conn.SCTPRead(recvMsg)
 		if err != nil {
+			if cpTprt.GnbInstance.IsQuitting() {
+				cpTprt.Log.Infoln("Stopped reading from AMF")
+				return
+			}
 			switch err {
 			case io.EOF, io.ErrUnexpectedEOF:
 				cpTprt.Log.Errorln("Read EOF from client")
@@ -159,12 +179,15 @@ func (cpTprt *GnbCpTransport) ReceiveFromPeer(peer transportcommon.TransportPeer
 				cpTprt.Log.Warnln("SCTPRead: %+v\n", err)
 				continue
 			default:
-				cpTprt.Log.Errorln("Handle connection[addr: %+v] error: %+v\n", amf.Conn.RemoteAddr(), err)
+				cpTprt.Log.Errorln("Handle connection[addr: %+v] error: %+v\n", conn.RemoteAddr(), err)
 				return
 			}
 		}
 
 		cpTprt.Log.Infof("Read %v bytes from %v\n", n, amf.GetIpAddr())
+		metrics.CountNgapMessage(cpTprt.GnbInstance.GnbName, metrics.DIR_RECEIVED,
+			recvMsg[:n])
+		cpTprt.capture(amf, false, recvMsg[:n])
 		//TODO Post to gnbamfworker channel
 		gnbamfworker.HandleMessage(cpTprt.GnbInstance, amf, recvMsg[:n])
 	}
@@ -181,17 +204,45 @@ func (cpTprt *GnbCpTransport) CheckTransportParam(peer transportcommon.Transport
 		return fmt.Errorf("packet len is 0")
 	}
 
-	if amf.Conn == nil {
+	conn := amf.GetConn()
+	if conn == nil {
 		return fmt.Errorf("AMF conn is nil")
 	}
 
-	if amf.Conn.RemoteAddr() == nil {
+	if conn.RemoteAddr() == nil {
 		return fmt.Errorf("AMF IP address is nil")
 	}
 
 	return nil
 }
 
+// capture writes the NGAP message to the capture file, if enabled
+func (cpTprt *GnbCpTransport) capture(amf *gnbctx.GnbAmf, sent bool, pkt []byte) {
+	if !capture.Enabled() {
+		return
+	}
+	gnb := cpTprt.GnbInstance
+	if sent {
+		capture.Ngap(gnb.GnbN2Ip, amf.LocalPort, amf.AmfIp, amf.AmfPort, pkt)
+	} else {
+		capture.Ngap(amf.AmfIp, amf.AmfPort, gnb.GnbN2Ip, amf.LocalPort, pkt)
+	}
+}
+
 func (cpTprt *GnbCpTransport) Init() error {
 	return nil
 }
+
+// Close closes the connections with the AMFs which are still open
+func (cpTprt *GnbCpTransport) Close() (err error) {
+	for _, amf := range cpTprt.GnbInstance.GetAmfs() {
+		conn := amf.GetConn()
+		if conn == nil || amf.GetAssocState() == gnbctx.ASSOC_STATE_DOWN {
+			continue
+		}
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
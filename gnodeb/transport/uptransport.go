@@ -9,9 +9,11 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/omec-project/gnbsim/capture"
 	"github.com/omec-project/gnbsim/common"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/metrics"
 	"github.com/omec-project/gnbsim/transportcommon"
 
 	"github.com/sirupsen/logrus"
@@ -20,9 +22,6 @@ import (
 // Need to check if NGAP may exceed this limit
 var MAX_UDP_PKT_LEN int = 65507
 
-//TODO: Should have a context variable which when cancelled will result in
-// the termination of the ReceiveFromPeer handler
-
 // GnbUpTransport represents the User Plane transport of the GNodeB
 type GnbUpTransport struct {
 	GnbInstance *gnbctx.GNodeB
@@ -83,6 +82,9 @@ func (upTprt *GnbUpTransport) SendToPeer(peer transportcommon.TransportPeer,
 		return fmt.Errorf("total bytes:%v, written bytes:%v", pktLen, n)
 	} else {
 		upTprt.Log.Infof("Sent UDP Packet, length: %v bytes\n", n)
+		metrics.CountGtpuPacket(upTprt.GnbInstance.GnbName, metrics.DIR_UPLINK, n)
+		capture.Gtpu(upTprt.GnbInstance.GnbN3Ip, upTprt.GnbInstance.GnbN3Port,
+			upf.UpfIpString, upf.UpfAddr.Port, pkt)
 	}
 
 	return
@@ -96,10 +98,18 @@ func (upTprt *GnbUpTransport) ReceiveFromPeer(peer transportcommon.TransportPeer
 		//TODO Handle notification, info
 		n, srcAddr, err := upTprt.Conn.ReadFromUDP(recvMsg)
 		if err != nil {
+			if upTprt.GnbInstance.IsQuitting() {
+				upTprt.Log.Infoln("Stopped reading from UPF")
+				return
+			}
 			upTprt.Log.Errorln("ReadFromUDP returned:", err)
+			continue
 		}
 		srcIp := srcAddr.IP.String()
 		upTprt.Log.Infof("Read %v bytes from %v:%v\n", n, srcIp, srcAddr.Port)
+		metrics.CountGtpuPacket(upTprt.GnbInstance.GnbName, metrics.DIR_DOWNLINK, n)
+		capture.Gtpu(srcIp, srcAddr.Port, upTprt.GnbInstance.GnbN3Ip,
+			upTprt.GnbInstance.GnbN3Port, recvMsg[:n])
 
 		gnbupf := upTprt.GnbInstance.GnbPeers.GetGnbUpf(srcIp)
 		if gnbupf == nil {
@@ -140,3 +150,11 @@ func (upTprt *GnbUpTransport) SendToPeerBlock(peer transportcommon.TransportPeer
 func (upTprt *GnbUpTransport) ConnectToPeer(peer transportcommon.TransportPeer) error {
 	return nil
 }
+
+// Close closes the user plane socket
+func (upTprt *GnbUpTransport) Close() error {
+	if upTprt.Conn == nil {
+		return nil
+	}
+	return upTprt.Conn.Close()
+}
@@ -6,12 +6,18 @@
 package gnbamfworker
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/util/test"
 
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/gnodeb/ngap"
+	"github.com/omec-project/gnbsim/gnodeb/worker/gnbcpueworker"
 
 	amfctx "github.com/omec-project/amf/context"
+	"github.com/omec-project/aper"
 	"github.com/omec-project/ngap/ngapConvert"
 	"github.com/omec-project/ngap/ngapType"
 	"github.com/omec-project/openapi/models"
@@ -182,18 +188,27 @@ func HandleNgSetupFailure(amf *gnbctx.GnbAmf, pdu *ngapType.NGAPPDU) {
 	}
 
 	amf.Log.Traceln("Handle NG Setup Failure")
+	amf.SetTimeToWait(0)
 	for i := 0; i < len(ngSetupFailure.ProtocolIEs.List); i++ {
 		ie := ngSetupFailure.ProtocolIEs.List[i]
-		if ie.Id.Value == ngapType.ProtocolIEIDCause {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDCause:
 			cause = ie.Value.Cause
 			amf.Log.Traceln("Decode IE Cause")
 			if cause == nil {
 				amf.Log.Errorln("Cause is nil")
 				return
 			}
-			break
+		case ngapType.ProtocolIEIDTimeToWait:
+			amf.Log.Traceln("Decode IE TimeToWait")
+			if ie.Value.TimeToWait == nil {
+				amf.Log.Errorln("TimeToWait is nil")
+				return
+			}
+			timeToWait := timeToWaitToDuration(ie.Value.TimeToWait.Value)
+			amf.SetTimeToWait(timeToWait)
+			amf.Log.Infoln("NG Setup Failure Time To Wait:", timeToWait)
 		}
-		// TODO handle TimeToWait IE
 	}
 
 	test.PrintAndGetCause(cause)
@@ -202,10 +217,29 @@ func HandleNgSetupFailure(amf *gnbctx.GnbAmf, pdu *ngapType.NGAPPDU) {
 	amf.Log.Traceln("Processed NG Setup Failure")
 }
 
+// timeToWaitToDuration decodes the Time To Wait IE of the NG Setup Failure
+func timeToWaitToDuration(value aper.Enumerated) time.Duration {
+	switch value {
+	case ngapType.TimeToWaitPresentV1s:
+		return time.Second
+	case ngapType.TimeToWaitPresentV2s:
+		return 2 * time.Second
+	case ngapType.TimeToWaitPresentV5s:
+		return 5 * time.Second
+	case ngapType.TimeToWaitPresentV10s:
+		return 10 * time.Second
+	case ngapType.TimeToWaitPresentV20s:
+		return 20 * time.Second
+	default:
+		return 60 * time.Second
+	}
+}
+
 func HandleDownlinkNasTransport(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	pdu *ngapType.NGAPPDU) {
 
 	amf.Log.Traceln("Processing Downlink Nas Transport")
+	var amfUeNgapId *ngapType.AMFUENGAPID
 	var gnbUeNgapId *ngapType.RANUENGAPID
 
 	if amf == nil {
@@ -234,20 +268,17 @@ func HandleDownlinkNasTransport(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	amf.Log.Traceln("Handle Downlink NAS Transport")
 	for i := 0; i < len(downlinkNasTransport.ProtocolIEs.List); i++ {
 		ie := downlinkNasTransport.ProtocolIEs.List[i]
-		if ie.Id.Value == ngapType.ProtocolIEIDRANUENGAPID {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
 			gnbUeNgapId = ie.Value.RANUENGAPID
 			amf.Log.Traceln("Decode IE RANUENGAPID")
-			if gnbUeNgapId == nil {
-				amf.Log.Errorln("RANUENGAPID is nil")
-				return
-			}
-			break
 		}
 	}
-	ngapId := gnbUeNgapId.Value
-	gnbue := gnb.GnbUes.GetGnbCpUe(ngapId)
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
 	if gnbue == nil {
-		amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:", ngapId)
 		return
 	}
 
@@ -258,6 +289,7 @@ func HandleInitialContextSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	pdu *ngapType.NGAPPDU) {
 
 	amf.Log.Traceln("Processing Initial Context Setup Request")
+	var amfUeNgapId *ngapType.AMFUENGAPID
 	var gnbUeNgapId *ngapType.RANUENGAPID
 
 	if amf == nil {
@@ -285,20 +317,17 @@ func HandleInitialContextSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 
 	amf.Log.Traceln("InitialContextSetupRequest")
 	for _, ie := range initialContextSetupRequest.ProtocolIEs.List {
-		if ie.Id.Value == ngapType.ProtocolIEIDRANUENGAPID {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
 			gnbUeNgapId = ie.Value.RANUENGAPID
 			amf.Log.Traceln("Decode IE RANUENGAPID")
-			if gnbUeNgapId == nil {
-				amf.Log.Errorln("RANUENGAPID is nil")
-				return
-			}
-			break
 		}
 	}
-	ngapId := gnbUeNgapId.Value
-	gnbue := gnb.GnbUes.GetGnbCpUe(ngapId)
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
 	if gnbue == nil {
-		amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:")
 		return
 	}
 
@@ -309,6 +338,7 @@ func HandleInitialContextSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 func HandlePduSessResourceSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	pdu *ngapType.NGAPPDU) {
 	amf.Log.Traceln("Processing Pdu Session Resource Setup Request")
+	var amfUeNgapId *ngapType.AMFUENGAPID
 	var gnbUeNgapId *ngapType.RANUENGAPID
 
 	if amf == nil {
@@ -335,20 +365,17 @@ func HandlePduSessResourceSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	}
 
 	for _, ie := range pduSessResourceSetupReq.ProtocolIEs.List {
-		if ie.Id.Value == ngapType.ProtocolIEIDRANUENGAPID {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
 			gnbUeNgapId = ie.Value.RANUENGAPID
 			amf.Log.Traceln("Decode IE RANUENGAPID")
-			if gnbUeNgapId == nil {
-				amf.Log.Errorln("RANUENGAPID is nil")
-				return
-			}
-			break
 		}
 	}
-	ngapId := gnbUeNgapId.Value
-	gnbue := gnb.GnbUes.GetGnbCpUe(ngapId)
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
 	if gnbue == nil {
-		amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:")
 		return
 	}
 
@@ -358,6 +385,7 @@ func HandlePduSessResourceSetupRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 func HandlePduSessResourceReleaseCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	pdu *ngapType.NGAPPDU) {
 	amf.Log.Traceln("Processing Pdu Session Resource Release Command")
+	var amfUeNgapId *ngapType.AMFUENGAPID
 	var gnbUeNgapId *ngapType.RANUENGAPID
 
 	if amf == nil {
@@ -384,26 +412,70 @@ func HandlePduSessResourceReleaseCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	}
 
 	for _, ie := range pduSessResourceReleaseCmd.ProtocolIEs.List {
-		if ie.Id.Value == ngapType.ProtocolIEIDRANUENGAPID {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
 			gnbUeNgapId = ie.Value.RANUENGAPID
 			amf.Log.Traceln("Decode IE RANUENGAPID")
-			if gnbUeNgapId == nil {
-				amf.Log.Errorln("RANUENGAPID is nil")
-				return
-			}
-			break
 		}
 	}
-	ngapId := gnbUeNgapId.Value
-	gnbue := gnb.GnbUes.GetGnbCpUe(ngapId)
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
 	if gnbue == nil {
-		amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:")
 		return
 	}
 
 	SendToGnbUe(gnbue, common.PDU_SESS_RESOURCE_RELEASE_COMMAND_EVENT, pdu)
 }
 
+func HandlePduSessResourceModifyRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+	amf.Log.Traceln("Processing Pdu Session Resource Modify Request")
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var gnbUeNgapId *ngapType.RANUENGAPID
+
+	if amf == nil {
+		amf.Log.Errorln("ran is nil")
+		return
+	}
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+	initiatingMessage := pdu.InitiatingMessage
+	if initiatingMessage == nil {
+		amf.Log.Errorln("Initiating Message is nil")
+		return
+	}
+	pduSessResourceModifyReq := initiatingMessage.Value.PDUSessionResourceModifyRequest
+	if pduSessResourceModifyReq == nil {
+		amf.Log.Errorln("PDUSessionResourceModifyRequest is nil")
+		return
+	}
+
+	for _, ie := range pduSessResourceModifyReq.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			gnbUeNgapId = ie.Value.RANUENGAPID
+			amf.Log.Traceln("Decode IE RANUENGAPID")
+		}
+	}
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
+	if gnbue == nil {
+		return
+	}
+
+	SendToGnbUe(gnbue, common.PDU_SESS_RESOURCE_MODIFY_REQUEST_EVENT, pdu)
+}
+
 func HandleUeCtxReleaseCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	pdu *ngapType.NGAPPDU) {
 
@@ -422,7 +494,6 @@ func HandleUeCtxReleaseCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 	}
 
 	var ueNgapIds *ngapType.UENGAPIDs
-	var ranUeNgapId *ngapType.RANUENGAPID
 
 	initiatingMessage := pdu.InitiatingMessage
 	if initiatingMessage == nil {
@@ -444,27 +515,607 @@ func HandleUeCtxReleaseCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
 				amf.Log.Errorln("UENGAPIDs is nil")
 				return
 			}
-			break
 		}
 	}
+	if ueNgapIds == nil {
+		amf.Log.Errorln("UENGAPIDs IE missing")
+		return
+	}
+
+	var gnbue *gnbctx.GnbCpUe
+	switch ueNgapIds.Present {
+	case ngapType.UENGAPIDsPresentUENGAPIDPair:
+		pair := ueNgapIds.UENGAPIDPair
+		gnbue = getGnbCpUe(gnb, amf, &pair.AMFUENGAPID, &pair.RANUENGAPID)
+	case ngapType.UENGAPIDsPresentAMFUENGAPID:
+		item := ngapType.UEAssociatedLogicalNGConnectionItem{}
+		item.AMFUENGAPID = ueNgapIds.AMFUENGAPID
+		gnbue = findNgConnection(gnb, amf, item)
+		if gnbue == nil {
+			amf.Log.Errorln("No GnbUe found corresponding to AMFUENGAPID:",
+				ueNgapIds.AMFUENGAPID.Value)
+			cause := &ngapType.Cause{
+				Present: ngapType.CausePresentRadioNetwork,
+				RadioNetwork: &ngapType.CauseRadioNetwork{
+					Value: ngapType.CauseRadioNetworkPresentInconsistentRemoteUENGAPID,
+				},
+			}
+			sendErrorIndication(gnb, amf, ueNgapIds.AMFUENGAPID, nil, cause, nil)
+		}
+	default:
+		amf.Log.Errorln("Invalid UENGAPIDs:", ueNgapIds.Present)
+	}
+	if gnbue == nil {
+		return
+	}
+
+	SendToGnbUe(gnbue, common.UE_CTX_RELEASE_COMMAND_EVENT, pdu)
+}
+
+// HandleNgReset releases the contexts of the UEs whose NG connection is reset
+// by the AMF, either all the UEs served by the AMF or the listed ones, and
+// acknowledges the reset once they are released
+func HandleNgReset(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing NG Reset")
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+
+	var cause *ngapType.Cause
+	var resetType *ngapType.ResetType
+
+	initiatingMessage := pdu.InitiatingMessage
+	if initiatingMessage == nil {
+		amf.Log.Errorln("Initiating Message is nil")
+		return
+	}
+
+	ngReset := initiatingMessage.Value.NGReset
+	if ngReset == nil {
+		amf.Log.Errorln("NGReset is nil")
+		return
+	}
+
+	for _, ie := range ngReset.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDCause:
+			cause = ie.Value.Cause
+			if cause == nil {
+				amf.Log.Errorln("Cause is nil")
+				return
+			}
+		case ngapType.ProtocolIEIDResetType:
+			resetType = ie.Value.ResetType
+			if resetType == nil {
+				amf.Log.Errorln("ResetType is nil")
+				return
+			}
+		}
+	}
+	if resetType == nil {
+		amf.Log.Errorln("ResetType IE missing")
+		return
+	}
+	if cause != nil {
+		test.PrintAndGetCause(cause)
+	}
 
-	if ueNgapIds.Present == ngapType.UENGAPIDsPresentUENGAPIDPair {
-		ranUeNgapId = &ueNgapIds.UENGAPIDPair.RANUENGAPID
-		if ranUeNgapId == nil {
-			amf.Log.Errorln("RANUENGAPID is nil")
+	var gnbues []*gnbctx.GnbCpUe
+	var ackList *ngapType.UEAssociatedLogicalNGConnectionList
+	switch resetType.Present {
+	case ngapType.ResetTypePresentNGInterface:
+		amf.Log.Infoln("Received NG Reset for the NG interface")
+		for _, gnbue := range gnb.GnbUes.GetGnbCpUes() {
+			if gnbue.GetAmf() == amf {
+				gnbues = append(gnbues, gnbue)
+			}
+		}
+	case ngapType.ResetTypePresentPartOfNGInterface:
+		lst := resetType.PartOfNGInterface
+		if lst == nil {
+			amf.Log.Errorln("PartOfNGInterface is nil")
 			return
 		}
-	} else {
-		/*TODO: Should add mapping for AMFUENGAPID vs GnbCpUeContext*/
-		amf.Log.Errorln("No RANUENGAPID received")
+		amf.Log.Infoln("Received NG Reset for", len(lst.List), "NG connections")
+		ackList = new(ngapType.UEAssociatedLogicalNGConnectionList)
+		for _, item := range lst.List {
+			if gnbue := findNgConnection(gnb, amf, item); gnbue != nil {
+				gnbues = append(gnbues, gnbue)
+			}
+			// NG connections unknown to the gNB are acknowledged as well
+			ackList.List = append(ackList.List, item)
+		}
+	default:
+		amf.Log.Errorln("Unsupported ResetType:", resetType.Present)
+		return
 	}
 
-	ngapId := ranUeNgapId.Value
-	gnbue := gnb.GnbUes.GetGnbCpUe(ngapId)
+	for _, gnbue := range gnbues {
+		msg := &gnbctx.NgResetMessage{Amf: amf}
+		msg.Event = common.NG_RESET_EVENT
+		msg.Error = fmt.Errorf("ng connection reset by amf %v", amf)
+		gnbue.PostMessage(msg)
+	}
+
+	// The NG Reset Acknowledge is sent once the UE contexts are released,
+	// without holding up the AMF worker meanwhile
+	go func() {
+		for _, gnbue := range gnbues {
+			<-gnbue.Terminated
+		}
+		ngapPdu, err := ngap.GetNGResetAcknowledge(ackList)
+		if err != nil {
+			amf.Log.Errorln("Failed to create NG Reset Acknowledge message:", err)
+			return
+		}
+		err = gnb.CpTransport.SendToPeer(amf, ngapPdu)
+		if err != nil {
+			amf.Log.Errorln("SendToPeer failed:", err)
+			return
+		}
+		amf.Log.Infoln("Sent NG Reset Acknowledge, released", len(gnbues), "UE contexts")
+	}()
+}
+
+// HandleNgResetAcknowledge completes the gNB initiated reset of the NG
+// connections listed by the AMF
+func HandleNgResetAcknowledge(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing NG Reset Acknowledge")
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+
+	successfulOutcome := pdu.SuccessfulOutcome
+	if successfulOutcome == nil {
+		amf.Log.Errorln("Successful Outcome is nil")
+		return
+	}
+	ngResetAck := successfulOutcome.Value.NGResetAcknowledge
+	if ngResetAck == nil {
+		amf.Log.Errorln("NGResetAcknowledge is nil")
+		return
+	}
+
+	var lst *ngapType.UEAssociatedLogicalNGConnectionList
+	for _, ie := range ngResetAck.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDUEAssociatedLogicalNGConnectionList {
+			lst = ie.Value.UEAssociatedLogicalNGConnectionList
+		}
+	}
+	if lst == nil {
+		amf.Log.Infoln("Received NG Reset Acknowledge for the NG interface")
+		return
+	}
+
+	amf.Log.Infoln("Received NG Reset Acknowledge for", len(lst.List), "NG connections")
+	for _, item := range lst.List {
+		gnbue := findNgConnection(gnb, amf, item)
+		if gnbue == nil {
+			continue
+		}
+		msg := &gnbctx.NgResetMessage{Amf: amf}
+		msg.Event = common.NG_RESET_ACK_EVENT
+		gnbue.PostMessage(msg)
+	}
+}
+
+// findNgConnection returns the context of the UE served by the AMF over the
+// NG connection, identified by the RAN UE NGAP ID or else the AMF UE NGAP ID
+func findNgConnection(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	item ngapType.UEAssociatedLogicalNGConnectionItem) *gnbctx.GnbCpUe {
+
+	if item.RANUENGAPID != nil {
+		gnbue := gnb.GnbUes.GetGnbCpUe(item.RANUENGAPID.Value)
+		if gnbue != nil && gnbue.GetAmf() == amf {
+			return gnbue
+		}
+		return nil
+	}
+	if item.AMFUENGAPID != nil {
+		for _, gnbue := range gnb.GnbUes.GetGnbCpUes() {
+			if gnbue.GetAmf() == amf && gnbue.AmfUeNgapId == item.AMFUENGAPID.Value {
+				return gnbue
+			}
+		}
+	}
+	return nil
+}
+
+// getGnbCpUe returns the context of the UE the AMF sent the UE associated
+// message for. The AMF is informed through an Error Indication if the gNB has
+// no such UE
+func getGnbCpUe(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	amfUeNgapId *ngapType.AMFUENGAPID,
+	ranUeNgapId *ngapType.RANUENGAPID) *gnbctx.GnbCpUe {
+
+	if ranUeNgapId == nil {
+		amf.Log.Errorln("RANUENGAPID is nil")
+		return nil
+	}
+	gnbue := gnb.GnbUes.GetGnbCpUe(ranUeNgapId.Value)
+	if gnbue != nil && gnbue.GetAmf() == amf {
+		return gnbue
+	}
+
+	amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:",
+		ranUeNgapId.Value)
+	cause := &ngapType.Cause{
+		Present: ngapType.CausePresentRadioNetwork,
+		RadioNetwork: &ngapType.CauseRadioNetwork{
+			Value: ngapType.CauseRadioNetworkPresentUnknownLocalUENGAPID,
+		},
+	}
+	sendErrorIndication(gnb, amf, amfUeNgapId, ranUeNgapId, cause, nil)
+	return nil
+}
+
+func sendErrorIndication(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	amfUeNgapId *ngapType.AMFUENGAPID, ranUeNgapId *ngapType.RANUENGAPID,
+	cause *ngapType.Cause, diag *ngapType.CriticalityDiagnostics) {
+
+	ngapPdu, err := ngap.GetErrorIndication(amfUeNgapId, ranUeNgapId, cause,
+		diag)
+	if err != nil {
+		amf.Log.Errorln("Failed to create Error Indication message:", err)
+		return
+	}
+	err = gnb.CpTransport.SendToPeer(amf, ngapPdu)
+	if err != nil {
+		amf.Log.Errorln("SendToPeer failed:", err)
+		return
+	}
+	amf.Log.Warnln("Sent Error Indication, Cause:", test.CauseString(cause))
+}
+
+// HandleErrorIndication logs the error reported by the AMF and forwards it
+// to the UE it is attributed to, if any
+func HandleErrorIndication(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing Error Indication")
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+
+	initiatingMessage := pdu.InitiatingMessage
+	if initiatingMessage == nil {
+		amf.Log.Errorln("Initiating Message is nil")
+		return
+	}
+	errorIndication := initiatingMessage.Value.ErrorIndication
+	if errorIndication == nil {
+		amf.Log.Errorln("ErrorIndication is nil")
+		return
+	}
+
+	item := ngapType.UEAssociatedLogicalNGConnectionItem{}
+	var cause *ngapType.Cause
+	var diag *ngapType.CriticalityDiagnostics
+	for _, ie := range errorIndication.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			item.AMFUENGAPID = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			item.RANUENGAPID = ie.Value.RANUENGAPID
+		case ngapType.ProtocolIEIDCause:
+			cause = ie.Value.Cause
+		case ngapType.ProtocolIEIDCriticalityDiagnostics:
+			diag = ie.Value.CriticalityDiagnostics
+		}
+	}
+
+	causeStr := "none"
+	if cause != nil {
+		causeStr = test.CauseString(cause)
+	}
+	amf.Log.Warnln("Received Error Indication, Cause:", causeStr)
+	if diag != nil && diag.ProcedureCode != nil {
+		amf.Log.Warnln("Error Indication for Procedure Code:",
+			diag.ProcedureCode.Value)
+	}
+
+	if item.AMFUENGAPID == nil && item.RANUENGAPID == nil {
+		return
+	}
+	gnbue := findNgConnection(gnb, amf, item)
 	if gnbue == nil {
-		amf.Log.Errorln("No GnbUe found corresponding to RANUENGAPID:")
+		amf.Log.Warnln("No GnbUe found for the Error Indication")
 		return
 	}
 
-	SendToGnbUe(gnbue, common.UE_CTX_RELEASE_COMMAND_EVENT, pdu)
+	SendToGnbUe(gnbue, common.NGAP_ERROR_INDICATION_EVENT, pdu)
+}
+
+// HandleHandoverRequest creates the context of the UE handed over to the gNB
+// by the source gNB identified in the Source to Target Transparent Container
+func HandleHandoverRequest(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing Handover Request")
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var container *ngapType.SourceToTargetTransparentContainer
+
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+	initiatingMessage := pdu.InitiatingMessage
+	if initiatingMessage == nil {
+		amf.Log.Errorln("Initiating Message is nil")
+		return
+	}
+	handoverRequest := initiatingMessage.Value.HandoverRequest
+	if handoverRequest == nil {
+		amf.Log.Errorln("HandoverRequest is nil")
+		return
+	}
+
+	for _, ie := range handoverRequest.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDSourceToTargetTransparentContainer:
+			container = ie.Value.SourceToTargetTransparentContainer
+			amf.Log.Traceln("Decode IE SourceToTargetTransparentContainer")
+		}
+	}
+	if amfUeNgapId == nil {
+		amf.Log.Errorln("AMFUENGAPID is nil")
+		return
+	}
+
+	source := getHandoverSource(gnb, amf, container)
+	if source == nil {
+		cause := &ngapType.Cause{
+			Present: ngapType.CausePresentRadioNetwork,
+			RadioNetwork: &ngapType.CauseRadioNetwork{
+				Value: ngapType.CauseRadioNetworkPresentUnspecified,
+			},
+		}
+		sendHandoverFailure(gnb, amf, amfUeNgapId, cause)
+		return
+	}
+
+	ranUeNgapId, err := gnb.AllocateRanUeNgapID()
+	if err != nil {
+		amf.Log.Errorln("AllocateRanUeNgapID returned:", err)
+		cause := &ngapType.Cause{
+			Present: ngapType.CausePresentRadioNetwork,
+			RadioNetwork: &ngapType.CauseRadioNetwork{
+				Value: ngapType.CauseRadioNetworkPresentNoRadioResourcesAvailableInTargetCell,
+			},
+		}
+		sendHandoverFailure(gnb, amf, amfUeNgapId, cause)
+		return
+	}
+
+	// The target context serves the same UE as the source context, it ends
+	// along with the source once the UE is no longer interested in it
+	gnbue := gnbctx.NewGnbCpUe(ranUeNgapId, gnb, amf)
+	gnbue.AmfUeNgapId = amfUeNgapId.Value
+	gnbue.Supi = source.Supi
+	gnbue.Ctx = source.Ctx
+	gnbue.WriteUeChan = source.WriteUeChan
+	gnbue.HandoverSource = source.Gnb
+	gnb.GnbUes.AddGnbCpUe(ranUeNgapId, gnbue)
+	go gnbcpueworker.Init(gnbue)
+
+	source.Gnb.GnbUes.AddHandoverGnbCpUe(gnbue.HandoverKey(), gnbue)
+	SendToGnbUe(gnbue, common.NGAP_HANDOVER_REQUEST_EVENT, pdu)
+}
+
+// getHandoverSource returns the context of the UE on the source gNB, the
+// source is identified by the key carried in the RRC container
+func getHandoverSource(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	container *ngapType.SourceToTargetTransparentContainer) *gnbctx.GnbCpUe {
+
+	if container == nil {
+		amf.Log.Errorln("SourceToTargetTransparentContainer is nil")
+		return nil
+	}
+	transfer := ngapType.SourceNGRANNodeToTargetNGRANNodeTransparentContainer{}
+	err := aper.UnmarshalWithParams(container.Value, &transfer, "valueExt")
+	if err != nil {
+		amf.Log.Errorln("UnmarshalWithParams returned:", err)
+		return nil
+	}
+
+	key := string(transfer.RRCContainer.Value)
+	source := gnb.GnbUes.GetHandoverGnbCpUe(key)
+	if source == nil {
+		amf.Log.Errorln("No source gNB UE context for handover key:", key)
+		return nil
+	}
+	gnb.GnbUes.RemoveHandoverGnbCpUe(key)
+	return source
+}
+
+func sendHandoverFailure(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	amfUeNgapId *ngapType.AMFUENGAPID, cause *ngapType.Cause) {
+
+	ngapPdu, err := ngap.GetHandoverFailure(amfUeNgapId.Value, cause)
+	if err != nil {
+		amf.Log.Errorln("Failed to create Handover Failure message:", err)
+		return
+	}
+	err = gnb.CpTransport.SendToPeer(amf, ngapPdu)
+	if err != nil {
+		amf.Log.Errorln("SendToPeer failed:", err)
+		return
+	}
+	amf.Log.Warnln("Sent Handover Failure, Cause:", test.CauseString(cause))
+}
+
+// HandleHandoverCommand forwards the Handover Command to the source UE
+// context
+func HandleHandoverCommand(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing Handover Command")
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var gnbUeNgapId *ngapType.RANUENGAPID
+
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+	successfulOutcome := pdu.SuccessfulOutcome
+	if successfulOutcome == nil {
+		amf.Log.Errorln("Successful Outcome is nil")
+		return
+	}
+	handoverCommand := successfulOutcome.Value.HandoverCommand
+	if handoverCommand == nil {
+		amf.Log.Errorln("HandoverCommand is nil")
+		return
+	}
+
+	for _, ie := range handoverCommand.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			gnbUeNgapId = ie.Value.RANUENGAPID
+			amf.Log.Traceln("Decode IE RANUENGAPID")
+		}
+	}
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
+	if gnbue == nil {
+		return
+	}
+
+	SendToGnbUe(gnbue, common.NGAP_HANDOVER_COMMAND_EVENT, pdu)
+}
+
+// HandleHandoverPreparationFailure forwards the Handover Preparation Failure
+// to the source UE context
+func HandleHandoverPreparationFailure(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	amf.Log.Traceln("Processing Handover Preparation Failure")
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var gnbUeNgapId *ngapType.RANUENGAPID
+
+	if pdu == nil {
+		amf.Log.Errorln("NGAP Message is nil")
+		return
+	}
+	if gnb == nil {
+		amf.Log.Errorln("gNodeB context is nil")
+		return
+	}
+	unsuccessfulOutcome := pdu.UnsuccessfulOutcome
+	if unsuccessfulOutcome == nil {
+		amf.Log.Errorln("Unsuccessful Outcome is nil")
+		return
+	}
+	failure := unsuccessfulOutcome.Value.HandoverPreparationFailure
+	if failure == nil {
+		amf.Log.Errorln("HandoverPreparationFailure is nil")
+		return
+	}
+
+	for _, ie := range failure.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+			amf.Log.Traceln("Decode IE AMFUENGAPID")
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			gnbUeNgapId = ie.Value.RANUENGAPID
+			amf.Log.Traceln("Decode IE RANUENGAPID")
+		}
+	}
+	gnbue := getGnbCpUe(gnb, amf, amfUeNgapId, gnbUeNgapId)
+	if gnbue == nil {
+		return
+	}
+
+	SendToGnbUe(gnbue, common.NGAP_HANDOVER_PREP_FAILURE_EVENT, pdu)
+}
+
+// HandleUnsupportedMessage reports a message the gNB cannot process to the
+// AMF, unless the criticality of the procedure allows ignoring it silently
+func HandleUnsupportedMessage(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf,
+	pdu *ngapType.NGAPPDU) {
+
+	diag := &ngapType.CriticalityDiagnostics{
+		TriggeringMessage: &ngapType.TriggeringMessage{},
+	}
+	cause := &ngapType.Cause{
+		Present:  ngapType.CausePresentProtocol,
+		Protocol: &ngapType.CauseProtocol{},
+	}
+
+	switch pdu.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		msg := pdu.InitiatingMessage
+		diag.ProcedureCode = &msg.ProcedureCode
+		diag.ProcedureCriticality = &msg.Criticality
+		diag.TriggeringMessage.Value =
+			ngapType.TriggeringMessagePresentInitiatingMessage
+
+		switch msg.Criticality.Value {
+		case ngapType.CriticalityPresentReject:
+			cause.Protocol.Value =
+				ngapType.CauseProtocolPresentAbstractSyntaxErrorReject
+		case ngapType.CriticalityPresentNotify:
+			cause.Protocol.Value =
+				ngapType.CauseProtocolPresentAbstractSyntaxErrorIgnoreAndNotify
+		default:
+			amf.Log.Warnln("Ignoring unsupported NGAP message, Procedure Code:",
+				msg.ProcedureCode.Value)
+			return
+		}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		msg := pdu.SuccessfulOutcome
+		diag.ProcedureCode = &msg.ProcedureCode
+		diag.ProcedureCriticality = &msg.Criticality
+		diag.TriggeringMessage.Value =
+			ngapType.TriggeringMessagePresentSuccessfulOutcome
+		cause.Protocol.Value =
+			ngapType.CauseProtocolPresentMessageNotCompatibleWithReceiverState
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		msg := pdu.UnsuccessfulOutcome
+		diag.ProcedureCode = &msg.ProcedureCode
+		diag.ProcedureCriticality = &msg.Criticality
+		diag.TriggeringMessage.Value =
+			ngapType.TriggeringMessagePresentUnsuccessfullOutcome
+		cause.Protocol.Value =
+			ngapType.CauseProtocolPresentMessageNotCompatibleWithReceiverState
+	default:
+		return
+	}
+
+	amf.Log.Errorln("Received unsupported NGAP message, Procedure Code:",
+		diag.ProcedureCode.Value)
+	sendErrorIndication(gnb, amf, nil, nil, cause, diag)
 }
@@ -40,8 +40,18 @@ func HandleMessage(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf, pkt []byte) error {
 			HandlePduSessResourceSetupRequest(gnb, amf, pdu)
 		case ngapType.ProcedureCodePDUSessionResourceRelease:
 			HandlePduSessResourceReleaseCommand(gnb, amf, pdu)
+		case ngapType.ProcedureCodePDUSessionResourceModify:
+			HandlePduSessResourceModifyRequest(gnb, amf, pdu)
 		case ngapType.ProcedureCodeUEContextRelease:
 			HandleUeCtxReleaseCommand(gnb, amf, pdu)
+		case ngapType.ProcedureCodeNGReset:
+			HandleNgReset(gnb, amf, pdu)
+		case ngapType.ProcedureCodeErrorIndication:
+			HandleErrorIndication(gnb, amf, pdu)
+		case ngapType.ProcedureCodeHandoverResourceAllocation:
+			HandleHandoverRequest(gnb, amf, pdu)
+		default:
+			HandleUnsupportedMessage(gnb, amf, pdu)
 		}
 	case ngapType.NGAPPDUPresentSuccessfulOutcome:
 		successfulOutcome := pdu.SuccessfulOutcome
@@ -51,6 +61,12 @@ func HandleMessage(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf, pkt []byte) error {
 		switch successfulOutcome.ProcedureCode.Value {
 		case ngapType.ProcedureCodeNGSetup:
 			HandleNgSetupResponse(amf, pdu)
+		case ngapType.ProcedureCodeNGReset:
+			HandleNgResetAcknowledge(gnb, amf, pdu)
+		case ngapType.ProcedureCodeHandoverPreparation:
+			HandleHandoverCommand(gnb, amf, pdu)
+		default:
+			HandleUnsupportedMessage(gnb, amf, pdu)
 		}
 	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
 		unsuccessfulOutcome := pdu.UnsuccessfulOutcome
@@ -60,6 +76,10 @@ func HandleMessage(gnb *gnbctx.GNodeB, amf *gnbctx.GnbAmf, pkt []byte) error {
 		switch unsuccessfulOutcome.ProcedureCode.Value {
 		case ngapType.ProcedureCodeNGSetup:
 			HandleNgSetupFailure(amf, pdu)
+		case ngapType.ProcedureCodeHandoverPreparation:
+			HandleHandoverPreparationFailure(gnb, amf, pdu)
+		default:
+			HandleUnsupportedMessage(gnb, amf, pdu)
 		}
 	}
 
@@ -38,22 +38,43 @@ func HandleConnectRequest(gnbue *gnbctx.GnbCpUe,
 	gnbue.WriteUeChan = msg.CommChan
 }
 
+// HandleInitialUEMessage forwards the NAS message starting the connection of
+// the UE to the AMF serving it, selected first if none is. If no AMF is
+// available the UE context is released as if the association with the AMF
+// was lost, so that the procedure in progress fails. Returns true once the
+// context is released
 func HandleInitialUEMessage(gnbue *gnbctx.GnbCpUe,
-	intfcMsg common.InterfaceMessage) {
+	intfcMsg common.InterfaceMessage) bool {
 
 	msg := intfcMsg.(*common.UuMessage)
+	if gnbue.GetAmf() == nil {
+		amf := gnbue.Gnb.SelectAmf(msg.FiveGSTmsi)
+		if amf == nil {
+			gnbue.Log.Errorln("No AMF available")
+			lost := &common.DefaultMessage{}
+			lost.Event = common.AMF_ASSOC_LOST_EVENT
+			lost.Error = fmt.Errorf("no amf available")
+			releaseUeContext(gnbue, common.AMF_ASSOC_LOST_EVENT, lost)
+			return true
+		}
+		gnbue.SetAmf(amf)
+		gnbue.Log.Infoln("Selected AMF, Name:", amf.AmfName, "IP:", amf.AmfIp,
+			"Port:", amf.AmfPort)
+	}
+
 	sendMsg, err := test.GetInitialUEMessage(gnbue.GnbUeNgapId, msg.NasPdus[0], "")
 	if err != nil {
 		gnbue.Log.Errorln("GetInitialUEMessage failed:", err)
-		return
+		return false
 	}
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, sendMsg)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
-		return
+		return false
 	}
 
 	gnbue.Log.Traceln("Sent Initial UE Message to AMF")
+	return false
 }
 
 func HandleDownlinkNasTransport(gnbue *gnbctx.GnbCpUe,
@@ -105,7 +126,7 @@ func HandleUlInfoTransfer(gnbue *gnbctx.GnbCpUe,
 		gnbue.Log.Errorln("GetUplinkNASTransport failed:", err)
 		return
 	}
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, sendMsg)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -184,7 +205,7 @@ func HandleInitialContextSetupRequest(gnbue *gnbctx.GnbCpUe,
 		return
 	}
 
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, resp)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), resp)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -310,7 +331,7 @@ func HandlePduSessResourceReleaseCommand(gnbue *gnbctx.GnbCpUe,
 		return
 	}
 
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, ngapPdu)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -320,6 +341,157 @@ func HandlePduSessResourceReleaseCommand(gnbue *gnbctx.GnbCpUe,
 	SendToUe(gnbue, common.DATA_BEARER_RELEASE_REQUEST_EVENT, nil)
 }
 
+func HandlePduSessResourceModifyRequest(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	msg := intfcMsg.(*common.N2Message)
+	var pduSessResourceModifyList *ngapType.PDUSessionResourceModifyListModReq
+
+	pdu := msg.NgapPdu
+
+	initiatingMessage := pdu.InitiatingMessage
+	pduSessResourceModifyReq := initiatingMessage.Value.PDUSessionResourceModifyRequest
+
+	for _, ie := range pduSessResourceModifyReq.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDPDUSessionResourceModifyListModReq:
+			pduSessResourceModifyList = ie.Value.PDUSessionResourceModifyListModReq
+		}
+	}
+	if pduSessResourceModifyList == nil || len(pduSessResourceModifyList.List) == 0 {
+		gnbue.Log.Errorln("PDUSessionResourceModifyListModReq is empty")
+		return
+	}
+
+	var pduSessions []*ngapTestpacket.PduSession
+	var nasPdus common.NasPduList
+	for _, item := range pduSessResourceModifyList.List {
+		pduSessId := item.PDUSessionID.Value
+		gnbue.Log.Infoln("PDU Session Resource Modify Request PDU Session ID:",
+			pduSessId)
+		pduSess := &ngapTestpacket.PduSession{}
+		pduSess.PduSessId = pduSessId
+		pduSessions = append(pduSessions, pduSess)
+
+		upCtx, err := gnbue.GetGnbUpUe(pduSessId)
+		if err != nil {
+			gnbue.Log.Errorln("Failed to fetch PDU session context:", err)
+			continue
+		}
+
+		resourceModifyRequestTransfer := ngapType.PDUSessionResourceModifyRequestTransfer{}
+		err = aper.UnmarshalWithParams(item.PDUSessionResourceModifyRequestTransfer,
+			&resourceModifyRequestTransfer, "valueExt")
+		if err != nil {
+			gnbue.Log.Errorln("UnmarshalWithParams returned:", err)
+			continue
+		}
+		ProcessQosFlowModifyList(upCtx, &resourceModifyRequestTransfer, pduSess)
+
+		pduSess.Success = true
+		if item.NASPDU != nil {
+			nasPdus = append(nasPdus, item.NASPDU.Value)
+		}
+	}
+
+	if len(nasPdus) != 0 {
+		SendToUe(gnbue, common.DL_INFO_TRANSFER_EVENT, nasPdus)
+		gnbue.Log.Traceln("Sent DL Information Transfer Event to UE")
+	}
+
+	ngapPdu, err := test.GetPDUSessionResourceModifyResponse(pduSessions,
+		gnbue.AmfUeNgapId, gnbue.GnbUeNgapId)
+	if err != nil {
+		gnbue.Log.Errorln("Failed to create PDU Session Resource Modify Response:", err)
+		return
+	}
+
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu)
+	if err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+		return
+	}
+	gnbue.Log.Traceln("Sent PDU Session Resource Modify Response Message to AMF")
+}
+
+// ProcessQosFlowModifyList adds, modifies and releases the QoS flows of the
+// PDU session as requested by the PDU Session Resource Modify Request
+// Transfer. A new QoS flow without QoS parameters fails to be added
+func ProcessQosFlowModifyList(upCtx *gnbctx.GnbUpUe,
+	transfer *ngapType.PDUSessionResourceModifyRequestTransfer,
+	pduSess *ngapTestpacket.PduSession) {
+
+	for _, ie := range transfer.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDQosFlowAddOrModifyRequestList:
+			if ie.Value.QosFlowAddOrModifyRequestList == nil {
+				continue
+			}
+			for _, item := range ie.Value.QosFlowAddOrModifyRequestList.List {
+				qosFlowId := item.QosFlowIdentifier.Value
+				qosParams := item.QosFlowLevelQosParameters
+				_, found := upCtx.QosFlows[qosFlowId]
+				if !found && qosParams == nil {
+					upCtx.Log.Errorln("QoS parameters missing for new QoS Flow Id:",
+						qosFlowId)
+					pduSess.FailedQfiList = append(pduSess.FailedQfiList, qosFlowId)
+					continue
+				}
+
+				// An existing QoS flow is left unchanged if no QoS parameters
+				// are provided
+				if qosParams != nil {
+					logQosFlowParams(upCtx, qosFlowId, qosParams)
+					if found {
+						err := upCtx.ModifyQosFlow(qosFlowId, qosParams)
+						if err != nil {
+							upCtx.Log.Errorln("Failed to modify QoS flow:", err)
+						}
+					} else {
+						upCtx.AddQosFlow(qosFlowId, &ngapType.QosFlowSetupRequestItem{
+							QosFlowIdentifier:         item.QosFlowIdentifier,
+							QosFlowLevelQosParameters: *qosParams,
+							ERABID:                    item.ERABID,
+						})
+					}
+				}
+				pduSess.SuccessQfiList = append(pduSess.SuccessQfiList, qosFlowId)
+			}
+		case ngapType.ProtocolIEIDQosFlowToReleaseList:
+			if ie.Value.QosFlowToReleaseList == nil {
+				continue
+			}
+			for _, item := range ie.Value.QosFlowToReleaseList.List {
+				qosFlowId := item.QosFlowIdentifier.Value
+				_, cause := test.PrintAndGetCause(&item.Cause)
+				upCtx.Log.Infoln("QoS Flow Id:", qosFlowId, "released, cause:", cause)
+				err := upCtx.RemoveQosFlow(qosFlowId)
+				if err != nil {
+					upCtx.Log.Errorln("Failed to release QoS flow:", err)
+				}
+			}
+		}
+	}
+}
+
+func logQosFlowParams(upCtx *gnbctx.GnbUpUe, qosFlowId int64,
+	qosParams *ngapType.QosFlowLevelQosParameters) {
+
+	upCtx.Log.Infoln("QoS Flow Id:", qosFlowId)
+	qosChar := qosParams.QosCharacteristics
+	if qosChar.Present == ngapType.QosCharacteristicsPresentNonDynamic5QI &&
+		qosChar.NonDynamic5QI != nil {
+		upCtx.Log.Infoln("Non Dynamic 5QI:", qosChar.NonDynamic5QI.FiveQI.Value)
+	}
+	arp := qosParams.AllocationAndRetentionPriority
+	upCtx.Log.Infoln("ARP Priority Level:", arp.PriorityLevelARP.Value)
+	if gbr := qosParams.GBRQosInformation; gbr != nil {
+		upCtx.Log.Infof("GFBR DL/UL: %v/%v bps, MFBR DL/UL: %v/%v bps",
+			gbr.GuaranteedFlowBitRateDL.Value, gbr.GuaranteedFlowBitRateUL.Value,
+			gbr.MaximumFlowBitRateDL.Value, gbr.MaximumFlowBitRateUL.Value)
+	}
+}
+
 func HandleDataBearerSetupResponse(gnbue *gnbctx.GnbCpUe,
 	intfcMsg common.InterfaceMessage) {
 
@@ -338,6 +510,7 @@ func HandleDataBearerSetupResponse(gnbue *gnbctx.GnbCpUe,
 			// routine. This will help in replacing sync map with normal map
 			// Thus will help avoid lock unlock operation on per downlink message
 			gnbUpUe.Upf.GnbUpUes.AddGnbUpUe(gnbUpUe.DlTeid, true, gnbUpUe)
+			gnbUpUe.Upf.GnbUpUes.AddGnbUpUe(gnbUpUe.UlTeid, false, gnbUpUe)
 			gnbUpUe.WriteUeChan = item.CommChan
 			gnbue.WaitGrp.Add(1)
 			go func() {
@@ -348,6 +521,13 @@ func HandleDataBearerSetupResponse(gnbue *gnbctx.GnbCpUe,
 		pduSessions = append(pduSessions, pduSess)
 	}
 
+	// The AMF already switched the user plane of the UE handed over to the
+	// gNB, nothing to report
+	if msg.TriggeringEvent == common.HANDOVER_CONFIRM_EVENT {
+		gnbue.Log.Traceln("User plane resumed after handover")
+		return
+	}
+
 	var ngapPdu []byte
 	var err error
 
@@ -367,7 +547,7 @@ func HandleDataBearerSetupResponse(gnbue *gnbctx.GnbCpUe,
 		}
 	}
 
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, ngapPdu)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -428,7 +608,7 @@ func HandleUeCtxReleaseCommand(gnbue *gnbctx.GnbCpUe,
 		return
 	}
 
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, ngapPdu)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -439,6 +619,12 @@ func HandleUeCtxReleaseCommand(gnbue *gnbctx.GnbCpUe,
 	quitEvt.Event = common.QUIT_EVENT
 	gnbue.ReadChan <- quitEvt
 
+	// UE is served by the target gNB of the handover by now
+	if gnbue.HandedOver {
+		gnbue.Log.Infoln("Released UE context after handover")
+		return
+	}
+
 	req := &common.UuMessage{}
 	req.Event = common.CONNECTION_RELEASE_REQUEST_EVENT
 	if causeNum == ngapType.CauseNasPresentDeregister {
@@ -447,7 +633,7 @@ func HandleUeCtxReleaseCommand(gnbue *gnbctx.GnbCpUe,
 		req.TriggeringEvent = common.TRIGGER_AN_RELEASE_EVENT
 	}
 
-	gnbue.WriteUeChan <- req
+	SendMsgToUe(gnbue, req)
 }
 
 func HandleRanConnectionRelease(gnbue *gnbctx.GnbCpUe,
@@ -464,7 +650,7 @@ func HandleRanConnectionRelease(gnbue *gnbctx.GnbCpUe,
 		gnbue.Log.Errorln("GetUplinkNASTransport failed:", err)
 		return
 	}
-	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.Amf, sendMsg)
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
 	if err != nil {
 		gnbue.Log.Errorln("SendToPeer failed:", err)
 		return
@@ -481,107 +667,15 @@ func ProcessPduSessResourceSetupList(gnbue *gnbctx.GnbCpUe,
 	var nasPdus common.NasPduList
 
 	for _, item := range lst {
-
-		resourceSetupRequestTransfer := ngapType.PDUSessionResourceSetupRequestTransfer{}
-		err := aper.UnmarshalWithParams(item.PDUSessionResourceSetupRequestTransfer,
-			&resourceSetupRequestTransfer, "valueExt")
+		dbParam, err := setupPduSessResource(gnbue, item)
 		if err != nil {
-			gnbue.Log.Errorln("UnmarshalWithParams returned:", err)
+			gnbue.Log.Errorln("Failed to set up PDU session resource:", err)
 			return
 		}
 
-		var gtpTunnel *ngapType.GTPTunnel
-		var pduSessType *ngapType.PDUSessionType
-		var qosFlowSetupReqList *ngapType.QosFlowSetupRequestList
-		for _, ie := range resourceSetupRequestTransfer.ProtocolIEs.List {
-			switch ie.Id.Value {
-			case ngapType.ProtocolIEIDULNGUUPTNLInformation:
-				gtpTunnel = ie.Value.ULNGUUPTNLInformation.GTPTunnel
-				if gtpTunnel == nil {
-					gnbue.Log.Errorln("GTPTunnel is nil")
-					return
-				}
-			case ngapType.ProtocolIEIDPDUSessionType:
-				pduSessType = ie.Value.PDUSessionType
-				if pduSessType == nil {
-					gnbue.Log.Errorln("PDUSessionType is nil")
-					return
-				}
-			case ngapType.ProtocolIEIDQosFlowSetupRequestList:
-				qosFlowSetupReqList = ie.Value.QosFlowSetupRequestList
-				if qosFlowSetupReqList == nil || len(qosFlowSetupReqList.List) == 0 {
-					gnbue.Log.Errorln("QosFlowSetupRequestList is empty")
-					return
-				}
-			}
-		}
-
-		ulteid := binary.BigEndian.Uint32(gtpTunnel.GTPTEID.Value)
-		dlteid, err := gnbue.Gnb.DlTeidGenerator.Allocate()
-		if err != nil {
-			gnbue.Log.Errorln("ID Generator Allocate() returned:", err)
-			return
-		}
-		upfIp, _ := ngapConvert.IPAddressToString(gtpTunnel.TransportLayerAddress)
-
-		gnbupue := gnbctx.NewGnbUpUe(uint32(dlteid), ulteid, gnbue.Gnb)
-		gnbupue.Snssai = ngapConvert.SNssaiToModels(item.SNSSAI)
-		gnbupue.PduSessId = item.PDUSessionID.Value
-		gnbupue.PduSessType = test.PDUSessionTypeToModels(*pduSessType)
-		pduSess := &ngapTestpacket.PduSession{}
-		pduSess.PduSessId = gnbupue.PduSessId
-		pduSess.Teid = gnbupue.DlTeid
-
-		gnbue.Log.Infoln("PDU Session ID:", gnbupue.PduSessId)
-		gnbue.Log.Infoln("S-NSSAI - SST: ", gnbupue.Snssai.Sst)
-		gnbue.Log.Infoln("S-NSSAI - SD: ", gnbupue.Snssai.Sd)
-		gnbue.Log.Infoln("UL GTP-TEID: ", ulteid)
-		gnbue.Log.Infoln("DL GTP-TEID: ", dlteid)
-		gnbue.Log.Infoln("UPF Endpoint IP: ", upfIp)
-		gnbue.Log.Infoln("PDU Session Type: ", gnbupue.PduSessType)
-
-		var qosFlowId int64
-		var qosChar ngapType.QosCharacteristics
-		var arp ngapType.AllocationAndRetentionPriority
-		var nonDynamic5QI *ngapType.NonDynamic5QIDescriptor
-		for _, qosFlowSetupReqItem := range qosFlowSetupReqList.List {
-			qosFlowId = qosFlowSetupReqItem.QosFlowIdentifier.Value
-			qosChar = qosFlowSetupReqItem.QosFlowLevelQosParameters.QosCharacteristics
-			arp = qosFlowSetupReqItem.QosFlowLevelQosParameters.AllocationAndRetentionPriority
-
-			gnbue.Log.Infoln("QoS Flow Id:", qosFlowId)
-			if qosChar.Present == ngapType.QosCharacteristicsPresentNonDynamic5QI {
-				nonDynamic5QI = qosChar.NonDynamic5QI
-				if nonDynamic5QI == nil {
-					gnbue.Log.Errorln("NonDynamic5QI is nil")
-					return
-				}
-				gnbue.Log.Infoln("Non Dynamic 5QI:", nonDynamic5QI.FiveQI.Value)
-			}
-			gnbue.Log.Infoln("ARP Priority Level:", arp.PriorityLevelARP.Value)
-			gnbue.Log.Infoln("Pre-emption Capability:", arp.PreEmptionCapability.Value)
-			gnbue.Log.Infoln("Pre-emption Vulnerability:", arp.PreEmptionVulnerability.Value)
-
-			pduSess.SuccessQfiList = append(pduSess.SuccessQfiList, qosFlowId)
-			gnbupue.AddQosFlow(qosFlowId, &qosFlowSetupReqItem)
-		}
-
-		pduSess.Success = true
 		if item.NASPDU != nil {
 			nasPdus = append(nasPdus, item.NASPDU.Value)
 		}
-
-		gnbupf, created := gnbue.Gnb.GnbPeers.GetOrAddGnbUpf(upfIp)
-		if created {
-			go gnbupfworker.Init(gnbupf)
-		}
-		gnbupue.Upf = gnbupf
-		gnbue.AddGnbUpUe(gnbupue.PduSessId, gnbupue)
-
-		//pduSessions = append(pduSessions, pduSess)
-		dbParam := &common.DataBearerParams{}
-		dbParam.CommChan = gnbupue.ReadUlChan
-		dbParam.PduSess = pduSess
 		dbParamSet = append(dbParamSet, dbParam)
 	}
 
@@ -598,11 +692,209 @@ func ProcessPduSessResourceSetupList(gnbue *gnbctx.GnbCpUe,
 	uemsg.Event = common.DATA_BEARER_SETUP_REQUEST_EVENT
 	uemsg.DBParams = dbParamSet
 	uemsg.TriggeringEvent = event
-	gnbue.WriteUeChan <- &uemsg
+	SendMsgToUe(gnbue, &uemsg)
+}
+
+// setupPduSessResource creates the GnbUpUe of the PDU session as per the PDU
+// Session Resource Setup Request Transfer and returns the parameters of the
+// data bearer to be set up with the UE
+func setupPduSessResource(gnbue *gnbctx.GnbCpUe,
+	item pduSessResourceSetupItem) (*common.DataBearerParams, error) {
+
+	resourceSetupRequestTransfer := ngapType.PDUSessionResourceSetupRequestTransfer{}
+	err := aper.UnmarshalWithParams(item.PDUSessionResourceSetupRequestTransfer,
+		&resourceSetupRequestTransfer, "valueExt")
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalWithParams returned:%v", err)
+	}
+
+	var gtpTunnel *ngapType.GTPTunnel
+	var pduSessType *ngapType.PDUSessionType
+	var qosFlowSetupReqList *ngapType.QosFlowSetupRequestList
+	for _, ie := range resourceSetupRequestTransfer.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDULNGUUPTNLInformation:
+			gtpTunnel = ie.Value.ULNGUUPTNLInformation.GTPTunnel
+			if gtpTunnel == nil {
+				return nil, fmt.Errorf("GTPTunnel is nil")
+			}
+		case ngapType.ProtocolIEIDPDUSessionType:
+			pduSessType = ie.Value.PDUSessionType
+			if pduSessType == nil {
+				return nil, fmt.Errorf("PDUSessionType is nil")
+			}
+		case ngapType.ProtocolIEIDQosFlowSetupRequestList:
+			qosFlowSetupReqList = ie.Value.QosFlowSetupRequestList
+			if qosFlowSetupReqList == nil || len(qosFlowSetupReqList.List) == 0 {
+				return nil, fmt.Errorf("QosFlowSetupRequestList is empty")
+			}
+		}
+	}
+	if gtpTunnel == nil || pduSessType == nil || qosFlowSetupReqList == nil {
+		return nil, fmt.Errorf("mandatory ie missing in PDU Session Resource Setup Request Transfer")
+	}
+
+	ulteid := binary.BigEndian.Uint32(gtpTunnel.GTPTEID.Value)
+	dlteid, err := gnbue.Gnb.DlTeidGenerator.Allocate()
+	if err != nil {
+		return nil, fmt.Errorf("ID Generator Allocate() returned:%v", err)
+	}
+	upfIp, _ := ngapConvert.IPAddressToString(gtpTunnel.TransportLayerAddress)
+
+	gnbupue := gnbctx.NewGnbUpUe(uint32(dlteid), ulteid, gnbue.Gnb)
+	gnbupue.Ctx = gnbue.Ctx
+	gnbupue.Snssai = ngapConvert.SNssaiToModels(item.SNSSAI)
+	gnbupue.PduSessId = item.PDUSessionID.Value
+	gnbupue.PduSessType = test.PDUSessionTypeToModels(*pduSessType)
+	pduSess := &ngapTestpacket.PduSession{}
+	pduSess.PduSessId = gnbupue.PduSessId
+	pduSess.Teid = gnbupue.DlTeid
+
+	gnbue.Log.Infoln("PDU Session ID:", gnbupue.PduSessId)
+	gnbue.Log.Infoln("S-NSSAI - SST: ", gnbupue.Snssai.Sst)
+	gnbue.Log.Infoln("S-NSSAI - SD: ", gnbupue.Snssai.Sd)
+	gnbue.Log.Infoln("UL GTP-TEID: ", ulteid)
+	gnbue.Log.Infoln("DL GTP-TEID: ", dlteid)
+	gnbue.Log.Infoln("UPF Endpoint IP: ", upfIp)
+	gnbue.Log.Infoln("PDU Session Type: ", gnbupue.PduSessType)
+
+	var qosFlowId int64
+	var qosChar ngapType.QosCharacteristics
+	var arp ngapType.AllocationAndRetentionPriority
+	var nonDynamic5QI *ngapType.NonDynamic5QIDescriptor
+	for _, qosFlowSetupReqItem := range qosFlowSetupReqList.List {
+		qosFlowId = qosFlowSetupReqItem.QosFlowIdentifier.Value
+		qosChar = qosFlowSetupReqItem.QosFlowLevelQosParameters.QosCharacteristics
+		arp = qosFlowSetupReqItem.QosFlowLevelQosParameters.AllocationAndRetentionPriority
+
+		gnbue.Log.Infoln("QoS Flow Id:", qosFlowId)
+		if qosChar.Present == ngapType.QosCharacteristicsPresentNonDynamic5QI {
+			nonDynamic5QI = qosChar.NonDynamic5QI
+			if nonDynamic5QI == nil {
+				gnbue.Gnb.DlTeidGenerator.FreeID(dlteid)
+				return nil, fmt.Errorf("NonDynamic5QI is nil")
+			}
+			gnbue.Log.Infoln("Non Dynamic 5QI:", nonDynamic5QI.FiveQI.Value)
+		}
+		gnbue.Log.Infoln("ARP Priority Level:", arp.PriorityLevelARP.Value)
+		gnbue.Log.Infoln("Pre-emption Capability:", arp.PreEmptionCapability.Value)
+		gnbue.Log.Infoln("Pre-emption Vulnerability:", arp.PreEmptionVulnerability.Value)
+
+		pduSess.SuccessQfiList = append(pduSess.SuccessQfiList, qosFlowId)
+		gnbupue.AddQosFlow(qosFlowId, &qosFlowSetupReqItem)
+	}
+
+	pduSess.Success = true
+
+	gnbupf, created := gnbue.Gnb.GnbPeers.GetOrAddGnbUpf(upfIp)
+	if created {
+		go gnbupfworker.Init(gnbue.Gnb, gnbupf)
+	}
+	gnbupue.Upf = gnbupf
+	gnbue.AddGnbUpUe(gnbupue.PduSessId, gnbupue)
+
+	dbParam := &common.DataBearerParams{}
+	dbParam.CommChan = gnbupue.ReadUlChan
+	dbParam.PduSess = pduSess
+	return dbParam, nil
+}
+
+// HandleAmfAssocLost releases the UE context locally if the association with
+// the AMF serving the UE is lost. The UE is told so that the procedure in
+// progress fails. Returns true once the context is released
+func HandleAmfAssocLost(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) bool {
+
+	msg := intfcMsg.(*gnbctx.AmfAssocLostMessage)
+	if gnbue.GetAmf() != msg.Amf {
+		return false
+	}
+	gnbue.Log.Warnln("Releasing UE context:", msg.Error)
+	releaseUeContext(gnbue, common.AMF_ASSOC_LOST_EVENT, msg)
+	return true
+}
+
+// HandleNgResetTrigger asks the AMF to reset the NG connection of the UE
+// through a gNB initiated NG Reset. The UE context is released once the AMF
+// acknowledges the reset
+func HandleNgResetTrigger(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	gnbue.Log.Traceln("Handling NG Reset Trigger Event")
+
+	sendMsg, err := ngap.GetNGReset([]*gnbctx.GnbCpUe{gnbue})
+	if err != nil {
+		gnbue.Log.Errorln("GetNGReset failed:", err)
+		return
+	}
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
+	if err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+		return
+	}
+
+	gnbue.Log.Traceln("Sent NG Reset Message to AMF")
+}
+
+// HandleNgReset releases the UE context locally once the NG connection of the
+// UE is reset, either by the AMF or by the gNB once the AMF acknowledged it.
+// Returns true once the context is released
+func HandleNgReset(gnbue *gnbctx.GnbCpUe, intfcMsg common.InterfaceMessage) bool {
+	msg := intfcMsg.(*gnbctx.NgResetMessage)
+	if gnbue.GetAmf() != msg.Amf {
+		return false
+	}
+
+	if msg.Event == common.NG_RESET_ACK_EVENT {
+		gnbue.Log.Infoln("Releasing UE context, NG connection reset")
+		releaseUeContext(gnbue, common.TRIGGER_NG_RESET_EVENT, msg)
+		return true
+	}
+	gnbue.Log.Warnln("Releasing UE context:", msg.Error)
+	releaseUeContext(gnbue, common.NG_RESET_EVENT, msg)
+	return true
+}
+
+// HandleErrorIndication reports the Error Indication received from the AMF
+// for the UE to the SimUe
+func HandleErrorIndication(gnbue *gnbctx.GnbCpUe, intfcMsg common.InterfaceMessage) {
+	gnbue.Log.Traceln("Handling Error Indication")
+
+	msg := intfcMsg.(*common.N2Message)
+	causeStr := "none"
+	for _, ie := range msg.NgapPdu.InitiatingMessage.Value.ErrorIndication.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDCause && ie.Value.Cause != nil {
+			causeStr = test.CauseString(ie.Value.Cause)
+		}
+	}
+
+	uemsg := &common.UuMessage{}
+	uemsg.Event = common.ERROR_INDICATION_EVENT
+	uemsg.Error = fmt.Errorf("error indication received from amf, cause:%v",
+		causeStr)
+	SendMsgToUe(gnbue, uemsg)
+}
+
+// releaseUeContext releases the UE context without signalling with the AMF
+// and tells the UE the event which led to the release
+func releaseUeContext(gnbue *gnbctx.GnbCpUe, triggeringEvent common.EventType,
+	intfcMsg common.InterfaceMessage) {
+
+	req := &common.UuMessage{}
+	req.Event = common.CONNECTION_RELEASE_REQUEST_EVENT
+	req.TriggeringEvent = triggeringEvent
+	req.Error = intfcMsg.GetErrorMsg()
+	SendMsgToUe(gnbue, req)
+
+	HandleQuitEvent(gnbue, intfcMsg)
 }
 
 func HandleQuitEvent(gnbue *gnbctx.GnbCpUe, intfcMsg common.InterfaceMessage) {
 	terminateUpUeContexts(gnbue)
+	// The context also ends without a UE Context Release Command once the UE
+	// is aborted. Late messages for its RAN UE NGAP ID are then answered with
+	// an Error Indication instead of being queued for a worker which is gone
+	gnbue.Gnb.GnbUes.RemoveGnbCpUe(gnbue.GnbUeNgapId)
 	gnbue.Gnb.RanUeNGAPIDGenerator.FreeID(gnbue.GnbUeNgapId)
 	gnbue.WaitGrp.Wait()
 	gnbue.Log.Infoln("gNB Control-Plane UE context terminated")
@@ -622,4 +914,272 @@ func terminateUpUeContext(upCtx *gnbctx.GnbUpUe) {
 	msg.Event = common.QUIT_EVENT
 	upCtx.ReadCmdChan <- msg
 	upCtx.Upf.GnbUpUes.RemoveGnbUpUe(upCtx.DlTeid, true)
+	// The UPF keeps the UL TEID once the PDU session is resumed, possibly
+	// through another GnbUpUe
+	if upCtx.Upf.GnbUpUes.GetGnbUpUe(upCtx.UlTeid, false) == upCtx {
+		upCtx.Upf.GnbUpUes.RemoveGnbUpUe(upCtx.UlTeid, false)
+	}
+}
+
+// HandleHandoverTrigger starts the preparation of the handover of the UE to
+// the target gNB with a Handover Required. The target gNB finds the GnbCpUe
+// through the handover key carried in the Source to Target Transparent
+// Container
+func HandleHandoverTrigger(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	gnbue.Log.Traceln("Handling Handover Trigger Event")
+
+	msg := intfcMsg.(*gnbctx.HandoverMessage)
+	targetGnb := msg.TargetGnb
+
+	var pduSessions []*ngapTestpacket.PduSession
+	f := func(k interface{}, v interface{}) bool {
+		upCtx := v.(*gnbctx.GnbUpUe)
+		pduSess := &ngapTestpacket.PduSession{}
+		pduSess.PduSessId = upCtx.PduSessId
+		pduSess.Teid = upCtx.DlTeid
+		for qfi := range upCtx.QosFlows {
+			pduSess.SuccessQfiList = append(pduSess.SuccessQfiList, qfi)
+		}
+		pduSess.Success = true
+		pduSessions = append(pduSessions, pduSess)
+		return true
+	}
+	gnbue.GnbUpUes.Range(f)
+
+	key := gnbue.HandoverKey()
+	sendMsg, err := ngap.GetHandoverRequired(gnbue, targetGnb, pduSessions,
+		[]byte(key))
+	if err != nil {
+		gnbue.Log.Errorln("GetHandoverRequired failed:", err)
+		sendHandoverFailure(gnbue, fmt.Errorf("failed to build handover required: %v", err))
+		return
+	}
+
+	gnbue.HandoverTarget = targetGnb
+	targetGnb.GnbUes.AddHandoverGnbCpUe(key, gnbue)
+
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
+	if err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+		targetGnb.GnbUes.RemoveHandoverGnbCpUe(key)
+		gnbue.HandoverTarget = nil
+		sendHandoverFailure(gnbue, fmt.Errorf("failed to send handover required: %v", err))
+		return
+	}
+
+	gnbue.Log.Traceln("Sent Handover Required Message to AMF, target gNB:",
+		targetGnb.GnbName)
+}
+
+// HandleHandoverCommand commands the UE to move to the target gNB. The user
+// plane of the UE is stopped on the source gNB, the UE context is released
+// once the AMF is notified of the handover by the target gNB
+func HandleHandoverCommand(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	msg := intfcMsg.(*common.N2Message)
+	var container *ngapType.TargetToSourceTransparentContainer
+
+	successfulOutcome := msg.NgapPdu.SuccessfulOutcome
+	handoverCommand := successfulOutcome.Value.HandoverCommand
+
+	for _, ie := range handoverCommand.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDPDUSessionResourceHandoverList:
+			if ie.Value.PDUSessionResourceHandoverList == nil {
+				continue
+			}
+			for _, item := range ie.Value.PDUSessionResourceHandoverList.List {
+				gnbue.Log.Infoln("PDU Session ID handed over:", item.PDUSessionID.Value)
+			}
+		case ngapType.ProtocolIEIDTargetToSourceTransparentContainer:
+			container = ie.Value.TargetToSourceTransparentContainer
+		}
+	}
+
+	if container == nil {
+		gnbue.Log.Errorln("TargetToSourceTransparentContainer is nil")
+		sendHandoverFailure(gnbue, fmt.Errorf("invalid handover command"))
+		return
+	}
+
+	transfer := ngapType.TargetNGRANNodeToSourceNGRANNodeTransparentContainer{}
+	err := aper.UnmarshalWithParams(container.Value, &transfer, "valueExt")
+	if err != nil {
+		gnbue.Log.Errorln("UnmarshalWithParams returned:", err)
+		sendHandoverFailure(gnbue, fmt.Errorf("invalid handover command"))
+		return
+	}
+
+	key := string(transfer.RRCContainer.Value)
+	targetUe := gnbue.Gnb.GnbUes.GetHandoverGnbCpUe(key)
+	if targetUe == nil {
+		gnbue.Log.Errorln("No target gNB UE context for handover key:", key)
+		sendHandoverFailure(gnbue, fmt.Errorf("target gnb ue context not found"))
+		return
+	}
+	gnbue.Gnb.GnbUes.RemoveHandoverGnbCpUe(key)
+
+	gnbue.HandedOver = true
+	terminateUpUeContexts(gnbue)
+
+	uemsg := &common.UuMessage{}
+	uemsg.Event = common.HANDOVER_COMMAND_EVENT
+	uemsg.CommChan = targetUe.ReadChan
+	SendMsgToUe(gnbue, uemsg)
+	gnbue.Log.Infoln("Commanded UE to move to target gNB:", targetUe.Gnb.GnbName)
+}
+
+// HandleHandoverPreparationFailure tells the UE that the handover could not be
+// prepared, the UE stays on the source gNB
+func HandleHandoverPreparationFailure(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	msg := intfcMsg.(*common.N2Message)
+	causeStr := "none"
+	unsuccessfulOutcome := msg.NgapPdu.UnsuccessfulOutcome
+	for _, ie := range unsuccessfulOutcome.Value.HandoverPreparationFailure.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDCause && ie.Value.Cause != nil {
+			causeStr = test.CauseString(ie.Value.Cause)
+		}
+	}
+
+	if gnbue.HandoverTarget != nil {
+		gnbue.HandoverTarget.GnbUes.RemoveHandoverGnbCpUe(gnbue.HandoverKey())
+		gnbue.HandoverTarget = nil
+	}
+
+	sendHandoverFailure(gnbue, fmt.Errorf(
+		"handover preparation failure received from amf, cause:%v", causeStr))
+}
+
+// HandleHandoverRequest sets up the resources of the PDU sessions of the UE
+// handed over to the target gNB and acknowledges the Handover Request. The
+// data bearers are set up with the UE once it confirms the handover
+func HandleHandoverRequest(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	msg := intfcMsg.(*common.N2Message)
+	var pduSessResourceSetupList *ngapType.PDUSessionResourceSetupListHOReq
+
+	initiatingMessage := msg.NgapPdu.InitiatingMessage
+	handoverRequest := initiatingMessage.Value.HandoverRequest
+
+	for _, ie := range handoverRequest.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDPDUSessionResourceSetupListHOReq:
+			pduSessResourceSetupList = ie.Value.PDUSessionResourceSetupListHOReq
+		case ngapType.ProtocolIEIDSecurityContext:
+			if ie.Value.SecurityContext != nil {
+				gnbue.Log.Infoln("Next Hop Chaining Count:",
+					ie.Value.SecurityContext.NextHopChainingCount.Value)
+			}
+		}
+	}
+
+	var pduSessions []*ngapTestpacket.PduSession
+	gnbue.HandoverDBParams = nil
+	if pduSessResourceSetupList != nil {
+		for _, v := range pduSessResourceSetupList.List {
+			// Handover Request Transfer is encoded the same way as the PDU
+			// Session Resource Setup Request Transfer
+			item := pduSessResourceSetupItem{}
+			item.PDUSessionID = v.PDUSessionID
+			item.SNSSAI = v.SNSSAI
+			item.PDUSessionResourceSetupRequestTransfer = v.HandoverRequestTransfer
+
+			dbParam, err := setupPduSessResource(gnbue, item)
+			if err != nil {
+				gnbue.Log.Errorln("Failed to set up PDU session resource:", err)
+				pduSess := &ngapTestpacket.PduSession{}
+				pduSess.PduSessId = v.PDUSessionID.Value
+				pduSessions = append(pduSessions, pduSess)
+				continue
+			}
+			pduSessions = append(pduSessions, dbParam.PduSess)
+			gnbue.HandoverDBParams = append(gnbue.HandoverDBParams, dbParam)
+		}
+	}
+
+	// At least one PDU session has to be admitted by the target gNB
+	if len(gnbue.HandoverDBParams) == 0 {
+		gnbue.Log.Errorln("No PDU session admitted, rejecting the handover")
+		rejectHandover(gnbue)
+		return
+	}
+
+	ngapPdu, err := test.GetHandoverRequestAcknowledge(pduSessions,
+		gnbue.AmfUeNgapId, gnbue.GnbUeNgapId, gnbue.Gnb.GnbN3Ip,
+		[]byte(gnbue.HandoverKey()))
+	if err != nil {
+		gnbue.Log.Errorln("Failed to create Handover Request Acknowledge:", err)
+		rejectHandover(gnbue)
+		return
+	}
+
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu)
+	if err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+		rejectHandover(gnbue)
+		return
+	}
+	gnbue.Log.Traceln("Sent Handover Request Acknowledge Message to AMF")
+}
+
+// rejectHandover tells the AMF the target gNB cannot accept the UE and
+// terminates the target GnbCpUe along with the user plane resources set up
+// for the UE
+func rejectHandover(gnbue *gnbctx.GnbCpUe) {
+	gnbue.HandoverSource.GnbUes.RemoveHandoverGnbCpUe(gnbue.HandoverKey())
+
+	cause := &ngapType.Cause{
+		Present: ngapType.CausePresentRadioNetwork,
+		RadioNetwork: &ngapType.CauseRadioNetwork{
+			Value: ngapType.CauseRadioNetworkPresentNoRadioResourcesAvailableInTargetCell,
+		},
+	}
+	ngapPdu, err := ngap.GetHandoverFailure(gnbue.AmfUeNgapId, cause)
+	if err != nil {
+		gnbue.Log.Errorln("Failed to create Handover Failure:", err)
+	} else if err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), ngapPdu); err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+	}
+
+	quitEvt := &common.DefaultMessage{}
+	quitEvt.Event = common.QUIT_EVENT
+	gnbue.ReadChan <- quitEvt
+}
+
+// HandleHandoverConfirm notifies the AMF that the UE moved to the target gNB
+// and resumes the user plane of the UE through the target gNB
+func HandleHandoverConfirm(gnbue *gnbctx.GnbCpUe,
+	intfcMsg common.InterfaceMessage) {
+
+	sendMsg, err := ngap.GetHandoverNotify(gnbue)
+	if err != nil {
+		gnbue.Log.Errorln("GetHandoverNotify failed:", err)
+		return
+	}
+	err = gnbue.Gnb.CpTransport.SendToPeer(gnbue.GetAmf(), sendMsg)
+	if err != nil {
+		gnbue.Log.Errorln("SendToPeer failed:", err)
+		return
+	}
+	gnbue.Log.Traceln("Sent Handover Notify Message to AMF")
+
+	uemsg := common.UuMessage{}
+	uemsg.Event = common.DATA_BEARER_SETUP_REQUEST_EVENT
+	uemsg.DBParams = gnbue.HandoverDBParams
+	uemsg.TriggeringEvent = common.HANDOVER_CONFIRM_EVENT
+	gnbue.HandoverDBParams = nil
+	SendMsgToUe(gnbue, &uemsg)
+}
+
+func sendHandoverFailure(gnbue *gnbctx.GnbCpUe, err error) {
+	uemsg := &common.UuMessage{}
+	uemsg.Event = common.HANDOVER_FAILURE_EVENT
+	uemsg.Error = err
+	SendMsgToUe(gnbue, uemsg)
 }
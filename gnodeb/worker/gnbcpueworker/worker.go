@@ -7,23 +7,39 @@ package gnbcpueworker
 import (
 	"github.com/omec-project/gnbsim/common"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/metrics"
 )
 
 func Init(gnbue *gnbctx.GnbCpUe) {
+	metrics.GnbCpUeAdded(gnbue.Gnb.GnbName)
+	defer metrics.GnbCpUeRemoved(gnbue.Gnb.GnbName)
+	defer close(gnbue.Terminated)
 	HandleEvents(gnbue)
 }
 
 func HandleEvents(gnbue *gnbctx.GnbCpUe) (err error) {
 
-	for msg := range gnbue.ReadChan {
+	for {
+		var msg common.InterfaceMessage
+		select {
+		case msg = <-gnbue.ReadChan:
+		case <-gnbue.Ctx.Done():
+			// UE is no longer interested in this context
+			HandleQuitEvent(gnbue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return
+		}
+
 		evt := msg.GetEventType()
 		gnbue.Log.Infoln("Handling event:", evt)
 
 		switch msg.GetEventType() {
 		case common.CONNECTION_REQUEST_EVENT:
 			HandleConnectRequest(gnbue, msg)
-		case common.REG_REQUEST_EVENT, common.SERVICE_REQUEST_EVENT:
-			HandleInitialUEMessage(gnbue, msg)
+		case common.REG_REQUEST_EVENT, common.SERVICE_REQUEST_EVENT,
+			common.DEREG_REQUEST_UE_ORIG_EVENT:
+			if HandleInitialUEMessage(gnbue, msg) {
+				return
+			}
 		case common.UL_INFO_TRANSFER_EVENT:
 			HandleUlInfoTransfer(gnbue, msg)
 		case common.DATA_BEARER_SETUP_RESPONSE_EVENT:
@@ -36,10 +52,34 @@ func HandleEvents(gnbue *gnbctx.GnbCpUe) (err error) {
 			HandlePduSessResourceSetupRequest(gnbue, msg)
 		case common.PDU_SESS_RESOURCE_RELEASE_COMMAND_EVENT:
 			HandlePduSessResourceReleaseCommand(gnbue, msg)
+		case common.PDU_SESS_RESOURCE_MODIFY_REQUEST_EVENT:
+			HandlePduSessResourceModifyRequest(gnbue, msg)
 		case common.UE_CTX_RELEASE_COMMAND_EVENT:
 			HandleUeCtxReleaseCommand(gnbue, msg)
 		case common.TRIGGER_AN_RELEASE_EVENT:
 			HandleRanConnectionRelease(gnbue, msg)
+		case common.TRIGGER_NG_RESET_EVENT:
+			HandleNgResetTrigger(gnbue, msg)
+		case common.AMF_ASSOC_LOST_EVENT:
+			if HandleAmfAssocLost(gnbue, msg) {
+				return
+			}
+		case common.NG_RESET_EVENT, common.NG_RESET_ACK_EVENT:
+			if HandleNgReset(gnbue, msg) {
+				return
+			}
+		case common.NGAP_ERROR_INDICATION_EVENT:
+			HandleErrorIndication(gnbue, msg)
+		case common.TRIGGER_HANDOVER_EVENT:
+			HandleHandoverTrigger(gnbue, msg)
+		case common.NGAP_HANDOVER_COMMAND_EVENT:
+			HandleHandoverCommand(gnbue, msg)
+		case common.NGAP_HANDOVER_PREP_FAILURE_EVENT:
+			HandleHandoverPreparationFailure(gnbue, msg)
+		case common.NGAP_HANDOVER_REQUEST_EVENT:
+			HandleHandoverRequest(gnbue, msg)
+		case common.HANDOVER_CONFIRM_EVENT:
+			HandleHandoverConfirm(gnbue, msg)
 		case common.QUIT_EVENT:
 			HandleQuitEvent(gnbue, msg)
 			return
@@ -49,7 +89,6 @@ func HandleEvents(gnbue *gnbctx.GnbCpUe) (err error) {
 
 		// TODO: Need to return and handle errors from handlers
 	}
-	return nil
 }
 
 func SendToUe(gnbue *gnbctx.GnbCpUe, event common.EventType, nasPdus common.NasPduList) {
@@ -57,5 +96,15 @@ func SendToUe(gnbue *gnbctx.GnbCpUe, event common.EventType, nasPdus common.NasP
 	uemsg := common.UuMessage{}
 	uemsg.Event = event
 	uemsg.NasPdus = nasPdus
-	gnbue.WriteUeChan <- &uemsg
+	SendMsgToUe(gnbue, &uemsg)
+}
+
+// SendMsgToUe writes the message to the UE unless the UE has stopped reading
+// messages from the GnbCpUe
+func SendMsgToUe(gnbue *gnbctx.GnbCpUe, msg common.InterfaceMessage) {
+	select {
+	case gnbue.WriteUeChan <- msg:
+	case <-gnbue.Ctx.Done():
+		gnbue.Log.Infoln("UE terminated, dropping event", msg.GetEventType())
+	}
 }
@@ -5,20 +5,41 @@
 package gnbupfworker
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/omec-project/gnbsim/common"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
 	"github.com/omec-project/gnbsim/util/test"
 )
 
-/* HandleNGSetupResponse processes the NG Setup Response and updates GnbAmf
- * context
+/* HandleDlGpduMessage forwards the downlink G-PDU to the GnbUpUe owning the
+ * TEID, an Error Indication is sent back to the UPF if there is none, at most
+ * once per ERROR_INDICATION_INTERVAL for a given TEID
  */
-func HandleDlGpduMessage(gnbUpf *gnbctx.GnbUpf, gtpPdu *test.GtpPdu) error {
+func HandleDlGpduMessage(gnb *gnbctx.GNodeB, gnbUpf *gnbctx.GnbUpf,
+	gtpPdu *test.GtpPdu) error {
+
 	gnbUpf.Log.Traceln("Processing downlink G-PDU packet")
 	gnbUpUe := gnbUpf.GnbUpUes.GetGnbUpUe(gtpPdu.Hdr.Teid, true)
 	if gnbUpUe == nil {
+		if !gnbUpf.AllowErrorIndication(gtpPdu.Hdr.Teid) {
+			gnbUpf.Log.Traceln("Dropping G-PDU for unknown DL TEID:",
+				gtpPdu.Hdr.Teid)
+			return nil
+		}
+		pkt, err := test.BuildErrorIndication(gtpPdu.Hdr.Teid,
+			net.ParseIP(gnb.GnbN3Ip))
+		if err != nil {
+			return fmt.Errorf("failed to build error indication:%v", err)
+		}
+		err = gnb.UpTransport.SendToPeer(gnbUpf, pkt)
+		if err != nil {
+			return fmt.Errorf("failed to send error indication:%v", err)
+		}
+		gnbUpf.Log.Warnln("Sent Error Indication for unknown DL TEID:",
+			gtpPdu.Hdr.Teid)
 		return nil
-		/* TODO: Send ErrorIndication message to upf*/
 	}
 	msg := &common.N3Message{}
 	msg.Event = common.DL_UE_DATA_TRANSPORT_EVENT
@@ -27,3 +48,32 @@ func HandleDlGpduMessage(gnbUpf *gnbctx.GnbUpf, gtpPdu *test.GtpPdu) error {
 
 	return nil
 }
+
+/* HandleErrorIndication informs the GnbUpUe that the UPF has no context for
+ * the UL TEID it has been sending G-PDUs with
+ */
+func HandleErrorIndication(gnbUpf *gnbctx.GnbUpf, gtpPdu *test.GtpPdu) error {
+	teid, peerAddr, err := test.DecodeErrorIndication(gtpPdu.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode error indication:%v", err)
+	}
+	gnbUpf.Log.Warnln("Received Error Indication for UL TEID:", teid,
+		"GTP-U Peer Address:", peerAddr)
+
+	gnbUpUe := gnbUpf.GnbUpUes.GetGnbUpUe(teid, false)
+	if gnbUpUe == nil {
+		return nil
+	}
+	msg := &common.N3Message{}
+	msg.Event = common.GTPU_ERROR_INDICATION_EVENT
+	msg.Pdu = gtpPdu
+	select {
+	case gnbUpUe.ReadDlChan <- msg:
+	case <-gnbUpUe.Ctx.Done():
+		// The GnbUpUe is being released, nothing left to report
+		gnbUpf.Log.Debugln("GnbUpUe released, dropping Error Indication for UL TEID:",
+			teid)
+	}
+
+	return nil
+}
@@ -15,14 +15,14 @@ import (
 	"github.com/omec-project/ngap/ngapType"
 )
 
-func Init(gnbUpf *gnbctx.GnbUpf) {
+func Init(gnb *gnbctx.GNodeB, gnbUpf *gnbctx.GnbUpf) {
 	if gnbUpf == nil {
 		logger.GNodeBLog.Errorln("GnbUpf context is nil")
 		return
 	}
 	for {
 		msg := <-gnbUpf.ReadChan
-		err := HandleMessage(gnbUpf, msg)
+		err := HandleMessage(gnb, gnbUpf, msg)
 		if err != nil {
 			gnbUpf.Log.Errorln("Gnb Upf Worker HandleMessage() returned:", err)
 		}
@@ -31,7 +31,8 @@ func Init(gnbUpf *gnbctx.GnbUpf) {
 
 // HandleMessage decodes an incoming GTP-U message and routes it to the corresponding
 // handlers.
-func HandleMessage(gnbUpf *gnbctx.GnbUpf, msg common.InterfaceMessage) error {
+func HandleMessage(gnb *gnbctx.GNodeB, gnbUpf *gnbctx.GnbUpf,
+	msg common.InterfaceMessage) error {
 	// decoding the incoming packet
 	tMsg := msg.(*common.TransportMessage)
 	gtpPdu, err := test.DecodeGTPv1Header(tMsg.RawPkt)
@@ -42,13 +43,20 @@ func HandleMessage(gnbUpf *gnbctx.GnbUpf, msg common.InterfaceMessage) error {
 	switch gtpPdu.Hdr.MsgType {
 	case test.TYPE_GPDU:
 		/* A G-PDU is T-PDU encapsulated with GTP-U header*/
-		err = HandleDlGpduMessage(gnbUpf, gtpPdu)
+		err = HandleDlGpduMessage(gnb, gnbUpf, gtpPdu)
 		if err != nil {
 			gnbUpf.Log.Errorln("HandleDlGpduMessage() returned:", err)
 			return fmt.Errorf("failed to handle downling gpdu message")
 		}
-
-		/* TODO: Handle More GTP-PDU types eg. Error Indication */
+	case test.TYPE_ERROR_INDICATION:
+		err = HandleErrorIndication(gnbUpf, gtpPdu)
+		if err != nil {
+			gnbUpf.Log.Errorln("HandleErrorIndication() returned:", err)
+			return fmt.Errorf("failed to handle error indication message")
+		}
+	default:
+		gnbUpf.Log.Warnln("Ignoring unsupported GTP-U message type:",
+			gtpPdu.Hdr.MsgType)
 	}
 
 	return nil
@@ -47,45 +47,61 @@ func HandleDlMessage(gnbue *gnbctx.GnbUpUe, intfcMsg common.InterfaceMessage) (e
 	ueDataMsg := &common.UserDataMessage{}
 	ueDataMsg.Payload = msg.Pdu.Payload
 
-	optHdr := msg.Pdu.OptHdr
-	if optHdr != nil {
-		if optHdr.NextHdrType == test.PDU_SESS_CONTAINER_EXT_HEADER_TYPE {
-			// TODO: Write a generic function to process all the extension
-			// headers and return a map(ext header type - ext headers)
-			// and user data
-			var extHdr *test.PduSessContainerExtHeader
-			ueDataMsg.Payload, extHdr, err =
-				test.DecodePduSessContainerExtHeader(msg.Pdu.Payload)
-			if err != nil {
-				return fmt.Errorf("failed to decode pdu session container extension header:%v", err)
-			}
-			ueDataMsg.Qfi = new(uint8)
-			*ueDataMsg.Qfi = extHdr.Qfi
-			gnbue.Log.Infoln("Received QFI value in downlink G-PDU:", extHdr.Qfi)
+	extHdr := msg.Pdu.GetExtHeader(test.PDU_SESS_CONTAINER_EXT_HEADER_TYPE)
+	if extHdr != nil {
+		qfi, err := test.DecodeDlPduSessInformation(extHdr.Content)
+		if err != nil {
+			return fmt.Errorf("failed to decode pdu session container extension header:%v", err)
 		}
+		ueDataMsg.Qfi = new(uint8)
+		*ueDataMsg.Qfi = qfi
+		gnbue.Log.Infoln("Received QFI value in downlink G-PDU:", qfi)
 	}
 
 	ueDataMsg.Event = common.DL_UE_DATA_TRANSFER_EVENT
-	gnbue.WriteUeChan <- ueDataMsg
+	if !sendToUe(gnbue, ueDataMsg) {
+		return nil
+	}
 	gnbue.Log.Infoln("Sent DL user data packet to UE")
 
 	return nil
 }
 
+// HandleErrorIndication reports to the UE PDU session that the UPF no longer
+// accepts the user data sent with its UL TEID
+func HandleErrorIndication(gnbue *gnbctx.GnbUpUe, intfcMsg common.InterfaceMessage) (err error) {
+	ueDataMsg := &common.UserDataMessage{}
+	ueDataMsg.Event = common.ERROR_INDICATION_EVENT
+	ueDataMsg.Error = fmt.Errorf("error indication received from upf %v for ul teid %v",
+		gnbue.Upf.UpfAddr.IP, gnbue.UlTeid)
+	if !sendToUe(gnbue, ueDataMsg) {
+		return nil
+	}
+	gnbue.Log.Infoln("Sent Error Indication to UE")
+
+	return nil
+}
+
 func HandleQuitEvent(gnbue *gnbctx.GnbUpUe, intfcMsg common.InterfaceMessage) (err error) {
 	userDataMsg := &common.UserDataMessage{}
 	userDataMsg.Event = common.LAST_DATA_PKT_EVENT
-	gnbue.WriteUeChan <- userDataMsg
+	sendToUe(gnbue, userDataMsg)
 	gnbue.WriteUeChan = nil
 
 	// Drain all the messages until END MARKER is received.
 	// This ensures that the transmitting go routine is not blocked while
 	// sending data on this channel
 	if gnbue.LastDataPktRecvd != true {
-		for pkt := range gnbue.ReadUlChan {
-			if pkt.GetEventType() == common.LAST_DATA_PKT_EVENT {
-				gnbue.Log.Debugln("Received last uplink data packet")
-				break
+	drain:
+		for {
+			select {
+			case pkt := <-gnbue.ReadUlChan:
+				if pkt.GetEventType() == common.LAST_DATA_PKT_EVENT {
+					gnbue.Log.Debugln("Received last uplink data packet")
+					break drain
+				}
+			case <-gnbue.Ctx.Done():
+				break drain
 			}
 		}
 	}
@@ -95,3 +111,14 @@ func HandleQuitEvent(gnbue *gnbctx.GnbUpUe, intfcMsg common.InterfaceMessage) (e
 
 	return nil
 }
+
+// sendToUe writes the message to the UE PDU session, returns false if the UE
+// has terminated
+func sendToUe(gnbue *gnbctx.GnbUpUe, msg common.InterfaceMessage) bool {
+	select {
+	case gnbue.WriteUeChan <- msg:
+		return true
+	case <-gnbue.Ctx.Done():
+		return false
+	}
+}
@@ -7,9 +7,12 @@ package gnbupueworker
 import (
 	"github.com/omec-project/gnbsim/common"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/metrics"
 )
 
 func Init(gnbue *gnbctx.GnbUpUe) {
+	metrics.GnbUpUeAdded(gnbue.Gnb.GnbName)
+	defer metrics.GnbUpUeRemoved(gnbue.Gnb.GnbName)
 	HandleEvents(gnbue)
 }
 
@@ -26,7 +29,12 @@ func HandleEvents(gnbue *gnbctx.GnbUpUe) {
 
 		/* Reading Down link packets from UPF worker*/
 		case msg := <-gnbue.ReadDlChan:
-			err = HandleDlMessage(gnbue, msg)
+			switch msg.GetEventType() {
+			case common.GTPU_ERROR_INDICATION_EVENT:
+				err = HandleErrorIndication(gnbue, msg)
+			default:
+				err = HandleDlMessage(gnbue, msg)
+			}
 			if err != nil {
 				gnbue.Log.Errorln("failed to handle downlink gtp-u message:", err)
 			}
@@ -40,6 +48,10 @@ func HandleEvents(gnbue *gnbctx.GnbUpUe) {
 				HandleQuitEvent(gnbue, msg)
 				return
 			}
+
+		case <-gnbue.Ctx.Done():
+			HandleQuitEvent(gnbue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return
 		}
 		//TODO: Handle Errors
 	}
@@ -12,8 +12,10 @@ import (
 	"time"
 
 	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
 	"github.com/omec-project/gnbsim/factory"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/metrics"
 	profilerouter "github.com/omec-project/gnbsim/profile/httprouter"
 	"github.com/omec-project/http2_util"
 	"github.com/omec-project/logger_util"
@@ -44,6 +46,7 @@ func StartHttpServer() (err error) {
 
 	// Register routes
 	profilerouter.AddService(router)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	config := factory.AppConfig.Configuration
 	serverAddr := config.Server.IpAddr + ":" + config.Server.Port
@@ -66,7 +69,7 @@ func StartHttpServer() (err error) {
 		//To Do
 	}
 
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		logger.AppLog.Errorln("HTTP server setup failed:", err)
 	}
 
@@ -76,6 +79,10 @@ func StartHttpServer() (err error) {
 
 func StopHttpServer() {
 	logger.HttpLog.Infoln("Shutting down HTTP server")
+	if server == nil {
+		// Not started yet
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), CTX_TIMEOUT*time.Second)
 	defer func() {
 		cancel()
@@ -32,6 +32,9 @@ var (
 	GinLog        *logrus.Entry
 	HttpLog       *logrus.Entry
 	ProfUeCtxLog  *logrus.Entry
+	MockCoreLog   *logrus.Entry
+	MockAmfLog    *logrus.Entry
+	MockUpfLog    *logrus.Entry
 )
 
 const (
@@ -93,6 +96,9 @@ func init() {
 	GtpLog = UtilLog.WithField("subcategory", "GTP")
 	NgapLog = UtilLog.WithField("subcategory", "NGAP")
 	PsuppLog = UtilLog.WithField("subcategory", "PSUPP")
+	MockCoreLog = log.WithFields(logrus.Fields{"component": "GNBSIM", "category": "MockCore"})
+	MockAmfLog = MockCoreLog.WithField("subcategory", "AMF")
+	MockUpfLog = MockCoreLog.WithField("subcategory", "UPF")
 }
 
 func SetLogLevel(level string) {
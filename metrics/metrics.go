@@ -0,0 +1,209 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics exposes the live state of the simulator as prometheus
+// counters, gauges and histograms
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace string = "gnbsim"
+
+// message directions
+const (
+	DIR_SENT     string = "sent"
+	DIR_RECEIVED string = "received"
+	DIR_UPLINK   string = "uplink"
+	DIR_DOWNLINK string = "downlink"
+)
+
+// procedure results
+const (
+	PROC_STARTED   string = "started"
+	PROC_PASSED    string = "passed"
+	PROC_FAILED    string = "failed"
+	PROC_TIMED_OUT string = "timed_out"
+	PROC_ABORTED   string = "aborted"
+)
+
+// association events
+const (
+	ASSOC_UP   string = "up"
+	ASSOC_DOWN string = "down"
+)
+
+// NGAP-PDU choices as encoded in the first octet of the message
+var ngapPduTypes = map[byte]string{
+	0: "initiating",
+	1: "successful",
+	2: "unsuccessful",
+}
+
+var (
+	ngapMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ngap_messages_total",
+			Help:      "NGAP messages sent to or received from the AMF by procedure code",
+		},
+		[]string{"gnb", "direction", "procedure_code", "pdu_type"},
+	)
+
+	nasMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "nas_messages_total",
+			Help:      "NAS messages sent or received by the UEs by message type",
+		},
+		[]string{"direction", "message_type"},
+	)
+
+	procedures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "procedures_total",
+			Help:      "Procedures executed by the UEs by result",
+		},
+		[]string{"profile", "procedure", "result"},
+	)
+
+	gnbCpUes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gnb_cp_ue_contexts",
+			Help:      "Active gNB control plane UE contexts",
+		},
+		[]string{"gnb"},
+	)
+
+	gnbUpUes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "gnb_up_ue_contexts",
+			Help:      "Active gNB user plane UE contexts",
+		},
+		[]string{"gnb"},
+	)
+
+	gtpuPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gtpu_packets_total",
+			Help:      "GTP-U packets exchanged with the UPFs",
+		},
+		[]string{"gnb", "direction"},
+	)
+
+	gtpuBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gtpu_bytes_total",
+			Help:      "GTP-U bytes exchanged with the UPFs",
+		},
+		[]string{"gnb", "direction"},
+	)
+
+	amfAssociations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "amf_association_up",
+			Help:      "Associations of the gNBs with the AMFs, 1 once the NG Setup succeeded",
+		},
+		[]string{"gnb", "amf"},
+	)
+
+	amfAssocEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "amf_association_events_total",
+			Help:      "Associations of the gNBs with the AMFs going up or down",
+		},
+		[]string{"gnb", "amf", "event"},
+	)
+
+	icmpRtt = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "icmp_rtt_seconds",
+			Help:      "Round trip time of the ICMP echo requests sent by the UEs",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ngapMessages, nasMessages, procedures, gnbCpUes,
+		gnbUpUes, gtpuPackets, gtpuBytes, amfAssociations, amfAssocEvents, icmpRtt)
+}
+
+// Handler returns the http handler serving the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// CountNgapMessage counts an encoded NGAP message. The procedure code and the
+// PDU type are read from the APER encoded header so that the message need not
+// be decoded again
+func CountNgapMessage(gnb, direction string, pkt []byte) {
+	if len(pkt) < 2 {
+		return
+	}
+	pduType, ok := ngapPduTypes[(pkt[0]>>5)&0x03]
+	if !ok {
+		pduType = "unknown"
+	}
+	ngapMessages.WithLabelValues(gnb, direction, strconv.Itoa(int(pkt[1])),
+		pduType).Inc()
+}
+
+func CountNasMessage(direction string, msgType uint8) {
+	nasMessages.WithLabelValues(direction, strconv.Itoa(int(msgType))).Inc()
+}
+
+func CountProcedure(profile, procedure, result string) {
+	procedures.WithLabelValues(profile, procedure, result).Inc()
+}
+
+func GnbCpUeAdded(gnb string) {
+	gnbCpUes.WithLabelValues(gnb).Inc()
+}
+
+func GnbCpUeRemoved(gnb string) {
+	gnbCpUes.WithLabelValues(gnb).Dec()
+}
+
+func GnbUpUeAdded(gnb string) {
+	gnbUpUes.WithLabelValues(gnb).Inc()
+}
+
+func GnbUpUeRemoved(gnb string) {
+	gnbUpUes.WithLabelValues(gnb).Dec()
+}
+
+func CountGtpuPacket(gnb, direction string, length int) {
+	gtpuPackets.WithLabelValues(gnb, direction).Inc()
+	gtpuBytes.WithLabelValues(gnb, direction).Add(float64(length))
+}
+
+// CountAmfAssocEvent records the association of the gNB with the AMF going up
+// or down
+func CountAmfAssocEvent(gnb, amf, event string) {
+	up := 0.0
+	if event == ASSOC_UP {
+		up = 1
+	}
+	amfAssociations.WithLabelValues(gnb, amf).Set(up)
+	amfAssocEvents.WithLabelValues(gnb, amf, event).Inc()
+}
+
+func ObserveIcmpRtt(rtt time.Duration) {
+	icmpRtt.Observe(rtt.Seconds())
+}
@@ -0,0 +1,299 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/util/test"
+
+	"git.cs.nctu.edu.tw/calee/sctp"
+	"github.com/sirupsen/logrus"
+)
+
+// Need to check if NGAP may exceed this limit
+var MAX_SCTP_PKT_LEN int = 2048
+
+// Amf terminates the N2 interface of the gNodeBs and runs the registration,
+// session management and connection management procedures on behalf of the
+// AMF and SMF
+type Amf struct {
+	cfg      *Config
+	db       *SubscriberDb
+	upf      *Upf
+	listener *sctp.SCTPListener
+
+	// Serialises the handling of NGAP messages and network triggered
+	// procedures
+	mu               sync.Mutex
+	uesBySupi        map[string]*AmfUe
+	uesByAmfUeNgapId map[int64]*AmfUe
+	uesByTmsi        map[uint32]*AmfUe
+	nextAmfUeNgapId  int64
+	nextTmsi         uint32
+	ngSetupRejected  int
+
+	// NGAP connections of the gNodeBs set up with the AMF, by global RAN
+	// node ID. Target gNodeBs of handovers are looked up here
+	gnbConns map[string]*sctp.SCTPConn
+
+	Log *logrus.Entry
+}
+
+func NewAmf(cfg *Config, db *SubscriberDb, upf *Upf) *Amf {
+	amf := &Amf{}
+	amf.cfg = cfg
+	amf.db = db
+	amf.upf = upf
+	amf.uesBySupi = make(map[string]*AmfUe)
+	amf.uesByAmfUeNgapId = make(map[int64]*AmfUe)
+	amf.uesByTmsi = make(map[uint32]*AmfUe)
+	amf.gnbConns = make(map[string]*sctp.SCTPConn)
+	amf.nextAmfUeNgapId = 1
+	amf.nextTmsi = 1
+	amf.Log = logger.MockAmfLog
+	return amf
+}
+
+func (amf *Amf) Start() error {
+	ip, err := net.ResolveIPAddr("ip", amf.cfg.Amf.N2IpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve n2 address %v: %v", amf.cfg.Amf.N2IpAddr, err)
+	}
+	addr := &sctp.SCTPAddr{
+		IPAddrs: []net.IPAddr{*ip},
+		Port:    amf.cfg.Amf.N2Port,
+	}
+
+	sockCfg := sctp.SocketConfig{
+		InitMsg: sctp.InitMsg{
+			NumOstreams:    3,
+			MaxInstreams:   5,
+			MaxAttempts:    2,
+			MaxInitTimeout: 2,
+		},
+	}
+	amf.listener, err = sockCfg.Listen("sctp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", addr, err)
+	}
+
+	amf.Log.Infoln("Listening for NGAP connections on", addr)
+	go amf.accept()
+	return nil
+}
+
+func (amf *Amf) Stop() {
+	if amf.listener != nil {
+		amf.listener.Close()
+	}
+
+	amf.mu.Lock()
+	defer amf.mu.Unlock()
+	for _, ue := range amf.uesBySupi {
+		ue.StopNwTimers()
+	}
+}
+
+func (amf *Amf) accept() {
+	for {
+		conn, err := amf.listener.AcceptSCTP()
+		if err != nil {
+			amf.Log.Infoln("Stopped accepting NGAP connections:", err)
+			return
+		}
+
+		err = conn.SetDefaultSentParam(&sctp.SndRcvInfo{PPID: test.NgapPPID})
+		if err != nil {
+			amf.Log.Errorln("SetDefaultSentParam returned:", err)
+			conn.Close()
+			continue
+		}
+
+		amf.Log.Infoln("Accepted NGAP connection from", conn.RemoteAddr())
+		go amf.receive(conn)
+	}
+}
+
+func (amf *Amf) receive(conn *sctp.SCTPConn) {
+	defer func() {
+		if err := conn.Close(); err != nil && err != syscall.EBADF {
+			amf.Log.Errorln("Close returned:", err)
+		}
+		amf.releaseConnection(conn)
+	}()
+
+	for {
+		recvMsg := make([]byte, MAX_SCTP_PKT_LEN)
+		n, _, _, err := conn.SCTPRead(recvMsg)
+		if err != nil {
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF:
+				amf.Log.Infoln("Read EOF from gNodeB")
+				return
+			case syscall.EAGAIN, syscall.EINTR:
+				continue
+			default:
+				amf.Log.Errorln("SCTPRead returned:", err)
+				return
+			}
+		}
+
+		amf.mu.Lock()
+		err = HandleMessage(amf, conn, recvMsg[:n])
+		amf.mu.Unlock()
+		if err != nil {
+			amf.Log.Errorln("HandleMessage returned:", err)
+		}
+	}
+}
+
+// releaseConnection moves the UEs served over a closed NGAP connection to
+// idle state
+func (amf *Amf) releaseConnection(conn *sctp.SCTPConn) {
+	amf.mu.Lock()
+	defer amf.mu.Unlock()
+	for id, gnbConn := range amf.gnbConns {
+		if gnbConn == conn {
+			delete(amf.gnbConns, id)
+		}
+	}
+	amf.releaseNgapConnections(conn)
+}
+
+// releaseNgapConnections releases the NG connections of the UEs served over
+// the NGAP connection and returns their number
+func (amf *Amf) releaseNgapConnections(conn *sctp.SCTPConn) int {
+	var n int
+	for _, ue := range amf.uesBySupi {
+		if ue.Conn == conn {
+			amf.releaseNgapConnection(ue)
+			n++
+		}
+	}
+	return n
+}
+
+// SendToGnb sends an NGAP encoded packet over the NGAP connection of the UE
+func (amf *Amf) SendToGnb(conn *sctp.SCTPConn, pkt []byte) error {
+	if conn == nil {
+		return fmt.Errorf("ngap connection not available")
+	}
+	n, err := conn.Write(pkt)
+	if err != nil || n != len(pkt) {
+		return fmt.Errorf("failed to write on socket: %v", err)
+	}
+	return nil
+}
+
+func (amf *Amf) SendToUe(ue *AmfUe, pkt []byte) error {
+	if !ue.Connected {
+		return fmt.Errorf("ue not in connected state")
+	}
+	return amf.SendToGnb(ue.Conn, pkt)
+}
+
+// SendNasToUe sends the NAS PDU to the UE in a Downlink NAS Transport message
+func (amf *Amf) SendNasToUe(ue *AmfUe, nasPdu []byte) error {
+	pkt, err := BuildDownlinkNasTransport(ue, nasPdu)
+	if err != nil {
+		return fmt.Errorf("failed to build downlink nas transport: %v", err)
+	}
+	return amf.SendToUe(ue, pkt)
+}
+
+func (amf *Amf) allocateNgapConnection(ue *AmfUe, conn *sctp.SCTPConn, ranUeNgapId int64) {
+	if ue.Connected {
+		delete(amf.uesByAmfUeNgapId, ue.AmfUeNgapId)
+	}
+	ue.Conn = conn
+	ue.RanUeNgapId = ranUeNgapId
+	ue.AmfUeNgapId = amf.nextAmfUeNgapId
+	amf.nextAmfUeNgapId++
+	ue.Connected = true
+	amf.uesByAmfUeNgapId[ue.AmfUeNgapId] = ue
+}
+
+// moveNgapConnection hands the NG signalling connection of a temporary
+// context over to the context of the identified UE
+func (amf *Amf) moveNgapConnection(from, to *AmfUe) {
+	if to.Connected {
+		delete(amf.uesByAmfUeNgapId, to.AmfUeNgapId)
+	}
+	to.Conn = from.Conn
+	to.RanUeNgapId = from.RanUeNgapId
+	to.AmfUeNgapId = from.AmfUeNgapId
+	to.Connected = true
+	amf.uesByAmfUeNgapId[to.AmfUeNgapId] = to
+
+	from.Conn = nil
+	from.Connected = false
+}
+
+func (amf *Amf) releaseNgapConnection(ue *AmfUe) {
+	amf.cancelHandover(ue)
+	delete(amf.uesByAmfUeNgapId, ue.AmfUeNgapId)
+	ue.Conn = nil
+	ue.Connected = false
+	for _, sess := range ue.PduSessions {
+		amf.upf.DeactivateSession(sess)
+	}
+}
+
+// cancelHandover drops the NG connection of the UE towards the target gNB of
+// the handover in progress, if any
+func (amf *Amf) cancelHandover(ue *AmfUe) {
+	if ue.Handover == nil {
+		return
+	}
+	delete(amf.uesByAmfUeNgapId, ue.Handover.TargetAmfUeNgapId)
+	ue.Handover = nil
+}
+
+// allocateGuti assigns a new 5G-GUTI to the UE, as per TS 23.003 Section 2.10
+func (amf *Amf) allocateGuti(ue *AmfUe) {
+	if ue.Guti != "" {
+		delete(amf.uesByTmsi, ue.Tmsi)
+	}
+	ue.Tmsi = amf.nextTmsi
+	amf.nextTmsi++
+	plmnId := amf.cfg.Amf.PlmnId
+	ue.Guti = fmt.Sprintf("%s%s%s%08x", plmnId.Mcc, plmnId.Mnc, amf.cfg.Amf.AmfId, ue.Tmsi)
+	amf.uesByTmsi[ue.Tmsi] = ue
+}
+
+// removeUe deletes the context of a UE which left the 5G system
+func (amf *Amf) removeUe(ue *AmfUe) {
+	ue.StopNwTimers()
+	amf.cancelHandover(ue)
+	for id, sess := range ue.PduSessions {
+		amf.upf.ReleaseSession(sess)
+		delete(ue.PduSessions, id)
+	}
+	delete(amf.uesByAmfUeNgapId, ue.AmfUeNgapId)
+	if amf.uesByTmsi[ue.Tmsi] == ue {
+		delete(amf.uesByTmsi, ue.Tmsi)
+	}
+	if amf.uesBySupi[ue.Supi] == ue {
+		delete(amf.uesBySupi, ue.Supi)
+	}
+	ue.Log.Infoln("Removed UE context")
+}
+
+// ServingNetworkName returns the serving network name used in the key
+// derivation, as per TS 24.501 Section 9.12.1
+func (amf *Amf) ServingNetworkName() string {
+	plmnId := amf.cfg.Amf.PlmnId
+	mnc := plmnId.Mnc
+	if len(mnc) == 2 {
+		mnc = "0" + mnc
+	}
+	return fmt.Sprintf("5G:mnc%s.mcc%s.3gppnetwork.org", mnc, plmnId.Mcc)
+}
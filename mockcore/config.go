@@ -0,0 +1,357 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/omec-project/gnbsim/util/nassecurity"
+	"github.com/omec-project/gnbsim/util/suci"
+
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/openapi/models"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DEFAULT_AMF_NAME          string = "mockamf"
+	DEFAULT_AMF_ID            string = "cafe00"
+	DEFAULT_N2_PORT           int    = 38412
+	DEFAULT_N3_PORT           int    = 2152
+	DEFAULT_UE_IP_POOL        string = "172.250.0.0/16"
+	DEFAULT_UE_IPV6_POOL      string = "2001:db8:250::/48"
+	DEFAULT_RELATIVE_CAPACITY int64  = 255
+	DEFAULT_T3512             int    = 3240 // seconds, TS 24.501 Section 10.2
+
+	// Longest T3512 value encodable in a GPRS timer 3 IE, in seconds
+	MAX_T3512 int = 31 * 36000
+)
+
+// NAS security algorithms in the default order of preference of the mock AMF
+var (
+	DEFAULT_INTEGRITY_ORDER = []string{"NIA2", "NIA1", "NIA3", "NIA0"}
+	DEFAULT_CIPHERING_ORDER = []string{"NEA0", "NEA2", "NEA1", "NEA3"}
+)
+
+// Config holds the configuration of the mock AMF and UPF which stand in for
+// a 5G core while exercising gnbsim profiles
+type Config struct {
+	Enable      bool                `yaml:"enable"`
+	Amf         *AmfConfig          `yaml:"amf"`
+	Upf         *UpfConfig          `yaml:"upf"`
+	Subscribers []*SubscriberConfig `yaml:"subscribers"`
+
+	// Home network private keys revealing the SUCIs concealed with the ECIES
+	// protection schemes, the mock core standing in for the SIDF
+	HomeNetworkKeys []*HomeNetworkKeyConfig `yaml:"homeNetworkKeys"`
+}
+
+// HomeNetworkKeyConfig is a home network private key (hex string) and the
+// identifier the UEs refer to it with
+type HomeNetworkKeyConfig struct {
+	Id               int    `yaml:"id"`
+	ProtectionScheme string `yaml:"protectionScheme"` // profileA or profileB
+	PrivateKey       string `yaml:"privateKey"`
+
+	scheme     uint8
+	privateKey []byte
+}
+
+type AmfConfig struct {
+	N2IpAddr         string          `yaml:"n2IpAddr"`
+	N2Port           int             `yaml:"n2Port"`
+	Name             string          `yaml:"name"`
+	PlmnId           models.PlmnId   `yaml:"plmnId"`
+	AmfId            string          `yaml:"amfId"` // region id, set id and pointer (3 bytes hex string)
+	SNssaiList       []models.Snssai `yaml:"sNssaiList"`
+	RelativeCapacity int64           `yaml:"relativeCapacity"`
+	Security         *SecurityConfig `yaml:"security"`
+
+	// PEI the AMF asks the UEs with an Identity Request once the NAS
+	// security context is established, imei or imeisv. Not asked if empty
+	PeiRequest string `yaml:"peiRequest"`
+	peiType    uint8
+
+	// Periodic registration update timer provided to the UEs in seconds,
+	// -1 deactivates it
+	T3512 int `yaml:"t3512"`
+
+	// Rejects the first NG Setup Requests, e.g. to exercise the NG Setup
+	// retry of the gNBs
+	NgSetupReject *NgSetupReject `yaml:"ngSetupReject"`
+}
+
+// NgSetupReject configures the NG Setup Failures sent by the AMF
+type NgSetupReject struct {
+	Count int `yaml:"count"` // number of NG Setup Requests rejected
+
+	// Time to wait in seconds provided to the gNB, 1, 2, 5, 10, 20 or 60.
+	// Not provided if zero
+	TimeToWait int `yaml:"timeToWait"`
+}
+
+// SecurityConfig lists the NAS security algorithms the AMF may select, in
+// its order of preference
+type SecurityConfig struct {
+	IntegrityOrder []string `yaml:"integrityOrder"`
+	CipheringOrder []string `yaml:"cipheringOrder"`
+
+	integrityAlgs []uint8
+	cipheringAlgs []uint8
+}
+
+type UpfConfig struct {
+	N3IpAddr   string `yaml:"n3IpAddr"`
+	N3Port     int    `yaml:"n3Port"`
+	UeIpPool   string `yaml:"ueIpPool"`   // CIDR from which UE IPv4 addresses are allocated
+	UeIpv6Pool string `yaml:"ueIpv6Pool"` // CIDR from which the /64 prefixes of the UEs are allocated
+}
+
+// SubscriberConfig holds the subscription data of ueCount consecutive IMSIs
+// starting from startImsi
+type SubscriberConfig struct {
+	StartImsi      string       `yaml:"startImsi"`
+	UeCount        int          `yaml:"ueCount"`
+	Key            string       `yaml:"key"`
+	Opc            string       `yaml:"opc"`
+	SequenceNumber string       `yaml:"sequenceNumber"`
+	NwTriggered    *NwTriggered `yaml:"networkTriggered"`
+	Reject         *Reject      `yaml:"reject"`
+}
+
+// NwTriggered configures the network initiated procedures which are started
+// for a subscriber, delays are in seconds counted from the moment the first
+// PDU session of the UE is set up
+type NwTriggered struct {
+	DeregisterAfter        int `yaml:"deregisterAfter"`
+	PduSessionReleaseAfter int `yaml:"pduSessionReleaseAfter"`
+	PduSessionModifyAfter  int `yaml:"pduSessionModifyAfter"`
+	NgResetAfter           int `yaml:"ngResetAfter"` // NG connection of the UE reset
+}
+
+// Reject configures the 5GMM causes with which the registration and service
+// requests of a subscriber are rejected. Count limits the rejects to the
+// first requests of each UE, 0 rejects all of them. T3346 is in seconds
+type Reject struct {
+	RegistrationCause uint8 `yaml:"registrationCause"`
+	ServiceCause      uint8 `yaml:"serviceCause"`
+	T3346             int   `yaml:"t3346"`
+	Count             int   `yaml:"count"`
+}
+
+// LoadConfig reads the mock core configuration from a yaml file. The file
+// may either hold the mock core configuration at the top level or under the
+// "mockCore" key, as within the gnbsim configuration
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", path, err)
+	}
+
+	wrapper := struct {
+		MockCore *Config `yaml:"mockCore"`
+	}{}
+	if err = yaml.Unmarshal(content, &wrapper); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %v: %v", path, err)
+	}
+
+	cfg := wrapper.MockCore
+	if cfg == nil {
+		cfg = &Config{}
+		if err = yaml.Unmarshal(content, cfg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %v: %v", path, err)
+		}
+		// standalone configuration is always meant to be run
+		cfg.Enable = true
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration and fills in defaults for the optional
+// fields
+func (cfg *Config) Validate() error {
+	if cfg.Amf == nil {
+		return fmt.Errorf("amf configuration missing")
+	}
+	if cfg.Upf == nil {
+		return fmt.Errorf("upf configuration missing")
+	}
+	if len(cfg.Subscribers) == 0 {
+		return fmt.Errorf("no subscribers configured")
+	}
+
+	amf := cfg.Amf
+	if amf.N2IpAddr == "" {
+		return fmt.Errorf("amf n2IpAddr missing")
+	}
+	if amf.N2Port == 0 {
+		amf.N2Port = DEFAULT_N2_PORT
+	}
+	if amf.Name == "" {
+		amf.Name = DEFAULT_AMF_NAME
+	}
+	if amf.AmfId == "" {
+		amf.AmfId = DEFAULT_AMF_ID
+	}
+	if id, err := hex.DecodeString(amf.AmfId); err != nil || len(id) != 3 {
+		return fmt.Errorf("invalid amfId:%v", amf.AmfId)
+	}
+	if len(amf.PlmnId.Mcc) != 3 || (len(amf.PlmnId.Mnc) != 2 && len(amf.PlmnId.Mnc) != 3) {
+		return fmt.Errorf("invalid amf plmnId:%v", amf.PlmnId)
+	}
+	if len(amf.SNssaiList) == 0 {
+		amf.SNssaiList = []models.Snssai{{Sst: 1, Sd: "010203"}}
+	}
+	if amf.RelativeCapacity == 0 {
+		amf.RelativeCapacity = DEFAULT_RELATIVE_CAPACITY
+	}
+	if amf.Security == nil {
+		amf.Security = &SecurityConfig{}
+	}
+	if len(amf.Security.IntegrityOrder) == 0 {
+		amf.Security.IntegrityOrder = DEFAULT_INTEGRITY_ORDER
+	}
+	if len(amf.Security.CipheringOrder) == 0 {
+		amf.Security.CipheringOrder = DEFAULT_CIPHERING_ORDER
+	}
+	var err error
+	amf.Security.integrityAlgs, err = nassecurity.ParseIntegrityAlgs(amf.Security.IntegrityOrder)
+	if err != nil {
+		return fmt.Errorf("invalid amf integrityOrder: %v", err)
+	}
+	amf.Security.cipheringAlgs, err = nassecurity.ParseCipheringAlgs(amf.Security.CipheringOrder)
+	if err != nil {
+		return fmt.Errorf("invalid amf cipheringOrder: %v", err)
+	}
+
+	switch strings.ToLower(amf.PeiRequest) {
+	case "":
+		amf.peiType = nasMessage.MobileIdentity5GSTypeNoIdentity
+	case "imei":
+		amf.peiType = nasMessage.MobileIdentity5GSTypeImei
+	case "imeisv":
+		amf.peiType = nasMessage.MobileIdentity5GSTypeImeisv
+	default:
+		return fmt.Errorf("invalid amf peiRequest:%v, should be imei or imeisv", amf.PeiRequest)
+	}
+
+	if amf.T3512 == 0 {
+		amf.T3512 = DEFAULT_T3512
+	}
+	if amf.T3512 < -1 || amf.T3512 > MAX_T3512 {
+		return fmt.Errorf("invalid amf t3512:%v, should be -1 or at most %v seconds",
+			amf.T3512, MAX_T3512)
+	}
+
+	if rej := amf.NgSetupReject; rej != nil {
+		if rej.Count < 0 {
+			return fmt.Errorf("invalid amf ngSetupReject count:%v", rej.Count)
+		}
+		switch rej.TimeToWait {
+		case 0, 1, 2, 5, 10, 20, 60:
+		default:
+			return fmt.Errorf("invalid amf ngSetupReject timeToWait:%v, should be 1, 2, 5, 10, 20 or 60",
+				rej.TimeToWait)
+		}
+	}
+
+	upf := cfg.Upf
+	if net.ParseIP(upf.N3IpAddr) == nil {
+		return fmt.Errorf("invalid upf n3IpAddr:%v", upf.N3IpAddr)
+	}
+	if upf.N3Port == 0 {
+		upf.N3Port = DEFAULT_N3_PORT
+	}
+	if upf.UeIpPool == "" {
+		upf.UeIpPool = DEFAULT_UE_IP_POOL
+	}
+	if _, _, err := net.ParseCIDR(upf.UeIpPool); err != nil {
+		return fmt.Errorf("invalid ueIpPool:%v", upf.UeIpPool)
+	}
+	if upf.UeIpv6Pool == "" {
+		upf.UeIpv6Pool = DEFAULT_UE_IPV6_POOL
+	}
+	if _, _, err := net.ParseCIDR(upf.UeIpv6Pool); err != nil {
+		return fmt.Errorf("invalid ueIpv6Pool:%v", upf.UeIpv6Pool)
+	}
+
+	for _, sub := range cfg.Subscribers {
+		if _, err := strconv.ParseUint(sub.StartImsi, 10, 64); err != nil {
+			return fmt.Errorf("invalid subscriber startImsi:%v", sub.StartImsi)
+		}
+		if sub.UeCount == 0 {
+			sub.UeCount = 1
+		}
+		if k, err := hex.DecodeString(sub.Key); err != nil || len(k) != 16 {
+			return fmt.Errorf("invalid key for subscriber range starting at %v", sub.StartImsi)
+		}
+		if opc, err := hex.DecodeString(sub.Opc); err != nil || len(opc) != 16 {
+			return fmt.Errorf("invalid opc for subscriber range starting at %v", sub.StartImsi)
+		}
+		if sqn, err := hex.DecodeString(sub.SequenceNumber); err != nil || len(sqn) != 6 {
+			return fmt.Errorf("invalid sequenceNumber for subscriber range starting at %v", sub.StartImsi)
+		}
+		if sub.Reject != nil && !validGprsTimer2(sub.Reject.T3346) {
+			return fmt.Errorf("invalid reject t3346:%v for subscriber range starting at %v",
+				sub.Reject.T3346, sub.StartImsi)
+		}
+	}
+
+	for _, key := range cfg.HomeNetworkKeys {
+		if key.Id < 0 || key.Id > 255 {
+			return fmt.Errorf("invalid home network key id:%v", key.Id)
+		}
+		if cfg.GetHomeNetworkKey(uint8(key.Id)) != key {
+			return fmt.Errorf("duplicate home network key id:%v", key.Id)
+		}
+		key.scheme, err = suci.ParseProtectionScheme(key.ProtectionScheme)
+		if err != nil || key.scheme == suci.NULL_SCHEME {
+			return fmt.Errorf("invalid protectionScheme for home network key %v", key.Id)
+		}
+		key.privateKey, err = hex.DecodeString(key.PrivateKey)
+		if err == nil {
+			_, err = suci.PublicKey(key.scheme, key.privateKey)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid privateKey for home network key %v", key.Id)
+		}
+	}
+	return nil
+}
+
+// validGprsTimer2 tells whether a timer value in seconds can be encoded as a
+// GPRS timer 2, TS 24.008 Section 10.5.7.4
+func validGprsTimer2(seconds int) bool {
+	switch {
+	case seconds < 0:
+		return false
+	case seconds <= 64:
+		return seconds%2 == 0
+	case seconds <= 31*60:
+		return seconds%60 == 0
+	default:
+		return seconds%360 == 0 && seconds <= 31*360
+	}
+}
+
+// GetHomeNetworkKey returns the home network key with the given identifier,
+// nil if unknown
+func (cfg *Config) GetHomeNetworkKey(id uint8) *HomeNetworkKeyConfig {
+	for _, key := range cfg.HomeNetworkKeys {
+		if key.Id == int(id) {
+			return key
+		}
+	}
+	return nil
+}
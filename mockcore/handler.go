@@ -0,0 +1,826 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/omec-project/gnbsim/util/test"
+
+	"git.cs.nctu.edu.tw/calee/sctp"
+	"github.com/omec-project/aper"
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapConvert"
+	"github.com/omec-project/ngap/ngapType"
+)
+
+/* HandleMessage decodes an incoming NGAP message and routes it to the
+ * corresponding handlers
+ */
+func HandleMessage(amf *Amf, conn *sctp.SCTPConn, pkt []byte) error {
+	pdu, err := ngap.Decoder(pkt)
+	if err != nil {
+		return fmt.Errorf("NGAP decode error : %+v", err)
+	}
+
+	switch pdu.Present {
+	case ngapType.NGAPPDUPresentInitiatingMessage:
+		initiatingMessage := pdu.InitiatingMessage
+		if initiatingMessage == nil {
+			return fmt.Errorf("initiating message is nil")
+		}
+		switch initiatingMessage.ProcedureCode.Value {
+		case ngapType.ProcedureCodeNGSetup:
+			return HandleNgSetupRequest(amf, conn, pdu)
+		case ngapType.ProcedureCodeInitialUEMessage:
+			return HandleInitialUeMessage(amf, conn, pdu)
+		case ngapType.ProcedureCodeUplinkNASTransport:
+			return HandleUplinkNasTransport(amf, conn, pdu)
+		case ngapType.ProcedureCodeUEContextReleaseRequest:
+			return HandleUeCtxReleaseRequest(amf, pdu)
+		case ngapType.ProcedureCodeNGReset:
+			return HandleNgReset(amf, conn, pdu)
+		case ngapType.ProcedureCodeErrorIndication:
+			return HandleErrorIndication(amf, pdu)
+		case ngapType.ProcedureCodeHandoverPreparation:
+			return HandleHandoverRequired(amf, conn, pdu)
+		case ngapType.ProcedureCodeHandoverNotification:
+			return HandleHandoverNotify(amf, conn, pdu)
+		}
+	case ngapType.NGAPPDUPresentSuccessfulOutcome:
+		successfulOutcome := pdu.SuccessfulOutcome
+		if successfulOutcome == nil {
+			return fmt.Errorf("successful outcome is nil")
+		}
+		switch successfulOutcome.ProcedureCode.Value {
+		case ngapType.ProcedureCodeInitialContextSetup:
+			return HandleInitialContextSetupResponse(amf, pdu)
+		case ngapType.ProcedureCodePDUSessionResourceSetup:
+			return HandlePduSessResourceSetupResponse(amf, pdu)
+		case ngapType.ProcedureCodePDUSessionResourceRelease:
+			return HandlePduSessResourceReleaseResponse(amf, pdu)
+		case ngapType.ProcedureCodePDUSessionResourceModify:
+			return HandlePduSessResourceModifyResponse(amf, pdu)
+		case ngapType.ProcedureCodeUEContextRelease:
+			return HandleUeCtxReleaseComplete(amf, pdu)
+		case ngapType.ProcedureCodeNGReset:
+			return HandleNgResetAcknowledge(amf, pdu)
+		case ngapType.ProcedureCodeHandoverResourceAllocation:
+			return HandleHandoverRequestAcknowledge(amf, conn, pdu)
+		}
+	case ngapType.NGAPPDUPresentUnsuccessfulOutcome:
+		unsuccessfulOutcome := pdu.UnsuccessfulOutcome
+		if unsuccessfulOutcome == nil {
+			return fmt.Errorf("unsuccessful outcome is nil")
+		}
+		if unsuccessfulOutcome.ProcedureCode.Value == ngapType.ProcedureCodeHandoverResourceAllocation {
+			return HandleHandoverFailure(amf, pdu)
+		}
+		amf.Log.Warnln("Received unsuccessful outcome, procedure code:",
+			unsuccessfulOutcome.ProcedureCode.Value)
+		return nil
+	}
+
+	amf.Log.Warnln("Ignoring unsupported NGAP message, present:", pdu.Present)
+	return nil
+}
+
+func HandleNgSetupRequest(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var ranNodeName string
+	var globalRanNodeId *ngapType.GlobalRANNodeID
+	for _, ie := range pdu.InitiatingMessage.Value.NGSetupRequest.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDRANNodeName:
+			if ie.Value.RANNodeName != nil {
+				ranNodeName = ie.Value.RANNodeName.Value
+			}
+		case ngapType.ProtocolIEIDGlobalRANNodeID:
+			globalRanNodeId = ie.Value.GlobalRANNodeID
+		}
+	}
+	if globalRanNodeId == nil {
+		return fmt.Errorf("mandatory ie missing in ng setup request")
+	}
+	amf.Log.Infoln("Received NG Setup Request from", ranNodeName)
+
+	if rej := amf.cfg.Amf.NgSetupReject; rej != nil && amf.ngSetupRejected < rej.Count {
+		amf.ngSetupRejected++
+		pkt, err := BuildNGSetupFailure(ngapType.CausePresentMisc,
+			ngapType.CauseMiscPresentControlProcessingOverload, rej.TimeToWait)
+		if err != nil {
+			return fmt.Errorf("failed to build ng setup failure: %v", err)
+		}
+		amf.Log.Infoln("Rejecting NG Setup Request from", ranNodeName)
+		return amf.SendToGnb(conn, pkt)
+	}
+
+	pkt, err := BuildNGSetupResponse(amf.cfg.Amf)
+	if err != nil {
+		return fmt.Errorf("failed to build ng setup response: %v", err)
+	}
+	if key := ranNodeKey(*globalRanNodeId); key != "" {
+		amf.gnbConns[key] = conn
+	}
+	return amf.SendToGnb(conn, pkt)
+}
+
+func HandleInitialUeMessage(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var ranUeNgapId *ngapType.RANUENGAPID
+	var nasPdu *ngapType.NASPDU
+	for _, ie := range pdu.InitiatingMessage.Value.InitialUEMessage.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			ranUeNgapId = ie.Value.RANUENGAPID
+		case ngapType.ProtocolIEIDNASPDU:
+			nasPdu = ie.Value.NASPDU
+		}
+	}
+	if ranUeNgapId == nil || nasPdu == nil {
+		return fmt.Errorf("mandatory ie missing in initial ue message")
+	}
+
+	return HandleInitialNasMessage(amf, conn, ranUeNgapId.Value, nasPdu.Value)
+}
+
+func HandleUplinkNasTransport(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var ranUeNgapId *ngapType.RANUENGAPID
+	var nasPdu *ngapType.NASPDU
+	for _, ie := range pdu.InitiatingMessage.Value.UplinkNASTransport.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			ranUeNgapId = ie.Value.RANUENGAPID
+		case ngapType.ProtocolIEIDNASPDU:
+			nasPdu = ie.Value.NASPDU
+		}
+	}
+	if amfUeNgapId == nil || nasPdu == nil {
+		return fmt.Errorf("mandatory ie missing in uplink nas transport")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		amf.Log.Warnln("No UE found for AMF UE NGAP ID:", amfUeNgapId.Value,
+			"sending Error Indication")
+		pkt, err := BuildErrorIndication(amfUeNgapId, ranUeNgapId,
+			ngapType.CausePresentRadioNetwork,
+			ngapType.CauseRadioNetworkPresentUnknownLocalUENGAPID)
+		if err != nil {
+			return fmt.Errorf("failed to build error indication: %v", err)
+		}
+		return amf.SendToGnb(conn, pkt)
+	}
+
+	return HandleNasMessage(amf, ue, nasPdu.Value)
+}
+
+func HandleInitialContextSetupResponse(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var setupList *ngapType.PDUSessionResourceSetupListCxtRes
+	for _, ie := range pdu.SuccessfulOutcome.Value.InitialContextSetupResponse.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDPDUSessionResourceSetupListCxtRes:
+			setupList = ie.Value.PDUSessionResourceSetupListCxtRes
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in initial context setup response")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received Initial Context Setup Response")
+
+	if setupList == nil {
+		return nil
+	}
+	for _, item := range setupList.List {
+		err := amf.activatePduSession(ue, item.PDUSessionID.Value,
+			item.PDUSessionResourceSetupResponseTransfer)
+		if err != nil {
+			ue.Log.Errorln("Failed to activate PDU session:", err)
+		}
+	}
+	return nil
+}
+
+func HandlePduSessResourceSetupResponse(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var setupList *ngapType.PDUSessionResourceSetupListSURes
+	for _, ie := range pdu.SuccessfulOutcome.Value.PDUSessionResourceSetupResponse.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDPDUSessionResourceSetupListSURes:
+			setupList = ie.Value.PDUSessionResourceSetupListSURes
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in pdu session resource setup response")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received PDU Session Resource Setup Response")
+
+	if setupList == nil {
+		return fmt.Errorf("no pdu session set up by the gnb")
+	}
+	for _, item := range setupList.List {
+		err := amf.activatePduSession(ue, item.PDUSessionID.Value,
+			item.PDUSessionResourceSetupResponseTransfer)
+		if err != nil {
+			ue.Log.Errorln("Failed to activate PDU session:", err)
+		}
+	}
+
+	amf.startNwTimers(ue)
+	return nil
+}
+
+func HandlePduSessResourceReleaseResponse(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	for _, ie := range pdu.SuccessfulOutcome.Value.PDUSessionResourceReleaseResponse.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in pdu session resource release response")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	// The PDU session is released once the UE completes the release
+	ue.Log.Infoln("Received PDU Session Resource Release Response")
+	return nil
+}
+
+func HandlePduSessResourceModifyResponse(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var failedList *ngapType.PDUSessionResourceFailedToModifyListModRes
+	for _, ie := range pdu.SuccessfulOutcome.Value.PDUSessionResourceModifyResponse.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDPDUSessionResourceFailedToModifyListModRes:
+			failedList = ie.Value.PDUSessionResourceFailedToModifyListModRes
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in pdu session resource modify response")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received PDU Session Resource Modify Response")
+	if failedList != nil {
+		for _, item := range failedList.List {
+			ue.Log.Warnln("PDU session resource failed to modify, PDU Session ID:",
+				item.PDUSessionID.Value)
+		}
+	}
+	return nil
+}
+
+func HandleUeCtxReleaseRequest(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var cause *ngapType.Cause
+	for _, ie := range pdu.InitiatingMessage.Value.UEContextReleaseRequest.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDCause:
+			cause = ie.Value.Cause
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in ue context release request")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received UE Context Release Request")
+
+	causePresent := ngapType.CausePresentRadioNetwork
+	causeValue := ngapType.CauseRadioNetworkPresentUserInactivity
+	if cause != nil && cause.Present == ngapType.CausePresentRadioNetwork &&
+		cause.RadioNetwork != nil {
+		causeValue = cause.RadioNetwork.Value
+	}
+	return amf.releaseUeContext(ue, causePresent, causeValue)
+}
+
+func HandleUeCtxReleaseComplete(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	for _, ie := range pdu.SuccessfulOutcome.Value.UEContextReleaseComplete.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in ue context release complete")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	if amfUeNgapId.Value != ue.AmfUeNgapId {
+		// NG connection towards the source gNB of the handover of the UE
+		ue.Log.Infoln("Received UE Context Release Complete from the source gNB")
+		delete(amf.uesByAmfUeNgapId, amfUeNgapId.Value)
+		return nil
+	}
+	ue.Log.Infoln("Received UE Context Release Complete")
+
+	amf.releaseNgapConnection(ue)
+	if ue.Deregistering {
+		amf.removeUe(ue)
+	}
+	return nil
+}
+
+// HandleNgReset releases the NG connections reset by the gNB, all the ones
+// over the NGAP connection or the listed ones. The UEs move to idle state
+func HandleNgReset(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var resetType *ngapType.ResetType
+	for _, ie := range pdu.InitiatingMessage.Value.NGReset.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDResetType {
+			resetType = ie.Value.ResetType
+		}
+	}
+	if resetType == nil {
+		return fmt.Errorf("mandatory ie missing in ng reset")
+	}
+
+	var ackList *ngapType.UEAssociatedLogicalNGConnectionList
+	switch resetType.Present {
+	case ngapType.ResetTypePresentNGInterface:
+		n := amf.releaseNgapConnections(conn)
+		amf.Log.Infoln("Received NG Reset for the NG interface, released", n, "NG connections")
+	case ngapType.ResetTypePresentPartOfNGInterface:
+		if resetType.PartOfNGInterface == nil {
+			return fmt.Errorf("ng connection list missing in ng reset")
+		}
+		ackList = resetType.PartOfNGInterface
+		for _, item := range ackList.List {
+			ue := amf.findNgapConnection(conn, item)
+			if ue == nil {
+				continue
+			}
+			ue.Log.Infoln("Received NG Reset, releasing NG connection")
+			amf.releaseNgapConnection(ue)
+			if ue.Deregistering {
+				amf.removeUe(ue)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported reset type:%v", resetType.Present)
+	}
+
+	pkt, err := BuildNGResetAcknowledge(ackList)
+	if err != nil {
+		return fmt.Errorf("failed to build ng reset acknowledge: %v", err)
+	}
+	return amf.SendToGnb(conn, pkt)
+}
+
+func HandleNgResetAcknowledge(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	amf.Log.Infoln("Received NG Reset Acknowledge")
+	return nil
+}
+
+// HandleErrorIndication logs the error the gNB reported, which points at a
+// message of the mock core the gNB could not process
+func HandleErrorIndication(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	causeStr := "none"
+	var diag *ngapType.CriticalityDiagnostics
+	for _, ie := range pdu.InitiatingMessage.Value.ErrorIndication.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDCause:
+			if ie.Value.Cause != nil {
+				causeStr = test.CauseString(ie.Value.Cause)
+			}
+		case ngapType.ProtocolIEIDCriticalityDiagnostics:
+			diag = ie.Value.CriticalityDiagnostics
+		}
+	}
+	amf.Log.Warnln("Received Error Indication, cause:", causeStr)
+	if diag != nil && diag.ProcedureCode != nil {
+		amf.Log.Warnln("Error Indication for procedure code:", diag.ProcedureCode.Value)
+	}
+	return nil
+}
+
+// HandleHandoverRequired prepares the handover of the UE at the target gNB.
+// The handover cannot be prepared if the target gNB has not set up the NG
+// interface with the AMF
+func HandleHandoverRequired(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var targetId *ngapType.TargetID
+	var pduList *ngapType.PDUSessionResourceListHORqd
+	var container *ngapType.SourceToTargetTransparentContainer
+	for _, ie := range pdu.InitiatingMessage.Value.HandoverRequired.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDTargetID:
+			targetId = ie.Value.TargetID
+		case ngapType.ProtocolIEIDPDUSessionResourceListHORqd:
+			pduList = ie.Value.PDUSessionResourceListHORqd
+		case ngapType.ProtocolIEIDSourceToTargetTransparentContainer:
+			container = ie.Value.SourceToTargetTransparentContainer
+		}
+	}
+	if amfUeNgapId == nil || targetId == nil || container == nil {
+		return fmt.Errorf("mandatory ie missing in handover required")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok || ue.Conn != conn {
+		return fmt.Errorf("no ue found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received Handover Required")
+
+	var targetConn *sctp.SCTPConn
+	if targetId.Present == ngapType.TargetIDPresentTargetRANNodeID &&
+		targetId.TargetRANNodeID != nil {
+		targetConn = amf.gnbConns[ranNodeKey(targetId.TargetRANNodeID.GlobalRANNodeID)]
+	}
+	if targetConn == nil {
+		ue.Log.Warnln("Unknown target gNB, handover not prepared")
+		pkt, err := BuildHandoverPreparationFailure(ue.AmfUeNgapId, ue.RanUeNgapId,
+			ngapType.CausePresentRadioNetwork, ngapType.CauseRadioNetworkPresentUnknownTargetID)
+		if err != nil {
+			return fmt.Errorf("failed to build handover preparation failure: %v", err)
+		}
+		return amf.SendToUe(ue, pkt)
+	}
+
+	var pduSessions []*PduSession
+	if pduList != nil {
+		for _, item := range pduList.List {
+			sess, ok := ue.PduSessions[uint8(item.PDUSessionID.Value)]
+			if !ok {
+				ue.Log.Warnln("Skipping unknown PDU session:", item.PDUSessionID.Value)
+				continue
+			}
+			pduSessions = append(pduSessions, sess)
+		}
+	}
+
+	// The UE is known to the target gNB by a NG connection of its own
+	amf.cancelHandover(ue)
+	ue.Handover = &Handover{}
+	ue.Handover.TargetConn = targetConn
+	ue.Handover.TargetAmfUeNgapId = amf.nextAmfUeNgapId
+	amf.nextAmfUeNgapId++
+	amf.uesByAmfUeNgapId[ue.Handover.TargetAmfUeNgapId] = ue
+	ue.DerivateNh()
+
+	pkt, err := BuildHandoverRequest(ue, amf.cfg.Amf, amf.cfg.Upf.N3IpAddr,
+		pduSessions, container)
+	if err != nil {
+		amf.cancelHandover(ue)
+		return fmt.Errorf("failed to build handover request: %v", err)
+	}
+	ue.Log.Infoln("Sending Handover Request to the target gNB")
+	return amf.SendToGnb(targetConn, pkt)
+}
+
+// HandleHandoverRequestAcknowledge commands the source gNB to hand the UE
+// over to the target gNB
+func HandleHandoverRequestAcknowledge(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	var ranUeNgapId *ngapType.RANUENGAPID
+	var admittedList *ngapType.PDUSessionResourceAdmittedList
+	var container *ngapType.TargetToSourceTransparentContainer
+	for _, ie := range pdu.SuccessfulOutcome.Value.HandoverRequestAcknowledge.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDRANUENGAPID:
+			ranUeNgapId = ie.Value.RANUENGAPID
+		case ngapType.ProtocolIEIDPDUSessionResourceAdmittedList:
+			admittedList = ie.Value.PDUSessionResourceAdmittedList
+		case ngapType.ProtocolIEIDTargetToSourceTransparentContainer:
+			container = ie.Value.TargetToSourceTransparentContainer
+		}
+	}
+	if amfUeNgapId == nil || ranUeNgapId == nil || container == nil {
+		return fmt.Errorf("mandatory ie missing in handover request acknowledge")
+	}
+
+	ue := amf.findHandover(conn, amfUeNgapId.Value)
+	if ue == nil {
+		return fmt.Errorf("no handover found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received Handover Request Acknowledge")
+
+	ue.Handover.TargetRanUeNgapId = ranUeNgapId.Value
+	if admittedList != nil {
+		ue.Handover.Admitted = admittedList.List
+	}
+
+	pkt, err := BuildHandoverCommand(ue, container)
+	if err != nil {
+		return fmt.Errorf("failed to build handover command: %v", err)
+	}
+	ue.Log.Infoln("Sending Handover Command to the source gNB")
+	return amf.SendToUe(ue, pkt)
+}
+
+// HandleHandoverFailure tells the source gNB the target gNB could not accept
+// the UE
+func HandleHandoverFailure(amf *Amf, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	causeStr := "none"
+	for _, ie := range pdu.UnsuccessfulOutcome.Value.HandoverFailure.ProtocolIEs.List {
+		switch ie.Id.Value {
+		case ngapType.ProtocolIEIDAMFUENGAPID:
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		case ngapType.ProtocolIEIDCause:
+			if ie.Value.Cause != nil {
+				causeStr = test.CauseString(ie.Value.Cause)
+			}
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in handover failure")
+	}
+
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId.Value]
+	if !ok || ue.Handover == nil || ue.Handover.TargetAmfUeNgapId != amfUeNgapId.Value {
+		return fmt.Errorf("no handover found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Warnln("Received Handover Failure, cause:", causeStr)
+	amf.cancelHandover(ue)
+
+	pkt, err := BuildHandoverPreparationFailure(ue.AmfUeNgapId, ue.RanUeNgapId,
+		ngapType.CausePresentRadioNetwork,
+		ngapType.CauseRadioNetworkPresentHoFailureInTarget5GCNgranNodeOrTargetSystem)
+	if err != nil {
+		return fmt.Errorf("failed to build handover preparation failure: %v", err)
+	}
+	return amf.SendToUe(ue, pkt)
+}
+
+// HandleHandoverNotify moves the NG connection of the UE to the target gNB,
+// switches the downlink tunnels of the PDU sessions to the target gNB and
+// releases the UE context at the source gNB
+func HandleHandoverNotify(amf *Amf, conn *sctp.SCTPConn, pdu *ngapType.NGAPPDU) error {
+	var amfUeNgapId *ngapType.AMFUENGAPID
+	for _, ie := range pdu.InitiatingMessage.Value.HandoverNotify.ProtocolIEs.List {
+		if ie.Id.Value == ngapType.ProtocolIEIDAMFUENGAPID {
+			amfUeNgapId = ie.Value.AMFUENGAPID
+		}
+	}
+	if amfUeNgapId == nil {
+		return fmt.Errorf("mandatory ie missing in handover notify")
+	}
+
+	ue := amf.findHandover(conn, amfUeNgapId.Value)
+	if ue == nil {
+		return fmt.Errorf("no handover found for amf ue ngap id:%v", amfUeNgapId.Value)
+	}
+	ue.Log.Infoln("Received Handover Notify")
+
+	// The source AMF UE NGAP ID identifies the UE until the source gNB
+	// completes the release of the UE context
+	ho := ue.Handover
+	ue.Handover = nil
+	sourceConn := ue.Conn
+	sourceAmfUeNgapId, sourceRanUeNgapId := ue.AmfUeNgapId, ue.RanUeNgapId
+	ue.Conn = ho.TargetConn
+	ue.AmfUeNgapId = ho.TargetAmfUeNgapId
+	ue.RanUeNgapId = ho.TargetRanUeNgapId
+
+	for _, item := range ho.Admitted {
+		if err := amf.switchPduSession(ue, item); err != nil {
+			ue.Log.Errorln("Failed to switch PDU session:", err)
+		}
+	}
+
+	pkt, err := BuildUEContextReleaseCommand(sourceAmfUeNgapId, sourceRanUeNgapId,
+		ngapType.CausePresentRadioNetwork, ngapType.CauseRadioNetworkPresentSuccessfulHandover)
+	if err != nil {
+		return fmt.Errorf("failed to build ue context release command: %v", err)
+	}
+	ue.Log.Infoln("Releasing UE context at the source gNB")
+	return amf.SendToGnb(sourceConn, pkt)
+}
+
+// findHandover returns the UE handed over to the gNB, identified by the AMF
+// UE NGAP ID allocated for the target gNB
+func (amf *Amf) findHandover(conn *sctp.SCTPConn, amfUeNgapId int64) *AmfUe {
+	ue, ok := amf.uesByAmfUeNgapId[amfUeNgapId]
+	if !ok || ue.Handover == nil || ue.Handover.TargetAmfUeNgapId != amfUeNgapId ||
+		ue.Handover.TargetConn != conn {
+		return nil
+	}
+	return ue
+}
+
+// switchPduSession forwards the downlink tunnel endpoint of the PDU session
+// at the target gNB to the UPF
+func (amf *Amf) switchPduSession(ue *AmfUe, item ngapType.PDUSessionResourceAdmittedItem) error {
+	pduSessionId := item.PDUSessionID.Value
+	sess, ok := ue.PduSessions[uint8(pduSessionId)]
+	if !ok {
+		return fmt.Errorf("unknown pdu session id:%v", pduSessionId)
+	}
+
+	transfer := ngapType.HandoverRequestAcknowledgeTransfer{}
+	err := aper.UnmarshalWithParams(item.HandoverRequestAcknowledgeTransfer, &transfer, "valueExt")
+	if err != nil {
+		return fmt.Errorf("failed to decode handover request acknowledge transfer: %v", err)
+	}
+
+	dlTeid, gnbN3Ip, err := dlTunnel(transfer.DLNGUUPTNLInformation)
+	if err != nil {
+		return err
+	}
+	amf.upf.UpdateSession(sess, dlTeid, gnbN3Ip)
+	ue.Log.Infoln("Switched PDU session:", pduSessionId, "DL TEID:", dlTeid,
+		"gNB N3 IP:", gnbN3Ip)
+	return nil
+}
+
+// ranNodeKey identifies a gNB by its PLMN and gNB ID
+func ranNodeKey(ranNodeId ngapType.GlobalRANNodeID) string {
+	ranId := ngapConvert.RanIdToModels(ranNodeId)
+	if ranId.PlmnId == nil || ranId.GNbId == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s%s-%s", ranId.PlmnId.Mcc, ranId.PlmnId.Mnc, ranId.GNbId.GNBValue)
+}
+
+// findNgapConnection returns the UE served over the NGAP connection, with the
+// AMF UE NGAP ID or else the RAN UE NGAP ID of the NG connection
+func (amf *Amf) findNgapConnection(conn *sctp.SCTPConn,
+	item ngapType.UEAssociatedLogicalNGConnectionItem) *AmfUe {
+	if item.AMFUENGAPID != nil {
+		ue, ok := amf.uesByAmfUeNgapId[item.AMFUENGAPID.Value]
+		if ok && ue.Conn == conn {
+			return ue
+		}
+		return nil
+	}
+	if item.RANUENGAPID != nil {
+		for _, ue := range amf.uesByAmfUeNgapId {
+			if ue.Conn == conn && ue.RanUeNgapId == item.RANUENGAPID.Value {
+				return ue
+			}
+		}
+	}
+	return nil
+}
+
+// releaseUeContext requests the gNB to release the NG signalling connection
+// of the UE
+func (amf *Amf) releaseUeContext(ue *AmfUe, causePresent int, cause aper.Enumerated) error {
+	pkt, err := BuildUEContextReleaseCommand(ue.AmfUeNgapId, ue.RanUeNgapId,
+		causePresent, cause)
+	if err != nil {
+		return fmt.Errorf("failed to build ue context release command: %v", err)
+	}
+	return amf.SendToUe(ue, pkt)
+}
+
+// activatePduSession forwards the downlink tunnel endpoint received from the
+// gNB to the UPF
+func (amf *Amf) activatePduSession(ue *AmfUe, pduSessionId int64, transfer []byte) error {
+	sess, ok := ue.PduSessions[uint8(pduSessionId)]
+	if !ok {
+		return fmt.Errorf("unknown pdu session id:%v", pduSessionId)
+	}
+
+	resp := ngapType.PDUSessionResourceSetupResponseTransfer{}
+	err := aper.UnmarshalWithParams(transfer, &resp, "valueExt")
+	if err != nil {
+		return fmt.Errorf("failed to decode pdu session resource setup response transfer: %v", err)
+	}
+
+	dlTeid, gnbN3Ip, err := dlTunnel(resp.DLQosFlowPerTNLInformation.UPTransportLayerInformation)
+	if err != nil {
+		return err
+	}
+	amf.upf.UpdateSession(sess, dlTeid, gnbN3Ip)
+	ue.Log.Infoln("Activated PDU session:", pduSessionId, "UE IP:", sess.UeAddrString(),
+		"DL TEID:", dlTeid, "gNB N3 IP:", gnbN3Ip)
+	return amf.upf.SendRouterAdvertisement(sess)
+}
+
+// dlTunnel returns the downlink tunnel endpoint of a PDU session at the gNB
+func dlTunnel(upInfo ngapType.UPTransportLayerInformation) (uint32, net.IP, error) {
+	gtpTunnel := upInfo.GTPTunnel
+	if gtpTunnel == nil || len(gtpTunnel.GTPTEID.Value) != 4 {
+		return 0, nil, fmt.Errorf("downlink gtp tunnel missing")
+	}
+	ipv4, _ := ngapConvert.IPAddressToString(gtpTunnel.TransportLayerAddress)
+	gnbN3Ip := net.ParseIP(ipv4)
+	if gnbN3Ip == nil {
+		return 0, nil, fmt.Errorf("invalid gnb n3 address:%v", ipv4)
+	}
+	return binary.BigEndian.Uint32(gtpTunnel.GTPTEID.Value), gnbN3Ip, nil
+}
+
+// startNwTimers schedules the network triggered procedures configured for
+// the subscriber, once per registration
+func (amf *Amf) startNwTimers(ue *AmfUe) {
+	nwTriggered := ue.Sub.NwTriggered
+	if nwTriggered == nil || ue.NwTimersStarted {
+		return
+	}
+	ue.NwTimersStarted = true
+
+	if nwTriggered.PduSessionReleaseAfter > 0 {
+		timer := time.AfterFunc(time.Duration(nwTriggered.PduSessionReleaseAfter)*time.Second,
+			func() {
+				amf.mu.Lock()
+				defer amf.mu.Unlock()
+				if err := amf.triggerPduSessionRelease(ue); err != nil {
+					ue.Log.Errorln("Network requested PDU session release failed:", err)
+				}
+			})
+		ue.NwTimers = append(ue.NwTimers, timer)
+	}
+
+	if nwTriggered.PduSessionModifyAfter > 0 {
+		timer := time.AfterFunc(time.Duration(nwTriggered.PduSessionModifyAfter)*time.Second,
+			func() {
+				amf.mu.Lock()
+				defer amf.mu.Unlock()
+				if err := amf.triggerPduSessionModification(ue); err != nil {
+					ue.Log.Errorln("Network requested PDU session modification failed:", err)
+				}
+			})
+		ue.NwTimers = append(ue.NwTimers, timer)
+	}
+
+	if nwTriggered.NgResetAfter > 0 {
+		timer := time.AfterFunc(time.Duration(nwTriggered.NgResetAfter)*time.Second,
+			func() {
+				amf.mu.Lock()
+				defer amf.mu.Unlock()
+				if err := amf.triggerNgReset(ue); err != nil {
+					ue.Log.Errorln("Network triggered NG Reset failed:", err)
+				}
+			})
+		ue.NwTimers = append(ue.NwTimers, timer)
+	}
+
+	if nwTriggered.DeregisterAfter > 0 {
+		timer := time.AfterFunc(time.Duration(nwTriggered.DeregisterAfter)*time.Second,
+			func() {
+				amf.mu.Lock()
+				defer amf.mu.Unlock()
+				if err := amf.triggerDeregistration(ue); err != nil {
+					ue.Log.Errorln("Network triggered deregistration failed:", err)
+				}
+			})
+		ue.NwTimers = append(ue.NwTimers, timer)
+	}
+}
+
+// triggerNgReset resets the NG connection of the UE, which moves to idle state
+func (amf *Amf) triggerNgReset(ue *AmfUe) error {
+	if amf.uesBySupi[ue.Supi] != ue || ue.Deregistering {
+		return nil
+	}
+	if !ue.Connected {
+		return fmt.Errorf("ue in idle state")
+	}
+
+	pkt, err := BuildNGReset([]*AmfUe{ue}, ngapType.CausePresentMisc,
+		ngapType.CauseMiscPresentOmIntervention)
+	if err != nil {
+		return fmt.Errorf("failed to build ng reset: %v", err)
+	}
+	ue.Log.Infoln("Sending NG Reset")
+	if err := amf.SendToUe(ue, pkt); err != nil {
+		return err
+	}
+	amf.releaseNgapConnection(ue)
+	return nil
+}
@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mockcore provides a minimal AMF and UPF which stand in for a 5G core
+// so that the gnbsim profiles can be exercised without one. The AMF answers
+// NG Setup, authenticates the configured subscribers using 5G AKA, sets up
+// the NAS security context and PDU sessions and runs the network triggered
+// procedures. The UPF terminates the N3 tunnels and answers ICMP echo
+// requests
+package mockcore
+
+import (
+	"fmt"
+
+	"github.com/omec-project/gnbsim/logger"
+)
+
+type MockCore struct {
+	Amf *Amf
+	Upf *Upf
+}
+
+// Start validates the configuration and starts the mock UPF and AMF
+func Start(cfg *Config) (*MockCore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mock core configuration: %v", err)
+	}
+
+	db, err := NewSubscriberDb(cfg.Subscribers)
+	if err != nil {
+		return nil, err
+	}
+
+	upf, err := NewUpf(cfg.Upf)
+	if err != nil {
+		return nil, err
+	}
+	if err = upf.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start upf: %v", err)
+	}
+
+	amf := NewAmf(cfg, db, upf)
+	if err = amf.Start(); err != nil {
+		upf.Stop()
+		return nil, fmt.Errorf("failed to start amf: %v", err)
+	}
+
+	logger.MockCoreLog.Infoln("Mock core started")
+	return &MockCore{Amf: amf, Upf: upf}, nil
+}
+
+func (mc *MockCore) Stop() {
+	mc.Amf.Stop()
+	mc.Upf.Stop()
+	logger.MockCoreLog.Infoln("Mock core stopped")
+}
@@ -0,0 +1,504 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+// Copyright 2019 free5GC.org
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"github.com/omec-project/nas"
+	"github.com/omec-project/nas/nasConvert"
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/nas/nasType"
+)
+
+// Default QoS rule: rule id 1, create new QoS rule, default rule with a
+// single match-all packet filter, precedence 255, QFI 1
+var defaultQosRule = []byte{0x01, 0x00, 0x06, 0x31, 0x31, 0x01, 0x01, 0xff, 0x01}
+
+const (
+	DEFAULT_QFI uint8 = 1
+	// Session AMBR of 1 Gbps expressed in units of 1 Mbps
+	sessionAmbrUnit1Mbps uint8 = 0x06
+	// GPRS timer 3 unit of a deactivated timer
+	gprsTimer3UnitDeactivated uint8 = 0x07
+)
+
+var sessionAmbrValue = [2]uint8{0x03, 0xe8}
+
+// QoS rule of the dedicated QoS flow: rule id 2, create new QoS rule with a
+// single bidirectional packet filter matching the SIP remote port 5060,
+// precedence 10, QFI 2
+var dedicatedQosRule = []byte{0x02, 0x00, 0x08, 0x21, 0x31, 0x03, 0x50, 0x13, 0xc4,
+	0x0a, DEDICATED_QFI}
+
+// Deletion of the QoS rule of the dedicated QoS flow
+var dedicatedQosRuleDelete = []byte{0x02, 0x00, 0x01, 0x40}
+
+const (
+	DEDICATED_QFI uint8 = 2
+	// QoS flow description operation codes, TS 24.501 Section 9.11.4.12
+	qosFlowDescCreate uint8 = 0x20
+	qosFlowDescDelete uint8 = 0x40
+	qosFlowDescModify uint8 = 0x60
+	// GPRS bit rate unit of 1 kbps
+	bitRateUnit1Kbps uint8 = 0x01
+)
+
+func BuildAuthenticationRequest(ue *AmfUe) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeAuthenticationRequest)
+
+	authenticationRequest := nasMessage.NewAuthenticationRequest(0)
+	authenticationRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	authenticationRequest.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	authenticationRequest.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	authenticationRequest.AuthenticationRequestMessageIdentity.SetMessageType(nas.MsgTypeAuthenticationRequest)
+	authenticationRequest.SpareHalfOctetAndNgksi = nasConvert.SpareHalfOctetAndNgksiToNas(ue.NgKsi)
+	abba := []uint8{0x00, 0x00}
+	authenticationRequest.ABBA.SetLen(uint8(len(abba)))
+	authenticationRequest.ABBA.SetABBAContents(abba)
+
+	var tmpArray [16]byte
+	authenticationRequest.AuthenticationParameterRAND =
+		nasType.NewAuthenticationParameterRAND(nasMessage.AuthenticationRequestAuthenticationParameterRANDType)
+	copy(tmpArray[:], ue.AuthVector.Rand[0:16])
+	authenticationRequest.AuthenticationParameterRAND.SetRANDValue(tmpArray)
+
+	authenticationRequest.AuthenticationParameterAUTN =
+		nasType.NewAuthenticationParameterAUTN(nasMessage.AuthenticationRequestAuthenticationParameterAUTNType)
+	authenticationRequest.AuthenticationParameterAUTN.SetLen(uint8(len(ue.AuthVector.Autn)))
+	copy(tmpArray[:], ue.AuthVector.Autn[0:16])
+	authenticationRequest.AuthenticationParameterAUTN.SetAUTN(tmpArray)
+
+	m.GmmMessage.AuthenticationRequest = authenticationRequest
+	return m.PlainNasEncode()
+}
+
+func BuildAuthenticationReject() ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeAuthenticationReject)
+
+	authenticationReject := nasMessage.NewAuthenticationReject(0)
+	authenticationReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	authenticationReject.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	authenticationReject.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	authenticationReject.AuthenticationRejectMessageIdentity.SetMessageType(nas.MsgTypeAuthenticationReject)
+
+	m.GmmMessage.AuthenticationReject = authenticationReject
+	return m.PlainNasEncode()
+}
+
+// BuildIdentityRequest builds an Identity Request, protected once the NAS
+// security context of the UE is established
+func BuildIdentityRequest(ue *AmfUe, typeOfIdentity uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeIdentityRequest)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	identityRequest := nasMessage.NewIdentityRequest(0)
+	identityRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	identityRequest.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	identityRequest.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	identityRequest.IdentityRequestMessageIdentity.SetMessageType(nas.MsgTypeIdentityRequest)
+	identityRequest.SpareHalfOctetAndIdentityType.SetTypeOfIdentity(typeOfIdentity)
+
+	m.GmmMessage.IdentityRequest = identityRequest
+	return NASEncode(ue, m)
+}
+
+// TS 24.501 8.2.25
+func BuildSecurityModeCommand(ue *AmfUe) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeSecurityModeCommand)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedWithNew5gNasSecurityContext,
+	}
+
+	securityModeCommand := nasMessage.NewSecurityModeCommand(0)
+	securityModeCommand.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	securityModeCommand.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	securityModeCommand.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	securityModeCommand.SecurityModeCommandMessageIdentity.SetMessageType(nas.MsgTypeSecurityModeCommand)
+
+	securityModeCommand.SelectedNASSecurityAlgorithms.SetTypeOfCipheringAlgorithm(ue.CipheringAlg)
+	securityModeCommand.SelectedNASSecurityAlgorithms.SetTypeOfIntegrityProtectionAlgorithm(ue.IntegrityAlg)
+
+	securityModeCommand.SpareHalfOctetAndNgksi = nasConvert.SpareHalfOctetAndNgksiToNas(ue.NgKsi)
+
+	securityModeCommand.ReplayedUESecurityCapabilities.SetLen(ue.UESecurityCapability.GetLen())
+	securityModeCommand.ReplayedUESecurityCapabilities.Buffer = ue.UESecurityCapability.Buffer
+
+	securityModeCommand.IMEISVRequest = nasType.NewIMEISVRequest(nasMessage.SecurityModeCommandIMEISVRequestType)
+	securityModeCommand.IMEISVRequest.SetIMEISVRequestValue(nasMessage.IMEISVRequested)
+
+	ue.SecurityContextAvailable = true
+	m.GmmMessage.SecurityModeCommand = securityModeCommand
+	payload, err := NASEncode(ue, m)
+	if err != nil {
+		ue.SecurityContextAvailable = false
+		return nil, err
+	}
+	return payload, nil
+}
+
+func BuildRegistrationAccept(ue *AmfUe, cfg *AmfConfig) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeRegistrationAccept)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	registrationAccept := nasMessage.NewRegistrationAccept(0)
+	registrationAccept.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	registrationAccept.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	registrationAccept.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	registrationAccept.RegistrationAcceptMessageIdentity.SetMessageType(nas.MsgTypeRegistrationAccept)
+
+	registrationAccept.RegistrationResult5GS.SetLen(1)
+	registrationAccept.RegistrationResult5GS.SetRegistrationResultValue5GS(nasMessage.AccessType3GPP)
+
+	if ue.Guti != "" {
+		gutiNas := nasConvert.GutiToNas(ue.Guti)
+		registrationAccept.GUTI5G = &gutiNas
+		registrationAccept.GUTI5G.SetIei(nasMessage.RegistrationAcceptGUTI5GType)
+	}
+
+	if len(cfg.SNssaiList) > 0 {
+		registrationAccept.AllowedNSSAI = nasType.NewAllowedNSSAI(nasMessage.RegistrationAcceptAllowedNSSAIType)
+		var buf []uint8
+		for _, snssai := range cfg.SNssaiList {
+			buf = append(buf, nasConvert.SnssaiToNas(snssai)...)
+		}
+		registrationAccept.AllowedNSSAI.SetLen(uint8(len(buf)))
+		registrationAccept.AllowedNSSAI.SetSNSSAIValue(buf)
+	}
+
+	registrationAccept.T3512Value = nasType.NewT3512Value(nasMessage.RegistrationAcceptT3512ValueType)
+	registrationAccept.T3512Value.SetLen(1)
+	if cfg.T3512 < 0 {
+		registrationAccept.T3512Value.SetUnit(gprsTimer3UnitDeactivated)
+	} else {
+		registrationAccept.T3512Value.Octet = nasConvert.GPRSTimer3ToNas(cfg.T3512)
+	}
+
+	m.GmmMessage.RegistrationAccept = registrationAccept
+	return NASEncode(ue, m)
+}
+
+// BuildRegistrationReject builds a Registration Reject, the T3346 back-off
+// timer is included if t3346 is non zero
+func BuildRegistrationReject(cause5GMM uint8, t3346 int) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeRegistrationReject)
+
+	registrationReject := nasMessage.NewRegistrationReject(0)
+	registrationReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	registrationReject.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	registrationReject.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	registrationReject.RegistrationRejectMessageIdentity.SetMessageType(nas.MsgTypeRegistrationReject)
+	registrationReject.Cause5GMM.SetCauseValue(cause5GMM)
+	if t3346 != 0 {
+		registrationReject.T3346Value = nasType.NewT3346Value(nasMessage.RegistrationRejectT3346ValueType)
+		registrationReject.T3346Value.SetLen(1)
+		registrationReject.T3346Value.SetGPRSTimer2Value(nasConvert.GPRSTimer2ToNas(t3346))
+	}
+
+	m.GmmMessage.RegistrationReject = registrationReject
+	return m.PlainNasEncode()
+}
+
+func BuildServiceAccept(ue *AmfUe) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeServiceAccept)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	serviceAccept := nasMessage.NewServiceAccept(0)
+	serviceAccept.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	serviceAccept.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	serviceAccept.SetMessageType(nas.MsgTypeServiceAccept)
+
+	serviceAccept.PDUSessionStatus = nasType.NewPDUSessionStatus(nasMessage.ServiceAcceptPDUSessionStatusType)
+	serviceAccept.PDUSessionStatus.SetLen(2)
+	serviceAccept.PDUSessionStatus.Buffer = nasConvert.PSIToBuf(*ue.PduSessionStatus())
+
+	m.GmmMessage.ServiceAccept = serviceAccept
+	return NASEncode(ue, m)
+}
+
+// BuildServiceReject builds a Service Reject, the T3346 back-off timer is
+// included if t3346 is non zero
+func BuildServiceReject(cause uint8, t3346 int) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeServiceReject)
+
+	serviceReject := nasMessage.NewServiceReject(0)
+	serviceReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	serviceReject.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	serviceReject.SetMessageType(nas.MsgTypeServiceReject)
+	serviceReject.SetCauseValue(cause)
+	if t3346 != 0 {
+		serviceReject.T3346Value = nasType.NewT3346Value(nasMessage.ServiceRejectT3346ValueType)
+		serviceReject.T3346Value.SetLen(1)
+		serviceReject.T3346Value.SetGPRSTimer2Value(nasConvert.GPRSTimer2ToNas(t3346))
+	}
+
+	m.GmmMessage.ServiceReject = serviceReject
+	return m.PlainNasEncode()
+}
+
+func BuildDeregistrationAccept(ue *AmfUe) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeDeregistrationAcceptUEOriginatingDeregistration)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	deregistrationAccept := nasMessage.NewDeregistrationAcceptUEOriginatingDeregistration(0)
+	deregistrationAccept.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	deregistrationAccept.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	deregistrationAccept.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	deregistrationAccept.SetMessageType(nas.MsgTypeDeregistrationAcceptUEOriginatingDeregistration)
+
+	m.GmmMessage.DeregistrationAcceptUEOriginatingDeregistration = deregistrationAccept
+	return NASEncode(ue, m)
+}
+
+// BuildDeregistrationRequest builds a network initiated deregistration
+// request which does not ask the UE to register again
+func BuildDeregistrationRequest(ue *AmfUe) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeDeregistrationRequestUETerminatedDeregistration)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	deregistrationRequest := nasMessage.NewDeregistrationRequestUETerminatedDeregistration(0)
+	deregistrationRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	deregistrationRequest.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	deregistrationRequest.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0)
+	deregistrationRequest.SetMessageType(nas.MsgTypeDeregistrationRequestUETerminatedDeregistration)
+	deregistrationRequest.SetAccessType(nasMessage.AccessType3GPP)
+	deregistrationRequest.SetSwitchOff(0)
+	deregistrationRequest.SetReRegistrationRequired(nasMessage.ReRegistrationNotRequired)
+
+	m.GmmMessage.DeregistrationRequestUETerminatedDeregistration = deregistrationRequest
+	return NASEncode(ue, m)
+}
+
+func BuildDLNASTransport(ue *AmfUe, nasPdu []byte, pduSessionId uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeDLNASTransport)
+
+	m.SecurityHeader = nas.SecurityHeader{
+		ProtocolDiscriminator: nasMessage.Epd5GSMobilityManagementMessage,
+		SecurityHeaderType:    nas.SecurityHeaderTypeIntegrityProtectedAndCiphered,
+	}
+
+	dLNASTransport := nasMessage.NewDLNASTransport(0)
+	dLNASTransport.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	dLNASTransport.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	dLNASTransport.SetMessageType(nas.MsgTypeDLNASTransport)
+	dLNASTransport.SpareHalfOctetAndPayloadContainerType.SetPayloadContainerType(nasMessage.PayloadContainerTypeN1SMInfo)
+	dLNASTransport.PayloadContainer.SetLen(uint16(len(nasPdu)))
+	dLNASTransport.PayloadContainer.SetPayloadContainerContents(nasPdu)
+
+	dLNASTransport.PduSessionID2Value = new(nasType.PduSessionID2Value)
+	dLNASTransport.PduSessionID2Value.SetIei(nasMessage.DLNASTransportPduSessionID2ValueType)
+	dLNASTransport.PduSessionID2Value.SetPduSessionID2Value(pduSessionId)
+
+	m.GmmMessage.DLNASTransport = dLNASTransport
+	return NASEncode(ue, m)
+}
+
+// BuildPDUSessionEstablishmentAccept builds the 5GSM accept for an IPv4, IPv6
+// or IPv4v6 PDU session with the requested SSC mode and a single default QoS
+// rule
+func BuildPDUSessionEstablishmentAccept(sess *PduSession, pti uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionEstablishmentAccept)
+
+	pDUSessionEstablishmentAccept := nasMessage.NewPDUSessionEstablishmentAccept(0x0)
+	pDUSessionEstablishmentAccept.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pDUSessionEstablishmentAccept.SetPDUSessionID(sess.PduSessId)
+	pDUSessionEstablishmentAccept.SetPTI(pti)
+	pDUSessionEstablishmentAccept.SetMessageType(nas.MsgTypePDUSessionEstablishmentAccept)
+
+	pDUSessionEstablishmentAccept.SetPDUSessionType(sess.PduSessType)
+	pDUSessionEstablishmentAccept.SetSSCMode(sess.SscMode)
+
+	pDUSessionEstablishmentAccept.AuthorizedQosRules.SetLen(uint16(len(defaultQosRule)))
+	pDUSessionEstablishmentAccept.AuthorizedQosRules.SetQosRule(defaultQosRule)
+
+	pDUSessionEstablishmentAccept.SessionAMBR.SetLen(6)
+	pDUSessionEstablishmentAccept.SessionAMBR.SetUnitForSessionAMBRForDownlink(sessionAmbrUnit1Mbps)
+	pDUSessionEstablishmentAccept.SessionAMBR.SetSessionAMBRForDownlink(sessionAmbrValue)
+	pDUSessionEstablishmentAccept.SessionAMBR.SetUnitForSessionAMBRForUplink(sessionAmbrUnit1Mbps)
+	pDUSessionEstablishmentAccept.SessionAMBR.SetSessionAMBRForUplink(sessionAmbrValue)
+
+	// TS 24.501 Section 9.11.4.10, the IPv6 interface identifier precedes the
+	// IPv4 address
+	var addr [12]uint8
+	addrLen := 0
+	if sess.UeIpv6Iid != nil {
+		addrLen += copy(addr[:], sess.UeIpv6Iid)
+	}
+	if sess.UeIp != nil {
+		addrLen += copy(addr[addrLen:], sess.UeIp.To4())
+	}
+	pDUSessionEstablishmentAccept.PDUAddress =
+		nasType.NewPDUAddress(nasMessage.PDUSessionEstablishmentAcceptPDUAddressType)
+	pDUSessionEstablishmentAccept.PDUAddress.SetLen(uint8(addrLen + 1))
+	pDUSessionEstablishmentAccept.PDUAddress.SetPDUSessionTypeValue(sess.PduSessType)
+	pDUSessionEstablishmentAccept.PDUAddress.SetPDUAddressInformation(addr)
+
+	snssai := nasConvert.SnssaiToNas(sess.Snssai)
+	pDUSessionEstablishmentAccept.SNSSAI = nasType.NewSNSSAI(nasMessage.PDUSessionEstablishmentAcceptSNSSAIType)
+	pDUSessionEstablishmentAccept.SNSSAI.SetLen(snssai[0])
+	copy(pDUSessionEstablishmentAccept.SNSSAI.Octet[:], snssai[1:])
+
+	if sess.Dnn != "" {
+		pDUSessionEstablishmentAccept.DNN = nasType.NewDNN(nasMessage.PDUSessionEstablishmentAcceptDNNType)
+		pDUSessionEstablishmentAccept.DNN.SetDNN([]uint8(sess.Dnn))
+	}
+
+	m.GsmMessage.PDUSessionEstablishmentAccept = pDUSessionEstablishmentAccept
+	return m.PlainNasEncode()
+}
+
+func BuildPDUSessionEstablishmentReject(pduSessionId, pti, cause uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionEstablishmentReject)
+
+	pDUSessionEstablishmentReject := nasMessage.NewPDUSessionEstablishmentReject(0x0)
+	pDUSessionEstablishmentReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pDUSessionEstablishmentReject.SetPDUSessionID(pduSessionId)
+	pDUSessionEstablishmentReject.SetPTI(pti)
+	pDUSessionEstablishmentReject.SetMessageType(nas.MsgTypePDUSessionEstablishmentReject)
+	pDUSessionEstablishmentReject.SetCauseValue(cause)
+
+	m.GsmMessage.PDUSessionEstablishmentReject = pDUSessionEstablishmentReject
+	return m.PlainNasEncode()
+}
+
+func BuildPDUSessionReleaseCommand(pduSessionId, pti, cause uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionReleaseCommand)
+
+	pDUSessionReleaseCommand := nasMessage.NewPDUSessionReleaseCommand(0x0)
+	pDUSessionReleaseCommand.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pDUSessionReleaseCommand.SetPDUSessionID(pduSessionId)
+	pDUSessionReleaseCommand.SetPTI(pti)
+	pDUSessionReleaseCommand.SetMessageType(nas.MsgTypePDUSessionReleaseCommand)
+	pDUSessionReleaseCommand.SetCauseValue(cause)
+
+	m.GsmMessage.PDUSessionReleaseCommand = pDUSessionReleaseCommand
+	return m.PlainNasEncode()
+}
+
+// BuildPDUSessionModificationCommand builds the 5GSM command updating the
+// QoS rules and QoS flow descriptions of the PDU session, either of them may
+// be nil
+func BuildPDUSessionModificationCommand(pduSessionId, pti uint8, qosRules,
+	qosFlowDescs []byte) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionModificationCommand)
+
+	pDUSessionModificationCommand := nasMessage.NewPDUSessionModificationCommand(0x0)
+	pDUSessionModificationCommand.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pDUSessionModificationCommand.SetPDUSessionID(pduSessionId)
+	pDUSessionModificationCommand.SetPTI(pti)
+	pDUSessionModificationCommand.SetMessageType(nas.MsgTypePDUSessionModificationCommand)
+
+	if qosRules != nil {
+		pDUSessionModificationCommand.AuthorizedQosRules =
+			nasType.NewAuthorizedQosRules(nasMessage.PDUSessionModificationCommandAuthorizedQosRulesType)
+		pDUSessionModificationCommand.AuthorizedQosRules.SetLen(uint16(len(qosRules)))
+		pDUSessionModificationCommand.AuthorizedQosRules.SetQosRule(qosRules)
+	}
+	if qosFlowDescs != nil {
+		pDUSessionModificationCommand.AuthorizedQosFlowDescriptions =
+			nasType.NewAuthorizedQosFlowDescriptions(
+				nasMessage.PDUSessionModificationCommandAuthorizedQosFlowDescriptionsType)
+		pDUSessionModificationCommand.AuthorizedQosFlowDescriptions.SetLen(uint16(len(qosFlowDescs)))
+		pDUSessionModificationCommand.AuthorizedQosFlowDescriptions.SetQoSFlowDescriptions(qosFlowDescs)
+	}
+
+	m.GsmMessage.PDUSessionModificationCommand = pDUSessionModificationCommand
+	return m.PlainNasEncode()
+}
+
+func BuildPDUSessionModificationReject(pduSessionId, pti, cause uint8) ([]byte, error) {
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionModificationReject)
+
+	pDUSessionModificationReject := nasMessage.NewPDUSessionModificationReject(0x0)
+	pDUSessionModificationReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pDUSessionModificationReject.SetPDUSessionID(pduSessionId)
+	pDUSessionModificationReject.SetPTI(pti)
+	pDUSessionModificationReject.SetMessageType(nas.MsgTypePDUSessionModificationReject)
+	pDUSessionModificationReject.SetCauseValue(cause)
+
+	m.GsmMessage.PDUSessionModificationReject = pDUSessionModificationReject
+	return m.PlainNasEncode()
+}
+
+// buildDedicatedQosFlowDescription encodes the QoS flow description of the
+// dedicated QoS flow, TS 24.501 Section 9.11.4.12. The 5QI is provided when
+// the QoS flow is created, the bit rates in kbps unless it is deleted
+func buildDedicatedQosFlowDescription(opCode uint8, gfbr, mfbr uint16) []byte {
+	desc := []byte{DEDICATED_QFI, opCode, 0x00}
+	if opCode == qosFlowDescDelete {
+		return desc
+	}
+
+	var numParams uint8
+	if opCode == qosFlowDescCreate {
+		desc = append(desc, 0x01, 0x01, uint8(DEDICATED_5QI))
+		numParams++
+	}
+	// GFBR uplink and downlink, MFBR uplink and downlink
+	for _, param := range []struct {
+		id   uint8
+		rate uint16
+	}{{0x02, gfbr}, {0x03, gfbr}, {0x04, mfbr}, {0x05, mfbr}} {
+		desc = append(desc, param.id, 0x03, bitRateUnit1Kbps, uint8(param.rate>>8),
+			uint8(param.rate))
+		numParams++
+	}
+	// E bit set, the parameters list replaces the previous one
+	desc[2] = 0x40 | numParams
+	return desc
+}
@@ -0,0 +1,880 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/omec-project/gnbsim/util/suci"
+
+	"git.cs.nctu.edu.tw/calee/sctp"
+	"github.com/omec-project/aper"
+	"github.com/omec-project/nas"
+	"github.com/omec-project/nas/nasConvert"
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/nas/nasType"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/openapi/models"
+)
+
+const DEFAULT_DNN string = "internet"
+
+// Length of the security header of a security protected 5GMM message: EPD,
+// security header type, MAC and sequence number
+const SECURITY_HEADER_LEN int = 7
+
+// HandleInitialNasMessage handles the NAS message carried in an Initial UE
+// Message, which starts a new NG signalling connection
+func HandleInitialNasMessage(amf *Amf, conn *sctp.SCTPConn, ranUeNgapId int64,
+	payload []byte) error {
+	if len(payload) < 3 {
+		return fmt.Errorf("initial nas message too short")
+	}
+
+	// Initial NAS messages are at most integrity protected, hence the
+	// plain message can be read before the UE is identified
+	plain := payload
+	if nas.GetSecurityHeaderType(payload)&0x0f != nas.SecurityHeaderTypePlainNas {
+		if len(payload) <= SECURITY_HEADER_LEN {
+			return fmt.Errorf("security protected initial nas message too short")
+		}
+		plain = payload[SECURITY_HEADER_LEN:]
+	}
+
+	msg := new(nas.Message)
+	if err := msg.PlainNasDecode(&plain); err != nil {
+		return fmt.Errorf("failed to decode initial nas message: %v", err)
+	}
+	if msg.GmmMessage == nil {
+		return fmt.Errorf("initial nas message is not a 5gmm message")
+	}
+
+	switch msg.GmmHeader.GetMessageType() {
+	case nas.MsgTypeRegistrationRequest:
+		return HandleRegistrationRequest(amf, conn, ranUeNgapId, msg, payload)
+	case nas.MsgTypeServiceRequest:
+		return HandleServiceRequest(amf, conn, ranUeNgapId, msg, payload)
+	case nas.MsgTypeDeregistrationRequestUEOriginatingDeregistration:
+		return HandleInitialDeregistrationRequest(amf, conn, ranUeNgapId, msg, payload)
+	default:
+		return fmt.Errorf("unsupported initial nas message type:%v",
+			msg.GmmHeader.GetMessageType())
+	}
+}
+
+// HandleNasMessage handles the NAS message received from a UE over an
+// established NG signalling connection
+func HandleNasMessage(amf *Amf, ue *AmfUe, payload []byte) error {
+	msg, err := NASDecode(ue, payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode nas message: %v", err)
+	}
+	if msg.GmmMessage == nil {
+		return fmt.Errorf("nas message is not a 5gmm message")
+	}
+
+	msgType := msg.GmmHeader.GetMessageType()
+	switch msgType {
+	case nas.MsgTypeAuthenticationResponse:
+		return HandleAuthenticationResponse(amf, ue, msg)
+	case nas.MsgTypeAuthenticationFailure:
+		return HandleAuthenticationFailure(amf, ue, msg)
+	case nas.MsgTypeIdentityResponse:
+		return HandleIdentityResponse(amf, ue, msg)
+	case nas.MsgTypeSecurityModeComplete:
+		return HandleSecurityModeComplete(amf, ue, msg)
+	case nas.MsgTypeSecurityModeReject:
+		ue.Log.Errorln("Received Security Mode Reject, cause:",
+			msg.SecurityModeReject.GetCauseValue())
+		return amf.rejectUe(ue, ngapType.CauseNasPresentUnspecified)
+	case nas.MsgTypeRegistrationRequest:
+		return HandleRegistrationUpdate(amf, ue, msg)
+	case nas.MsgTypeRegistrationComplete:
+		ue.Log.Infoln("Received Registration Complete")
+		return nil
+	case nas.MsgTypeULNASTransport:
+		return HandleUlNasTransport(amf, ue, msg)
+	case nas.MsgTypeDeregistrationRequestUEOriginatingDeregistration:
+		return HandleDeregistrationRequest(amf, ue, msg)
+	case nas.MsgTypeDeregistrationAcceptUETerminatedDeregistration:
+		ue.Log.Infoln("Received Deregistration Accept")
+		return amf.releaseUeContext(ue, ngapType.CausePresentNas,
+			ngapType.CauseNasPresentDeregister)
+	default:
+		return fmt.Errorf("unsupported nas message type:%v", msgType)
+	}
+}
+
+func HandleRegistrationRequest(amf *Amf, conn *sctp.SCTPConn, ranUeNgapId int64,
+	msg *nas.Message, payload []byte) error {
+	regReq := msg.RegistrationRequest
+	mobileId := regReq.MobileIdentity5GS.GetMobileIdentity5GSContents()
+	if len(mobileId) == 0 {
+		return fmt.Errorf("mobile identity missing in registration request")
+	}
+
+	var ue *AmfUe
+	var supi string
+	switch mobileId[0] & 0x07 {
+	case nasMessage.MobileIdentity5GSTypeSuci:
+		imsi, err := amf.suciToImsi(mobileId)
+		if err != nil {
+			amf.Log.Errorln("Failed to derive imsi from suci:", err)
+		} else {
+			supi = "imsi-" + imsi
+			ue = amf.uesBySupi[supi]
+		}
+	case nasMessage.MobileIdentity5GSType5gGuti:
+		if len(mobileId) == 11 {
+			ue = amf.uesByTmsi[binary.BigEndian.Uint32(mobileId[7:])]
+		}
+		if ue != nil {
+			supi = ue.Supi
+		}
+	}
+
+	if supi == "" {
+		if mobileId[0]&0x07 == nasMessage.MobileIdentity5GSType5gGuti {
+			// The UE is asked for its SUCI, as per TS 24.501 Section 5.5.1.2.2
+			amf.Log.Infoln("Unknown 5G-GUTI, starting identification")
+			return amf.startIdentification(conn, ranUeNgapId, regReq.UESecurityCapability)
+		}
+		return amf.rejectRegistration(conn, ranUeNgapId, "",
+			nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork, 0)
+	}
+
+	sub := amf.db.GetSubscriber(strings.TrimPrefix(supi, "imsi-"))
+	if sub != nil {
+		if cause := amf.db.RegistrationRejectCause(sub); cause != 0 {
+			// The network no longer holds a registration for the UE
+			if ue != nil {
+				amf.removeUe(ue)
+			}
+			amf.Log.Infoln("Rejecting registration of", supi, "as configured, cause:", cause)
+			return amf.rejectRegistration(conn, ranUeNgapId, supi, cause, sub.Reject.T3346)
+		}
+	}
+
+	// A registration update from a UE with a valid NAS security context is
+	// accepted without authenticating the UE again
+	regType := regReq.NgksiAndRegistrationType5GS.GetRegistrationType5GS()
+	if ue != nil && regType != nasMessage.RegistrationType5GSInitialRegistration &&
+		ue.SecurityContextAvailable {
+		if _, err := NASDecode(ue, payload); err != nil {
+			ue.Log.Errorln("Failed to verify registration request:", err)
+		} else {
+			amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+			return HandleRegistrationUpdate(amf, ue, msg)
+		}
+	}
+
+	ue = amf.prepareRegistration(ue, supi)
+	if ue == nil {
+		return amf.rejectRegistration(conn, ranUeNgapId, supi,
+			nasMessage.Cause5GMMIllegalUE, 0)
+	}
+
+	ue.Log.Infoln("Received Registration Request")
+	amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+	return amf.startRegistration(ue, regReq.UESecurityCapability)
+}
+
+// prepareRegistration returns the context of the registering UE, created if
+// the UE is not known yet. nil is returned if the subscriber is unknown
+func (amf *Amf) prepareRegistration(ue *AmfUe, supi string) *AmfUe {
+	if ue == nil {
+		sub := amf.db.GetSubscriber(strings.TrimPrefix(supi, "imsi-"))
+		if sub == nil {
+			amf.Log.Errorln("Unknown subscriber:", supi)
+			return nil
+		}
+		ue = NewAmfUe(supi, sub)
+		amf.uesBySupi[supi] = ue
+		return ue
+	}
+
+	// The UE registers afresh, dropping the state of the previous
+	// registration
+	ue.StopNwTimers()
+	for id, sess := range ue.PduSessions {
+		amf.upf.ReleaseSession(sess)
+		delete(ue.PduSessions, id)
+	}
+	ue.Deregistering = false
+	return ue
+}
+
+func (amf *Amf) startRegistration(ue *AmfUe,
+	ueSecurityCapability *nasType.UESecurityCapability) error {
+	ue.UESecurityCapability = ueSecurityCapability
+	ue.SecurityContextAvailable = false
+	ue.NgKsi = models.NgKsi{
+		Tsc: models.ScType_NATIVE,
+		Ksi: (ue.NgKsi.Ksi + 1) % 7,
+	}
+
+	return amf.startAuthentication(ue)
+}
+
+// startIdentification asks for the SUCI of a UE which registered with an
+// unknown 5G-GUTI. A temporary context holds the NG signalling connection
+// until the UE is identified
+func (amf *Amf) startIdentification(conn *sctp.SCTPConn, ranUeNgapId int64,
+	ueSecurityCapability *nasType.UESecurityCapability) error {
+	ue := NewAmfUe("", nil)
+	// dropped once the NG signalling connection is released
+	ue.Deregistering = true
+	ue.UESecurityCapability = ueSecurityCapability
+	amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+	return amf.requestIdentity(ue, nasMessage.MobileIdentity5GSTypeSuci)
+}
+
+func (amf *Amf) requestIdentity(ue *AmfUe, typeOfIdentity uint8) error {
+	nasPdu, err := BuildIdentityRequest(ue, typeOfIdentity)
+	if err != nil {
+		return fmt.Errorf("failed to build identity request: %v", err)
+	}
+	ue.RequestedIdentity = typeOfIdentity
+	ue.Log.Infoln("Sending Identity Request, type of identity:", typeOfIdentity)
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+func HandleIdentityResponse(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	if ue.RequestedIdentity == nasMessage.MobileIdentity5GSTypeNoIdentity {
+		return fmt.Errorf("no identification in progress")
+	}
+	requested := ue.RequestedIdentity
+	ue.RequestedIdentity = nasMessage.MobileIdentity5GSTypeNoIdentity
+
+	mobileId := msg.IdentityResponse.MobileIdentity.GetMobileIdentityContents()
+	var typeOfIdentity uint8
+	if len(mobileId) != 0 {
+		typeOfIdentity = mobileId[0] & 0x07
+	}
+	ue.Log.Infoln("Received Identity Response, type of identity:", typeOfIdentity)
+
+	switch requested {
+	case nasMessage.MobileIdentity5GSTypeSuci:
+		var imsi string
+		var err error
+		if typeOfIdentity != requested {
+			err = fmt.Errorf("suci not provided")
+		} else {
+			imsi, err = amf.suciToImsi(mobileId)
+		}
+		if err != nil {
+			ue.Log.Errorln("Failed to derive imsi from suci:", err)
+			return amf.rejectIdentification(ue,
+				nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork)
+		}
+		return amf.resumeRegistration(ue, "imsi-"+imsi)
+	case nasMessage.MobileIdentity5GSTypeImei, nasMessage.MobileIdentity5GSTypeImeisv:
+		if typeOfIdentity == requested {
+			ue.Pei = nasConvert.PeiToString(mobileId)
+			ue.Log.Infoln("PEI:", ue.Pei)
+		} else {
+			// The PEI is not needed to serve the UE
+			ue.Log.Warnln("PEI not provided by the UE")
+		}
+		return amf.acceptRegistration(ue)
+	default:
+		return fmt.Errorf("unexpected identity requested:%v", requested)
+	}
+}
+
+// resumeRegistration authenticates a UE which registered with an unknown
+// 5G-GUTI, once identified by its SUCI
+func (amf *Amf) resumeRegistration(tmp *AmfUe, supi string) error {
+	ue := amf.prepareRegistration(amf.uesBySupi[supi], supi)
+	if ue == nil {
+		return amf.rejectIdentification(tmp, nasMessage.Cause5GMMIllegalUE)
+	}
+
+	ue.Log.Infoln("Identified UE, resuming registration")
+	amf.moveNgapConnection(tmp, ue)
+	return amf.startRegistration(ue, tmp.UESecurityCapability)
+}
+
+// rejectIdentification rejects the registration of a UE which could not be
+// identified, over the NG signalling connection held by its temporary context
+func (amf *Amf) rejectIdentification(tmp *AmfUe, cause uint8) error {
+	nasPdu, err := BuildRegistrationReject(cause, 0)
+	if err != nil {
+		return fmt.Errorf("failed to build registration reject: %v", err)
+	}
+	if err = amf.SendNasToUe(tmp, nasPdu); err != nil {
+		return err
+	}
+	return amf.releaseUeContext(tmp, ngapType.CausePresentNas,
+		ngapType.CauseNasPresentNormalRelease)
+}
+
+func (amf *Amf) startAuthentication(ue *AmfUe) error {
+	av, err := amf.db.GenerateAuthVector(ue.Sub, amf.ServingNetworkName())
+	if err != nil {
+		return fmt.Errorf("failed to generate authentication vector: %v", err)
+	}
+	ue.AuthVector = av
+
+	nasPdu, err := BuildAuthenticationRequest(ue)
+	if err != nil {
+		return fmt.Errorf("failed to build authentication request: %v", err)
+	}
+	ue.Log.Infoln("Sending Authentication Request")
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+func HandleAuthenticationResponse(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	ue.Log.Infoln("Received Authentication Response")
+	if ue.AuthVector == nil {
+		return fmt.Errorf("no authentication in progress")
+	}
+
+	authResp := msg.AuthenticationResponse
+	if authResp.AuthenticationResponseParameter == nil {
+		return fmt.Errorf("authentication response parameter missing")
+	}
+	resStar := authResp.AuthenticationResponseParameter.GetRES()
+	if !bytes.Equal(resStar[:], ue.AuthVector.XresStar) {
+		ue.Log.Errorln("RES* mismatch, rejecting authentication")
+		nasPdu, err := BuildAuthenticationReject()
+		if err != nil {
+			return fmt.Errorf("failed to build authentication reject: %v", err)
+		}
+		if err = amf.SendNasToUe(ue, nasPdu); err != nil {
+			return err
+		}
+		return amf.rejectUe(ue, ngapType.CauseNasPresentAuthenticationFailure)
+	}
+
+	ue.DerivateKamf()
+	if !ue.SelectSecurityAlgorithms(amf.cfg.Amf.Security) {
+		ue.Log.Errorln("No common security algorithm supported by the UE")
+		nasPdu, err := BuildRegistrationReject(nasMessage.Cause5GMMUESecurityCapabilitiesMismatch, 0)
+		if err != nil {
+			return fmt.Errorf("failed to build registration reject: %v", err)
+		}
+		if err = amf.SendNasToUe(ue, nasPdu); err != nil {
+			return err
+		}
+		return amf.rejectUe(ue, ngapType.CauseNasPresentUnspecified)
+	}
+	ue.DerivateAlgKey()
+
+	nasPdu, err := BuildSecurityModeCommand(ue)
+	if err != nil {
+		return fmt.Errorf("failed to build security mode command: %v", err)
+	}
+	ue.Log.Infoln("Sending Security Mode Command")
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+func HandleAuthenticationFailure(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	authFailure := msg.AuthenticationFailure
+	cause := authFailure.GetCauseValue()
+	ue.Log.Infoln("Received Authentication Failure, cause:", cause)
+
+	if cause != nasMessage.Cause5GMMSynchFailure ||
+		authFailure.AuthenticationFailureParameter == nil || ue.AuthVector == nil {
+		return amf.rejectUe(ue, ngapType.CauseNasPresentAuthenticationFailure)
+	}
+
+	auts := authFailure.AuthenticationFailureParameter.GetAuthenticationFailureParameter()
+	err := amf.db.Resynchronise(ue.Sub, ue.AuthVector.Rand, auts[:])
+	if err != nil {
+		ue.Log.Errorln("Resynchronisation failed:", err)
+		return amf.rejectUe(ue, ngapType.CauseNasPresentAuthenticationFailure)
+	}
+	return amf.startAuthentication(ue)
+}
+
+func HandleSecurityModeComplete(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	ue.Log.Infoln("Received Security Mode Complete")
+
+	peiType := amf.cfg.Amf.peiType
+	if peiType != nasMessage.MobileIdentity5GSTypeNoIdentity && ue.Pei == "" {
+		// The registration is accepted once the PEI is retrieved
+		return amf.requestIdentity(ue, peiType)
+	}
+	return amf.acceptRegistration(ue)
+}
+
+func (amf *Amf) acceptRegistration(ue *AmfUe) error {
+	amf.allocateGuti(ue)
+	nasPdu, err := BuildRegistrationAccept(ue, amf.cfg.Amf)
+	if err != nil {
+		return fmt.Errorf("failed to build registration accept: %v", err)
+	}
+
+	pkt, err := BuildInitialContextSetupRequest(ue, amf.cfg.Amf, amf.cfg.Upf.N3IpAddr,
+		nasPdu, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build initial context setup request: %v", err)
+	}
+	ue.Log.Infoln("Sending Registration Accept, GUTI:", ue.Guti)
+	return amf.SendToUe(ue, pkt)
+}
+
+// HandleRegistrationUpdate accepts the mobility or periodic registration update
+// of a registered UE. The PDU sessions of the UE are kept
+func HandleRegistrationUpdate(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	regType := msg.RegistrationRequest.NgksiAndRegistrationType5GS.GetRegistrationType5GS()
+	switch regType {
+	case nasMessage.RegistrationType5GSMobilityRegistrationUpdating:
+		ue.Log.Infoln("Received Mobility Registration Update")
+	case nasMessage.RegistrationType5GSPeriodicRegistrationUpdating:
+		ue.Log.Infoln("Received Periodic Registration Update")
+	default:
+		return fmt.Errorf("unexpected registration type:%v", regType)
+	}
+
+	amf.allocateGuti(ue)
+	nasPdu, err := BuildRegistrationAccept(ue, amf.cfg.Amf)
+	if err != nil {
+		return fmt.Errorf("failed to build registration accept: %v", err)
+	}
+	ue.Log.Infoln("Sending Registration Accept, GUTI:", ue.Guti)
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+func HandleServiceRequest(amf *Amf, conn *sctp.SCTPConn, ranUeNgapId int64,
+	msg *nas.Message, payload []byte) error {
+	tmsi := msg.ServiceRequest.TMSI5GS.GetTMSI5G()
+	ue, ok := amf.uesByTmsi[binary.BigEndian.Uint32(tmsi[:])]
+	if !ok {
+		amf.Log.Errorln("No UE found for 5G-TMSI:", hex.EncodeToString(tmsi[:]))
+		return amf.rejectService(conn, ranUeNgapId,
+			nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork, 0)
+	}
+
+	ue.Log.Infoln("Received Service Request")
+	if _, err := NASDecode(ue, payload); err != nil {
+		ue.Log.Errorln("Failed to verify service request:", err)
+		return amf.rejectService(conn, ranUeNgapId, nasMessage.Cause5GMMMACFailure, 0)
+	}
+
+	if ue.Sub != nil {
+		if cause := amf.db.ServiceRejectCause(ue.Sub); cause != 0 {
+			ue.Log.Infoln("Rejecting service request as configured, cause:", cause)
+			if cause == nasMessage.Cause5GMMImplicitlyDeregistered ||
+				cause == nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork {
+				// The UE has to register again, as per TS 24.501 Section 5.6.1.5
+				amf.removeUe(ue)
+			}
+			return amf.rejectService(conn, ranUeNgapId, cause, ue.Sub.Reject.T3346)
+		}
+	}
+
+	amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+	nasPdu, err := BuildServiceAccept(ue)
+	if err != nil {
+		return fmt.Errorf("failed to build service accept: %v", err)
+	}
+
+	var pduSessions []*PduSession
+	for _, sess := range ue.PduSessions {
+		pduSessions = append(pduSessions, sess)
+	}
+	pkt, err := BuildInitialContextSetupRequest(ue, amf.cfg.Amf, amf.cfg.Upf.N3IpAddr,
+		nasPdu, pduSessions)
+	if err != nil {
+		return fmt.Errorf("failed to build initial context setup request: %v", err)
+	}
+	ue.Log.Infoln("Sending Service Accept")
+	return amf.SendToUe(ue, pkt)
+}
+
+// HandleInitialDeregistrationRequest handles the deregistration request sent
+// by a UE in idle state
+func HandleInitialDeregistrationRequest(amf *Amf, conn *sctp.SCTPConn, ranUeNgapId int64,
+	msg *nas.Message, payload []byte) error {
+	deregReq := msg.DeregistrationRequestUEOriginatingDeregistration
+	mobileId := deregReq.MobileIdentity5GS.GetMobileIdentity5GSContents()
+	if len(mobileId) != 11 || mobileId[0]&0x07 != nasMessage.MobileIdentity5GSType5gGuti {
+		return fmt.Errorf("5g-guti missing in initial deregistration request")
+	}
+	ue, ok := amf.uesByTmsi[binary.BigEndian.Uint32(mobileId[7:])]
+	if !ok {
+		return fmt.Errorf("no ue found for 5g-tmsi:%v", hex.EncodeToString(mobileId[7:]))
+	}
+
+	msg, err := NASDecode(ue, payload)
+	if err != nil {
+		return fmt.Errorf("failed to verify deregistration request: %v", err)
+	}
+	amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+	return HandleDeregistrationRequest(amf, ue, msg)
+}
+
+func HandleUlNasTransport(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	ulNasTransport := msg.ULNASTransport
+	if ulNasTransport.GetPayloadContainerType() != nasMessage.PayloadContainerTypeN1SMInfo {
+		return fmt.Errorf("unsupported payload container type:%v",
+			ulNasTransport.GetPayloadContainerType())
+	}
+
+	smPayload := ulNasTransport.GetPayloadContainerContents()
+	smMsg := new(nas.Message)
+	if err := smMsg.PlainNasDecode(&smPayload); err != nil {
+		return fmt.Errorf("failed to decode 5gsm message: %v", err)
+	}
+	if smMsg.GsmMessage == nil {
+		return fmt.Errorf("payload container does not hold a 5gsm message")
+	}
+
+	switch smMsg.GsmHeader.GetMessageType() {
+	case nas.MsgTypePDUSessionEstablishmentRequest:
+		return HandlePduSessEstRequest(amf, ue, ulNasTransport, smMsg)
+	case nas.MsgTypePDUSessionReleaseRequest:
+		relReq := smMsg.PDUSessionReleaseRequest
+		ue.Log.Infoln("Received PDU Session Release Request, PDU Session ID:",
+			relReq.GetPDUSessionID())
+		return amf.releasePduSession(ue, relReq.GetPDUSessionID(), relReq.GetPTI(),
+			nasMessage.Cause5GSMRegularDeactivation)
+	case nas.MsgTypePDUSessionModificationRequest:
+		modReq := smMsg.PDUSessionModificationRequest
+		pduSessionId := modReq.GetPDUSessionID()
+		ue.Log.Infoln("Received PDU Session Modification Request, PDU Session ID:",
+			pduSessionId)
+		if _, ok := ue.PduSessions[pduSessionId]; !ok {
+			ue.Log.Errorln("Unknown PDU session:", pduSessionId)
+			return amf.rejectPduSessionModification(ue, pduSessionId, modReq.GetPTI(),
+				nasMessage.Cause5GSMInvalidPDUSessionIdentity)
+		}
+		return amf.modifyPduSession(ue, pduSessionId, modReq.GetPTI())
+	case nas.MsgTypePDUSessionModificationComplete:
+		ue.Log.Infoln("Received PDU Session Modification Complete, PDU Session ID:",
+			smMsg.PDUSessionModificationComplete.GetPDUSessionID())
+		return nil
+	case nas.MsgTypePDUSessionModificationCommandReject:
+		cmdRej := smMsg.PDUSessionModificationCommandReject
+		ue.Log.Warnln("Received PDU Session Modification Command Reject, PDU Session ID:",
+			cmdRej.GetPDUSessionID(), "5GSM cause:", cmdRej.GetCauseValue())
+		return nil
+	case nas.MsgTypePDUSessionReleaseComplete:
+		pduSessionId := smMsg.PDUSessionReleaseComplete.GetPDUSessionID()
+		ue.Log.Infoln("Received PDU Session Release Complete, PDU Session ID:", pduSessionId)
+		if sess, ok := ue.PduSessions[pduSessionId]; ok {
+			amf.upf.ReleaseSession(sess)
+			delete(ue.PduSessions, pduSessionId)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported 5gsm message type:%v", smMsg.GsmHeader.GetMessageType())
+	}
+}
+
+func HandlePduSessEstRequest(amf *Amf, ue *AmfUe, ulNasTransport *nasMessage.ULNASTransport,
+	smMsg *nas.Message) error {
+	estReq := smMsg.PDUSessionEstablishmentRequest
+	pduSessionId := estReq.GetPDUSessionID()
+	pti := estReq.GetPTI()
+	ue.Log.Infoln("Received PDU Session Establishment Request, PDU Session ID:", pduSessionId)
+
+	if _, ok := ue.PduSessions[pduSessionId]; ok {
+		ue.Log.Errorln("PDU session already exists:", pduSessionId)
+		return amf.rejectPduSession(ue, pduSessionId, pti,
+			nasMessage.Cause5GSMRequestRejectedUnspecified)
+	}
+
+	sess := &PduSession{PduSessId: pduSessionId, Dnn: DEFAULT_DNN, SscMode: 1,
+		PduSessType: nasMessage.PDUSessionTypeIPv4}
+	if estReq.SSCMode != nil {
+		sess.SscMode = estReq.SSCMode.GetSSCMode()
+	}
+	if estReq.PDUSessionType != nil {
+		sess.PduSessType = estReq.PDUSessionType.GetPDUSessionTypeValue()
+	}
+	switch sess.PduSessType {
+	case nasMessage.PDUSessionTypeIPv4, nasMessage.PDUSessionTypeIPv6,
+		nasMessage.PDUSessionTypeIPv4IPv6:
+	default:
+		ue.Log.Errorln("Unsupported PDU session type:", sess.PduSessType)
+		return amf.rejectPduSession(ue, pduSessionId, pti,
+			nasMessage.Cause5GSMUnknownPDUSessionType)
+	}
+	if ulNasTransport.DNN != nil {
+		sess.Dnn = string(ulNasTransport.DNN.GetDNN())
+	}
+	if ulNasTransport.SNSSAI != nil {
+		sess.Snssai = nasConvert.SnssaiToModels(ulNasTransport.SNSSAI)
+	} else if len(amf.cfg.Amf.SNssaiList) != 0 {
+		sess.Snssai = amf.cfg.Amf.SNssaiList[0]
+	}
+
+	if err := amf.upf.AllocateSession(sess); err != nil {
+		ue.Log.Errorln("Failed to allocate PDU session:", err)
+		return amf.rejectPduSession(ue, pduSessionId, pti,
+			nasMessage.Cause5GSMInsufficientResources)
+	}
+	ue.PduSessions[pduSessionId] = sess
+
+	smPdu, err := BuildPDUSessionEstablishmentAccept(sess, pti)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session establishment accept: %v", err)
+	}
+	nasPdu, err := BuildDLNASTransport(ue, smPdu, pduSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to build dl nas transport: %v", err)
+	}
+
+	pkt, err := BuildPDUSessionResourceSetupRequest(ue, sess, amf.cfg.Upf.N3IpAddr, nasPdu)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session resource setup request: %v", err)
+	}
+	ue.Log.Infoln("Sending PDU Session Establishment Accept, UE IP:", sess.UeAddrString())
+	return amf.SendToUe(ue, pkt)
+}
+
+func HandleDeregistrationRequest(amf *Amf, ue *AmfUe, msg *nas.Message) error {
+	deregReq := msg.DeregistrationRequestUEOriginatingDeregistration
+	ue.Log.Infoln("Received Deregistration Request")
+	ue.Deregistering = true
+	ue.StopNwTimers()
+
+	// No accept is sent to a UE which is switched off
+	if deregReq.GetSwitchOff() == 0 {
+		nasPdu, err := BuildDeregistrationAccept(ue)
+		if err != nil {
+			return fmt.Errorf("failed to build deregistration accept: %v", err)
+		}
+		if err = amf.SendNasToUe(ue, nasPdu); err != nil {
+			return err
+		}
+	}
+	return amf.releaseUeContext(ue, ngapType.CausePresentNas,
+		ngapType.CauseNasPresentDeregister)
+}
+
+// triggerDeregistration runs the network initiated deregistration procedure
+func (amf *Amf) triggerDeregistration(ue *AmfUe) error {
+	if amf.uesBySupi[ue.Supi] != ue || ue.Deregistering {
+		return nil
+	}
+	if !ue.Connected {
+		return fmt.Errorf("ue in idle state, paging not supported")
+	}
+
+	ue.Deregistering = true
+	nasPdu, err := BuildDeregistrationRequest(ue)
+	if err != nil {
+		return fmt.Errorf("failed to build deregistration request: %v", err)
+	}
+	ue.Log.Infoln("Sending Network Initiated Deregistration Request")
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+// triggerPduSessionRelease runs the network requested PDU session release
+// procedure for every PDU session of the UE
+func (amf *Amf) triggerPduSessionRelease(ue *AmfUe) error {
+	if amf.uesBySupi[ue.Supi] != ue || ue.Deregistering {
+		return nil
+	}
+	if !ue.Connected {
+		return fmt.Errorf("ue in idle state, paging not supported")
+	}
+
+	for id := range ue.PduSessions {
+		ue.Log.Infoln("Sending Network Requested PDU Session Release, PDU Session ID:", id)
+		err := amf.releasePduSession(ue, id, 0, nasMessage.Cause5GSMRegularDeactivation)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (amf *Amf) releasePduSession(ue *AmfUe, pduSessionId, pti, cause uint8) error {
+	if _, ok := ue.PduSessions[pduSessionId]; !ok {
+		return fmt.Errorf("unknown pdu session id:%v", pduSessionId)
+	}
+
+	smPdu, err := BuildPDUSessionReleaseCommand(pduSessionId, pti, cause)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session release command: %v", err)
+	}
+	nasPdu, err := BuildDLNASTransport(ue, smPdu, pduSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to build dl nas transport: %v", err)
+	}
+
+	pkt, err := BuildPDUSessionResourceReleaseCommand(ue, pduSessionId, nasPdu)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session resource release command: %v", err)
+	}
+	return amf.SendToUe(ue, pkt)
+}
+
+// triggerPduSessionModification runs the network requested PDU session
+// modification procedure for every PDU session of the UE
+func (amf *Amf) triggerPduSessionModification(ue *AmfUe) error {
+	if amf.uesBySupi[ue.Supi] != ue || ue.Deregistering {
+		return nil
+	}
+	if !ue.Connected {
+		return fmt.Errorf("ue in idle state, paging not supported")
+	}
+
+	for id := range ue.PduSessions {
+		ue.Log.Infoln("Sending Network Requested PDU Session Modification, PDU Session ID:", id)
+		if err := amf.modifyPduSession(ue, id, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modifyPduSession adds, modifies or releases the dedicated QoS flow of the
+// PDU session, depending on the number of earlier modifications
+func (amf *Amf) modifyPduSession(ue *AmfUe, pduSessionId, pti uint8) error {
+	sess, ok := ue.PduSessions[pduSessionId]
+	if !ok {
+		return fmt.Errorf("unknown pdu session id:%v", pduSessionId)
+	}
+	qosFlowOp := sess.Modifications % 3
+	sess.Modifications++
+
+	var qosRules, qosFlowDescs []byte
+	var gfbr, mfbr uint16
+	switch qosFlowOp {
+	case QOS_FLOW_ADD:
+		gfbr, mfbr = 64, 128
+		qosRules = dedicatedQosRule
+		qosFlowDescs = buildDedicatedQosFlowDescription(qosFlowDescCreate, gfbr, mfbr)
+		ue.Log.Infoln("Adding dedicated QoS flow, QFI:", DEDICATED_QFI)
+	case QOS_FLOW_MODIFY:
+		gfbr, mfbr = 128, 256
+		qosFlowDescs = buildDedicatedQosFlowDescription(qosFlowDescModify, gfbr, mfbr)
+		ue.Log.Infoln("Modifying dedicated QoS flow, QFI:", DEDICATED_QFI)
+	case QOS_FLOW_RELEASE:
+		qosRules = dedicatedQosRuleDelete
+		qosFlowDescs = buildDedicatedQosFlowDescription(qosFlowDescDelete, 0, 0)
+		ue.Log.Infoln("Releasing dedicated QoS flow, QFI:", DEDICATED_QFI)
+	}
+
+	smPdu, err := BuildPDUSessionModificationCommand(pduSessionId, pti, qosRules, qosFlowDescs)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session modification command: %v", err)
+	}
+	nasPdu, err := BuildDLNASTransport(ue, smPdu, pduSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to build dl nas transport: %v", err)
+	}
+
+	transfer, err := BuildPDUSessionResourceModifyRequestTransfer(qosFlowOp, gfbr, mfbr)
+	if err != nil {
+		return err
+	}
+	pkt, err := BuildPDUSessionResourceModifyRequest(ue, pduSessionId, nasPdu, transfer)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session resource modify request: %v", err)
+	}
+	return amf.SendToUe(ue, pkt)
+}
+
+func (amf *Amf) rejectPduSessionModification(ue *AmfUe, pduSessionId, pti, cause uint8) error {
+	smPdu, err := BuildPDUSessionModificationReject(pduSessionId, pti, cause)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session modification reject: %v", err)
+	}
+	nasPdu, err := BuildDLNASTransport(ue, smPdu, pduSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to build dl nas transport: %v", err)
+	}
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+func (amf *Amf) rejectPduSession(ue *AmfUe, pduSessionId, pti, cause uint8) error {
+	smPdu, err := BuildPDUSessionEstablishmentReject(pduSessionId, pti, cause)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session establishment reject: %v", err)
+	}
+	nasPdu, err := BuildDLNASTransport(ue, smPdu, pduSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to build dl nas transport: %v", err)
+	}
+	return amf.SendNasToUe(ue, nasPdu)
+}
+
+// rejectUe releases the NG signalling connection of a UE whose registration
+// failed and drops its context
+func (amf *Amf) rejectUe(ue *AmfUe, cause aper.Enumerated) error {
+	ue.Deregistering = true
+	ue.StopNwTimers()
+	return amf.releaseUeContext(ue, ngapType.CausePresentNas, cause)
+}
+
+// rejectRegistration rejects a UE for which no context could be created and
+// releases the NG signalling connection
+func (amf *Amf) rejectRegistration(conn *sctp.SCTPConn, ranUeNgapId int64, supi string,
+	cause uint8, t3346 int) error {
+	nasPdu, err := BuildRegistrationReject(cause, t3346)
+	if err != nil {
+		return fmt.Errorf("failed to build registration reject: %v", err)
+	}
+	return amf.rejectInitialNasMessage(conn, ranUeNgapId, supi, nasPdu)
+}
+
+func (amf *Amf) rejectService(conn *sctp.SCTPConn, ranUeNgapId int64, cause uint8,
+	t3346 int) error {
+	nasPdu, err := BuildServiceReject(cause, t3346)
+	if err != nil {
+		return fmt.Errorf("failed to build service reject: %v", err)
+	}
+	return amf.rejectInitialNasMessage(conn, ranUeNgapId, "", nasPdu)
+}
+
+func (amf *Amf) rejectInitialNasMessage(conn *sctp.SCTPConn, ranUeNgapId int64, supi string,
+	nasPdu []byte) error {
+	// Temporary context used only to address the NG signalling connection
+	ue := NewAmfUe(supi, nil)
+	ue.Deregistering = true
+	amf.allocateNgapConnection(ue, conn, ranUeNgapId)
+
+	if err := amf.SendNasToUe(ue, nasPdu); err != nil {
+		return err
+	}
+	return amf.releaseUeContext(ue, ngapType.CausePresentNas,
+		ngapType.CauseNasPresentNormalRelease)
+}
+
+// suciToImsi derives the IMSI from a SUCI. The MSIN concealed with an ECIES
+// protection scheme is revealed using the configured home network keys
+func (amf *Amf) suciToImsi(mobileId []byte) (string, error) {
+	if len(mobileId) < 9 {
+		return "", fmt.Errorf("suci too short")
+	}
+	scheme := mobileId[6]
+	if scheme != suci.NULL_SCHEME {
+		keyId := mobileId[7]
+		key := amf.cfg.GetHomeNetworkKey(keyId)
+		if key == nil {
+			return "", fmt.Errorf("unknown home network public key id:%v", keyId)
+		}
+		if key.scheme != scheme {
+			return "", fmt.Errorf("protection scheme %v does not match home network key %v",
+				suci.ProtectionSchemeName(scheme), keyId)
+		}
+		msin, err := suci.Reveal(scheme, key.privateKey, mobileId[8:])
+		if err != nil {
+			return "", fmt.Errorf("failed to reveal msin: %v", err)
+		}
+		// carries on as if the null scheme had been used
+		plain := append([]byte{}, mobileId[:6]...)
+		plain = append(plain, suci.NULL_SCHEME, 0)
+		mobileId = append(plain, msin...)
+	}
+	suciStr, _ := nasConvert.SuciToString(mobileId)
+	// suci-0-${mcc}-${mnc}-${routingIndicator}-${protectionScheme}-${homeNetworkPublicKeyIdentifier}-${schemeOutput}
+	parts := strings.Split(suciStr, "-")
+	if len(parts) != 8 || parts[0] != "suci" {
+		return "", fmt.Errorf("unsupported suci format:%v", suciStr)
+	}
+	return parts[2] + parts[3] + parts[7], nil
+}
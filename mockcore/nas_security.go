@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+// Copyright 2019 free5GC.org
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/omec-project/gnbsim/util/nassecurity"
+
+	"github.com/omec-project/nas"
+	"github.com/omec-project/nas/security"
+)
+
+// NASEncode encodes a downlink NAS message, protecting it with the security
+// context of the UE when one is available
+func NASEncode(ue *AmfUe, msg *nas.Message) ([]byte, error) {
+	if ue == nil {
+		return nil, fmt.Errorf("amfUe is nil")
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("nas message is empty")
+	}
+
+	if !ue.SecurityContextAvailable {
+		return msg.PlainNasEncode()
+	}
+
+	needCiphering := false
+	switch msg.SecurityHeader.SecurityHeaderType {
+	case nas.SecurityHeaderTypeIntegrityProtected:
+	case nas.SecurityHeaderTypeIntegrityProtectedAndCiphered:
+		needCiphering = true
+	case nas.SecurityHeaderTypeIntegrityProtectedWithNew5gNasSecurityContext:
+		ue.ULCount.Set(0, 0)
+		ue.DLCount.Set(0, 0)
+	default:
+		return nil, fmt.Errorf("wrong security header type: 0x%0x", msg.SecurityHeader.SecurityHeaderType)
+	}
+
+	payload, err := msg.PlainNasEncode()
+	if err != nil {
+		return nil, fmt.Errorf("plain nas encode failed: %v", err)
+	}
+
+	if needCiphering {
+		if err = nassecurity.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.DLCount.Get(), security.Bearer3GPP,
+			security.DirectionDownlink, payload); err != nil {
+			return nil, fmt.Errorf("encrypt failed: %v", err)
+		}
+	}
+
+	// add sequence number
+	payload = append([]byte{ue.DLCount.SQN()}, payload...)
+
+	mac32, err := nassecurity.NASMacCalculate(ue.IntegrityAlg, ue.KnasInt, ue.DLCount.Get(),
+		security.Bearer3GPP, security.DirectionDownlink, payload)
+	if err != nil {
+		return nil, fmt.Errorf("nas mac calculate failed: %v", err)
+	}
+
+	payload = append(mac32, payload...)
+	payload = append([]byte{msg.SecurityHeader.ProtocolDiscriminator,
+		msg.SecurityHeader.SecurityHeaderType}, payload...)
+
+	ue.DLCount.AddOne()
+	return payload, nil
+}
+
+// NASDecode decodes an uplink NAS message. Integrity protected messages which
+// fail the MAC verification are rejected
+func NASDecode(ue *AmfUe, payload []byte) (*nas.Message, error) {
+	if ue == nil {
+		return nil, fmt.Errorf("amfUe is nil")
+	}
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("nas payload is empty")
+	}
+
+	msg := new(nas.Message)
+	msg.SecurityHeaderType = nas.GetSecurityHeaderType(payload) & 0x0f
+	if msg.SecurityHeaderType == nas.SecurityHeaderTypePlainNas {
+		err := msg.PlainNasDecode(&payload)
+		return msg, err
+	}
+
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("security protected nas payload too short")
+	}
+
+	if !ue.SecurityContextAvailable {
+		return nil, fmt.Errorf("no security context available")
+	}
+
+	receivedMac32 := payload[2:6]
+	sequenceNumber := payload[6]
+	// remove security header except for sequence number
+	payload = payload[6:]
+
+	ciphered := false
+	switch msg.SecurityHeaderType {
+	case nas.SecurityHeaderTypeIntegrityProtected:
+	case nas.SecurityHeaderTypeIntegrityProtectedAndCiphered:
+		ciphered = true
+	case nas.SecurityHeaderTypeIntegrityProtectedWithNew5gNasSecurityContext:
+		ue.ULCount.Set(0, 0)
+		ue.DLCount.Set(0, 0)
+	case nas.SecurityHeaderTypeIntegrityProtectedAndCipheredWithNew5gNasSecurityContext:
+		ciphered = true
+		ue.ULCount.Set(0, 0)
+		ue.DLCount.Set(0, 0)
+	default:
+		return nil, fmt.Errorf("wrong security header type: 0x%0x", msg.SecurityHeaderType)
+	}
+
+	if ue.ULCount.SQN() > sequenceNumber {
+		ue.ULCount.SetOverflow(ue.ULCount.Overflow() + 1)
+	}
+	ue.ULCount.SetSQN(sequenceNumber)
+
+	mac32, err := nassecurity.NASMacCalculate(ue.IntegrityAlg, ue.KnasInt, ue.ULCount.Get(),
+		security.Bearer3GPP, security.DirectionUplink, payload)
+	if err != nil {
+		return nil, fmt.Errorf("nas mac calculate failed: %v", err)
+	}
+	if !bytes.Equal(mac32, receivedMac32) {
+		return nil, fmt.Errorf("nas mac verification failed (received: 0x%x, expected: 0x%x)",
+			receivedMac32, mac32)
+	}
+
+	// remove sequence number
+	payload = payload[1:]
+	if ciphered {
+		if err = nassecurity.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.ULCount.Get(), security.Bearer3GPP,
+			security.DirectionUplink, payload); err != nil {
+			return nil, fmt.Errorf("decrypt failed: %v", err)
+		}
+	}
+
+	err = msg.PlainNasDecode(&payload)
+	return msg, err
+}
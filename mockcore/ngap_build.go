@@ -0,0 +1,1108 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+// Copyright 2019 free5GC.org
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/omec-project/aper"
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/ngap"
+	"github.com/omec-project/ngap/ngapConvert"
+	"github.com/omec-project/ngap/ngapType"
+)
+
+const (
+	DEFAULT_5QI int64 = 9
+	// 5QI of the dedicated GBR QoS flow, conversational voice
+	DEDICATED_5QI int64 = 1
+	// Aggregate maximum bit rate advertised for the UE and its PDU sessions
+	DEFAULT_AMBR int64 = 1000000000
+)
+
+func BuildNGSetupResponse(cfg *AmfConfig) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
+	pdu.SuccessfulOutcome = new(ngapType.SuccessfulOutcome)
+
+	successfulOutcome := pdu.SuccessfulOutcome
+	successfulOutcome.ProcedureCode.Value = ngapType.ProcedureCodeNGSetup
+	successfulOutcome.Criticality.Value = ngapType.CriticalityPresentReject
+	successfulOutcome.Value.Present = ngapType.SuccessfulOutcomePresentNGSetupResponse
+	successfulOutcome.Value.NGSetupResponse = new(ngapType.NGSetupResponse)
+
+	nGSetupResponse := successfulOutcome.Value.NGSetupResponse
+	nGSetupResponseIEs := &nGSetupResponse.ProtocolIEs
+
+	// AMFName
+	ie := ngapType.NGSetupResponseIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFName
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.NGSetupResponseIEsPresentAMFName
+	ie.Value.AMFName = new(ngapType.AMFName)
+	ie.Value.AMFName.Value = cfg.Name
+	nGSetupResponseIEs.List = append(nGSetupResponseIEs.List, ie)
+
+	// ServedGUAMIList
+	ie = ngapType.NGSetupResponseIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDServedGUAMIList
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.NGSetupResponseIEsPresentServedGUAMIList
+	ie.Value.ServedGUAMIList = new(ngapType.ServedGUAMIList)
+
+	servedGUAMIItem := ngapType.ServedGUAMIItem{}
+	servedGUAMIItem.GUAMI = buildGuami(cfg)
+	ie.Value.ServedGUAMIList.List = append(ie.Value.ServedGUAMIList.List, servedGUAMIItem)
+	nGSetupResponseIEs.List = append(nGSetupResponseIEs.List, ie)
+
+	// RelativeAMFCapacity
+	ie = ngapType.NGSetupResponseIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRelativeAMFCapacity
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.NGSetupResponseIEsPresentRelativeAMFCapacity
+	ie.Value.RelativeAMFCapacity = new(ngapType.RelativeAMFCapacity)
+	ie.Value.RelativeAMFCapacity.Value = cfg.RelativeCapacity
+	nGSetupResponseIEs.List = append(nGSetupResponseIEs.List, ie)
+
+	// PLMNSupportList
+	ie = ngapType.NGSetupResponseIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPLMNSupportList
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.NGSetupResponseIEsPresentPLMNSupportList
+	ie.Value.PLMNSupportList = new(ngapType.PLMNSupportList)
+
+	pLMNSupportItem := ngapType.PLMNSupportItem{}
+	pLMNSupportItem.PLMNIdentity = ngapConvert.PlmnIdToNgap(cfg.PlmnId)
+	for _, snssai := range cfg.SNssaiList {
+		sliceSupportItem := ngapType.SliceSupportItem{}
+		sliceSupportItem.SNSSAI = ngapConvert.SNssaiToNgap(snssai)
+		pLMNSupportItem.SliceSupportList.List = append(pLMNSupportItem.SliceSupportList.List, sliceSupportItem)
+	}
+	ie.Value.PLMNSupportList.List = append(ie.Value.PLMNSupportList.List, pLMNSupportItem)
+	nGSetupResponseIEs.List = append(nGSetupResponseIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildNGSetupFailure builds an NG Setup Failure, carrying the Time To Wait IE
+// unless timeToWait is zero
+func BuildNGSetupFailure(causePresent int, cause aper.Enumerated, timeToWait int) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentUnsuccessfulOutcome
+	pdu.UnsuccessfulOutcome = new(ngapType.UnsuccessfulOutcome)
+
+	unsuccessfulOutcome := pdu.UnsuccessfulOutcome
+	unsuccessfulOutcome.ProcedureCode.Value = ngapType.ProcedureCodeNGSetup
+	unsuccessfulOutcome.Criticality.Value = ngapType.CriticalityPresentReject
+	unsuccessfulOutcome.Value.Present = ngapType.UnsuccessfulOutcomePresentNGSetupFailure
+	unsuccessfulOutcome.Value.NGSetupFailure = new(ngapType.NGSetupFailure)
+
+	nGSetupFailureIEs := &unsuccessfulOutcome.Value.NGSetupFailure.ProtocolIEs
+
+	// Cause
+	ie := ngapType.NGSetupFailureIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.NGSetupFailureIEsPresentCause
+	ngapCause, err := buildCause(causePresent, cause)
+	if err != nil {
+		return nil, err
+	}
+	ie.Value.Cause = ngapCause
+	nGSetupFailureIEs.List = append(nGSetupFailureIEs.List, ie)
+
+	// Time To Wait
+	if timeToWait != 0 {
+		ie = ngapType.NGSetupFailureIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDTimeToWait
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.NGSetupFailureIEsPresentTimeToWait
+		ie.Value.TimeToWait = new(ngapType.TimeToWait)
+		ie.Value.TimeToWait.Value = timeToWaitToEnum(timeToWait)
+		nGSetupFailureIEs.List = append(nGSetupFailureIEs.List, ie)
+	}
+
+	return ngap.Encoder(pdu)
+}
+
+// timeToWaitToEnum maps a validated time to wait in seconds to its NGAP value
+func timeToWaitToEnum(seconds int) aper.Enumerated {
+	switch seconds {
+	case 1:
+		return ngapType.TimeToWaitPresentV1s
+	case 2:
+		return ngapType.TimeToWaitPresentV2s
+	case 5:
+		return ngapType.TimeToWaitPresentV5s
+	case 10:
+		return ngapType.TimeToWaitPresentV10s
+	case 20:
+		return ngapType.TimeToWaitPresentV20s
+	default:
+		return ngapType.TimeToWaitPresentV60s
+	}
+}
+
+func BuildDownlinkNasTransport(ue *AmfUe, nasPdu []byte) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeDownlinkNASTransport
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentIgnore
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentDownlinkNASTransport
+	initiatingMessage.Value.DownlinkNASTransport = new(ngapType.DownlinkNASTransport)
+
+	downlinkNasTransportIEs := &initiatingMessage.Value.DownlinkNASTransport.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.DownlinkNASTransportIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.DownlinkNASTransportIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	downlinkNasTransportIEs.List = append(downlinkNasTransportIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.DownlinkNASTransportIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.DownlinkNASTransportIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	downlinkNasTransportIEs.List = append(downlinkNasTransportIEs.List, ie)
+
+	// NAS PDU
+	ie = ngapType.DownlinkNASTransportIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDNASPDU
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.DownlinkNASTransportIEsPresentNASPDU
+	ie.Value.NASPDU = new(ngapType.NASPDU)
+	ie.Value.NASPDU.Value = nasPdu
+	downlinkNasTransportIEs.List = append(downlinkNasTransportIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildInitialContextSetupRequest builds the Initial Context Setup Request
+// carrying nasPdu. When pduSessions is not empty the user plane resources of
+// those PDU sessions are set up as well, as required by a service request
+func BuildInitialContextSetupRequest(ue *AmfUe, cfg *AmfConfig, upfIp string,
+	nasPdu []byte, pduSessions []*PduSession) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeInitialContextSetup
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentInitialContextSetupRequest
+	initiatingMessage.Value.InitialContextSetupRequest = new(ngapType.InitialContextSetupRequest)
+
+	initialContextSetupRequestIEs := &initiatingMessage.Value.InitialContextSetupRequest.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// UE Aggregate Maximum Bit Rate (conditional: if pdu session resource setup)
+	if len(pduSessions) != 0 {
+		ie = ngapType.InitialContextSetupRequestIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDUEAggregateMaximumBitRate
+		ie.Criticality.Value = ngapType.CriticalityPresentReject
+		ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentUEAggregateMaximumBitRate
+		ie.Value.UEAggregateMaximumBitRate = new(ngapType.UEAggregateMaximumBitRate)
+		ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateUL.Value = DEFAULT_AMBR
+		ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateDL.Value = DEFAULT_AMBR
+		initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+	}
+
+	// GUAMI
+	ie = ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDGUAMI
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentGUAMI
+	guami := buildGuami(cfg)
+	ie.Value.GUAMI = &guami
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// PDU Session Resource Setup Request List
+	if len(pduSessions) != 0 {
+		ie = ngapType.InitialContextSetupRequestIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceSetupListCxtReq
+		ie.Criticality.Value = ngapType.CriticalityPresentReject
+		ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentPDUSessionResourceSetupListCxtReq
+		ie.Value.PDUSessionResourceSetupListCxtReq = new(ngapType.PDUSessionResourceSetupListCxtReq)
+		for _, sess := range pduSessions {
+			transfer, err := BuildPDUSessionResourceSetupRequestTransfer(sess, upfIp)
+			if err != nil {
+				return nil, err
+			}
+			item := ngapType.PDUSessionResourceSetupItemCxtReq{}
+			item.PDUSessionID.Value = int64(sess.PduSessId)
+			item.SNSSAI = ngapConvert.SNssaiToNgap(sess.Snssai)
+			item.PDUSessionResourceSetupRequestTransfer = transfer
+			ie.Value.PDUSessionResourceSetupListCxtReq.List =
+				append(ie.Value.PDUSessionResourceSetupListCxtReq.List, item)
+		}
+		initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+	}
+
+	// Allowed NSSAI
+	ie = ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAllowedNSSAI
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentAllowedNSSAI
+	ie.Value.AllowedNSSAI = new(ngapType.AllowedNSSAI)
+	for _, snssai := range cfg.SNssaiList {
+		allowedNSSAIItem := ngapType.AllowedNSSAIItem{}
+		allowedNSSAIItem.SNSSAI = ngapConvert.SNssaiToNgap(snssai)
+		ie.Value.AllowedNSSAI.List = append(ie.Value.AllowedNSSAI.List, allowedNSSAIItem)
+	}
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// UE Security Capabilities
+	ie = ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDUESecurityCapabilities
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentUESecurityCapabilities
+	ie.Value.UESecurityCapabilities = buildUESecurityCapabilities(ue)
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// Security Key
+	ie = ngapType.InitialContextSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDSecurityKey
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentSecurityKey
+	ie.Value.SecurityKey = new(ngapType.SecurityKey)
+	ie.Value.SecurityKey.Value = ngapConvert.ByteToBitString(ue.DerivateKgnb(), 256)
+	initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+
+	// NAS-PDU
+	if nasPdu != nil {
+		ie = ngapType.InitialContextSetupRequestIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDNASPDU
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.InitialContextSetupRequestIEsPresentNASPDU
+		ie.Value.NASPDU = new(ngapType.NASPDU)
+		ie.Value.NASPDU.Value = nasPdu
+		initialContextSetupRequestIEs.List = append(initialContextSetupRequestIEs.List, ie)
+	}
+
+	return ngap.Encoder(pdu)
+}
+
+func BuildPDUSessionResourceSetupRequest(ue *AmfUe, sess *PduSession, upfIp string,
+	nasPdu []byte) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodePDUSessionResourceSetup
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentPDUSessionResourceSetupRequest
+	initiatingMessage.Value.PDUSessionResourceSetupRequest = new(ngapType.PDUSessionResourceSetupRequest)
+
+	pDUSessionResourceSetupRequestIEs := &initiatingMessage.Value.PDUSessionResourceSetupRequest.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.PDUSessionResourceSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	pDUSessionResourceSetupRequestIEs.List = append(pDUSessionResourceSetupRequestIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.PDUSessionResourceSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	pDUSessionResourceSetupRequestIEs.List = append(pDUSessionResourceSetupRequestIEs.List, ie)
+
+	// PDU Session Resource Setup Request list
+	transfer, err := BuildPDUSessionResourceSetupRequestTransfer(sess, upfIp)
+	if err != nil {
+		return nil, err
+	}
+	item := ngapType.PDUSessionResourceSetupItemSUReq{}
+	item.PDUSessionID.Value = int64(sess.PduSessId)
+	item.PDUSessionNASPDU = new(ngapType.NASPDU)
+	item.PDUSessionNASPDU.Value = nasPdu
+	item.SNSSAI = ngapConvert.SNssaiToNgap(sess.Snssai)
+	item.PDUSessionResourceSetupRequestTransfer = transfer
+
+	ie = ngapType.PDUSessionResourceSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceSetupListSUReq
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestIEsPresentPDUSessionResourceSetupListSUReq
+	ie.Value.PDUSessionResourceSetupListSUReq = new(ngapType.PDUSessionResourceSetupListSUReq)
+	ie.Value.PDUSessionResourceSetupListSUReq.List = append(ie.Value.PDUSessionResourceSetupListSUReq.List, item)
+	pDUSessionResourceSetupRequestIEs.List = append(pDUSessionResourceSetupRequestIEs.List, ie)
+
+	// UE Aggregate Maximum Bit Rate
+	ie = ngapType.PDUSessionResourceSetupRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDUEAggregateMaximumBitRate
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestIEsPresentUEAggregateMaximumBitRate
+	ie.Value.UEAggregateMaximumBitRate = new(ngapType.UEAggregateMaximumBitRate)
+	ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateUL.Value = DEFAULT_AMBR
+	ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateDL.Value = DEFAULT_AMBR
+	pDUSessionResourceSetupRequestIEs.List = append(pDUSessionResourceSetupRequestIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildPDUSessionResourceSetupRequestTransfer builds the transfer container
+// normally provided by the SMF, holding the UPF tunnel endpoint and a single
+// non-GBR QoS flow
+func BuildPDUSessionResourceSetupRequestTransfer(sess *PduSession, upfIp string) ([]byte, error) {
+	data := ngapType.PDUSessionResourceSetupRequestTransfer{}
+
+	// PDU Session Aggregate Maximum Bit Rate
+	ie := ngapType.PDUSessionResourceSetupRequestTransferIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionAggregateMaximumBitRate
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestTransferIEsPresentPDUSessionAggregateMaximumBitRate
+	ie.Value.PDUSessionAggregateMaximumBitRate = new(ngapType.PDUSessionAggregateMaximumBitRate)
+	ie.Value.PDUSessionAggregateMaximumBitRate.PDUSessionAggregateMaximumBitRateUL.Value = DEFAULT_AMBR
+	ie.Value.PDUSessionAggregateMaximumBitRate.PDUSessionAggregateMaximumBitRateDL.Value = DEFAULT_AMBR
+	data.ProtocolIEs.List = append(data.ProtocolIEs.List, ie)
+
+	// UL NG-U UP TNL Information
+	ie = ngapType.PDUSessionResourceSetupRequestTransferIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDULNGUUPTNLInformation
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestTransferIEsPresentULNGUUPTNLInformation
+	ie.Value.ULNGUUPTNLInformation = new(ngapType.UPTransportLayerInformation)
+
+	upInfo := ie.Value.ULNGUUPTNLInformation
+	upInfo.Present = ngapType.UPTransportLayerInformationPresentGTPTunnel
+	upInfo.GTPTunnel = new(ngapType.GTPTunnel)
+	teidOct := make([]byte, 4)
+	binary.BigEndian.PutUint32(teidOct, sess.UlTeid)
+	upInfo.GTPTunnel.GTPTEID.Value = teidOct
+	upInfo.GTPTunnel.TransportLayerAddress = ngapConvert.IPAddressToNgap(upfIp, "")
+	data.ProtocolIEs.List = append(data.ProtocolIEs.List, ie)
+
+	// PDU Session Type
+	ie = ngapType.PDUSessionResourceSetupRequestTransferIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionType
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestTransferIEsPresentPDUSessionType
+	ie.Value.PDUSessionType = new(ngapType.PDUSessionType)
+	switch sess.PduSessType {
+	case nasMessage.PDUSessionTypeIPv6:
+		ie.Value.PDUSessionType.Value = ngapType.PDUSessionTypePresentIpv6
+	case nasMessage.PDUSessionTypeIPv4IPv6:
+		ie.Value.PDUSessionType.Value = ngapType.PDUSessionTypePresentIpv4v6
+	default:
+		ie.Value.PDUSessionType.Value = ngapType.PDUSessionTypePresentIpv4
+	}
+	data.ProtocolIEs.List = append(data.ProtocolIEs.List, ie)
+
+	// QoS Flow Setup Request List
+	ie = ngapType.PDUSessionResourceSetupRequestTransferIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDQosFlowSetupRequestList
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceSetupRequestTransferIEsPresentQosFlowSetupRequestList
+	ie.Value.QosFlowSetupRequestList = new(ngapType.QosFlowSetupRequestList)
+
+	qosItem := ngapType.QosFlowSetupRequestItem{}
+	qosItem.QosFlowIdentifier.Value = int64(DEFAULT_QFI)
+	qosChar := &qosItem.QosFlowLevelQosParameters.QosCharacteristics
+	qosChar.Present = ngapType.QosCharacteristicsPresentNonDynamic5QI
+	qosChar.NonDynamic5QI = new(ngapType.NonDynamic5QIDescriptor)
+	qosChar.NonDynamic5QI.FiveQI.Value = DEFAULT_5QI
+	arp := &qosItem.QosFlowLevelQosParameters.AllocationAndRetentionPriority
+	arp.PriorityLevelARP.Value = 8
+	arp.PreEmptionCapability.Value = ngapType.PreEmptionCapabilityPresentShallNotTriggerPreEmption
+	arp.PreEmptionVulnerability.Value = ngapType.PreEmptionVulnerabilityPresentNotPreEmptable
+	ie.Value.QosFlowSetupRequestList.List = append(ie.Value.QosFlowSetupRequestList.List, qosItem)
+	data.ProtocolIEs.List = append(data.ProtocolIEs.List, ie)
+
+	buf, err := aper.MarshalWithParams(data, "valueExt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pdu session resource setup request transfer: %v", err)
+	}
+	return buf, nil
+}
+
+func BuildPDUSessionResourceReleaseCommand(ue *AmfUe, pduSessionId uint8, nasPdu []byte) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodePDUSessionResourceRelease
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentPDUSessionResourceReleaseCommand
+	initiatingMessage.Value.PDUSessionResourceReleaseCommand = new(ngapType.PDUSessionResourceReleaseCommand)
+
+	releaseCommandIEs := &initiatingMessage.Value.PDUSessionResourceReleaseCommand.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.PDUSessionResourceReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceReleaseCommandIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	releaseCommandIEs.List = append(releaseCommandIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.PDUSessionResourceReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceReleaseCommandIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	releaseCommandIEs.List = append(releaseCommandIEs.List, ie)
+
+	// NAS-PDU
+	ie = ngapType.PDUSessionResourceReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDNASPDU
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.PDUSessionResourceReleaseCommandIEsPresentNASPDU
+	ie.Value.NASPDU = new(ngapType.NASPDU)
+	ie.Value.NASPDU.Value = nasPdu
+	releaseCommandIEs.List = append(releaseCommandIEs.List, ie)
+
+	// PDU Session Resource To Release List
+	transfer := ngapType.PDUSessionResourceReleaseCommandTransfer{}
+	transfer.Cause.Present = ngapType.CausePresentNas
+	transfer.Cause.Nas = new(ngapType.CauseNas)
+	transfer.Cause.Nas.Value = ngapType.CauseNasPresentNormalRelease
+	buf, err := aper.MarshalWithParams(transfer, "valueExt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pdu session resource release command transfer: %v", err)
+	}
+
+	item := ngapType.PDUSessionResourceToReleaseItemRelCmd{}
+	item.PDUSessionID.Value = int64(pduSessionId)
+	item.PDUSessionResourceReleaseCommandTransfer = buf
+
+	ie = ngapType.PDUSessionResourceReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceToReleaseListRelCmd
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceReleaseCommandIEsPresentPDUSessionResourceToReleaseListRelCmd
+	ie.Value.PDUSessionResourceToReleaseListRelCmd = new(ngapType.PDUSessionResourceToReleaseListRelCmd)
+	ie.Value.PDUSessionResourceToReleaseListRelCmd.List =
+		append(ie.Value.PDUSessionResourceToReleaseListRelCmd.List, item)
+	releaseCommandIEs.List = append(releaseCommandIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+func BuildPDUSessionResourceModifyRequest(ue *AmfUe, pduSessionId uint8, nasPdu,
+	transfer []byte) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodePDUSessionResourceModify
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentPDUSessionResourceModifyRequest
+	initiatingMessage.Value.PDUSessionResourceModifyRequest = new(ngapType.PDUSessionResourceModifyRequest)
+
+	modifyRequestIEs := &initiatingMessage.Value.PDUSessionResourceModifyRequest.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.PDUSessionResourceModifyRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceModifyRequestIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	modifyRequestIEs.List = append(modifyRequestIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.PDUSessionResourceModifyRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceModifyRequestIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	modifyRequestIEs.List = append(modifyRequestIEs.List, ie)
+
+	// PDU Session Resource Modify Request List
+	item := ngapType.PDUSessionResourceModifyItemModReq{}
+	item.PDUSessionID.Value = int64(pduSessionId)
+	item.NASPDU = new(ngapType.NASPDU)
+	item.NASPDU.Value = nasPdu
+	item.PDUSessionResourceModifyRequestTransfer = transfer
+
+	ie = ngapType.PDUSessionResourceModifyRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceModifyListModReq
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.PDUSessionResourceModifyRequestIEsPresentPDUSessionResourceModifyListModReq
+	ie.Value.PDUSessionResourceModifyListModReq = new(ngapType.PDUSessionResourceModifyListModReq)
+	ie.Value.PDUSessionResourceModifyListModReq.List =
+		append(ie.Value.PDUSessionResourceModifyListModReq.List, item)
+	modifyRequestIEs.List = append(modifyRequestIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildPDUSessionResourceModifyRequestTransfer builds the transfer container
+// normally provided by the SMF, adding, modifying or releasing the dedicated
+// GBR QoS flow. The bit rates are in kbps
+func BuildPDUSessionResourceModifyRequestTransfer(qosFlowOp int, gfbr,
+	mfbr uint16) ([]byte, error) {
+	data := ngapType.PDUSessionResourceModifyRequestTransfer{}
+
+	ie := ngapType.PDUSessionResourceModifyRequestTransferIEs{}
+	if qosFlowOp == QOS_FLOW_RELEASE {
+		// QoS Flow to Release List
+		ie.Id.Value = ngapType.ProtocolIEIDQosFlowToReleaseList
+		ie.Criticality.Value = ngapType.CriticalityPresentReject
+		ie.Value.Present = ngapType.PDUSessionResourceModifyRequestTransferIEsPresentQosFlowToReleaseList
+		ie.Value.QosFlowToReleaseList = new(ngapType.QosFlowListWithCause)
+
+		qosItem := ngapType.QosFlowWithCauseItem{}
+		qosItem.QosFlowIdentifier.Value = int64(DEDICATED_QFI)
+		qosItem.Cause.Present = ngapType.CausePresentNas
+		qosItem.Cause.Nas = new(ngapType.CauseNas)
+		qosItem.Cause.Nas.Value = ngapType.CauseNasPresentNormalRelease
+		ie.Value.QosFlowToReleaseList.List = append(ie.Value.QosFlowToReleaseList.List, qosItem)
+	} else {
+		// QoS Flow Add or Modify Request List
+		ie.Id.Value = ngapType.ProtocolIEIDQosFlowAddOrModifyRequestList
+		ie.Criticality.Value = ngapType.CriticalityPresentReject
+		ie.Value.Present = ngapType.PDUSessionResourceModifyRequestTransferIEsPresentQosFlowAddOrModifyRequestList
+		ie.Value.QosFlowAddOrModifyRequestList = new(ngapType.QosFlowAddOrModifyRequestList)
+
+		qosItem := ngapType.QosFlowAddOrModifyRequestItem{}
+		qosItem.QosFlowIdentifier.Value = int64(DEDICATED_QFI)
+		qosItem.QosFlowLevelQosParameters = new(ngapType.QosFlowLevelQosParameters)
+		qosChar := &qosItem.QosFlowLevelQosParameters.QosCharacteristics
+		qosChar.Present = ngapType.QosCharacteristicsPresentNonDynamic5QI
+		qosChar.NonDynamic5QI = new(ngapType.NonDynamic5QIDescriptor)
+		qosChar.NonDynamic5QI.FiveQI.Value = DEDICATED_5QI
+		arp := &qosItem.QosFlowLevelQosParameters.AllocationAndRetentionPriority
+		arp.PriorityLevelARP.Value = 2
+		arp.PreEmptionCapability.Value = ngapType.PreEmptionCapabilityPresentShallNotTriggerPreEmption
+		arp.PreEmptionVulnerability.Value = ngapType.PreEmptionVulnerabilityPresentNotPreEmptable
+		gbr := new(ngapType.GBRQosInformation)
+		gbr.GuaranteedFlowBitRateDL.Value = int64(gfbr) * 1000
+		gbr.GuaranteedFlowBitRateUL.Value = int64(gfbr) * 1000
+		gbr.MaximumFlowBitRateDL.Value = int64(mfbr) * 1000
+		gbr.MaximumFlowBitRateUL.Value = int64(mfbr) * 1000
+		qosItem.QosFlowLevelQosParameters.GBRQosInformation = gbr
+		ie.Value.QosFlowAddOrModifyRequestList.List =
+			append(ie.Value.QosFlowAddOrModifyRequestList.List, qosItem)
+	}
+	data.ProtocolIEs.List = append(data.ProtocolIEs.List, ie)
+
+	buf, err := aper.MarshalWithParams(data, "valueExt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pdu session resource modify request transfer: %v", err)
+	}
+	return buf, nil
+}
+
+// BuildUEContextReleaseCommand builds the release of the NG connection
+// identified by the UE NGAP IDs, which may not be the current NG connection of
+// the UE once it has been handed over
+func BuildUEContextReleaseCommand(amfUeNgapId, ranUeNgapId int64, causePresent int,
+	cause aper.Enumerated) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeUEContextRelease
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentUEContextReleaseCommand
+	initiatingMessage.Value.UEContextReleaseCommand = new(ngapType.UEContextReleaseCommand)
+
+	ueContextReleaseCommandIEs := &initiatingMessage.Value.UEContextReleaseCommand.ProtocolIEs
+
+	// UE NGAP IDs
+	ie := ngapType.UEContextReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDUENGAPIDs
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.UEContextReleaseCommandIEsPresentUENGAPIDs
+	ie.Value.UENGAPIDs = new(ngapType.UENGAPIDs)
+	ie.Value.UENGAPIDs.Present = ngapType.UENGAPIDsPresentUENGAPIDPair
+	ie.Value.UENGAPIDs.UENGAPIDPair = new(ngapType.UENGAPIDPair)
+	ie.Value.UENGAPIDs.UENGAPIDPair.AMFUENGAPID.Value = amfUeNgapId
+	ie.Value.UENGAPIDs.UENGAPIDPair.RANUENGAPID.Value = ranUeNgapId
+	ueContextReleaseCommandIEs.List = append(ueContextReleaseCommandIEs.List, ie)
+
+	// Cause
+	ie = ngapType.UEContextReleaseCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.UEContextReleaseCommandIEsPresentCause
+	ngapCause, err := buildCause(causePresent, cause)
+	if err != nil {
+		return nil, err
+	}
+	ie.Value.Cause = ngapCause
+	ueContextReleaseCommandIEs.List = append(ueContextReleaseCommandIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildNGReset builds an AMF initiated NG Reset of the NG connections of the
+// UEs
+func BuildNGReset(ues []*AmfUe, causePresent int, cause aper.Enumerated) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeNGReset
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentNGReset
+	initiatingMessage.Value.NGReset = new(ngapType.NGReset)
+
+	ngResetIEs := &initiatingMessage.Value.NGReset.ProtocolIEs
+
+	// Cause
+	ie := ngapType.NGResetIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.NGResetIEsPresentCause
+	ngapCause, err := buildCause(causePresent, cause)
+	if err != nil {
+		return nil, err
+	}
+	ie.Value.Cause = ngapCause
+	ngResetIEs.List = append(ngResetIEs.List, ie)
+
+	// Reset Type, part of NG interface
+	ie = ngapType.NGResetIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDResetType
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.NGResetIEsPresentResetType
+	ie.Value.ResetType = new(ngapType.ResetType)
+	ie.Value.ResetType.Present = ngapType.ResetTypePresentPartOfNGInterface
+	ie.Value.ResetType.PartOfNGInterface = new(ngapType.UEAssociatedLogicalNGConnectionList)
+	for _, ue := range ues {
+		item := ngapType.UEAssociatedLogicalNGConnectionItem{}
+		item.AMFUENGAPID = &ngapType.AMFUENGAPID{Value: ue.AmfUeNgapId}
+		item.RANUENGAPID = &ngapType.RANUENGAPID{Value: ue.RanUeNgapId}
+		ie.Value.ResetType.PartOfNGInterface.List =
+			append(ie.Value.ResetType.PartOfNGInterface.List, item)
+	}
+	ngResetIEs.List = append(ngResetIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildNGResetAcknowledge builds the NG Reset Acknowledge, listing the NG
+// connections reset unless the whole NG interface was reset
+func BuildNGResetAcknowledge(lst *ngapType.UEAssociatedLogicalNGConnectionList) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
+	pdu.SuccessfulOutcome = new(ngapType.SuccessfulOutcome)
+
+	successfulOutcome := pdu.SuccessfulOutcome
+	successfulOutcome.ProcedureCode.Value = ngapType.ProcedureCodeNGReset
+	successfulOutcome.Criticality.Value = ngapType.CriticalityPresentReject
+	successfulOutcome.Value.Present = ngapType.SuccessfulOutcomePresentNGResetAcknowledge
+	successfulOutcome.Value.NGResetAcknowledge = new(ngapType.NGResetAcknowledge)
+
+	ngResetAcknowledgeIEs := &successfulOutcome.Value.NGResetAcknowledge.ProtocolIEs
+
+	// UE-associated Logical NG-connection List
+	if lst != nil {
+		ie := ngapType.NGResetAcknowledgeIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDUEAssociatedLogicalNGConnectionList
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.NGResetAcknowledgeIEsPresentUEAssociatedLogicalNGConnectionList
+		ie.Value.UEAssociatedLogicalNGConnectionList = lst
+		ngResetAcknowledgeIEs.List = append(ngResetAcknowledgeIEs.List, ie)
+	}
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildErrorIndication builds the Error Indication reporting a UE associated
+// message received for an unknown NG connection
+func BuildErrorIndication(amfUeNgapId *ngapType.AMFUENGAPID,
+	ranUeNgapId *ngapType.RANUENGAPID, causePresent int,
+	cause aper.Enumerated) ([]byte, error) {
+
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeErrorIndication
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentIgnore
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentErrorIndication
+	initiatingMessage.Value.ErrorIndication = new(ngapType.ErrorIndication)
+
+	errorIndicationIEs := &initiatingMessage.Value.ErrorIndication.ProtocolIEs
+
+	// AMF UE NGAP ID
+	if amfUeNgapId != nil {
+		ie := ngapType.ErrorIndicationIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.ErrorIndicationIEsPresentAMFUENGAPID
+		ie.Value.AMFUENGAPID = amfUeNgapId
+		errorIndicationIEs.List = append(errorIndicationIEs.List, ie)
+	}
+
+	// RAN UE NGAP ID
+	if ranUeNgapId != nil {
+		ie := ngapType.ErrorIndicationIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.ErrorIndicationIEsPresentRANUENGAPID
+		ie.Value.RANUENGAPID = ranUeNgapId
+		errorIndicationIEs.List = append(errorIndicationIEs.List, ie)
+	}
+
+	// Cause
+	ngapCause, err := buildCause(causePresent, cause)
+	if err != nil {
+		return nil, err
+	}
+	ie := ngapType.ErrorIndicationIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.ErrorIndicationIEsPresentCause
+	ie.Value.Cause = ngapCause
+	errorIndicationIEs.List = append(errorIndicationIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildHandoverRequest asks the target gNB to allocate resources for the UE
+// handed over to it. The PDU sessions are set up with the same transfer as
+// the PDU Session Resource Setup Request
+func BuildHandoverRequest(ue *AmfUe, cfg *AmfConfig, upfIp string,
+	pduSessions []*PduSession,
+	container *ngapType.SourceToTargetTransparentContainer) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
+	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
+
+	initiatingMessage := pdu.InitiatingMessage
+	initiatingMessage.ProcedureCode.Value = ngapType.ProcedureCodeHandoverResourceAllocation
+	initiatingMessage.Criticality.Value = ngapType.CriticalityPresentReject
+	initiatingMessage.Value.Present = ngapType.InitiatingMessagePresentHandoverRequest
+	initiatingMessage.Value.HandoverRequest = new(ngapType.HandoverRequest)
+
+	handoverRequestIEs := &initiatingMessage.Value.HandoverRequest.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.Handover.TargetAmfUeNgapId
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// Handover Type
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDHandoverType
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentHandoverType
+	ie.Value.HandoverType = new(ngapType.HandoverType)
+	ie.Value.HandoverType.Value = ngapType.HandoverTypePresentIntra5gs
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// Cause
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentCause
+	ngapCause, err := buildCause(ngapType.CausePresentRadioNetwork,
+		ngapType.CauseRadioNetworkPresentHandoverDesirableForRadioReason)
+	if err != nil {
+		return nil, err
+	}
+	ie.Value.Cause = ngapCause
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// UE Aggregate Maximum Bit Rate
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDUEAggregateMaximumBitRate
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentUEAggregateMaximumBitRate
+	ie.Value.UEAggregateMaximumBitRate = new(ngapType.UEAggregateMaximumBitRate)
+	ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateUL.Value = DEFAULT_AMBR
+	ie.Value.UEAggregateMaximumBitRate.UEAggregateMaximumBitRateDL.Value = DEFAULT_AMBR
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// UE Security Capabilities
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDUESecurityCapabilities
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentUESecurityCapabilities
+	ie.Value.UESecurityCapabilities = buildUESecurityCapabilities(ue)
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// Security Context
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDSecurityContext
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentSecurityContext
+	ie.Value.SecurityContext = new(ngapType.SecurityContext)
+	ie.Value.SecurityContext.NextHopChainingCount.Value = int64(ue.Ncc)
+	ie.Value.SecurityContext.NextHopNH.Value = ngapConvert.ByteToBitString(ue.Nh, 256)
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// PDU Session Resource Setup List
+	if len(pduSessions) != 0 {
+		ie = ngapType.HandoverRequestIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceSetupListHOReq
+		ie.Criticality.Value = ngapType.CriticalityPresentReject
+		ie.Value.Present = ngapType.HandoverRequestIEsPresentPDUSessionResourceSetupListHOReq
+		ie.Value.PDUSessionResourceSetupListHOReq = new(ngapType.PDUSessionResourceSetupListHOReq)
+		for _, sess := range pduSessions {
+			transfer, err := BuildPDUSessionResourceSetupRequestTransfer(sess, upfIp)
+			if err != nil {
+				return nil, err
+			}
+			item := ngapType.PDUSessionResourceSetupItemHOReq{}
+			item.PDUSessionID.Value = int64(sess.PduSessId)
+			item.SNSSAI = ngapConvert.SNssaiToNgap(sess.Snssai)
+			item.HandoverRequestTransfer = transfer
+			ie.Value.PDUSessionResourceSetupListHOReq.List =
+				append(ie.Value.PDUSessionResourceSetupListHOReq.List, item)
+		}
+		handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+	}
+
+	// Allowed NSSAI
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAllowedNSSAI
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentAllowedNSSAI
+	ie.Value.AllowedNSSAI = new(ngapType.AllowedNSSAI)
+	for _, snssai := range cfg.SNssaiList {
+		allowedNSSAIItem := ngapType.AllowedNSSAIItem{}
+		allowedNSSAIItem.SNSSAI = ngapConvert.SNssaiToNgap(snssai)
+		ie.Value.AllowedNSSAI.List = append(ie.Value.AllowedNSSAI.List, allowedNSSAIItem)
+	}
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// Source to Target Transparent Container, passed on from the source gNB
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDSourceToTargetTransparentContainer
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentSourceToTargetTransparentContainer
+	ie.Value.SourceToTargetTransparentContainer = container
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	// GUAMI
+	ie = ngapType.HandoverRequestIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDGUAMI
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverRequestIEsPresentGUAMI
+	guami := buildGuami(cfg)
+	ie.Value.GUAMI = &guami
+	handoverRequestIEs.List = append(handoverRequestIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildHandoverCommand tells the source gNB the handover has been prepared at
+// the target gNB
+func BuildHandoverCommand(ue *AmfUe,
+	container *ngapType.TargetToSourceTransparentContainer) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
+	pdu.SuccessfulOutcome = new(ngapType.SuccessfulOutcome)
+
+	successfulOutcome := pdu.SuccessfulOutcome
+	successfulOutcome.ProcedureCode.Value = ngapType.ProcedureCodeHandoverPreparation
+	successfulOutcome.Criticality.Value = ngapType.CriticalityPresentReject
+	successfulOutcome.Value.Present = ngapType.SuccessfulOutcomePresentHandoverCommand
+	successfulOutcome.Value.HandoverCommand = new(ngapType.HandoverCommand)
+
+	handoverCommandIEs := &successfulOutcome.Value.HandoverCommand.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.HandoverCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverCommandIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = ue.AmfUeNgapId
+	handoverCommandIEs.List = append(handoverCommandIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.HandoverCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverCommandIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ue.RanUeNgapId
+	handoverCommandIEs.List = append(handoverCommandIEs.List, ie)
+
+	// Handover Type
+	ie = ngapType.HandoverCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDHandoverType
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverCommandIEsPresentHandoverType
+	ie.Value.HandoverType = new(ngapType.HandoverType)
+	ie.Value.HandoverType.Value = ngapType.HandoverTypePresentIntra5gs
+	handoverCommandIEs.List = append(handoverCommandIEs.List, ie)
+
+	// PDU Session Resource Handover List, no data is forwarded between the
+	// gNBs
+	if len(ue.Handover.Admitted) != 0 {
+		transfer, err := aper.MarshalWithParams(ngapType.HandoverCommandTransfer{}, "valueExt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode handover command transfer: %v", err)
+		}
+		ie = ngapType.HandoverCommandIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceHandoverList
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.HandoverCommandIEsPresentPDUSessionResourceHandoverList
+		ie.Value.PDUSessionResourceHandoverList = new(ngapType.PDUSessionResourceHandoverList)
+		for _, admitted := range ue.Handover.Admitted {
+			item := ngapType.PDUSessionResourceHandoverItem{}
+			item.PDUSessionID = admitted.PDUSessionID
+			item.HandoverCommandTransfer = transfer
+			ie.Value.PDUSessionResourceHandoverList.List =
+				append(ie.Value.PDUSessionResourceHandoverList.List, item)
+		}
+		handoverCommandIEs.List = append(handoverCommandIEs.List, ie)
+	}
+
+	// Target to Source Transparent Container, passed on from the target gNB
+	ie = ngapType.HandoverCommandIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDTargetToSourceTransparentContainer
+	ie.Criticality.Value = ngapType.CriticalityPresentReject
+	ie.Value.Present = ngapType.HandoverCommandIEsPresentTargetToSourceTransparentContainer
+	ie.Value.TargetToSourceTransparentContainer = container
+	handoverCommandIEs.List = append(handoverCommandIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// BuildHandoverPreparationFailure tells the source gNB the handover could not
+// be prepared
+func BuildHandoverPreparationFailure(amfUeNgapId, ranUeNgapId int64,
+	causePresent int, cause aper.Enumerated) ([]byte, error) {
+	var pdu ngapType.NGAPPDU
+	pdu.Present = ngapType.NGAPPDUPresentUnsuccessfulOutcome
+	pdu.UnsuccessfulOutcome = new(ngapType.UnsuccessfulOutcome)
+
+	unsuccessfulOutcome := pdu.UnsuccessfulOutcome
+	unsuccessfulOutcome.ProcedureCode.Value = ngapType.ProcedureCodeHandoverPreparation
+	unsuccessfulOutcome.Criticality.Value = ngapType.CriticalityPresentReject
+	unsuccessfulOutcome.Value.Present = ngapType.UnsuccessfulOutcomePresentHandoverPreparationFailure
+	unsuccessfulOutcome.Value.HandoverPreparationFailure = new(ngapType.HandoverPreparationFailure)
+
+	failureIEs := &unsuccessfulOutcome.Value.HandoverPreparationFailure.ProtocolIEs
+
+	// AMF UE NGAP ID
+	ie := ngapType.HandoverPreparationFailureIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDAMFUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.HandoverPreparationFailureIEsPresentAMFUENGAPID
+	ie.Value.AMFUENGAPID = new(ngapType.AMFUENGAPID)
+	ie.Value.AMFUENGAPID.Value = amfUeNgapId
+	failureIEs.List = append(failureIEs.List, ie)
+
+	// RAN UE NGAP ID
+	ie = ngapType.HandoverPreparationFailureIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDRANUENGAPID
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.HandoverPreparationFailureIEsPresentRANUENGAPID
+	ie.Value.RANUENGAPID = new(ngapType.RANUENGAPID)
+	ie.Value.RANUENGAPID.Value = ranUeNgapId
+	failureIEs.List = append(failureIEs.List, ie)
+
+	// Cause
+	ie = ngapType.HandoverPreparationFailureIEs{}
+	ie.Id.Value = ngapType.ProtocolIEIDCause
+	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+	ie.Value.Present = ngapType.HandoverPreparationFailureIEsPresentCause
+	ngapCause, err := buildCause(causePresent, cause)
+	if err != nil {
+		return nil, err
+	}
+	ie.Value.Cause = ngapCause
+	failureIEs.List = append(failureIEs.List, ie)
+
+	return ngap.Encoder(pdu)
+}
+
+// buildUESecurityCapabilities provides the NR algorithms supported by the UE
+// to the gNB
+func buildUESecurityCapabilities(ue *AmfUe) *ngapType.UESecurityCapabilities {
+	ueSecurityCapabilities := new(ngapType.UESecurityCapabilities)
+	nrEncryptionAlgorithm := []byte{0x00, 0x00}
+	nrEncryptionAlgorithm[0] |= ue.UESecurityCapability.GetEA1_128_5G() << 7
+	nrEncryptionAlgorithm[0] |= ue.UESecurityCapability.GetEA2_128_5G() << 6
+	nrEncryptionAlgorithm[0] |= ue.UESecurityCapability.GetEA3_128_5G() << 5
+	ueSecurityCapabilities.NRencryptionAlgorithms.Value =
+		ngapConvert.ByteToBitString(nrEncryptionAlgorithm, 16)
+
+	nrIntegrityAlgorithm := []byte{0x00, 0x00}
+	nrIntegrityAlgorithm[0] |= ue.UESecurityCapability.GetIA1_128_5G() << 7
+	nrIntegrityAlgorithm[0] |= ue.UESecurityCapability.GetIA2_128_5G() << 6
+	nrIntegrityAlgorithm[0] |= ue.UESecurityCapability.GetIA3_128_5G() << 5
+	ueSecurityCapabilities.NRintegrityProtectionAlgorithms.Value =
+		ngapConvert.ByteToBitString(nrIntegrityAlgorithm, 16)
+
+	// only NR algorithms are supported
+	ueSecurityCapabilities.EUTRAencryptionAlgorithms.Value =
+		ngapConvert.ByteToBitString([]byte{0x00, 0x00}, 16)
+	ueSecurityCapabilities.EUTRAintegrityProtectionAlgorithms.Value =
+		ngapConvert.ByteToBitString([]byte{0x00, 0x00}, 16)
+	return ueSecurityCapabilities
+}
+
+func buildGuami(cfg *AmfConfig) (guami ngapType.GUAMI) {
+	guami.PLMNIdentity = ngapConvert.PlmnIdToNgap(cfg.PlmnId)
+	guami.AMFRegionID.Value, guami.AMFSetID.Value, guami.AMFPointer.Value =
+		ngapConvert.AmfIdToNgap(cfg.AmfId)
+	return
+}
+
+func buildCause(causePresent int, cause aper.Enumerated) (*ngapType.Cause, error) {
+	ngapCause := &ngapType.Cause{Present: causePresent}
+	switch causePresent {
+	case ngapType.CausePresentRadioNetwork:
+		ngapCause.RadioNetwork = &ngapType.CauseRadioNetwork{Value: cause}
+	case ngapType.CausePresentTransport:
+		ngapCause.Transport = &ngapType.CauseTransport{Value: cause}
+	case ngapType.CausePresentNas:
+		ngapCause.Nas = &ngapType.CauseNas{Value: cause}
+	case ngapType.CausePresentProtocol:
+		ngapCause.Protocol = &ngapType.CauseProtocol{Value: cause}
+	case ngapType.CausePresentMisc:
+		ngapCause.Misc = &ngapType.CauseMisc{Value: cause}
+	default:
+		return nil, fmt.Errorf("unknown cause present:%v", causePresent)
+	}
+	return ngapCause, nil
+}
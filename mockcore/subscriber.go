@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/omec-project/UeauCommon"
+	"github.com/omec-project/milenage"
+)
+
+// Authentication Management Field with the separation bit set
+var authAmf = []byte{0x80, 0x00}
+
+type Subscriber struct {
+	Imsi        string
+	Key         []byte
+	Opc         []byte
+	Sqn         []byte
+	NwTriggered *NwTriggered
+	Reject      *Reject
+
+	// number of registration and service requests rejected so far
+	regRejects     int
+	serviceRejects int
+}
+
+// AuthVector holds a 5G AKA authentication vector along with the key derived
+// from it for the serving network
+type AuthVector struct {
+	Rand     []byte
+	Autn     []byte
+	XresStar []byte
+	Kseaf    []byte
+}
+
+// SubscriberDb holds the subscribers known to the mock core indexed by IMSI
+type SubscriberDb struct {
+	subs map[string]*Subscriber
+	mu   sync.Mutex
+}
+
+func NewSubscriberDb(cfgs []*SubscriberConfig) (*SubscriberDb, error) {
+	db := &SubscriberDb{subs: make(map[string]*Subscriber)}
+	for _, cfg := range cfgs {
+		startImsi, err := strconv.ParseUint(cfg.StartImsi, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid startImsi:%v", cfg.StartImsi)
+		}
+		key, _ := hex.DecodeString(cfg.Key)
+		opc, _ := hex.DecodeString(cfg.Opc)
+		sqn, _ := hex.DecodeString(cfg.SequenceNumber)
+		for count := 0; count < cfg.UeCount; count++ {
+			imsi := fmt.Sprintf("%0*d", len(cfg.StartImsi), startImsi+uint64(count))
+			sub := &Subscriber{
+				Imsi:        imsi,
+				Key:         key,
+				Opc:         opc,
+				Sqn:         append([]byte{}, sqn...),
+				NwTriggered: cfg.NwTriggered,
+				Reject:      cfg.Reject,
+			}
+			db.subs[imsi] = sub
+		}
+	}
+	return db, nil
+}
+
+func (db *SubscriberDb) GetSubscriber(imsi string) *Subscriber {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.subs[imsi]
+}
+
+// RegistrationRejectCause returns the cause with which the next registration
+// request of the subscriber is rejected, 0 if it is not to be rejected
+func (db *SubscriberDb) RegistrationRejectCause(sub *Subscriber) uint8 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rej := sub.Reject
+	if rej == nil || rej.RegistrationCause == 0 ||
+		(rej.Count != 0 && sub.regRejects >= rej.Count) {
+		return 0
+	}
+	sub.regRejects++
+	return rej.RegistrationCause
+}
+
+// ServiceRejectCause returns the cause with which the next service request
+// of the subscriber is rejected, 0 if it is not to be rejected
+func (db *SubscriberDb) ServiceRejectCause(sub *Subscriber) uint8 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rej := sub.Reject
+	if rej == nil || rej.ServiceCause == 0 ||
+		(rej.Count != 0 && sub.serviceRejects >= rej.Count) {
+		return 0
+	}
+	sub.serviceRejects++
+	return rej.ServiceCause
+}
+
+// GenerateAuthVector generates a 5G AKA authentication vector as per
+// TS 33.501 Section 6.1.3.2 after incrementing the sequence number of the
+// subscriber
+func (db *SubscriberDb) GenerateAuthVector(sub *Subscriber, snName string) (*AuthVector, error) {
+	db.mu.Lock()
+	incrementSqn(sub.Sqn)
+	sqn := append([]byte{}, sub.Sqn...)
+	db.mu.Unlock()
+
+	av := &AuthVector{Rand: make([]byte, 16)}
+	if _, err := rand.Read(av.Rand); err != nil {
+		return nil, fmt.Errorf("failed to generate rand: %v", err)
+	}
+
+	macA, macS := make([]byte, 8), make([]byte, 8)
+	ck, ik := make([]byte, 16), make([]byte, 16)
+	res := make([]byte, 8)
+	ak, akStar := make([]byte, 6), make([]byte, 6)
+
+	err := milenage.F1(sub.Opc, sub.Key, av.Rand, sqn, authAmf, macA, macS)
+	if err != nil {
+		return nil, fmt.Errorf("milenage F1 failed: %v", err)
+	}
+	err = milenage.F2345(sub.Opc, sub.Key, av.Rand, res, ck, ik, ak, akStar)
+	if err != nil {
+		return nil, fmt.Errorf("milenage F2345 failed: %v", err)
+	}
+
+	// AUTN = SQN xor AK || AMF || MAC-A
+	sqnXorAk := make([]byte, 6)
+	for i := range sqn {
+		sqnXorAk[i] = sqn[i] ^ ak[i]
+	}
+	av.Autn = append(append(append([]byte{}, sqnXorAk...), authAmf...), macA...)
+
+	key := append(ck, ik...)
+	P0 := []byte(snName)
+	kdfVal := UeauCommon.GetKDFValue(key, UeauCommon.FC_FOR_RES_STAR_XRES_STAR_DERIVATION,
+		P0, UeauCommon.KDFLen(P0), av.Rand, UeauCommon.KDFLen(av.Rand), res, UeauCommon.KDFLen(res))
+	av.XresStar = kdfVal[len(kdfVal)/2:]
+
+	kausf := UeauCommon.GetKDFValue(key, UeauCommon.FC_FOR_KAUSF_DERIVATION,
+		P0, UeauCommon.KDFLen(P0), sqnXorAk, UeauCommon.KDFLen(sqnXorAk))
+	av.Kseaf = UeauCommon.GetKDFValue(kausf, UeauCommon.FC_FOR_KSEAF_DERIVATION,
+		P0, UeauCommon.KDFLen(P0))
+
+	return av, nil
+}
+
+// Resynchronise recovers the sequence number of the USIM from the AUTS
+// received in an Authentication Failure with cause synch failure, as per
+// TS 33.102 Section 6.3.5. The next vector is generated with a higher SQN
+func (db *SubscriberDb) Resynchronise(sub *Subscriber, randVal, auts []byte) error {
+	if len(auts) != 14 {
+		return fmt.Errorf("invalid auts length:%v", len(auts))
+	}
+
+	macA, macS := make([]byte, 8), make([]byte, 8)
+	ck, ik := make([]byte, 16), make([]byte, 16)
+	res := make([]byte, 8)
+	ak, akStar := make([]byte, 6), make([]byte, 6)
+
+	err := milenage.F2345(sub.Opc, sub.Key, randVal, res, ck, ik, ak, akStar)
+	if err != nil {
+		return fmt.Errorf("milenage F2345 failed: %v", err)
+	}
+
+	sqnMs := make([]byte, 6)
+	for i := range sqnMs {
+		sqnMs[i] = auts[i] ^ akStar[i]
+	}
+
+	// MAC-S is computed with a dummy AMF of all zeros
+	err = milenage.F1(sub.Opc, sub.Key, randVal, sqnMs, []byte{0x00, 0x00}, macA, macS)
+	if err != nil {
+		return fmt.Errorf("milenage F1 failed: %v", err)
+	}
+	if !bytes.Equal(macS, auts[6:]) {
+		return fmt.Errorf("auts mac verification failed")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	copy(sub.Sqn, sqnMs)
+	return nil
+}
+
+func incrementSqn(sqn []byte) {
+	for i := len(sqn) - 1; i >= 0; i-- {
+		sqn[i]++
+		if sqn[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/omec-project/gnbsim/logger"
+
+	"git.cs.nctu.edu.tw/calee/sctp"
+	"github.com/omec-project/UeauCommon"
+	"github.com/omec-project/nas/nasType"
+	"github.com/omec-project/nas/security"
+	"github.com/omec-project/ngap/ngapType"
+	"github.com/omec-project/openapi/models"
+	"github.com/sirupsen/logrus"
+)
+
+var supiRegexp = regexp.MustCompile("(?:imsi|supi)-([0-9]{5,15})")
+
+type PduSession struct {
+	PduSessId   uint8
+	PduSessType uint8
+	Dnn         string
+	Snssai      models.Snssai
+	SscMode     uint8
+	UeIp        net.IP
+	UlTeid      uint32
+	DlTeid      uint32
+	GnbN3Ip     net.IP
+	Active      bool
+
+	// IPv6 /64 prefix of the PDU session and interface identifier of the UE
+	UeIpv6Prefix net.IP
+	UeIpv6Iid    []byte
+
+	// Number of modifications of the PDU session, each of them applies the
+	// next QoS flow operation to the dedicated QoS flow
+	Modifications int
+}
+
+// UeAddrString returns the UE IPv4 address and IPv6 prefix of the PDU session
+func (sess *PduSession) UeAddrString() string {
+	var addrs []string
+	if sess.UeIp != nil {
+		addrs = append(addrs, sess.UeIp.String())
+	}
+	if sess.UeIpv6Prefix != nil {
+		addrs = append(addrs, sess.UeIpv6Prefix.String()+"/64")
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Operations successively applied to the dedicated QoS flow of a PDU session
+// by its modifications
+const (
+	QOS_FLOW_ADD int = iota
+	QOS_FLOW_MODIFY
+	QOS_FLOW_RELEASE
+)
+
+// AmfUe holds the context of a UE within the mock AMF. The context outlives
+// the NG signalling connection so that a UE in idle state can resume it
+// through a service request
+type AmfUe struct {
+	Supi  string
+	Sub   *Subscriber
+	Guti  string
+	Tmsi  uint32
+	NgKsi models.NgKsi
+	Pei   string
+
+	// Type of identity asked in the pending Identity Request
+	RequestedIdentity uint8
+
+	// NG signalling connection
+	Conn        *sctp.SCTPConn
+	AmfUeNgapId int64
+	RanUeNgapId int64
+	Connected   bool
+
+	// Security context
+	AuthVector               *AuthVector
+	UESecurityCapability     *nasType.UESecurityCapability
+	Kamf                     []byte
+	KnasEnc                  [16]uint8
+	KnasInt                  [16]uint8
+	CipheringAlg             uint8
+	IntegrityAlg             uint8
+	ULCount                  security.Count
+	DLCount                  security.Count
+	SecurityContextAvailable bool
+
+	// Key provided to the gNB and the next hop key chained from it, as per
+	// TS 33.501 Section 6.9.2.1
+	Kgnb []byte
+	Nh   []byte
+	Ncc  uint8
+
+	// Handover of the UE in progress, nil otherwise
+	Handover *Handover
+
+	PduSessions map[uint8]*PduSession
+
+	// Set while the network is releasing the UE from the 5G system
+	Deregistering bool
+
+	// Network triggered procedures are scheduled once per registration
+	NwTimersStarted bool
+	NwTimers        []*time.Timer
+
+	Log *logrus.Entry
+}
+
+// Handover holds the NG connection of the UE towards the target gNB until
+// the target gNB notifies the UE has moved to it
+type Handover struct {
+	TargetConn        *sctp.SCTPConn
+	TargetAmfUeNgapId int64
+	TargetRanUeNgapId int64
+
+	// PDU sessions admitted by the target gNB
+	Admitted []ngapType.PDUSessionResourceAdmittedItem
+}
+
+func NewAmfUe(supi string, sub *Subscriber) *AmfUe {
+	ue := &AmfUe{}
+	ue.Supi = supi
+	ue.Sub = sub
+	ue.PduSessions = make(map[uint8]*PduSession)
+	ue.Log = logger.MockAmfLog.WithField(logger.FieldSupi, supi)
+	return ue
+}
+
+// DerivateKamf derives Kamf from Kseaf as per TS 33.501 Annex A.7
+func (ue *AmfUe) DerivateKamf() {
+	groups := supiRegexp.FindStringSubmatch(ue.Supi)
+	P0 := []byte(groups[1])
+	L0 := UeauCommon.KDFLen(P0)
+	// ABBA
+	P1 := []byte{0x00, 0x00}
+	L1 := UeauCommon.KDFLen(P1)
+
+	ue.Kamf = UeauCommon.GetKDFValue(ue.AuthVector.Kseaf,
+		UeauCommon.FC_FOR_KAMF_DERIVATION, P0, L0, P1, L1)
+}
+
+// DerivateAlgKey derives the NAS keys as per TS 33.501 Annex A.9
+func (ue *AmfUe) DerivateAlgKey() {
+	P0 := []byte{security.NNASEncAlg}
+	L0 := UeauCommon.KDFLen(P0)
+	P1 := []byte{ue.CipheringAlg}
+	L1 := UeauCommon.KDFLen(P1)
+
+	kenc := UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_ALGORITHM_KEY_DERIVATION, P0, L0, P1, L1)
+	copy(ue.KnasEnc[:], kenc[16:32])
+
+	P0 = []byte{security.NNASIntAlg}
+	L0 = UeauCommon.KDFLen(P0)
+	P1 = []byte{ue.IntegrityAlg}
+	L1 = UeauCommon.KDFLen(P1)
+
+	kint := UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_ALGORITHM_KEY_DERIVATION, P0, L0, P1, L1)
+	copy(ue.KnasInt[:], kint[16:32])
+}
+
+// DerivateKgnb derives the key provided to the gNB as per TS 33.501 Annex A.9
+// using the uplink NAS count of the last received message
+func (ue *AmfUe) DerivateKgnb() []byte {
+	count := ue.ULCount.Get()
+	P0 := []byte{byte(count >> 24), byte(count >> 16), byte(count >> 8), byte(count)}
+	L0 := UeauCommon.KDFLen(P0)
+	// 3GPP access
+	P1 := []byte{0x01}
+	L1 := UeauCommon.KDFLen(P1)
+
+	ue.Kgnb = UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_KGNB_KN3IWF_DERIVATION, P0, L0, P1, L1)
+	// The next hop chain restarts from the new KgNB
+	ue.Nh = nil
+	ue.Ncc = 0
+	return ue.Kgnb
+}
+
+// DerivateNh derives the next hop key provided to the target gNB of a
+// handover as per TS 33.501 Annex A.10 and increments the next hop chaining
+// count
+func (ue *AmfUe) DerivateNh() []byte {
+	syncInput := ue.Nh
+	if syncInput == nil {
+		syncInput = ue.Kgnb
+	}
+	P0 := syncInput
+	L0 := UeauCommon.KDFLen(P0)
+
+	ue.Nh = UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_NH_DERIVATION, P0, L0)
+	ue.Ncc = (ue.Ncc + 1) % 8
+	return ue.Nh
+}
+
+// SelectSecurityAlgorithms selects the NAS algorithms supported by the UE in
+// the order of preference of the mock AMF
+func (ue *AmfUe) SelectSecurityAlgorithms(secCfg *SecurityConfig) bool {
+	secCap := ue.UESecurityCapability
+	if secCap == nil {
+		return false
+	}
+
+	intFound := false
+	for _, alg := range secCfg.integrityAlgs {
+		var supported uint8
+		switch alg {
+		case security.AlgIntegrity128NIA0:
+			supported = secCap.GetIA0_5G()
+		case security.AlgIntegrity128NIA1:
+			supported = secCap.GetIA1_128_5G()
+		case security.AlgIntegrity128NIA2:
+			supported = secCap.GetIA2_128_5G()
+		case security.AlgIntegrity128NIA3:
+			supported = secCap.GetIA3_128_5G()
+		}
+		if supported == 1 {
+			ue.IntegrityAlg = alg
+			intFound = true
+			break
+		}
+	}
+
+	encFound := false
+	for _, alg := range secCfg.cipheringAlgs {
+		var supported uint8
+		switch alg {
+		case security.AlgCiphering128NEA0:
+			supported = secCap.GetEA0_5G()
+		case security.AlgCiphering128NEA1:
+			supported = secCap.GetEA1_128_5G()
+		case security.AlgCiphering128NEA2:
+			supported = secCap.GetEA2_128_5G()
+		case security.AlgCiphering128NEA3:
+			supported = secCap.GetEA3_128_5G()
+		}
+		if supported == 1 {
+			ue.CipheringAlg = alg
+			encFound = true
+			break
+		}
+	}
+
+	return intFound && encFound
+}
+
+// PduSessionStatus returns the status of the PDU sessions of the UE as
+// carried in the PDU session status IE
+func (ue *AmfUe) PduSessionStatus() *[16]bool {
+	var status [16]bool
+	for id := range ue.PduSessions {
+		if id < 16 {
+			status[id] = true
+		}
+	}
+	return &status
+}
+
+func (ue *AmfUe) StopNwTimers() {
+	for _, timer := range ue.NwTimers {
+		timer.Stop()
+	}
+	ue.NwTimers = nil
+	ue.NwTimersStarted = false
+}
@@ -0,0 +1,478 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mockcore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/util/test"
+
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	IPV4_PROTOCOL_ICMP     uint8 = 1
+	ICMP_TYPE_ECHO_REPLY   uint8 = 0
+	ICMP_TYPE_ECHO_REQUEST uint8 = 8
+
+	IPV6_HEADER_LEN                  int   = 40
+	IPV6_NEXT_HEADER_ICMPV6          uint8 = 58
+	ICMPV6_TYPE_ECHO_REQUEST         uint8 = 128
+	ICMPV6_TYPE_ECHO_REPLY           uint8 = 129
+	ICMPV6_TYPE_ROUTER_SOLICITATION  uint8 = 133
+	ICMPV6_TYPE_ROUTER_ADVERTISEMENT uint8 = 134
+
+	// Router lifetime advertised to the UEs, in seconds
+	ROUTER_LIFETIME uint16 = 1800
+)
+
+// Link-local address of the UPF, source of the Router Advertisements
+var upfLinkLocalAddr = net.ParseIP("fe80::1")
+
+// Upf terminates the N3 tunnels set up by the mock AMF and answers the ICMP
+// echo requests sent by the UEs, which is the only traffic gnbsim generates.
+// The /64 prefixes of the IPv6 PDU sessions are advertised to the UEs in
+// Router Advertisements
+type Upf struct {
+	cfg  *UpfConfig
+	conn *net.UDPConn
+
+	poolBase net.IP
+	poolSize uint32
+	nextIp   uint32
+	ipInUse  map[uint32]bool
+
+	// IPv6 /64 prefixes, numbered from the first prefix of the pool
+	prefixBase     uint64
+	prefixPoolSize uint64
+	nextPrefix     uint64
+	prefixInUse    map[uint64]bool
+
+	nextTeid uint32
+	// PDU sessions indexed by uplink TEID
+	sessions map[uint32]*PduSession
+
+	mu  sync.Mutex
+	Log *logrus.Entry
+}
+
+func NewUpf(cfg *UpfConfig) (*Upf, error) {
+	_, ipNet, err := net.ParseCIDR(cfg.UeIpPool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ue ip pool:%v", err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("ue ip pool must be an ipv4 subnet of at least 4 addresses:%v",
+			cfg.UeIpPool)
+	}
+
+	_, ipv6Net, err := net.ParseCIDR(cfg.UeIpv6Pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ue ipv6 pool:%v", err)
+	}
+	v6Ones, v6Bits := ipv6Net.Mask.Size()
+	if v6Bits != 128 || v6Ones > 63 {
+		return nil, fmt.Errorf("ue ipv6 pool must be an ipv6 prefix of at least two /64 prefixes:%v",
+			cfg.UeIpv6Pool)
+	}
+	prefixBits := 64 - v6Ones
+	if prefixBits > 32 {
+		prefixBits = 32
+	}
+
+	upf := &Upf{}
+	upf.cfg = cfg
+	upf.poolBase = ipNet.IP.To4()
+	// excluding network and broadcast addresses
+	upf.poolSize = (uint32(1) << uint(bits-ones)) - 2
+	upf.ipInUse = make(map[uint32]bool)
+	upf.prefixBase = binary.BigEndian.Uint64(ipv6Net.IP[:8])
+	upf.prefixPoolSize = uint64(1) << uint(prefixBits)
+	upf.prefixInUse = make(map[uint64]bool)
+	upf.nextTeid = 1
+	upf.sessions = make(map[uint32]*PduSession)
+	upf.Log = logger.MockUpfLog
+	return upf, nil
+}
+
+func (upf *Upf) Start() error {
+	addr := &net.UDPAddr{IP: net.ParseIP(upf.cfg.N3IpAddr), Port: upf.cfg.N3Port}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", addr, err)
+	}
+	upf.conn = conn
+	upf.Log.Infoln("Listening for GTP-U packets on", addr)
+	go upf.receive()
+	return nil
+}
+
+func (upf *Upf) Stop() {
+	if upf.conn != nil {
+		upf.conn.Close()
+	}
+}
+
+// AllocateSession assigns a UE IPv4 address and/or IPv6 prefix, as per the
+// PDU session type, and an uplink TEID to the PDU session
+func (upf *Upf) AllocateSession(sess *PduSession) error {
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+
+	hasIpv4 := sess.PduSessType != nasMessage.PDUSessionTypeIPv6
+	hasIpv6 := sess.PduSessType == nasMessage.PDUSessionTypeIPv6 ||
+		sess.PduSessType == nasMessage.PDUSessionTypeIPv4IPv6
+	if hasIpv4 && uint32(len(upf.ipInUse)) >= upf.poolSize {
+		return fmt.Errorf("ue ip pool exhausted")
+	}
+	if hasIpv6 && uint64(len(upf.prefixInUse)) >= upf.prefixPoolSize {
+		return fmt.Errorf("ue ipv6 pool exhausted")
+	}
+
+	if hasIpv4 {
+		for upf.ipInUse[upf.nextIp] {
+			upf.nextIp = (upf.nextIp + 1) % upf.poolSize
+		}
+		offset := upf.nextIp
+		upf.ipInUse[offset] = true
+		upf.nextIp = (upf.nextIp + 1) % upf.poolSize
+
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(upf.poolBase)+offset+1)
+		sess.UeIp = ip
+	}
+
+	if hasIpv6 {
+		iid := make([]byte, 8)
+		if _, err := rand.Read(iid); err != nil {
+			return fmt.Errorf("failed to generate ipv6 interface identifier: %v", err)
+		}
+
+		for upf.prefixInUse[upf.nextPrefix] {
+			upf.nextPrefix = (upf.nextPrefix + 1) % upf.prefixPoolSize
+		}
+		offset := upf.nextPrefix
+		upf.prefixInUse[offset] = true
+		upf.nextPrefix = (upf.nextPrefix + 1) % upf.prefixPoolSize
+
+		prefix := make(net.IP, net.IPv6len)
+		binary.BigEndian.PutUint64(prefix[:8], upf.prefixBase+offset)
+		sess.UeIpv6Prefix = prefix
+		sess.UeIpv6Iid = iid
+	}
+
+	sess.UlTeid = upf.nextTeid
+	upf.nextTeid++
+	upf.sessions[sess.UlTeid] = sess
+	return nil
+}
+
+// UpdateSession records the downlink tunnel endpoint of the PDU session as
+// received from the gNB
+func (upf *Upf) UpdateSession(sess *PduSession, dlTeid uint32, gnbN3Ip net.IP) {
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+	sess.DlTeid = dlTeid
+	sess.GnbN3Ip = gnbN3Ip
+	sess.Active = true
+}
+
+// DeactivateSession stops forwarding downlink packets of the PDU session,
+// which happens when the UE moves to idle state
+func (upf *Upf) DeactivateSession(sess *PduSession) {
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+	sess.Active = false
+}
+
+func (upf *Upf) ReleaseSession(sess *PduSession) {
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+	delete(upf.sessions, sess.UlTeid)
+	if sess.UeIp != nil {
+		offset := binary.BigEndian.Uint32(sess.UeIp.To4()) - binary.BigEndian.Uint32(upf.poolBase) - 1
+		delete(upf.ipInUse, offset)
+	}
+	if sess.UeIpv6Prefix != nil {
+		offset := binary.BigEndian.Uint64(sess.UeIpv6Prefix[:8]) - upf.prefixBase
+		delete(upf.prefixInUse, offset)
+	}
+	sess.Active = false
+}
+
+func (upf *Upf) receive() {
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := upf.conn.ReadFromUDP(buf)
+		if err != nil {
+			upf.Log.Infoln("Stopped receiving GTP-U packets:", err)
+			return
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		if err := upf.handleGtpPacket(pkt, src); err != nil {
+			upf.Log.Errorln("Failed to handle GTP-U packet:", err)
+		}
+	}
+}
+
+func (upf *Upf) handleGtpPacket(pkt []byte, src *net.UDPAddr) error {
+	gtpPdu, err := test.DecodeGTPv1Header(pkt)
+	if err != nil {
+		return fmt.Errorf("failed to decode gtp-u header: %v", err)
+	}
+	switch gtpPdu.Hdr.MsgType {
+	case test.TYPE_GPDU:
+	case test.TYPE_ERROR_INDICATION:
+		return upf.handleErrorIndication(gtpPdu)
+	default:
+		return fmt.Errorf("unsupported gtp-u message type:%v", gtpPdu.Hdr.MsgType)
+	}
+
+	payload := gtpPdu.Payload
+
+	upf.mu.Lock()
+	sess, ok := upf.sessions[gtpPdu.Hdr.Teid]
+	var active bool
+	var dlTeid uint32
+	var gnbN3Ip, prefix net.IP
+	if ok {
+		active = sess.Active
+		dlTeid = sess.DlTeid
+		gnbN3Ip = sess.GnbN3Ip
+		prefix = sess.UeIpv6Prefix
+	}
+	upf.mu.Unlock()
+	if !ok {
+		return upf.sendErrorIndication(gtpPdu.Hdr.Teid, src)
+	}
+	if !active {
+		return fmt.Errorf("no active pdu session found for teid:%v", gtpPdu.Hdr.Teid)
+	}
+
+	var reply []byte
+	if len(payload) != 0 && payload[0]>>4 == 6 {
+		reply, err = buildIcmpv6Reply(payload, prefix)
+	} else {
+		reply, err = buildIcmpEchoReply(payload)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = upf.sendDl(reply, dlTeid, gnbN3Ip); err != nil {
+		return err
+	}
+	upf.Log.Traceln("Sent ICMP reply, dl teid:", dlTeid)
+	return nil
+}
+
+// sendErrorIndication tells the gNB that the UPF has no PDU session for the
+// uplink TEID of the G-PDU it sent, TS 29.281 Section 7.3.1
+func (upf *Upf) sendErrorIndication(ulTeid uint32, dst *net.UDPAddr) error {
+	pkt, err := test.BuildErrorIndication(ulTeid, net.ParseIP(upf.cfg.N3IpAddr))
+	if err != nil {
+		return fmt.Errorf("failed to build error indication: %v", err)
+	}
+	_, err = upf.conn.WriteToUDP(pkt, dst)
+	if err != nil {
+		return fmt.Errorf("failed to send error indication to %v: %v", dst, err)
+	}
+	upf.Log.Warnln("Sent Error Indication for unknown UL TEID:", ulTeid, "to", dst)
+	return nil
+}
+
+// handleErrorIndication stops forwarding downlink packets to the tunnel the
+// gNB reported as unknown
+func (upf *Upf) handleErrorIndication(gtpPdu *test.GtpPdu) error {
+	dlTeid, gnbN3Ip, err := test.DecodeErrorIndication(gtpPdu.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode error indication: %v", err)
+	}
+	upf.Log.Warnln("Received Error Indication for DL TEID:", dlTeid,
+		"gNB N3 address:", gnbN3Ip)
+
+	upf.mu.Lock()
+	defer upf.mu.Unlock()
+	for _, sess := range upf.sessions {
+		if sess.Active && sess.DlTeid == dlTeid && sess.GnbN3Ip.Equal(gnbN3Ip) {
+			sess.Active = false
+			upf.Log.Warnln("Deactivated PDU session with UL TEID:", sess.UlTeid)
+		}
+	}
+	return nil
+}
+
+// SendRouterAdvertisement advertises the IPv6 prefix to the UE once the user
+// plane of the PDU session is set up, TS 23.501 Section 5.8.2.2.3
+func (upf *Upf) SendRouterAdvertisement(sess *PduSession) error {
+	upf.mu.Lock()
+	active, dlTeid, gnbN3Ip, prefix := sess.Active, sess.DlTeid, sess.GnbN3Ip, sess.UeIpv6Prefix
+	upf.mu.Unlock()
+	if !active || prefix == nil {
+		return nil
+	}
+
+	ra := buildRouterAdvertisement(net.IPv6unspecified, prefix)
+	if err := upf.sendDl(ra, dlTeid, gnbN3Ip); err != nil {
+		return err
+	}
+	upf.Log.Traceln("Sent Router Advertisement, dl teid:", dlTeid)
+	return nil
+}
+
+func (upf *Upf) sendDl(pkt []byte, dlTeid uint32, gnbN3Ip net.IP) error {
+	hdr, err := test.BuildGTPv1Header(false, false, false, 0, 0, 0,
+		test.TYPE_GPDU, uint16(len(pkt)), dlTeid)
+	if err != nil {
+		return fmt.Errorf("failed to build gtp-u header: %v", err)
+	}
+
+	addr := &net.UDPAddr{IP: gnbN3Ip, Port: DEFAULT_N3_PORT}
+	_, err = upf.conn.WriteToUDP(append(hdr, pkt...), addr)
+	if err != nil {
+		return fmt.Errorf("failed to send gtp-u packet to %v: %v", addr, err)
+	}
+	return nil
+}
+
+// buildIcmpEchoReply turns an IPv4 ICMP echo request into the corresponding
+// echo reply
+func buildIcmpEchoReply(pkt []byte) ([]byte, error) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil, fmt.Errorf("not an ipv4 packet")
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < 20 || totalLen < ihl+8 || totalLen > len(pkt) {
+		return nil, fmt.Errorf("malformed ipv4 packet")
+	}
+	if pkt[9] != IPV4_PROTOCOL_ICMP || pkt[ihl] != ICMP_TYPE_ECHO_REQUEST {
+		return nil, fmt.Errorf("not an icmp echo request")
+	}
+
+	reply := make([]byte, totalLen)
+	copy(reply, pkt[:totalLen])
+
+	// swap source and destination addresses
+	copy(reply[12:16], pkt[16:20])
+	copy(reply[16:20], pkt[12:16])
+	reply[8] = 64
+	reply[10], reply[11] = 0, 0
+	binary.BigEndian.PutUint16(reply[10:12], checksum(reply[:ihl]))
+
+	icmpMsg := reply[ihl:]
+	icmpMsg[0] = ICMP_TYPE_ECHO_REPLY
+	icmpMsg[2], icmpMsg[3] = 0, 0
+	binary.BigEndian.PutUint16(icmpMsg[2:4], checksum(icmpMsg))
+	return reply, nil
+}
+
+// buildIcmpv6Reply answers an ICMPv6 echo request with the echo reply and a
+// Router Solicitation with a Router Advertisement of the prefix of the PDU
+// session
+func buildIcmpv6Reply(pkt []byte, prefix net.IP) ([]byte, error) {
+	if len(pkt) < IPV6_HEADER_LEN || pkt[0]>>4 != 6 {
+		return nil, fmt.Errorf("not an ipv6 packet")
+	}
+	payloadLen := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if payloadLen < 4 || IPV6_HEADER_LEN+payloadLen > len(pkt) {
+		return nil, fmt.Errorf("malformed ipv6 packet")
+	}
+	if pkt[6] != IPV6_NEXT_HEADER_ICMPV6 {
+		return nil, fmt.Errorf("not an icmpv6 packet")
+	}
+	src, dst := net.IP(pkt[8:24]), net.IP(pkt[24:40])
+
+	switch pkt[IPV6_HEADER_LEN] {
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		reply := make([]byte, IPV6_HEADER_LEN+payloadLen)
+		copy(reply, pkt)
+		reply[7] = 64
+		// swap source and destination addresses
+		copy(reply[8:24], dst)
+		copy(reply[24:40], src)
+
+		icmpMsg := reply[IPV6_HEADER_LEN:]
+		icmpMsg[0] = ICMPV6_TYPE_ECHO_REPLY
+		icmpMsg[2], icmpMsg[3] = 0, 0
+		binary.BigEndian.PutUint16(icmpMsg[2:4], icmpv6Checksum(dst, src, icmpMsg))
+		return reply, nil
+	case ICMPV6_TYPE_ROUTER_SOLICITATION:
+		if prefix == nil {
+			return nil, fmt.Errorf("no ipv6 prefix allocated to the pdu session")
+		}
+		return buildRouterAdvertisement(src, prefix), nil
+	default:
+		return nil, fmt.Errorf("unsupported icmpv6 message type:%v", pkt[IPV6_HEADER_LEN])
+	}
+}
+
+// buildRouterAdvertisement advertises the /64 prefix to the UE, the prefix is
+// not on-link and used for stateless address autoconfiguration as per
+// TS 29.061 Section 11.2.1.3. Unsolicited advertisements, with an unspecified
+// UE address, are sent to all nodes
+func buildRouterAdvertisement(ueAddr, prefix net.IP) []byte {
+	ra := make([]byte, 48)
+	ra[0] = ICMPV6_TYPE_ROUTER_ADVERTISEMENT
+	ra[4] = 64 // cur hop limit
+	binary.BigEndian.PutUint16(ra[6:8], ROUTER_LIFETIME)
+
+	// Prefix Information option, RFC 4861 Section 4.6.2
+	opt := ra[16:]
+	opt[0], opt[1] = 3, 4
+	opt[2] = 64
+	opt[3] = 0x40                                     // autonomous address-configuration flag
+	binary.BigEndian.PutUint32(opt[4:8], 0xffffffff)  // valid lifetime
+	binary.BigEndian.PutUint32(opt[8:12], 0xffffffff) // preferred lifetime
+	copy(opt[16:32], prefix.To16())
+
+	dst := ueAddr
+	if dst.IsUnspecified() {
+		dst = net.ParseIP("ff02::1")
+	}
+	binary.BigEndian.PutUint16(ra[2:4], icmpv6Checksum(upfLinkLocalAddr, dst, ra))
+
+	pkt := make([]byte, IPV6_HEADER_LEN, IPV6_HEADER_LEN+len(ra))
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(ra)))
+	pkt[6] = IPV6_NEXT_HEADER_ICMPV6
+	pkt[7] = 255
+	copy(pkt[8:24], upfLinkLocalAddr)
+	copy(pkt[24:40], dst.To16())
+	return append(pkt, ra...)
+}
+
+// icmpv6Checksum computes the ICMPv6 checksum, including the IPv6 pseudo
+// header, of a message with a zeroed checksum field
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	buf := make([]byte, 40, 40+len(msg))
+	copy(buf[0:16], src.To16())
+	copy(buf[16:32], dst.To16())
+	binary.BigEndian.PutUint32(buf[32:36], uint32(len(msg)))
+	buf[39] = IPV6_NEXT_HEADER_ICMPV6
+	return checksum(append(buf, msg...))
+}
+
+func checksum(buf []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	if len(buf)%2 == 1 {
+		sum += uint32(buf[len(buf)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// arrival types
+const (
+	ARRIVAL_FIXED   string = "fixed"
+	ARRIVAL_POISSON string = "poisson"
+)
+
+// CallModel controls the rate at which UEs of a profile are launched instead
+// of starting all of them at once. Durations are in seconds.
+type CallModel struct {
+	CallsPerSecond   float64 `yaml:"callsPerSecond" json:"callsPerSecond"`
+	RampUpDuration   float64 `yaml:"rampUpDuration" json:"rampUpDuration"`
+	RampDownDuration float64 `yaml:"rampDownDuration" json:"rampDownDuration"`
+	ArrivalType      string  `yaml:"arrivalType" json:"arrivalType"`
+	MaxConcurrentUes int     `yaml:"maxConcurrentUes" json:"maxConcurrentUes"`
+}
+
+func (cm *CallModel) Validate() error {
+	if cm.CallsPerSecond <= 0 {
+		return fmt.Errorf("callsPerSecond should be greater than 0")
+	}
+	if cm.RampUpDuration < 0 || cm.RampDownDuration < 0 {
+		return fmt.Errorf("ramp up/down duration can not be negative")
+	}
+	if cm.MaxConcurrentUes < 0 {
+		return fmt.Errorf("maxConcurrentUes can not be negative")
+	}
+	switch cm.ArrivalType {
+	case "":
+		cm.ArrivalType = ARRIVAL_FIXED
+	case ARRIVAL_FIXED, ARRIVAL_POISSON:
+	default:
+		return fmt.Errorf("unsupported arrivalType:%v", cm.ArrivalType)
+	}
+	return nil
+}
+
+// CallPacer schedules UE arrivals as per the CallModel. The call rate grows
+// linearly from zero to CallsPerSecond during ramp up, stays flat and then
+// falls linearly back to zero for the last arrivals during ramp down.
+// Arrivals are placed on a unit rate time axis (equally spaced for fixed
+// arrivals, exponentially spaced for poisson arrivals) and then mapped to
+// wall clock time through the inverse of the cumulative call rate.
+type CallPacer struct {
+	model     *CallModel
+	total     int
+	launched  int
+	unitTime  float64
+	startTime time.Time
+	rnd       *rand.Rand
+	sem       chan struct{}
+}
+
+func NewCallPacer(model *CallModel, total int) *CallPacer {
+	pacer := &CallPacer{
+		model: model,
+		total: total,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if model.MaxConcurrentUes > 0 {
+		pacer.sem = make(chan struct{}, model.MaxConcurrentUes)
+	}
+	return pacer
+}
+
+// arrivalOffset returns the wall clock offset in seconds from the start of
+// the profile for an arrival at unit time s
+func (pacer *CallPacer) arrivalOffset(s float64) float64 {
+	cps := pacer.model.CallsPerSecond
+	up := pacer.model.RampUpDuration
+	down := pacer.model.RampDownDuration
+
+	// number of arrivals expected during ramp up and ramp down
+	upCalls := cps * up / 2
+	downCalls := cps * down / 2
+	downStart := math.Max(upCalls, float64(pacer.total)-downCalls)
+
+	if s < upCalls {
+		return math.Sqrt(2 * up * s / cps)
+	}
+	if s < downStart || downCalls == 0 {
+		return up + (s-upCalls)/cps
+	}
+	offset := up + (downStart-upCalls)/cps
+	x := math.Min(s-downStart, downCalls)
+	return offset + down*(1-math.Sqrt(1-x/downCalls))
+}
+
+// WaitForNextArrival blocks, if configured, until the number of running UEs
+// drops below MaxConcurrentUes and then until it is time to launch the next
+// UE. An arrival delayed by the running UEs pushes back the following ones
+// rather than launching them in a burst once UEs complete. It returns an
+// error without waiting any further once ctx is cancelled, no UE should then
+// be launched
+func (pacer *CallPacer) WaitForNextArrival(ctx context.Context) error {
+	if pacer.sem != nil {
+		select {
+		case pacer.sem <- struct{}{}:
+		case <-ctx.Done():
+			return fmt.Errorf("wait for a free UE slot cancelled: %v", ctx.Err())
+		}
+	}
+
+	now := time.Now()
+	if pacer.launched == 0 {
+		pacer.startTime = now
+	}
+	if pacer.model.ArrivalType == ARRIVAL_POISSON {
+		pacer.unitTime += pacer.rnd.ExpFloat64()
+	} else if pacer.launched > 0 {
+		pacer.unitTime += 1
+	}
+	pacer.launched++
+
+	offset := pacer.arrivalOffset(pacer.unitTime)
+	arrival := pacer.startTime.Add(time.Duration(offset * float64(time.Second)))
+	if pacer.sem != nil && arrival.Before(now) {
+		pacer.startTime = pacer.startTime.Add(now.Sub(arrival))
+		return nil
+	}
+	if wait := time.Until(arrival); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			pacer.Done()
+			return fmt.Errorf("wait for next arrival cancelled: %v", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Done should be called once the UE launched after WaitForNextArrival
+// completes its execution
+func (pacer *CallPacer) Done() {
+	if pacer.sem != nil {
+		<-pacer.sem
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestArrivalOffset(t *testing.T) {
+	tests := []struct {
+		name  string
+		model CallModel
+		total int
+		s     float64 // unit time of the arrival
+		want  float64 // seconds from the start of the profile
+	}{
+		// 10 calls per second, 10 arrivals during each 2 seconds ramp
+		{"first arrival", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 0, 0},
+		{"ramp up", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 5, math.Sqrt2},
+		{"ramp up end", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 10, 2},
+		{"flat rate", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 50, 6},
+		{"ramp down start", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 90, 10},
+		{"ramp down", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 97.5, 11},
+		{"ramp down end", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 100, 12},
+		{"past ramp down", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 100, 120, 12},
+		{"no ramp", CallModel{CallsPerSecond: 4}, 10, 6, 1.5},
+		{"ramp up only", CallModel{CallsPerSecond: 10, RampUpDuration: 2}, 100, 20, 3},
+		// fewer UEs than the ramps expect, ramp down starts at the end of ramp up
+		{"overlapping ramps", CallModel{CallsPerSecond: 10, RampUpDuration: 2, RampDownDuration: 2}, 15, 12.5,
+			2 + 2*(1-math.Sqrt(0.75))},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pacer := NewCallPacer(&tc.model, tc.total)
+			if got := pacer.arrivalOffset(tc.s); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("arrivalOffset(%v) = %v, want %v", tc.s, got, tc.want)
+			}
+		})
+	}
+}
+
+// The number of arrivals by time t grows as cps*t^2/(2*up) during ramp up,
+// i.e. the call rate grows linearly up to CallsPerSecond
+func TestArrivalOffsetRamp(t *testing.T) {
+	model := &CallModel{CallsPerSecond: 20, RampUpDuration: 3, RampDownDuration: 5}
+	pacer := NewCallPacer(model, 200)
+
+	prev := -1.0
+	for s := 0.0; s <= 200; s++ {
+		offset := pacer.arrivalOffset(s)
+		if offset <= prev {
+			t.Fatalf("arrivalOffset(%v) = %v, not after the previous arrival %v", s, offset, prev)
+		}
+		prev = offset
+
+		if offset <= model.RampUpDuration {
+			arrivals := model.CallsPerSecond * offset * offset / (2 * model.RampUpDuration)
+			if math.Abs(arrivals-s) > 1e-6 {
+				t.Errorf("%v arrivals by %vs, want %v", s, offset, arrivals)
+			}
+		}
+	}
+	// 30 arrivals during ramp up, 120 at 20 calls per second and 50 during
+	// ramp down
+	if want := 3 + 6 + 5.0; math.Abs(prev-want) > 1e-9 {
+		t.Errorf("last arrival at %vs, want %vs", prev, want)
+	}
+}
+
+// The UE slot is acquired before the arrival is scheduled, an arrival that
+// could not get one is not accounted for
+func TestWaitForNextArrivalMaxConcurrentUes(t *testing.T) {
+	model := &CallModel{CallsPerSecond: 1000, MaxConcurrentUes: 1, ArrivalType: ARRIVAL_FIXED}
+	pacer := NewCallPacer(model, 10)
+
+	if err := pacer.WaitForNextArrival(context.Background()); err != nil {
+		t.Fatalf("WaitForNextArrival() returned: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pacer.WaitForNextArrival(ctx); err == nil {
+		t.Fatalf("WaitForNextArrival() did not wait for a free UE slot")
+	}
+	if pacer.launched != 1 {
+		t.Errorf("launched = %v, want 1", pacer.launched)
+	}
+
+	pacer.Done()
+	if err := pacer.WaitForNextArrival(context.Background()); err != nil {
+		t.Fatalf("WaitForNextArrival() returned: %v", err)
+	}
+	// the second arrival was due 1ms after the start, it is pushed back to
+	// when the UE slot got free
+	if time.Since(pacer.startTime) > 10*time.Millisecond {
+		t.Errorf("arrivals not pushed back by the wait for a free UE slot")
+	}
+}
@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/omec-project/gnbsim/common"
+)
+
+// next iteration value which ends the execution of the UE
+const ITERATION_QUIT string = "quit"
+
+// Step is a procedure executed as part of an iteration of a custom profile.
+// Durations are in seconds.
+type Step struct {
+	Procedure  string `yaml:"procedure" json:"procedure"`
+	WaitBefore int    `yaml:"waitBefore" json:"waitBefore"`
+	WaitAfter  int    `yaml:"waitAfter" json:"waitAfter"`
+	Repeat     int    `yaml:"repeat" json:"repeat"`   // additional executions of the step
+	Timeout    int    `yaml:"timeout" json:"timeout"` // overrides perUserTimeout
+
+	// The step passes only if the network makes the procedure fail. A
+	// procedure timeout is not an expected failure
+	ExpectFailure bool `yaml:"expectFailure" json:"expectFailure"`
+
+	// PDU sessions the PDU session procedures and the user data generation
+	// apply to, all the PDU sessions of the profile if empty
+	PduSessionIds []int `yaml:"pduSessionIds" json:"pduSessionIds"`
+}
+
+// Iterations is a list of steps executed in order. Once all the steps passed
+// the UE moves to the onSuccess iteration (same as next). If a step fails the
+// UE moves to the onFailure iteration, when configured, instead of failing
+type Iterations struct {
+	Name      string  `yaml:"name" json:"name"`
+	Steps     []*Step `yaml:"steps" json:"steps"`
+	Next      string  `yaml:"next" json:"next"`
+	OnSuccess string  `yaml:"onSuccess" json:"onSuccess"`
+	OnFailure string  `yaml:"onFailure" json:"onFailure"`
+	Repeat    int     `yaml:"repeat" json:"repeat"`
+
+	// Keys not known to the iteration, only looked at to point configurations
+	// still using the "1".."7" procedure keys to the steps list
+	Unknown map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// PStep is the parsed form of a Step
+type PStep struct {
+	Procedure  common.ProcedureType
+	WaitBefore time.Duration
+	WaitAfter  time.Duration
+	Repeat     int
+	Timeout    time.Duration
+
+	ExpectFailure bool
+	PduSessionIds []uint8
+}
+
+// PIterations is the parsed form of Iterations
+type PIterations struct {
+	Name    string
+	Steps   []*PStep
+	NextItr string
+	Repeat  int
+
+	// Empty if a failed step fails the UE
+	FailureItr string
+}
+
+// InitIterations parses and validates the iterations of a custom profile
+func (p *Profile) InitIterations() error {
+	if len(p.Iterations) == 0 {
+		return fmt.Errorf("no iterations configured")
+	}
+
+	pIterations := make(map[string]*PIterations)
+	for _, itr := range p.Iterations {
+		if itr.Name == "" {
+			return fmt.Errorf("iteration name missing")
+		}
+		if _, found := pIterations[itr.Name]; found {
+			return fmt.Errorf("duplicate iteration:%v", itr.Name)
+		}
+		if key := legacyStepKey(itr); key != "" {
+			return fmt.Errorf("iteration %v: procedure key %q is no longer supported, "+
+				"list the procedures under steps instead, e.g. "+
+				"steps: [{procedure: REGISTRATION-PROCEDURE, waitAfter: 5}]", itr.Name, key)
+		}
+		if len(itr.Steps) == 0 {
+			return fmt.Errorf("iteration %v: no steps configured", itr.Name)
+		}
+		if itr.Repeat < 0 {
+			return fmt.Errorf("iteration %v: repeat can not be negative", itr.Name)
+		}
+		if itr.Next != "" && itr.OnSuccess != "" && itr.Next != itr.OnSuccess {
+			return fmt.Errorf("iteration %v: next and onSuccess can not differ", itr.Name)
+		}
+		next := itr.Next
+		if itr.OnSuccess != "" {
+			next = itr.OnSuccess
+		}
+		if next == "" {
+			next = ITERATION_QUIT // default value
+		}
+
+		pItr := &PIterations{
+			Name:       itr.Name,
+			NextItr:    next,
+			Repeat:     itr.Repeat,
+			FailureItr: itr.OnFailure,
+		}
+		for i, step := range itr.Steps {
+			pStep, err := parseStep(step)
+			if err != nil {
+				return fmt.Errorf("iteration %v, step %v: %v", itr.Name, i+1, err)
+			}
+			pItr.Steps = append(pItr.Steps, pStep)
+		}
+		pIterations[itr.Name] = pItr
+	}
+
+	for _, pItr := range pIterations {
+		if _, found := pIterations[pItr.NextItr]; !found && pItr.NextItr != ITERATION_QUIT {
+			return fmt.Errorf("iteration %v: unknown next iteration:%v", pItr.Name, pItr.NextItr)
+		}
+		if _, found := pIterations[pItr.FailureItr]; !found &&
+			pItr.FailureItr != "" && pItr.FailureItr != ITERATION_QUIT {
+			return fmt.Errorf("iteration %v: unknown onFailure iteration:%v", pItr.Name, pItr.FailureItr)
+		}
+	}
+
+	if p.StartIteration == "" {
+		p.StartIteration = p.Iterations[0].Name
+	} else if _, found := pIterations[p.StartIteration]; !found {
+		return fmt.Errorf("unknown start iteration:%v", p.StartIteration)
+	}
+
+	p.PIterations = pIterations
+	return nil
+}
+
+// legacyStepKey returns the first of the "1".."7" keys which listed the
+// procedures of an iteration before steps were introduced
+func legacyStepKey(itr *Iterations) string {
+	for i := 1; i <= 7; i++ {
+		key := strconv.Itoa(i)
+		if _, found := itr.Unknown[key]; found {
+			return key
+		}
+	}
+	return ""
+}
+
+func parseStep(step *Step) (*PStep, error) {
+	if step == nil {
+		return nil, fmt.Errorf("empty step")
+	}
+	proc := common.GetProcId(step.Procedure)
+	if proc == common.UNKNOWN_PROCEDURE {
+		return nil, fmt.Errorf("unknown procedure:%v", step.Procedure)
+	}
+	if step.WaitBefore < 0 || step.WaitAfter < 0 || step.Repeat < 0 || step.Timeout < 0 {
+		return nil, fmt.Errorf("waitBefore, waitAfter, repeat and timeout can not be negative")
+	}
+	pStep := &PStep{
+		Procedure:  proc,
+		WaitBefore: time.Duration(step.WaitBefore) * time.Second,
+		WaitAfter:  time.Duration(step.WaitAfter) * time.Second,
+		Repeat:     step.Repeat,
+		Timeout:    time.Duration(step.Timeout) * time.Second,
+
+		ExpectFailure: step.ExpectFailure,
+	}
+	for _, id := range step.PduSessionIds {
+		if id < 1 || id > 15 {
+			return nil, fmt.Errorf("invalid pduSessionId:%v, should be in range 1-15", id)
+		}
+		pStep.PduSessionIds = append(pStep.PduSessionIds, uint8(id))
+	}
+	return pStep, nil
+}
+
+// getNextStepProcedure returns the procedure of the next step to be executed
+// by the UE of a custom profile, 0 if there is nothing more to execute
+func (p *Profile) getNextStepProcedure(pCtx *ProfileUeContext) common.ProcedureType {
+	pCtx.Log.Infoln("Current UE iteration ", pCtx.CurrentItr)
+	pCtx.Log.Infoln("Current UE procedure index  ", pCtx.CurrentProcIndex)
+	itp, found := p.PIterations[pCtx.CurrentItr]
+	if !found {
+		pCtx.Log.Errorln("Unknown iteration:", pCtx.CurrentItr)
+		return 0
+	}
+
+	if pCtx.CurrentProcIndex == 0 {
+		pCtx.Repeat = itp.Repeat
+		return pCtx.startStep(itp, 1)
+	}
+
+	step := itp.Steps[pCtx.CurrentProcIndex-1]
+	pCtx.wait(step.WaitAfter)
+	if pCtx.StepRepeat > 0 {
+		pCtx.StepRepeat--
+		pCtx.Log.Infoln("Repeat current step : ", pCtx.CurrentProcIndex, ", Repeat Count ", pCtx.StepRepeat)
+		pCtx.wait(step.WaitBefore)
+		return step.Procedure
+	}
+	if pCtx.CurrentProcIndex < len(itp.Steps) {
+		return pCtx.startStep(itp, pCtx.CurrentProcIndex+1)
+	}
+	if pCtx.Repeat > 0 {
+		pCtx.Repeat = pCtx.Repeat - 1
+		pCtx.Log.Infoln("Repeat current iteration : ", itp.Name, ", Repeat Count ", pCtx.Repeat)
+		return pCtx.startStep(itp, 1)
+	}
+
+	pCtx.Log.Infoln("Iteration Complete ", pCtx.CurrentItr)
+	return p.startIteration(pCtx, itp.NextItr)
+}
+
+// GetFailureProcedure returns the first procedure of the onFailure iteration
+// of the current iteration of the UE, 0 if onFailure is quit. It returns false
+// if no onFailure iteration is configured, the UE then fails
+func (p *Profile) GetFailureProcedure(pCtx *ProfileUeContext) (common.ProcedureType, bool) {
+	itp, found := p.PIterations[pCtx.CurrentItr]
+	if !found || itp.FailureItr == "" {
+		return 0, false
+	}
+
+	pCtx.Log.Infoln("Iteration Failed ", pCtx.CurrentItr)
+	return p.startIteration(pCtx, itp.FailureItr), true
+}
+
+func (p *Profile) startIteration(pCtx *ProfileUeContext, name string) common.ProcedureType {
+	if name == ITERATION_QUIT {
+		return 0
+	}
+	nItr := p.PIterations[name]
+	pCtx.Log.Infoln("Going to next iteration ", nItr.Name)
+	pCtx.Repeat = nItr.Repeat
+	return pCtx.startStep(nItr, 1)
+}
+
+// ExpectFailure tells whether the current step of the UE expects the network
+// to make the procedure fail
+func (p *Profile) ExpectFailure(pCtx *ProfileUeContext) bool {
+	step := p.currentStep(pCtx)
+	return step != nil && step.ExpectFailure
+}
+
+func (pCtx *ProfileUeContext) startStep(itp *PIterations, index int) common.ProcedureType {
+	step := itp.Steps[index-1]
+	pCtx.Log.Infof("Next Procedure Index %v and next Procedure = %v ", index, step.Procedure)
+	pCtx.StepRepeat = step.Repeat
+	pCtx.setProcedure(itp.Name, index, step.Procedure)
+	pCtx.wait(step.WaitBefore)
+	return step.Procedure
+}
+
+// wait sleeps for the given duration unless the UE is aborted meanwhile
+func (pCtx *ProfileUeContext) wait(d time.Duration) {
+	if d == 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-pCtx.ctx.Done():
+	}
+}
+
+// GetProcedureTimeout returns the time given to the UE to complete its
+// current procedure
+func (p *Profile) GetProcedureTimeout(pCtx *ProfileUeContext) time.Duration {
+	if step := p.currentStep(pCtx); step != nil && step.Timeout != 0 {
+		return step.Timeout
+	}
+	return time.Duration(p.PerUserTimeout) * time.Second
+}
+
+// currentStep returns the step being executed by the UE of a custom profile
+func (p *Profile) currentStep(pCtx *ProfileUeContext) *PStep {
+	itp, found := p.PIterations[pCtx.CurrentItr]
+	if !found {
+		return nil
+	}
+	index := pCtx.CurrentProcIndex
+	if index <= 0 || index > len(itp.Steps) {
+		return nil
+	}
+	return itp.Steps[index-1]
+}
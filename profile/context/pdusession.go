@@ -0,0 +1,221 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/omec-project/gnbsim/common"
+
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/openapi/models"
+)
+
+// PDU session established by the UEs of a profile with no PDU session
+// configured
+const DEFAULT_PDU_SESSION_ID int = 10
+
+// PduSessionConfig describes a PDU session established by the UEs of a
+// profile. The dnn, sNssai, defaultAs and defaultAsV6 of the profile are used
+// unless configured
+type PduSessionConfig struct {
+	PduSessId   int            `yaml:"pduSessionId" json:"pduSessionId"` // 1 to 15
+	Dnn         string         `yaml:"dnn" json:"dnn"`
+	SNssai      *models.Snssai `yaml:"sNssai" json:"sNssai"`
+	PduSessType string         `yaml:"pduSessionType" json:"pduSessionType"` // IPv4, IPv6 or IPv4v6
+	SscMode     int            `yaml:"sscMode" json:"sscMode"`               // 1 to 3, default 1
+	DefaultAs   string         `yaml:"defaultAs" json:"defaultAs"`
+	DefaultAsV6 string         `yaml:"defaultAsV6" json:"defaultAsV6"`
+
+	// Address family of the user data packets, IPv4 or IPv6. Defaults to IPv6
+	// for IPv6 PDU sessions, IPv4 otherwise
+	DataAddrFamily string `yaml:"dataAddressFamily" json:"dataAddressFamily"`
+}
+
+// InitPduSessions validates the PDU sessions of the profile and the PDU
+// sessions selected by the steps of its iterations. A single PDU session
+// with ID 10 is established unless configured, the PDU sessions configured
+// without ID get the next ID from 10 onwards, wrapping around to 1, not
+// configured for another PDU session
+func (p *Profile) InitPduSessions() error {
+	sessions := p.PduSessions
+	if len(sessions) == 0 {
+		sessions = []*PduSessionConfig{{}}
+	}
+
+	usedIds := make(map[int]bool)
+	for _, cfg := range sessions {
+		if cfg != nil && cfg.PduSessId != 0 {
+			usedIds[cfg.PduSessId] = true
+		}
+	}
+
+	p.PPduSessions = nil
+	for i, cfg := range sessions {
+		if cfg == nil {
+			return fmt.Errorf("pdu session %v: empty", i+1)
+		}
+		id := cfg.PduSessId
+		if id == 0 {
+			var err error
+			id, err = nextPduSessionId(usedIds)
+			if err != nil {
+				return fmt.Errorf("pdu session %v: %v", i+1, err)
+			}
+		}
+		params, err := p.parsePduSession(cfg, id)
+		if err != nil {
+			return fmt.Errorf("pdu session %v: %v", i+1, err)
+		}
+		if p.findPduSession(params.PduSessId) != nil {
+			return fmt.Errorf("duplicate pduSessionId:%v", params.PduSessId)
+		}
+		p.PPduSessions = append(p.PPduSessions, params)
+	}
+
+	for _, itr := range p.Iterations {
+		if itr == nil {
+			continue
+		}
+		for i, step := range itr.Steps {
+			if step == nil {
+				continue
+			}
+			for _, id := range step.PduSessionIds {
+				if id <= 0 || id > 15 || p.findPduSession(uint8(id)) == nil {
+					return fmt.Errorf("iteration %v, step %v: unknown pduSessionId:%v",
+						itr.Name, i+1, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// nextPduSessionId returns the first PDU session ID from
+// DEFAULT_PDU_SESSION_ID onwards, wrapping around to 1, not in use and marks
+// it as used
+func nextPduSessionId(usedIds map[int]bool) (int, error) {
+	for i := 0; i < 15; i++ {
+		id := (DEFAULT_PDU_SESSION_ID-1+i)%15 + 1
+		if !usedIds[id] {
+			usedIds[id] = true
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no pduSessionId left in range 1-15")
+}
+
+func (p *Profile) parsePduSession(cfg *PduSessionConfig, id int) (
+	*common.PduSessionParams, error) {
+	params := &common.PduSessionParams{
+		Dnn:    cfg.Dnn,
+		SNssai: cfg.SNssai,
+	}
+
+	if id < 1 || id > 15 {
+		return nil, fmt.Errorf("invalid pduSessionId:%v, should be in range 1-15", id)
+	}
+	params.PduSessId = uint8(id)
+
+	if params.Dnn == "" {
+		params.Dnn = p.Dnn
+	}
+	if params.SNssai == nil {
+		params.SNssai = p.SNssai
+	}
+
+	switch strings.ToLower(cfg.PduSessType) {
+	case "", "ipv4":
+		params.PduSessType = nasMessage.PDUSessionTypeIPv4
+	case "ipv6":
+		params.PduSessType = nasMessage.PDUSessionTypeIPv6
+	case "ipv4v6":
+		params.PduSessType = nasMessage.PDUSessionTypeIPv4IPv6
+	default:
+		return nil, fmt.Errorf("unsupported pduSessionType:%v", cfg.PduSessType)
+	}
+
+	// The user data packets are sent to the AS address of the selected
+	// address family
+	family := strings.ToLower(cfg.DataAddrFamily)
+	if family == "" {
+		family = "ipv4"
+		if params.PduSessType == nasMessage.PDUSessionTypeIPv6 {
+			family = "ipv6"
+		}
+	}
+	switch family {
+	case "ipv4":
+		if params.PduSessType == nasMessage.PDUSessionTypeIPv6 {
+			return nil, fmt.Errorf("dataAddressFamily ipv4 not supported by pduSessionType:%v",
+				cfg.PduSessType)
+		}
+		params.DefaultAs = cfg.DefaultAs
+		if params.DefaultAs == "" {
+			params.DefaultAs = p.DefaultAs
+		}
+		if params.DefaultAs != "" {
+			if ip := net.ParseIP(params.DefaultAs); ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid ipv4 defaultAs:%v", params.DefaultAs)
+			}
+		}
+	case "ipv6":
+		if params.PduSessType == nasMessage.PDUSessionTypeIPv4 {
+			return nil, fmt.Errorf("dataAddressFamily ipv6 not supported by pduSessionType:%v",
+				cfg.PduSessType)
+		}
+		params.DefaultAs = cfg.DefaultAsV6
+		if params.DefaultAs == "" {
+			params.DefaultAs = p.DefaultAsV6
+		}
+		// required once user data is generated, the profile may not send any
+		if params.DefaultAs != "" {
+			if ip := net.ParseIP(params.DefaultAs); ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("invalid ipv6 defaultAsV6:%v", params.DefaultAs)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dataAddressFamily:%v", cfg.DataAddrFamily)
+	}
+
+	switch cfg.SscMode {
+	case 0:
+		params.SscMode = 1
+	case 1, 2, 3:
+		params.SscMode = uint8(cfg.SscMode)
+	default:
+		return nil, fmt.Errorf("invalid sscMode:%v, should be in range 1-3", cfg.SscMode)
+	}
+	return params, nil
+}
+
+func (p *Profile) findPduSession(id uint8) *common.PduSessionParams {
+	for _, params := range p.PPduSessions {
+		if params.PduSessId == id {
+			return params
+		}
+	}
+	return nil
+}
+
+// GetPduSessions returns the PDU sessions the current step of the UE applies
+// to, all the PDU sessions of the profile unless the step selects some
+func (p *Profile) GetPduSessions(pCtx *ProfileUeContext) []*common.PduSessionParams {
+	step := p.currentStep(pCtx)
+	if step == nil || len(step.PduSessionIds) == 0 {
+		return p.PPduSessions
+	}
+
+	var sessions []*common.PduSessionParams
+	for _, id := range step.PduSessionIds {
+		if params := p.findPduSession(id); params != nil {
+			sessions = append(sessions, params)
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInitPduSessionsImplicitIds(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []int // configured pduSessionId, 0 if unset
+		want []uint8
+	}{
+		{"default", nil, []uint8{10}},
+		{"in order", []int{0, 0, 0}, []uint8{10, 11, 12}},
+		{"explicit ids skipped", []int{0, 11, 0, 10}, []uint8{12, 11, 13, 10}},
+		{"wrap around", []int{15, 0, 0, 0, 0, 0, 0}, []uint8{15, 10, 11, 12, 13, 14, 1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Profile{}
+			for _, id := range tc.ids {
+				p.PduSessions = append(p.PduSessions, &PduSessionConfig{PduSessId: id})
+			}
+			if err := p.InitPduSessions(); err != nil {
+				t.Fatalf("InitPduSessions() returned: %v", err)
+			}
+			var got []uint8
+			for _, params := range p.PPduSessions {
+				got = append(got, params.PduSessId)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("pdu session ids = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInitPduSessionsIdsExhausted(t *testing.T) {
+	p := &Profile{}
+	p.PduSessions = append(p.PduSessions, &PduSessionConfig{PduSessId: 3})
+	for i := 0; i < 14; i++ {
+		p.PduSessions = append(p.PduSessions, &PduSessionConfig{})
+	}
+	if err := p.InitPduSessions(); err != nil {
+		t.Fatalf("InitPduSessions() returned: %v", err)
+	}
+
+	p.PduSessions = append(p.PduSessions, &PduSessionConfig{})
+	if err := p.InitPduSessions(); err == nil {
+		t.Errorf("InitPduSessions() accepted 16 pdu sessions")
+	}
+}
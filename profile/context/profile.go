@@ -6,18 +6,34 @@
 package context
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/util/nassecurity"
+	"github.com/omec-project/gnbsim/util/suci"
 
 	"github.com/omec-project/openapi/models"
 	"github.com/sirupsen/logrus"
 )
 
 const PER_USER_TIMEOUT uint32 = 100 //seconds
+
+const (
+	IMEI_LEN    int    = 15 // TAC, serial number and check digit
+	IMEISV_LEN  int    = 16 // TAC, serial number and software version number
+	TAC_SNR_LEN int    = 14
+	TAC_SNR_MAX uint64 = 100000000000000
+)
+
 var SummaryChan = make(chan common.InterfaceMessage)
 
 type ProcedureEventsDetails struct {
@@ -27,35 +43,35 @@ type ProcedureEventsDetails struct {
 var ProceduresMap map[common.ProcedureType]*ProcedureEventsDetails
 var ProfileMap map[string]*Profile
 
-type PIterations struct {
-	Name    string
-	ProcMap map[int]common.ProcedureType
-	WaitMap map[int]int
-	NextItr string
-	Repeat  int
-}
+// Guards ProfileMap, profiles are added by the REST interface at run time
+var profileMapMu sync.RWMutex
 
-type Iterations struct {
-	Name    string `yaml:"name"`
-	First   string `yaml:"1"`
-	Second  string `yaml:"2"`
-	Third   string `yaml:"3"`
-	Fourth  string `yaml:"4"`
-	Fifth   string `yaml:"5"`
-	Sixth   string `yaml:"6"`
-	Seventh string `yaml:"7"`
-	Next    string `yaml:"next"`
-	Repeat  int    `yaml:"repeat"`
-}
+// Parent of the contexts of all the profiles, cancelled on shutdown
+var rootCtx, rootCancel = context.WithCancel(context.Background())
 
 type ProfileUeContext struct {
 	TrigEventsChan   chan *common.ProfileMessage  // Receiving Events from the REST interface
 	WriteSimChan     chan common.InterfaceMessage // Sending events to SIMUE -  start proc and proc parameters
 	ReadChan         chan *common.ProfileMessage  // simUe to profile ?
 	Repeat           int                          // used only if UE is part of custom profile
+	StepRepeat       int                          // remaining executions of the current step. Used in custom profile
 	CurrentItr       string                       // used only if UE is part of custom profile
 	CurrentProcIndex int                          // current procedure index. Used in custom profile
 	Procedure        common.ProcedureType
+	Result           *common.UeResult // outcome of the procedures run by the UE
+	Supi             string
+
+	// Execution state of the UE, reported over the REST interface
+	status      string
+	err         string
+	lastEvent   common.EventType
+	guti        string
+	pduSessions []*PduSessionState
+
+	// Cancelled to abort the execution of the UE
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
 
 	/* logger */
 	Log *logrus.Entry
@@ -73,6 +89,7 @@ type Profile struct {
 	DataPktCount   int            `yaml:"dataPktCount" json:"dataPktCount"`
 	PerUserTimeout uint32         `yaml:"perUserTimeout" json:"perUserTimeout"`
 	DefaultAs      string         `yaml:"defaultAs" json:"defaultAs"`
+	DefaultAsV6    string         `yaml:"defaultAsV6" json:"defaultAsV6"`
 	Key            string         `yaml:"key" json:"key"`
 	Opc            string         `yaml:"opc" json:"opc"`
 	SeqNum         string         `yaml:"sequenceNumber" json:"sequenceNumber"`
@@ -81,17 +98,86 @@ type Profile struct {
 	ExecInParallel bool           `yaml:"execInParallel" json:"execInParallel"`
 	StepTrigger    bool           `yaml:"stepTrigger" json:"stepTrigger"`
 	StartIteration string         `yaml:"startiteration" json:"startiteration"`
-	Iterations     []*Iterations  `yaml:"iterations"`
+	Iterations     []*Iterations  `yaml:"iterations" json:"iterations"`
+	CallModel      *CallModel     `yaml:"callModel" json:"callModel"`
+
+	// gNB the UEs are handed over to by the N2 handover procedure, they are
+	// handed back to gnbName when they already moved to it
+	TargetGnbName string `yaml:"targetGnbName" json:"targetGnbName"`
+
+	// PDU sessions established by the UEs, a single PDU session with the
+	// dnn, sNssai and defaultAs above unless configured
+	PduSessions []*PduSessionConfig `yaml:"pduSessions" json:"pduSessions"`
+
+	// Deregister the registered UEs when the profile is aborted, otherwise
+	// only their NG signalling connections are released
+	DeregisterOnAbort bool `yaml:"deregisterOnAbort" json:"deregisterOnAbort"`
+
+	// Wait for the T3346 back-off timer of a reject before running the next
+	// procedure of the UE
+	HonourT3346 bool `yaml:"honourT3346" json:"honourT3346"`
+
+	// Register the UE again when the network rejects its service request
+	// because it implicitly deregistered the UE or cannot derive its identity.
+	// The service request procedure passes once the UE is registered again
+	ReRegisterOnReject bool `yaml:"reRegisterOnReject" json:"reRegisterOnReject"`
+
+	// NAS security algorithms advertised by the UEs, NEA0-3 and NIA0-3
+	CipheringAlgs []string `yaml:"cipheringAlgs" json:"cipheringAlgs"`
+	IntegrityAlgs []string `yaml:"integrityAlgs" json:"integrityAlgs"`
+
+	// SUCI computation of the UEs, the null scheme unless configured
+	Suci *SuciConfig `yaml:"suci" json:"suci"`
+
+	// PEI of the first UE, the next UEs are given the next serial numbers.
+	// The check digit of the IMEI is recomputed for each UE
+	StartImei   string `yaml:"startImei" json:"startImei"`     // 15 digits
+	StartImeiSv string `yaml:"startImeiSv" json:"startImeiSv"` // 16 digits
 
 	PIterations map[string]*PIterations
 	Procedures  []common.ProcedureType
 
+	// Parsed cipheringAlgs and integrityAlgs
+	PCipheringAlgs []uint8
+	PIntegrityAlgs []uint8
+
+	// Parsed suci
+	PSuci *suci.Params
+
+	// Parsed pduSessions
+	PPduSessions []*common.PduSessionParams
+
+	// Parsed startImei and startImeiSv, the TAC and serial number
+	imei   uint64
+	imeiSv uint64
+
 	// Profile routine reads messages from other entities on this channel
 	// Entities can be SimUe, Main routine.
 	ReadChan chan *common.ProfileMessage
 
 	PSimUe map[string]*ProfileUeContext
 
+	// Collects execution time of the procedures run by the UEs
+	LatencyRecorder *common.LatencyRecorder
+
+	// Tracks the SimUe routines of the profile, waited upon to release the
+	// UEs of an aborted profile
+	SimUeWaitGrp sync.WaitGroup
+
+	// Execution state of the profile, reported over the REST interface
+	status    string
+	startTime time.Time
+	endTime   time.Time
+	summary   *common.SummaryMessage
+	mu        sync.Mutex
+
+	// Cancelled to abort the execution of the profile
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed when the execution of the profile is over
+	done chan struct{}
+
 	/* logger */
 	Log *logrus.Entry
 }
@@ -105,21 +191,46 @@ func (profile *Profile) Init() {
 	profile.ReadChan = make(chan *common.ProfileMessage)
 	profile.PSimUe = make(map[string]*ProfileUeContext)
 	profile.Log = logger.ProfileLog.WithField(logger.FieldProfile, profile.Name)
+	profile.status = common.STATUS_NOT_STARTED
+	profile.ctx, profile.cancel = context.WithCancel(rootCtx)
+	profile.done = make(chan struct{})
 	if profile.DataPktCount == 0 {
 		profile.DataPktCount = 5 // default
 	}
 	if profile.DefaultAs == "" {
 		profile.DefaultAs = "192.168.250.1" // default destination for AIAB
 	}
+	profileMapMu.Lock()
 	ProfileMap[profile.Name] = profile
+	profileMapMu.Unlock()
 	profile.Log.Traceln("profile initialized ", profile.Name, ", Enable ", profile.Enable)
 }
 
+func GetProfile(name string) *Profile {
+	profileMapMu.RLock()
+	defer profileMapMu.RUnlock()
+	return ProfileMap[name]
+}
+
+// GetProfiles returns all the known profiles sorted by name
+func GetProfiles() []*Profile {
+	profileMapMu.RLock()
+	defer profileMapMu.RUnlock()
+	profiles := make([]*Profile, 0, len(ProfileMap))
+	for _, profile := range ProfileMap {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles
+}
+
 // enable step trigger only if execParallel is enabled in profile
 func SendStepEventProfile(name string) error {
-	profile, found := ProfileMap[name]
-	if found == false {
-		err := fmt.Errorf("unknown profile:%s", profile)
+	profile := GetProfile(name)
+	if profile == nil {
+		err := fmt.Errorf("unknown profile:%s", name)
 		log.Println(err)
 		return err
 	}
@@ -132,26 +243,41 @@ func SendStepEventProfile(name string) error {
 	// msg.Supi =
 	// msg.ProcedureType =
 	msg.Event = common.PROFILE_STEP_EVENT
-	for _, ctx := range profile.PSimUe {
+	for _, ctx := range profile.GetUeContexts() {
+		// UEs which are over do not wait for the trigger anymore
+		if !ctx.IsRunning() {
+			continue
+		}
 		profile.Log.Traceln("profile ", profile, ", writing on trig channel - start")
-		ctx.TrigEventsChan <- msg
+		select {
+		case ctx.TrigEventsChan <- msg:
+		case <-ctx.Context().Done():
+		case <-profile.Done():
+		}
 		profile.Log.Traceln("profile ", profile, ", writing on trig channel - end")
 	}
 	return nil
 }
 
 func SendAddNewCallsEventProfile(name string, number int32) error {
-	profile, found := ProfileMap[name]
-	if found == false {
-		err := fmt.Errorf("unknown profile:%s", profile)
+	profile := GetProfile(name)
+	if profile == nil {
+		err := fmt.Errorf("unknown profile:%s", name)
 		return err
 	}
+	if !profile.IsRunning() {
+		return fmt.Errorf("profile:%s is not running", name)
+	}
 	msg := &common.ProfileMessage{}
 	msg.Event = common.PROFILE_ADDCALLS_EVENT
 	var i int32
 	for i = 0; i < number; i++ {
 		profile.Log.Traceln("profile ", profile, ", writing on trig channel - start")
-		profile.ReadChan <- msg
+		select {
+		case profile.ReadChan <- msg:
+		case <-profile.Done():
+			return fmt.Errorf("profile:%s is not running", name)
+		}
 		profile.Log.Traceln("profile ", profile, ", writing on trig channel - end")
 	}
 	return nil
@@ -181,6 +307,146 @@ func (p *Profile) CheckCurrentEvent(Procedure common.ProcedureType, triggerEvent
 	return err
 }
 
+// InitSecurityAlgorithms parses the NAS security algorithms advertised by the
+// UEs of the profile, NEA0 and NIA2 unless configured
+func (p *Profile) InitSecurityAlgorithms() (err error) {
+	if len(p.CipheringAlgs) == 0 {
+		p.CipheringAlgs = []string{"NEA0"}
+	}
+	if len(p.IntegrityAlgs) == 0 {
+		p.IntegrityAlgs = []string{"NIA2"}
+	}
+	p.PCipheringAlgs, err = nassecurity.ParseCipheringAlgs(p.CipheringAlgs)
+	if err != nil {
+		return fmt.Errorf("invalid cipheringAlgs: %v", err)
+	}
+	p.PIntegrityAlgs, err = nassecurity.ParseIntegrityAlgs(p.IntegrityAlgs)
+	if err != nil {
+		return fmt.Errorf("invalid integrityAlgs: %v", err)
+	}
+	return nil
+}
+
+// SuciConfig selects how the UEs conceal their SUPI. homeNetworkPublicKey is
+// a hex string, the X25519 key for profileA and the compressed or
+// uncompressed secp256r1 key for profileB
+type SuciConfig struct {
+	ProtectionScheme       string `yaml:"protectionScheme" json:"protectionScheme"` // null, profileA or profileB
+	HomeNetworkPublicKey   string `yaml:"homeNetworkPublicKey" json:"homeNetworkPublicKey"`
+	HomeNetworkPublicKeyId int    `yaml:"homeNetworkPublicKeyId" json:"homeNetworkPublicKeyId"`
+	RoutingIndicator       string `yaml:"routingIndicator" json:"routingIndicator"` // 1 to 4 digits
+}
+
+// InitSuci parses the SUCI configuration of the profile. The null scheme and
+// routing indicator "0" are used unless configured
+func (p *Profile) InitSuci() error {
+	cfg := p.Suci
+	if cfg == nil {
+		cfg = &SuciConfig{}
+	}
+	if cfg.RoutingIndicator == "" {
+		cfg.RoutingIndicator = "0"
+	}
+
+	params := &suci.Params{}
+	var err error
+	params.RoutingIndicator, err = suci.EncodeRoutingIndicator(cfg.RoutingIndicator)
+	if err != nil {
+		return fmt.Errorf("invalid suci: %v", err)
+	}
+	params.ProtectionScheme, err = suci.ParseProtectionScheme(cfg.ProtectionScheme)
+	if err != nil {
+		return fmt.Errorf("invalid suci: %v", err)
+	}
+	if cfg.HomeNetworkPublicKeyId < 0 || cfg.HomeNetworkPublicKeyId > 255 {
+		return fmt.Errorf("invalid suci: homeNetworkPublicKeyId should be in range 0-255")
+	}
+	params.HomeNetworkPublicKeyId = uint8(cfg.HomeNetworkPublicKeyId)
+
+	if params.ProtectionScheme == suci.NULL_SCHEME {
+		if cfg.HomeNetworkPublicKey != "" || params.HomeNetworkPublicKeyId != 0 {
+			return fmt.Errorf("invalid suci: home network public key not used by the null scheme")
+		}
+	} else {
+		params.HomeNetworkPublicKey, err = hex.DecodeString(cfg.HomeNetworkPublicKey)
+		if err != nil || len(params.HomeNetworkPublicKey) == 0 {
+			return fmt.Errorf("invalid suci: homeNetworkPublicKey should be a hex string")
+		}
+		err = suci.ValidatePublicKey(params.ProtectionScheme, params.HomeNetworkPublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid suci: %v", err)
+		}
+	}
+
+	p.PSuci = params
+	return nil
+}
+
+// InitPei validates the IMEI and IMEISV of the first UE of the profile
+func (p *Profile) InitPei() error {
+	if p.StartImei != "" {
+		if len(p.StartImei) != IMEI_LEN || !isDigits(p.StartImei) {
+			return fmt.Errorf("invalid startImei: should have %v digits", IMEI_LEN)
+		}
+		p.imei, _ = strconv.ParseUint(p.StartImei[:TAC_SNR_LEN], 10, 64)
+	}
+	if p.StartImeiSv != "" {
+		if len(p.StartImeiSv) != IMEISV_LEN || !isDigits(p.StartImeiSv) {
+			return fmt.Errorf("invalid startImeiSv: should have %v digits", IMEISV_LEN)
+		}
+		p.imeiSv, _ = strconv.ParseUint(p.StartImeiSv[:TAC_SNR_LEN], 10, 64)
+	}
+	return nil
+}
+
+// GetPei returns the IMEI and IMEISV of the UE, as per TS 23.003 Section
+// 6.2. They are empty if not configured
+func (p *Profile) GetPei(supi string) (imei, imeiSv string) {
+	var offset uint64
+	start, err1 := strconv.ParseUint(p.StartImsi, 10, 64)
+	imsi, err2 := strconv.ParseUint(strings.TrimPrefix(supi, "imsi-"), 10, 64)
+	if err1 == nil && err2 == nil && imsi > start {
+		offset = imsi - start
+	}
+
+	if p.StartImei != "" {
+		imei = fmt.Sprintf("%014d", (p.imei+offset)%TAC_SNR_MAX)
+		imei += strconv.Itoa(int(luhnCheckDigit(imei)))
+	}
+	if p.StartImeiSv != "" {
+		imeiSv = fmt.Sprintf("%014d", (p.imeiSv+offset)%TAC_SNR_MAX)
+		imeiSv += p.StartImeiSv[TAC_SNR_LEN:]
+	}
+	return imei, imeiSv
+}
+
+// luhnCheckDigit computes the check digit of an IMEI, as per TS 23.003
+// Annex B
+func luhnCheckDigit(digits string) uint8 {
+	var sum uint8
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i] - '0'
+		// every other digit is doubled, starting with the rightmost one
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 func (p *Profile) GetFirstProcedure() common.ProcedureType {
 	if len(p.Procedures) == 0 {
 		p.Log.Fatalln("Procedure List Empty")
@@ -229,45 +495,10 @@ func (p *Profile) GetNextProcedure(pCtx *ProfileUeContext, currentProcedure comm
 		return nextProcedure
 	}
 
-	// check if custom Profile
-	if len(p.Iterations) > 0 {
-		pCtx.Log.Infoln("Current UE iteration ", pCtx.CurrentItr)
-		pCtx.Log.Infoln("Current UE procedure index  ", pCtx.CurrentProcIndex)
-		itp, found := p.PIterations[pCtx.CurrentItr]
-		pCtx.Log.Infoln("Current Iteration map - ", itp)
-		if itp.WaitMap[pCtx.CurrentProcIndex] != 0 {
-			time.Sleep(time.Second * time.Duration(itp.WaitMap[pCtx.CurrentProcIndex]))
-		}
-		nextProcIndex := pCtx.CurrentProcIndex + 1
-		nextProcedure, found := itp.ProcMap[nextProcIndex]
-		if found == true {
-			pCtx.Log.Infof("Next Procedure Index %v and next Procedure = %v ", nextProcIndex, nextProcedure)
-			pCtx.Procedure = nextProcedure
-			pCtx.CurrentProcIndex = nextProcIndex
-			pCtx.Log.Infoln("Updated procedure to", nextProcedure)
-			return nextProcedure
-		}
-		if pCtx.Repeat > 0 {
-			pCtx.Repeat = pCtx.Repeat - 1
-			pCtx.Log.Infoln("Repeat current iteration : ", itp.Name, ", Repeat Count ", pCtx.Repeat)
-			pCtx.CurrentProcIndex = 1
-			nextProcedure := itp.ProcMap[1]
-			pCtx.Procedure = nextProcedure
-			return nextProcedure
-		}
-		pCtx.Log.Infoln("Iteration Complete ", pCtx.CurrentItr)
-		nextItr := itp.NextItr
-		if nextItr != "quit" {
-			nItr := p.PIterations[nextItr]
-			pCtx.Log.Infoln("Going to next iteration ", nItr.Name)
-			pCtx.CurrentItr = nItr.Name
-			pCtx.CurrentProcIndex = 1
-			pCtx.Repeat = nItr.Repeat
-			nextProcedure := nItr.ProcMap[1]
-			pCtx.Procedure = nextProcedure
-			return nextProcedure
-		}
+	// custom profile
+	nextProcedure = p.getNextStepProcedure(pCtx)
+	if nextProcedure == 0 {
+		pCtx.Log.Infoln("Nothing more to execute for UE")
 	}
-	pCtx.Log.Infoln("Nothing more to execute for UE")
 	return nextProcedure
 }
@@ -0,0 +1,360 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omec-project/gnbsim/common"
+	"github.com/omec-project/gnbsim/logger"
+)
+
+// ProfileState is a snapshot of the execution state of a profile
+type ProfileState struct {
+	Name          string     `json:"profileName"`
+	Type          string     `json:"profileType"`
+	Status        string     `json:"status"`
+	UeCount       int        `json:"ueCount"`
+	UePassedCount uint       `json:"uePassedCount"`
+	UeFailedCount uint       `json:"ueFailedCount"`
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	EndTime       *time.Time `json:"endTime,omitempty"`
+}
+
+// UeState is a snapshot of the execution state of a UE
+type UeState struct {
+	Supi             string             `json:"supi"`
+	Status           string             `json:"status"`
+	CurrentIteration string             `json:"currentIteration,omitempty"`
+	CurrentProcIndex int                `json:"currentProcIndex,omitempty"`
+	Procedure        string             `json:"procedure,omitempty"`
+	LastEvent        string             `json:"lastEvent,omitempty"`
+	Guti             string             `json:"guti,omitempty"`
+	PduSessions      []*PduSessionState `json:"pduSessions"`
+	Error            string             `json:"error,omitempty"`
+}
+
+type PduSessionState struct {
+	PduSessId    int64  `json:"pduSessionId"`
+	PduSessType  string `json:"pduSessionType"`
+	PduAddress   string `json:"pduAddress,omitempty"`
+	PduAddressV6 string `json:"pduAddressV6,omitempty"`
+	Dnn          string `json:"dnn,omitempty"`
+	SNssai       string `json:"sNssai,omitempty"`
+}
+
+func NewProfileUeContext(ctx context.Context, supi string, startItr string) *ProfileUeContext {
+	pCtx := &ProfileUeContext{}
+	pCtx.ctx, pCtx.cancel = context.WithCancel(ctx)
+	pCtx.Supi = supi
+	pCtx.CurrentItr = startItr
+	pCtx.ReadChan = make(chan *common.ProfileMessage)
+	pCtx.TrigEventsChan = make(chan *common.ProfileMessage)
+	pCtx.status = common.STATUS_NOT_STARTED
+	pCtx.pduSessions = make([]*PduSessionState, 0)
+	pCtx.Log = logger.ProfUeCtxLog.WithField(logger.FieldSupi, supi)
+	return pCtx
+}
+
+func (pCtx *ProfileUeContext) setProcedure(itr string, index int, procedure common.ProcedureType) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.CurrentItr = itr
+	pCtx.CurrentProcIndex = index
+	pCtx.Procedure = procedure
+}
+
+// SetCurrentProcedure records the procedure being executed by the UE
+func (pCtx *ProfileUeContext) SetCurrentProcedure(procedure common.ProcedureType) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.Procedure = procedure
+}
+
+func (pCtx *ProfileUeContext) SetStatus(status string) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.status = status
+}
+
+func (pCtx *ProfileUeContext) IsRunning() bool {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	return pCtx.status == common.STATUS_RUNNING
+}
+
+// SetFinished records the outcome of the execution of the UE
+func (pCtx *ProfileUeContext) SetFinished(result *common.UeResult) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.status = result.Status
+	pCtx.err = result.Error
+}
+
+func (pCtx *ProfileUeContext) SetLastEvent(event common.EventType) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.lastEvent = event
+}
+
+// SetIdentities records the GUTI and the PDU sessions currently held by the UE
+func (pCtx *ProfileUeContext) SetIdentities(guti string, pduSessions []*PduSessionState) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	pCtx.guti = guti
+	pCtx.pduSessions = pduSessions
+}
+
+// Identities returns the GUTI and the PDU sessions currently held by the UE
+func (pCtx *ProfileUeContext) Identities() (string, []*PduSessionState) {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	return pCtx.guti, pCtx.pduSessions
+}
+
+// Abort requests the UE to stop executing its procedures. Returns an error if
+// the UE has already finished or is being aborted
+func (pCtx *ProfileUeContext) Abort() error {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	if pCtx.ctx.Err() != nil {
+		return fmt.Errorf("ue:%v already aborted", pCtx.Supi)
+	}
+	if pCtx.status != common.STATUS_NOT_STARTED && pCtx.status != common.STATUS_RUNNING {
+		return fmt.Errorf("ue:%v not running, status:%v", pCtx.Supi, pCtx.status)
+	}
+	pCtx.Log.Infoln("Aborting UE")
+	pCtx.cancel()
+	return nil
+}
+
+// Context returns the context of the UE, which is cancelled when the UE or
+// its profile is aborted
+func (pCtx *ProfileUeContext) Context() context.Context {
+	return pCtx.ctx
+}
+
+func (pCtx *ProfileUeContext) State() *UeState {
+	pCtx.mu.Lock()
+	defer pCtx.mu.Unlock()
+	state := &UeState{
+		Supi:             pCtx.Supi,
+		Status:           pCtx.status,
+		CurrentIteration: pCtx.CurrentItr,
+		CurrentProcIndex: pCtx.CurrentProcIndex,
+		Guti:             pCtx.guti,
+		PduSessions:      pCtx.pduSessions,
+		Error:            pCtx.err,
+	}
+	if pCtx.Procedure != 0 {
+		state.Procedure = pCtx.Procedure.String()
+	}
+	if pCtx.lastEvent != 0 {
+		state.LastEvent = pCtx.lastEvent.String()
+	}
+	return state
+}
+
+// AddUeContext adds the context of a UE to the profile
+func (p *Profile) AddUeContext(pCtx *ProfileUeContext) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PSimUe[pCtx.Supi] = pCtx
+}
+
+func (p *Profile) GetUeContext(supi string) *ProfileUeContext {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.PSimUe[supi]
+}
+
+// GetUeContexts returns the contexts of all the UEs of the profile sorted by
+// SUPI
+func (p *Profile) GetUeContexts() []*ProfileUeContext {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ues := make([]*ProfileUeContext, 0, len(p.PSimUe))
+	for _, pCtx := range p.PSimUe {
+		ues = append(ues, pCtx)
+	}
+	sort.Slice(ues, func(i, j int) bool {
+		return ues[i].Supi < ues[j].Supi
+	})
+	return ues
+}
+
+// Start marks the profile as running and resets its execution summary. It
+// has no effect if the profile is already running
+func (p *Profile) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status == common.STATUS_RUNNING {
+		return
+	}
+	p.status = common.STATUS_RUNNING
+	p.startTime = time.Now()
+	p.summary = &common.SummaryMessage{
+		ProfileType: p.ProfileType,
+		ProfileName: p.Name,
+		ErrorList:   make([]error, 0, 10),
+	}
+	p.LatencyRecorder = common.NewLatencyRecorder()
+}
+
+// Finish marks the end of the execution of the profile and sends its
+// execution summary over summaryChan
+func (p *Profile) Finish(summaryChan chan common.InterfaceMessage) {
+	summaryChan <- p.finish()
+	close(p.done)
+}
+
+func (p *Profile) finish() *common.SummaryMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endTime = time.Now()
+	p.summary.ProcLatency = p.LatencyRecorder.Summarize()
+	p.summary.ProcFailLatency = p.LatencyRecorder.SummarizeFailures()
+	switch {
+	case p.ctx.Err() != nil:
+		p.status = common.STATUS_ABORTED
+		p.summary.Aborted = true
+	case len(p.summary.ErrorList) != 0 || p.summary.UeFailedCount != 0:
+		p.status = common.STATUS_FAIL
+	default:
+		p.status = common.STATUS_PASS
+	}
+	return p.copySummary()
+}
+
+// Fail marks the profile as failed before it could be executed
+func (p *Profile) Fail() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = common.STATUS_FAIL
+}
+
+// AddUeResult counts the outcome of the execution of a UE in the summary
+func (p *Profile) AddUeResult(pCtx *ProfileUeContext, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.summary.UeFailedCount++
+		p.summary.ErrorList = append(p.summary.ErrorList, err)
+	} else {
+		p.summary.UePassedCount++
+	}
+	p.summary.UeResults = append(p.summary.UeResults, pCtx.Result)
+}
+
+func (p *Profile) AddError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.summary.ErrorList = append(p.summary.ErrorList, err)
+}
+
+// GetSummary returns a copy of the execution summary collected so far, nil
+// if the profile has not been started
+func (p *Profile) GetSummary() *common.SummaryMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.summary == nil {
+		return nil
+	}
+	return p.copySummary()
+}
+
+func (p *Profile) copySummary() *common.SummaryMessage {
+	summary := *p.summary
+	summary.ErrorList = append([]error(nil), p.summary.ErrorList...)
+	summary.UeResults = append([]*common.UeResult(nil), p.summary.UeResults...)
+	return &summary
+}
+
+// Abort stops the execution of all the UEs of the profile, releases them and
+// prevents the remaining ones from being started
+func (p *Profile) Abort() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status != common.STATUS_RUNNING {
+		return fmt.Errorf("profile:%v not running, status:%v", p.Name, p.status)
+	}
+	if p.ctx.Err() != nil {
+		return fmt.Errorf("profile:%v already aborted", p.Name)
+	}
+	p.Log.Infoln("Aborting profile")
+	p.cancel()
+	return nil
+}
+
+func (p *Profile) Aborted() bool {
+	return p.ctx.Err() != nil
+}
+
+// Context returns the context of the profile, which is cancelled when the
+// profile is aborted or gnbsim is shutting down
+func (p *Profile) Context() context.Context {
+	return p.ctx
+}
+
+// Done returns a channel which is closed when the execution of the profile
+// is over
+func (p *Profile) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until the execution summary of the profile has been sent, if
+// the profile has been started
+func (p *Profile) Wait() {
+	p.mu.Lock()
+	started := !p.startTime.IsZero()
+	p.mu.Unlock()
+	if started {
+		<-p.done
+	}
+}
+
+// Shutdown aborts all the profiles, including the ones which are yet to be
+// started
+func Shutdown() {
+	logger.ProfileLog.Infoln("Aborting all profiles")
+	rootCancel()
+}
+
+func IsShuttingDown() bool {
+	return rootCtx.Err() != nil
+}
+
+func (p *Profile) IsRunning() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status == common.STATUS_RUNNING
+}
+
+func (p *Profile) State() *ProfileState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := &ProfileState{
+		Name:    p.Name,
+		Type:    p.ProfileType,
+		Status:  p.status,
+		UeCount: len(p.PSimUe),
+	}
+	if p.summary != nil {
+		state.UePassedCount = p.summary.UePassedCount
+		state.UeFailedCount = p.summary.UeFailedCount
+	}
+	if !p.startTime.IsZero() {
+		startTime := p.startTime
+		state.StartTime = &startTime
+	}
+	if !p.endTime.IsZero() {
+		endTime := p.endTime
+		state.EndTime = &endTime
+	}
+	return state
+}
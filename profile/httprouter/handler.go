@@ -6,14 +6,18 @@
 package httprouter
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/omec-project/gnbsim/factory"
+	"github.com/omec-project/gnbsim/gnodeb"
 	"github.com/omec-project/gnbsim/logger"
 	profile "github.com/omec-project/gnbsim/profile"
 	profCtx "github.com/omec-project/gnbsim/profile/context"
+	"github.com/omec-project/gnbsim/report"
 	"github.com/omec-project/openapi"
 	"github.com/omec-project/openapi/models"
 )
@@ -91,9 +95,194 @@ func HTTPExecuteProfile(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, rsp)
 		return
 	}
-	logger.HttpLog.Debugf("%#v", prof)
+	logger.HttpLog.Debugf("%#v", &prof)
+
+	if profCtx.IsShuttingDown() {
+		sendProblem(c, http.StatusServiceUnavailable, "Shutting down",
+			"gnbsim is shutting down, no new profile can be executed")
+		return
+	}
+	if prof.Name == "" {
+		sendProblem(c, http.StatusBadRequest, "Malformed request syntax", "profileName not provided")
+		return
+	}
+	if existing := profCtx.GetProfile(prof.Name); existing != nil && existing.IsRunning() {
+		sendProblem(c, http.StatusConflict, "Profile already running",
+			fmt.Sprintf("profile:%v is already running", prof.Name))
+		return
+	}
 
 	prof.Init()
+	err = profile.InitProfile(&prof, profCtx.SummaryChan)
+	if err != nil {
+		sendProblem(c, http.StatusBadRequest, "Profile initialization failed", err.Error())
+		return
+	}
+	// Marking the profile as running here lets the caller know that the
+	// execution has started
+	prof.Start()
 	go profile.ExecuteProfile(&prof, profCtx.SummaryChan)
-	c.JSON(http.StatusOK, gin.H{})
+	c.JSON(http.StatusOK, prof.State())
+}
+
+func HTTPGetProfiles(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPGetProfiles!")
+	profiles := profCtx.GetProfiles()
+	states := make([]*profCtx.ProfileState, 0, len(profiles))
+	for _, prof := range profiles {
+		states = append(states, prof.State())
+	}
+	c.JSON(http.StatusOK, states)
+}
+
+func HTTPGetProfile(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPGetProfile!")
+	prof := getProfile(c)
+	if prof == nil {
+		return
+	}
+	c.JSON(http.StatusOK, prof.State())
+}
+
+// HTTPGetProfileSummary returns the execution summary of the UEs which have
+// finished so far
+func HTTPGetProfileSummary(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPGetProfileSummary!")
+	prof := getProfile(c)
+	if prof == nil {
+		return
+	}
+	summary := prof.GetSummary()
+	if summary == nil {
+		sendProblem(c, http.StatusNotFound, "Summary not available",
+			fmt.Sprintf("profile:%v has not been started", prof.Name))
+		return
+	}
+	rsp := report.NewProfileReport(summary)
+	rsp.Status = prof.State().Status
+	c.JSON(http.StatusOK, rsp)
+}
+
+func HTTPAbortProfile(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPAbortProfile!")
+	prof := getProfile(c)
+	if prof == nil {
+		return
+	}
+	if err := prof.Abort(); err != nil {
+		sendProblem(c, http.StatusConflict, "Profile not aborted", err.Error())
+		return
+	}
+	// UEs stop executing asynchronously
+	c.JSON(http.StatusAccepted, prof.State())
+}
+
+func HTTPGetUes(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPGetUes!")
+	prof := getProfile(c)
+	if prof == nil {
+		return
+	}
+	ues := prof.GetUeContexts()
+	states := make([]*profCtx.UeState, 0, len(ues))
+	for _, pCtx := range ues {
+		states = append(states, pCtx.State())
+	}
+	c.JSON(http.StatusOK, states)
+}
+
+func HTTPGetUe(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPGetUe!")
+	pCtx := getUeContext(c)
+	if pCtx == nil {
+		return
+	}
+	c.JSON(http.StatusOK, pCtx.State())
+}
+
+func HTTPAbortUe(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPAbortUe!")
+	pCtx := getUeContext(c)
+	if pCtx == nil {
+		return
+	}
+	if err := pCtx.Abort(); err != nil {
+		sendProblem(c, http.StatusConflict, "UE not aborted", err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, pCtx.State())
+}
+
+// HTTPNgReset resets the NG interface of the gNB with its AMFs, or only with
+// the AMF given by the amf query parameter as ip:port
+func HTTPNgReset(c *gin.Context) {
+	logger.HttpLog.Infoln("HTTPNgReset!")
+	gnbName := c.Param("gnb-name")
+	gnb, err := factory.AppConfig.Configuration.GetGNodeB(gnbName)
+	if err != nil {
+		sendProblem(c, http.StatusNotFound, "gNB not found", err.Error())
+		return
+	}
+
+	amfAddr, selected := c.GetQuery("amf")
+	amfs := []string{}
+	for _, amf := range gnb.GetAmfs() {
+		if selected && amf.String() != amfAddr {
+			continue
+		}
+		if err := gnodeb.ResetAmf(gnb, amf); err != nil {
+			if selected {
+				sendProblem(c, http.StatusConflict, "NG Reset failed", err.Error())
+				return
+			}
+			logger.HttpLog.Warnln("NG Reset skipped:", err)
+			continue
+		}
+		amfs = append(amfs, amf.String())
+	}
+	if selected && len(amfs) == 0 {
+		sendProblem(c, http.StatusNotFound, "AMF not found",
+			fmt.Sprintf("unknown amf:%v of gnb:%v", amfAddr, gnbName))
+		return
+	}
+	// Reset completes once the AMFs acknowledge it
+	c.JSON(http.StatusAccepted, gin.H{"amfs": amfs})
+}
+
+// getProfile returns the profile named in the request path. Sends a not found
+// response if there is no such profile
+func getProfile(c *gin.Context) *profCtx.Profile {
+	profName := c.Param("profile-name")
+	prof := profCtx.GetProfile(profName)
+	if prof == nil {
+		sendProblem(c, http.StatusNotFound, "Profile not found",
+			fmt.Sprintf("unknown profile:%v", profName))
+	}
+	return prof
+}
+
+// getUeContext returns the context of the UE identified in the request path.
+// Sends a not found response if there is no such UE
+func getUeContext(c *gin.Context) *profCtx.ProfileUeContext {
+	prof := getProfile(c)
+	if prof == nil {
+		return nil
+	}
+	supi := c.Param("supi")
+	pCtx := prof.GetUeContext(supi)
+	if pCtx == nil {
+		sendProblem(c, http.StatusNotFound, "UE not found",
+			fmt.Sprintf("unknown ue:%v in profile:%v", supi, prof.Name))
+	}
+	return pCtx
+}
+
+func sendProblem(c *gin.Context, status int, title, detail string) {
+	logger.HttpLog.Errorln(title, ":", detail)
+	problemDetail := models.ProblemDetails{
+		Title:  title,
+		Status: int32(status),
+		Detail: detail,
+	}
+	c.JSON(status, problemDetail)
 }
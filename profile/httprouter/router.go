@@ -88,4 +88,52 @@ var routes = Routes{
 		"/:profile-name/addNewCalls",
 		HTTPAddNewCallsProfile,
 	},
+	{
+		"GetProfiles",
+		strings.ToUpper("Get"),
+		"/profiles",
+		HTTPGetProfiles,
+	},
+	{
+		"GetProfile",
+		strings.ToUpper("Get"),
+		"/profiles/:profile-name",
+		HTTPGetProfile,
+	},
+	{
+		"AbortProfile",
+		strings.ToUpper("Delete"),
+		"/profiles/:profile-name",
+		HTTPAbortProfile,
+	},
+	{
+		"GetProfileSummary",
+		strings.ToUpper("Get"),
+		"/profiles/:profile-name/summary",
+		HTTPGetProfileSummary,
+	},
+	{
+		"GetUes",
+		strings.ToUpper("Get"),
+		"/profiles/:profile-name/ues",
+		HTTPGetUes,
+	},
+	{
+		"GetUe",
+		strings.ToUpper("Get"),
+		"/profiles/:profile-name/ues/:supi",
+		HTTPGetUe,
+	},
+	{
+		"AbortUe",
+		strings.ToUpper("Delete"),
+		"/profiles/:profile-name/ues/:supi",
+		HTTPAbortUe,
+	},
+	{
+		"NgReset",
+		strings.ToUpper("Post"),
+		"/gnbs/:gnb-name/ngReset",
+		HTTPNgReset,
+	},
 }
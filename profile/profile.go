@@ -13,7 +13,6 @@ import (
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/factory"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
-	"github.com/omec-project/gnbsim/logger"
 	profctx "github.com/omec-project/gnbsim/profile/context"
 	"github.com/omec-project/gnbsim/simue"
 )
@@ -28,6 +27,10 @@ const (
 	NW_TRIGG_UE_DEREG       string = "nwtriggeruedereg"
 	UE_REQ_PDU_SESS_RELEASE string = "uereqpdusessrelease"
 	NW_REQ_PDU_SESS_RELEASE string = "nwreqpdusessrelease"
+	UE_REQ_PDU_SESS_MODIFY  string = "uereqpdusessmodify"
+	NW_REQ_PDU_SESS_MODIFY  string = "nwreqpdusessmodify"
+	NG_RESET                string = "ngreset"
+	N2_HANDOVER             string = "n2handover"
 	CUSTOM_PROCEDURE        string = "custom"
 )
 
@@ -38,27 +41,51 @@ func InitializeAllProfiles() {
 	initProcedureEventMap()
 }
 
-func InitProfile(profile *profctx.Profile, summaryChan chan common.InterfaceMessage) {
+// InitProfile creates the UEs of the profile. On failure the profile is
+// marked as failed and its summary is sent on summaryChan
+func InitProfile(profile *profctx.Profile, summaryChan chan common.InterfaceMessage) (err error) {
 
-	summary := &common.SummaryMessage{
-		ProfileType: profile.ProfileType,
-		ProfileName: profile.Name,
-		ErrorList:   make([]error, 0, 10),
+	defer func() {
+		if err != nil {
+			profile.Fail()
+			summary := &common.SummaryMessage{
+				ProfileType: profile.ProfileType,
+				ProfileName: profile.Name,
+				ErrorList:   []error{err},
+			}
+			summaryChan <- summary
+		}
+	}()
+
+	err = initProcedureList(profile)
+	if err != nil {
+		return err
+	}
+
+	err = profile.InitSecurityAlgorithms()
+	if err != nil {
+		return err
 	}
 
-	err := initProcedureList(profile)
+	err = profile.InitSuci()
 	if err != nil {
-		summary.ErrorList = append(summary.ErrorList, err)
-		summaryChan <- summary
-		return
+		return err
+	}
+
+	err = profile.InitPei()
+	if err != nil {
+		return err
+	}
+
+	err = profile.InitPduSessions()
+	if err != nil {
+		return err
 	}
 
 	imsi, err := strconv.Atoi(profile.StartImsi)
 	if err != nil {
 		err = fmt.Errorf("invalid imsi value:%v", profile.StartImsi)
-		summary.ErrorList = append(summary.ErrorList, err)
-		summaryChan <- summary
-		return
+		return err
 	}
 	startImsi := imsi
 	profile.Imsi = imsi
@@ -73,9 +100,20 @@ func InitProfile(profile *profctx.Profile, summaryChan chan common.InterfaceMess
 	gnb, err := factory.AppConfig.Configuration.GetGNodeB(profile.GnbName)
 	if err != nil {
 		err = fmt.Errorf("Failed to fetch gNB context: %v", err)
-		summary.ErrorList = append(summary.ErrorList, err)
-		summaryChan <- summary
-		return
+		return err
+	}
+
+	if profile.TargetGnbName != "" {
+		if profile.TargetGnbName == profile.GnbName {
+			return fmt.Errorf("target gNB same as the gNB of the profile: %v",
+				profile.TargetGnbName)
+		}
+		_, err = factory.AppConfig.Configuration.GetGNodeB(profile.TargetGnbName)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch target gNB context: %v", err)
+		}
+	} else if profile.ProfileType == N2_HANDOVER {
+		return fmt.Errorf("targetGnbName missing in profile type: %v", N2_HANDOVER)
 	}
 
 	for count := 1; count <= profile.UeCount; count++ {
@@ -83,18 +121,13 @@ func InitProfile(profile *profctx.Profile, summaryChan chan common.InterfaceMess
 		initImsi(profile, gnb, imsiStr)
 		startImsi++
 	}
+	return nil
 }
 
 func initImsi(profile *profctx.Profile, gnb *gnbctx.GNodeB, imsiStr string) {
-	readChan := make(chan *common.ProfileMessage)
-	c := simue.InitUE(imsiStr, gnb, profile, readChan)
-	p := profctx.ProfileUeContext{WriteSimChan: c}
-	p.CurrentItr = profile.StartIteration
-	p.ReadChan = readChan
-	trigChan := make(chan *common.ProfileMessage)
-	p.TrigEventsChan = trigChan
-	p.Log = logger.ProfUeCtxLog.WithField(logger.FieldSupi, imsiStr)
-	profile.PSimUe[imsiStr] = &p
+	p := profctx.NewProfileUeContext(profile.Context(), imsiStr, profile.StartIteration)
+	p.WriteSimChan = simue.InitUE(imsiStr, gnb, profile, p, false)
+	profile.AddUeContext(p)
 }
 
 // option1 : Run default profile start to end..Once done Received
@@ -113,16 +146,16 @@ func ExecuteProfile(profile *profctx.Profile, summaryChan chan common.InterfaceM
 
 	profile.Log.Infoln("ExecuteProfile started ")
 	var wg sync.WaitGroup
-	var Mu sync.Mutex
 
-	summary := &common.SummaryMessage{
-		ProfileType: profile.ProfileType,
-		ProfileName: profile.Name,
-		ErrorList:   make([]error, 0, 10),
-	}
+	profile.Start()
 
 	defer func() {
-		summaryChan <- summary
+		if profile.Aborted() {
+			// Partial summary is reported once the UEs have been released
+			profile.Log.Infoln("Waiting for the UEs to be released")
+			profile.SimUeWaitGrp.Wait()
+		}
+		profile.Finish(summaryChan)
 	}()
 
 	go func() {
@@ -136,8 +169,7 @@ func ExecuteProfile(profile *profctx.Profile, summaryChan chan common.InterfaceM
 				gnb, err := factory.AppConfig.Configuration.GetGNodeB(profile.GnbName)
 				if err != nil {
 					err = fmt.Errorf("Failed to fetch gNB context: %v", err)
-					summary.ErrorList = append(summary.ErrorList, err)
-					summaryChan <- summary
+					profile.AddError(err)
 					return
 				}
 
@@ -146,46 +178,56 @@ func ExecuteProfile(profile *profctx.Profile, summaryChan chan common.InterfaceM
 				imsi := profile.Imsi + profile.UeCount
 				imsiStr := "imsi-" + strconv.Itoa(imsi)
 				initImsi(profile, gnb, imsiStr)
-				pCtx := profile.PSimUe[imsiStr]
+				pCtx := profile.GetUeContext(imsiStr)
 				profile.Log.Infoln("pCtx ", pCtx)
 				wg.Add(1)
 				go func(pCtx *profctx.ProfileUeContext) {
 					defer wg.Done()
 					err := simue.ImsiStateMachine(profile, pCtx, imsiStr, summaryChan)
 					// Execution for the UE is complete. Count UE result as success or failure
-					Mu.Lock()
-					if err != nil {
-						summary.UeFailedCount++
-						summary.ErrorList = append(summary.ErrorList, err)
-					} else {
-						summary.UePassedCount++
-					}
-					Mu.Unlock()
+					profile.AddUeResult(pCtx, err)
 				}(pCtx)
 				plock.Unlock()
+			case <-profile.Done():
+				return
 			}
 		}
 	}()
+	// UEs are launched as per the call model if one is configured, otherwise
+	// all of them are started at once. Without ExecInParallel, each UE is
+	// started once the previous one is done, and not before its arrival time
+	var pacer *profctx.CallPacer
+	if profile.CallModel != nil {
+		profile.Log.Infof("ExecuteProfile using call model %+v", *profile.CallModel)
+		pacer = profctx.NewCallPacer(profile.CallModel, profile.UeCount)
+	}
+
 	imsi := profile.Imsi
 	for count := 1; count <= profile.UeCount; count++ {
 		imsiStr := "imsi-" + strconv.Itoa(imsi)
 		imsi++
+		if pacer != nil {
+			if err := pacer.WaitForNextArrival(profile.Context()); err != nil {
+				profile.Log.Infoln("ExecuteProfile aborted. Not starting remaining UEs:", err)
+				break
+			}
+		}
+		if profile.Aborted() {
+			profile.Log.Infoln("ExecuteProfile aborted. Not starting remaining UEs")
+			break
+		}
 		wg.Add(1)
-		pCtx := profile.PSimUe[imsiStr]
+		pCtx := profile.GetUeContext(imsiStr)
 
-		go func(pCtx *profctx.ProfileUeContext) {
+		go func(pCtx *profctx.ProfileUeContext, imsiStr string) {
 			defer wg.Done()
+			if pacer != nil {
+				defer pacer.Done()
+			}
 			err := simue.ImsiStateMachine(profile, pCtx, imsiStr, summaryChan)
 			// Execution for the UE is complete. Count UE result as success or failure
-			Mu.Lock()
-			if err != nil {
-				summary.UeFailedCount++
-				summary.ErrorList = append(summary.ErrorList, err)
-			} else {
-				summary.UePassedCount++
-			}
-			Mu.Unlock()
-		}(pCtx)
+			profile.AddUeResult(pCtx, err)
+		}(pCtx, imsiStr)
 
 		if profile.ExecInParallel == false {
 			profile.Log.Infoln("ExecuteProfile ExecInParallel false. Waiting for UEs to finish procesessing")
@@ -207,6 +249,7 @@ func initProcedureEventMap() {
 	proc1.Events = map[common.EventType]common.EventType{
 		common.REG_REQUEST_EVENT:     common.AUTH_REQUEST_EVENT,
 		common.AUTH_REQUEST_EVENT:    common.AUTH_RESPONSE_EVENT,
+		common.ID_REQUEST_EVENT:      common.ID_RESPONSE_EVENT,
 		common.SEC_MOD_COMMAND_EVENT: common.SEC_MOD_COMPLETE_EVENT,
 		common.REG_ACCEPT_EVENT:      common.REG_COMPLETE_EVENT,
 		common.PROFILE_PASS_EVENT:    common.QUIT_EVENT,
@@ -235,6 +278,7 @@ func initProcedureEventMap() {
 	proc4 := profctx.ProcedureEventsDetails{}
 	proc4.Events = map[common.EventType]common.EventType{
 		common.DEREG_REQUEST_UE_ORIG_EVENT: common.DEREG_ACCEPT_UE_ORIG_EVENT,
+		common.ID_REQUEST_EVENT:            common.ID_RESPONSE_EVENT,
 		common.PROFILE_PASS_EVENT:          common.QUIT_EVENT,
 	}
 	profctx.ProceduresMap[common.UE_INITIATED_DEREGISTRATION_PROCEDURE] = &proc4
@@ -251,6 +295,7 @@ func initProcedureEventMap() {
 	proc6 := profctx.ProcedureEventsDetails{}
 	proc6.Events = map[common.EventType]common.EventType{
 		common.SERVICE_REQUEST_EVENT: common.SERVICE_ACCEPT_EVENT,
+		common.ID_REQUEST_EVENT:      common.ID_RESPONSE_EVENT,
 		common.PROFILE_PASS_EVENT:    common.QUIT_EVENT,
 	}
 	profctx.ProceduresMap[common.UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE] = &proc6
@@ -278,6 +323,60 @@ func initProcedureEventMap() {
 	}
 	profctx.ProceduresMap[common.USER_DATA_PKT_GENERATION_PROCEDURE] = &proc9
 
+	// common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE:
+	proc10 := profctx.ProcedureEventsDetails{}
+	proc10.Events = map[common.EventType]common.EventType{
+		common.PDU_SESS_MOD_REQUEST_EVENT: common.PDU_SESS_MOD_COMMAND_EVENT,
+		common.PDU_SESS_MOD_COMMAND_EVENT: common.PDU_SESS_MOD_COMPLETE_EVENT,
+		common.PROFILE_PASS_EVENT:         common.QUIT_EVENT,
+	}
+	profctx.ProceduresMap[common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE] = &proc10
+
+	// common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE:
+	proc11 := profctx.ProcedureEventsDetails{}
+	proc11.Events = map[common.EventType]common.EventType{
+		common.PDU_SESS_MOD_COMMAND_EVENT: common.PDU_SESS_MOD_COMPLETE_EVENT,
+		common.PROFILE_PASS_EVENT:         common.QUIT_EVENT,
+	}
+	profctx.ProceduresMap[common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE] = &proc11
+
+	// common.NG_RESET_PROCEDURE:
+	proc12 := profctx.ProcedureEventsDetails{}
+	proc12.Events = map[common.EventType]common.EventType{
+		common.TRIGGER_NG_RESET_EVENT: common.CONNECTION_RELEASE_REQUEST_EVENT,
+		common.PROFILE_PASS_EVENT:     common.QUIT_EVENT,
+	}
+	profctx.ProceduresMap[common.NG_RESET_PROCEDURE] = &proc12
+
+	// common.N2_HANDOVER_PROCEDURE:
+	proc13 := profctx.ProcedureEventsDetails{}
+	proc13.Events = map[common.EventType]common.EventType{
+		common.TRIGGER_HANDOVER_EVENT: common.HANDOVER_COMMAND_EVENT,
+		common.PROFILE_PASS_EVENT:     common.QUIT_EVENT,
+	}
+	profctx.ProceduresMap[common.N2_HANDOVER_PROCEDURE] = &proc13
+
+	// common.GUTI_REGISTRATION_PROCEDURE,
+	// common.MOBILITY_REGISTRATION_UPDATE_PROCEDURE and
+	// common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE. The network may accept
+	// the UE without authenticating it again
+	for _, procedure := range []common.ProcedureType{
+		common.GUTI_REGISTRATION_PROCEDURE,
+		common.MOBILITY_REGISTRATION_UPDATE_PROCEDURE,
+		common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE,
+	} {
+		proc := profctx.ProcedureEventsDetails{}
+		proc.Events = map[common.EventType]common.EventType{
+			common.REG_REQUEST_EVENT:     common.REG_ACCEPT_EVENT,
+			common.AUTH_REQUEST_EVENT:    common.AUTH_RESPONSE_EVENT,
+			common.ID_REQUEST_EVENT:      common.ID_RESPONSE_EVENT,
+			common.SEC_MOD_COMMAND_EVENT: common.SEC_MOD_COMPLETE_EVENT,
+			common.REG_ACCEPT_EVENT:      common.REG_COMPLETE_EVENT,
+			common.PROFILE_PASS_EVENT:    common.QUIT_EVENT,
+		}
+		profctx.ProceduresMap[procedure] = &proc
+	}
+
 }
 
 func initProcedureList(profile *profctx.Profile) error {
@@ -333,10 +432,44 @@ func initProcedureList(profile *profctx.Profile) error {
 			common.USER_DATA_PKT_GENERATION_PROCEDURE,
 			common.NW_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE,
 		}
-
+	case UE_REQ_PDU_SESS_MODIFY:
+		profile.Procedures = []common.ProcedureType{
+			common.REGISTRATION_PROCEDURE,
+			common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+			common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE,
+			common.USER_DATA_PKT_GENERATION_PROCEDURE,
+		}
+	case NW_REQ_PDU_SESS_MODIFY:
+		profile.Procedures = []common.ProcedureType{
+			common.REGISTRATION_PROCEDURE,
+			common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+			common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE,
+			common.USER_DATA_PKT_GENERATION_PROCEDURE,
+		}
+	case NG_RESET:
+		profile.Procedures = []common.ProcedureType{
+			common.REGISTRATION_PROCEDURE,
+			common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+			common.USER_DATA_PKT_GENERATION_PROCEDURE,
+			common.NG_RESET_PROCEDURE,
+			common.UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE,
+		}
+	case N2_HANDOVER:
+		profile.Procedures = []common.ProcedureType{
+			common.REGISTRATION_PROCEDURE,
+			common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+			common.USER_DATA_PKT_GENERATION_PROCEDURE,
+			common.N2_HANDOVER_PROCEDURE,
+			common.UE_INITIATED_DEREGISTRATION_PROCEDURE,
+		}
 	case CUSTOM_PROCEDURE:
-		// Custom Profiles do not have prefdefined procedure list
-		return nil
+		// Custom Profiles do not have prefdefined procedure list, they run the
+		// steps of their iterations. These are already parsed for the profiles
+		// of the configuration file, not for the ones received over HTTP
+		if profile.PIterations != nil {
+			return nil
+		}
+		return profile.InitIterations()
 
 	default:
 		return fmt.Errorf("profile type not supported: %v", profile.ProfileType)
@@ -9,9 +9,17 @@ import (
 	simueCtx "github.com/omec-project/gnbsim/simue/context"
 )
 
-func SendToSimUe(simUe *simueCtx.SimUe, event common.EventType, proc common.ProcedureType) {
+func SendToSimUe(simUe *simueCtx.SimUe, event common.EventType, proc common.ProcedureType,
+	pduSessions []*common.PduSessionParams) {
 	msg := &common.ProfileMessage{}
 	msg.Event = event
 	msg.Proc = proc
-	simUe.ReadChan <- msg
+	msg.PduSessions = pduSessions
+	select {
+	case simUe.ReadChan <- msg:
+	case <-simUe.TermCtx.Done():
+		// The UE terminated, e.g. it failed to initialize, and no longer
+		// reads its channel
+		simUe.Log.Warnln("UE terminated, dropping:", event)
+	}
 }
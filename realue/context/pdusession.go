@@ -5,7 +5,10 @@
 package context
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
@@ -23,6 +26,7 @@ type PduSession struct {
 	SscMode          uint8
 	PktCount         int
 	PduSessId        int64
+	Dnn              string
 	Snssai           models.Snssai
 	PduSessType      models.PduSessionType
 	PduAddress       net.IP
@@ -32,6 +36,24 @@ type PduSession struct {
 	TxDataPktCount   int
 	RxDataPktCount   int
 	LastDataPktRecvd bool
+	// Time at which the last ICMP echo request was sent. Used to compute the
+	// round trip time on receiving the echo reply
+	EchoReqSentAt time.Time
+	// IPv6 interface identifier assigned by the network, the IPv6 prefix is
+	// then learnt through a Router Advertisement
+	Ipv6InterfaceId []byte
+	// User data generation waiting for the IPv6 prefix
+	DataPktGenPending bool
+	// Set while echo requests are sent at DataPktInterval instead of one
+	// after the reply to the previous one, at most MaxDataPktLoss of them may
+	// then be lost. The counts of echo requests sent and replies received
+	// before the user data generation started are kept to compute the loss
+	DataPktInterval   time.Duration
+	MaxDataPktLoss    int
+	DataPktTicker     *time.Ticker
+	DataPktBaseTx     int
+	DataPktBaseRx     int
+	DataPktReplyWaits int // ticks waited for replies after the last request
 	// Inidicates that a Go routine already exists for this PDU Session
 	Launched bool
 	/* uplink packets are written to gNB UE user plane context on this channel */
@@ -46,8 +68,16 @@ type PduSession struct {
 	// commands from RealUE control plane are read on this channel
 	ReadCmdChan chan common.InterfaceMessage
 
+	// Ctx is inherited from the RealUE
+	Ctx context.Context
+
 	/* logger */
 	Log *logrus.Entry
+
+	// Global IPv6 address formed from the prefix and the interface identifier,
+	// set by the PDU session routine and read by the others
+	pduAddressV6 net.IP
+	mu           sync.Mutex
 }
 
 func NewPduSession(realUe *RealUe, pduSessId int64) *PduSession {
@@ -55,6 +85,7 @@ func NewPduSession(realUe *RealUe, pduSessId int64) *PduSession {
 	pduSess.PduSessId = pduSessId
 	pduSess.ReadDlChan = make(chan common.InterfaceMessage, 10)
 	pduSess.ReadCmdChan = make(chan common.InterfaceMessage, 10)
+	pduSess.Ctx = realUe.Ctx
 	pduSess.Log = realUe.Log.WithFields(logrus.Fields{"subcategory": "PduSession",
 		logger.FieldPduSessId: pduSessId})
 	pduSess.Log.Traceln("Pdu Session Created")
@@ -69,3 +100,37 @@ func (pduSess *PduSession) GetNextSeqNum() int {
 	}
 	return pduSess.SeqNum
 }
+
+// HasIpv6 tells whether an IPv6 interface identifier was assigned to the PDU
+// session
+func (pduSess *PduSession) HasIpv6() bool {
+	return len(pduSess.Ipv6InterfaceId) == 8
+}
+
+// LinkLocalAddress returns the IPv6 link-local address of the PDU session
+func (pduSess *PduSession) LinkLocalAddress() net.IP {
+	addr := make(net.IP, net.IPv6len)
+	addr[0], addr[1] = 0xfe, 0x80
+	copy(addr[8:], pduSess.Ipv6InterfaceId)
+	return addr
+}
+
+// SetIpv6Prefix forms the global IPv6 address of the PDU session from the
+// /64 prefix advertised by the network
+func (pduSess *PduSession) SetIpv6Prefix(prefix net.IP) {
+	addr := make(net.IP, net.IPv6len)
+	copy(addr[:8], prefix.To16()[:8])
+	copy(addr[8:], pduSess.Ipv6InterfaceId)
+
+	pduSess.mu.Lock()
+	defer pduSess.mu.Unlock()
+	pduSess.pduAddressV6 = addr
+}
+
+// GetPduAddressV6 returns the global IPv6 address of the PDU session, nil
+// until the IPv6 prefix is learnt
+func (pduSess *PduSession) GetPduAddressV6() net.IP {
+	pduSess.mu.Lock()
+	defer pduSess.mu.Unlock()
+	return pduSess.pduAddressV6
+}
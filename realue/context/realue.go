@@ -6,13 +6,20 @@
 package context
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"sync"
 
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/logger"
+	"github.com/omec-project/gnbsim/util/nassecurity"
+	"github.com/omec-project/gnbsim/util/suci"
 
 	"github.com/omec-project/UeauCommon"
 	"github.com/omec-project/milenage"
@@ -23,20 +30,44 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrUeSecurityCapabilitiesMismatch is returned when the network selects NAS
+// security algorithms the UE did not advertise or does not replay the UE
+// security capability as sent by the UE
+var ErrUeSecurityCapabilitiesMismatch = errors.New("ue security capabilities mismatch")
+
+// Maximum difference between a fresh SQN and the highest SQN accepted by the
+// UE, as suggested by TS 33.102 Annex C.2.1
+const SQN_DELTA uint64 = 1 << 28
+
+// AuthFailureError is returned when the UE fails to authenticate the network.
+// Auts is set along with the synch failure cause
+type AuthFailureError struct {
+	Cause uint8
+	Auts  []byte
+}
+
+func (e *AuthFailureError) Error() string {
+	return "authentication failure, cause: " + nasMessage.Cause5GMMToString(e.Cause)
+}
+
 // RealUe represents a Real UE
 type RealUe struct {
 	Supi               string
 	Suci               []uint8
+	SuciParams         *suci.Params // protection scheme used to compute Suci
 	Guti               string
+	Imei               string // empty unless configured in the profile
+	ImeiSv             string // empty unless configured in the profile
 	Key                string
 	Opc                string
 	SeqNum             string
-	Dnn                string
-	SNssai             *models.Snssai
+	SqnMs              uint64 // highest SQN accepted from the network
 	ULCount            security.Count
 	DLCount            security.Count
-	CipheringAlg       uint8
-	IntegrityAlg       uint8
+	CipheringAlgs      []uint8 // advertised in the UE security capability
+	IntegrityAlgs      []uint8 // advertised in the UE security capability
+	CipheringAlg       uint8   // selected by the network
+	IntegrityAlg       uint8   // selected by the network
 	KnasEnc            [16]uint8
 	KnasInt            [16]uint8
 	Kamf               []uint8
@@ -44,7 +75,10 @@ type RealUe struct {
 	AuthenticationSubs *models.AuthenticationSubscription
 	Plmn               *models.PlmnId
 	PduSessions        map[int64]*PduSession
+	PendingDataPktGen  int   // PDU sessions still generating user data
+	DataPktGenErr      error // first failure of the PDU sessions
 	WaitGrp            sync.WaitGroup
+	Idle               bool
 
 	//RealUe writes messages to SimUE on this channel
 	WriteSimUeChan chan common.InterfaceMessage
@@ -52,28 +86,42 @@ type RealUe struct {
 	//RealUe reads messages from SimUE on this channel
 	ReadChan chan common.InterfaceMessage
 
+	// Ctx is cancelled once the SimUE stops reading messages from the RealUe
+	Ctx context.Context
+
 	/* logger */
 	Log *logrus.Entry
 }
 
-func NewRealUe(supi string, cipheringAlg, integrityAlg uint8,
+func NewRealUe(supi string, suciParams *suci.Params,
+	cipheringAlgs, integrityAlgs []uint8,
 	simuechan chan common.InterfaceMessage, plmnid *models.PlmnId,
-	key string, opc string, seqNum string, Dnn string, SNssai *models.Snssai) *RealUe {
+	key string, opc string, seqNum string) *RealUe {
 
 	ue := RealUe{}
 	ue.Supi = supi
-	ue.CipheringAlg = cipheringAlg
-	ue.IntegrityAlg = integrityAlg
+	ue.Log = logger.RealUeLog.WithField(logger.FieldSupi, supi)
+	ue.SuciParams = suciParams
+	ue.CipheringAlgs = cipheringAlgs
+	ue.IntegrityAlgs = integrityAlgs
+	// replaced by the algorithms selected by the network in the Security
+	// Mode Command
+	ue.CipheringAlg = cipheringAlgs[0]
+	ue.IntegrityAlg = integrityAlgs[0]
 	ue.Key = key
 	ue.Opc = opc
 	ue.SeqNum = seqNum
-	ue.Dnn = Dnn
-	ue.SNssai = SNssai
+	// The network may use the configured sequence number in the first
+	// authentication
+	if sqn, err := strconv.ParseUint(seqNum, 16, 48); err != nil {
+		ue.Log.Errorln("Invalid sequence number:", seqNum)
+	} else if sqn > 0 {
+		ue.SqnMs = sqn - 1
+	}
 	ue.Plmn = plmnid
 	ue.WriteSimUeChan = simuechan
 	ue.PduSessions = make(map[int64]*PduSession)
 	ue.ReadChan = make(chan common.InterfaceMessage, 5)
-	ue.Log = logger.RealUeLog.WithField(logger.FieldSupi, supi)
 
 	ue.Log.Traceln("Created new context")
 	return &ue
@@ -85,33 +133,99 @@ func (ue *RealUe) GetUESecurityCapability() (UESecurityCapability *nasType.UESec
 		Len:    2,
 		Buffer: []uint8{0x00, 0x00},
 	}
-	switch ue.CipheringAlg {
-	case security.AlgCiphering128NEA0:
-		UESecurityCapability.SetEA0_5G(1)
-	case security.AlgCiphering128NEA1:
-		UESecurityCapability.SetEA1_128_5G(1)
-	case security.AlgCiphering128NEA2:
-		UESecurityCapability.SetEA2_128_5G(1)
-	case security.AlgCiphering128NEA3:
-		UESecurityCapability.SetEA3_128_5G(1)
+	for _, alg := range ue.CipheringAlgs {
+		switch alg {
+		case security.AlgCiphering128NEA0:
+			UESecurityCapability.SetEA0_5G(1)
+		case security.AlgCiphering128NEA1:
+			UESecurityCapability.SetEA1_128_5G(1)
+		case security.AlgCiphering128NEA2:
+			UESecurityCapability.SetEA2_128_5G(1)
+		case security.AlgCiphering128NEA3:
+			UESecurityCapability.SetEA3_128_5G(1)
+		}
 	}
 
-	switch ue.IntegrityAlg {
-	case security.AlgIntegrity128NIA0:
-		UESecurityCapability.SetIA0_5G(1)
-	case security.AlgIntegrity128NIA1:
-		UESecurityCapability.SetIA1_128_5G(1)
-	case security.AlgIntegrity128NIA2:
-		UESecurityCapability.SetIA2_128_5G(1)
-	case security.AlgIntegrity128NIA3:
-		UESecurityCapability.SetIA3_128_5G(1)
+	for _, alg := range ue.IntegrityAlgs {
+		switch alg {
+		case security.AlgIntegrity128NIA0:
+			UESecurityCapability.SetIA0_5G(1)
+		case security.AlgIntegrity128NIA1:
+			UESecurityCapability.SetIA1_128_5G(1)
+		case security.AlgIntegrity128NIA2:
+			UESecurityCapability.SetIA2_128_5G(1)
+		case security.AlgIntegrity128NIA3:
+			UESecurityCapability.SetIA3_128_5G(1)
+		}
 	}
 
 	return
 }
 
+// NasSecurityContext holds the NAS security algorithms selected by the network
+// in a Security Mode Command along with the keys derived for them
+type NasSecurityContext struct {
+	CipheringAlg uint8
+	IntegrityAlg uint8
+	KnasEnc      [16]uint8
+	KnasInt      [16]uint8
+}
+
+// NewSecurityContext checks the NAS security algorithms selected by the
+// network in the Security Mode Command and derives the corresponding keys. The
+// UE keeps its current context until SetSecurityContext is called, i.e. once
+// the MAC of the Security Mode Command is verified
+func (ue *RealUe) NewSecurityContext(cipheringAlg, integrityAlg uint8,
+	replayedCap *nasType.ReplayedUESecurityCapabilities) (*NasSecurityContext, error) {
+	if !containsAlg(ue.CipheringAlgs, cipheringAlg) {
+		return nil, fmt.Errorf("%w: ciphering algorithm %v not supported",
+			ErrUeSecurityCapabilitiesMismatch, nassecurity.CipheringAlgName(cipheringAlg))
+	}
+	if !containsAlg(ue.IntegrityAlgs, integrityAlg) {
+		return nil, fmt.Errorf("%w: integrity algorithm %v not supported",
+			ErrUeSecurityCapabilitiesMismatch, nassecurity.IntegrityAlgName(integrityAlg))
+	}
+	ueSecCap := ue.GetUESecurityCapability()
+	if replayedCap == nil || replayedCap.GetLen() < ueSecCap.GetLen() ||
+		!bytes.Equal(replayedCap.Buffer[:ueSecCap.GetLen()], ueSecCap.Buffer) {
+		return nil, fmt.Errorf("%w: replayed ue security capability differs",
+			ErrUeSecurityCapabilitiesMismatch)
+	}
+
+	return &NasSecurityContext{
+		CipheringAlg: cipheringAlg,
+		IntegrityAlg: integrityAlg,
+		KnasEnc:      ue.derivateAlgKey(security.NNASEncAlg, cipheringAlg),
+		KnasInt:      ue.derivateAlgKey(security.NNASIntAlg, integrityAlg),
+	}, nil
+}
+
+// SetSecurityContext adopts the NAS security context of a verified Security
+// Mode Command
+func (ue *RealUe) SetSecurityContext(secCtx *NasSecurityContext) {
+	ue.Log.Infof("Selected NAS security algorithms, ciphering:%v, integrity:%v",
+		nassecurity.CipheringAlgName(secCtx.CipheringAlg),
+		nassecurity.IntegrityAlgName(secCtx.IntegrityAlg))
+	ue.CipheringAlg = secCtx.CipheringAlg
+	ue.IntegrityAlg = secCtx.IntegrityAlg
+	ue.KnasEnc = secCtx.KnasEnc
+	ue.KnasInt = secCtx.KnasInt
+}
+
+func containsAlg(algs []uint8, alg uint8) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// DeriveRESstarAndSetKey authenticates the network as per TS 33.102 Section
+// 6.3.3 and returns RES*. An AuthFailureError is returned if the MAC of the
+// AUTN is wrong, the SQN is not fresh or the AMF separation bit is not set
 func (ue *RealUe) DeriveRESstarAndSetKey(
-	autn, rand []byte, snName string) []byte {
+	autn, rand []byte, snName string) ([]byte, error) {
 
 	authSubs := ue.AuthenticationSubs
 
@@ -154,25 +268,42 @@ func (ue *RealUe) DeriveRESstarAndSetKey(
 	}
 
 	rcvSQN := make([]byte, 6)
-
-	// Todo : check what to do with the seperation bit of the AMF field
 	rcvAMF := autn[6:8]
 
 	for i := 0; i < 6; i++ {
 		rcvSQN[i] = ak[i] ^ autn[i]
 	}
 
-	authSubs.SequenceNumber = hex.EncodeToString(rcvSQN)
-
-	// Todo : Figure 9 of 33.102 shows that we can use the SQN received from the
-	// network to calculate XMAC which we can then compare with the received MAC
-	// value in the Authentication Request(AUTN IE) to authenticate the network
-
-	// Generate MAC_A, MAC_S
+	// Generate XMAC, MAC_S
 	err = milenage.F1(opc, k, rand, rcvSQN, rcvAMF, macA, macS)
 	if err != nil {
 		ue.Log.Fatalf("regexp Compile error: %+v", err)
 	}
+	if !bytes.Equal(macA, autn[8:16]) {
+		ue.Log.Errorln("MAC of the AUTN does not match XMAC")
+		return nil, &AuthFailureError{Cause: nasMessage.Cause5GMMMACFailure}
+	}
+
+	sqn := sqnToUint64(rcvSQN)
+	if sqn <= ue.SqnMs || sqn-ue.SqnMs > SQN_DELTA {
+		ue.Log.Errorf("SQN %012x out of range, highest accepted SQN %012x",
+			sqn, ue.SqnMs)
+		auts, err := ue.generateAuts(opc, k, rand, akStar)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &AuthFailureError{Cause: nasMessage.Cause5GMMSynchFailure, Auts: auts}
+	}
+
+	// 5G authentication vectors have the separation bit of the AMF set,
+	// TS 33.501 Annex A.1
+	if rcvAMF[0]&0x80 == 0 {
+		ue.Log.Errorln("AMF separation bit not set")
+		return nil, &AuthFailureError{Cause: nasMessage.Cause5GMMNon5GAuthenticationUnacceptable}
+	}
+
+	ue.SqnMs = sqn
+	authSubs.SequenceNumber = hex.EncodeToString(rcvSQN)
 
 	// derive RES*
 	key := append(ck, ik...)
@@ -185,8 +316,37 @@ func (ue *RealUe) DeriveRESstarAndSetKey(
 	ue.DerivateAlgKey()
 	kdfVal_for_resStar :=
 		UeauCommon.GetKDFValue(key, FC, P0, UeauCommon.KDFLen(P0), P1, UeauCommon.KDFLen(P1), P2, UeauCommon.KDFLen(P2))
-	return kdfVal_for_resStar[len(kdfVal_for_resStar)/2:]
+	return kdfVal_for_resStar[len(kdfVal_for_resStar)/2:], nil
+
+}
+
+// generateAuts returns the AUTS carrying the highest SQN accepted by the UE
+// for the network to resynchronise, TS 33.102 Section 6.3.3
+func (ue *RealUe) generateAuts(opc, k, rand, akStar []byte) ([]byte, error) {
+	sqnMs := make([]byte, 8)
+	binary.BigEndian.PutUint64(sqnMs, ue.SqnMs)
+	sqnMs = sqnMs[2:]
+
+	// MAC-S is computed with a dummy AMF of all zeros
+	macA, macS := make([]byte, 8), make([]byte, 8)
+	err := milenage.F1(opc, k, rand, sqnMs, []byte{0x00, 0x00}, macA, macS)
+	if err != nil {
+		return nil, fmt.Errorf("milenage F1 failed: %v", err)
+	}
+
+	auts := make([]byte, 0, 14)
+	for i := 0; i < 6; i++ {
+		auts = append(auts, sqnMs[i]^akStar[i])
+	}
+	return append(auts, macS...), nil
+}
 
+func sqnToUint64(sqn []byte) uint64 {
+	var val uint64
+	for _, b := range sqn {
+		val = val<<8 | uint64(b)
+	}
+	return val
 }
 
 func (ue *RealUe) DerivateKamf(key []byte, snName string, SQN, AK []byte) {
@@ -218,23 +378,33 @@ func (ue *RealUe) DerivateKamf(key []byte, snName string, SQN, AK []byte) {
 
 // Algorithm key Derivation function defined in TS 33.501 Annex A.9
 func (ue *RealUe) DerivateAlgKey() {
-	// Security Key
-	P0 := []byte{security.NNASEncAlg}
+	ue.KnasEnc = ue.derivateAlgKey(security.NNASEncAlg, ue.CipheringAlg)
+	ue.KnasInt = ue.derivateAlgKey(security.NNASIntAlg, ue.IntegrityAlg)
+}
+
+// derivateAlgKey derives the NAS key of the given algorithm type and identity
+// from Kamf, TS 33.501 Annex A.8
+func (ue *RealUe) derivateAlgKey(algType, alg uint8) (key [16]uint8) {
+	P0 := []byte{algType}
 	L0 := UeauCommon.KDFLen(P0)
-	P1 := []byte{ue.CipheringAlg}
+	P1 := []byte{alg}
 	L1 := UeauCommon.KDFLen(P1)
 
-	kenc := UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_ALGORITHM_KEY_DERIVATION, P0, L0, P1, L1)
-	copy(ue.KnasEnc[:], kenc[16:32])
-
-	// Integrity Key
-	P0 = []byte{security.NNASIntAlg}
-	L0 = UeauCommon.KDFLen(P0)
-	P1 = []byte{ue.IntegrityAlg}
-	L1 = UeauCommon.KDFLen(P1)
+	kdfVal := UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_ALGORITHM_KEY_DERIVATION, P0, L0, P1, L1)
+	copy(key[:], kdfVal[16:32])
+	return
+}
 
-	kint := UeauCommon.GetKDFValue(ue.Kamf, UeauCommon.FC_FOR_ALGORITHM_KEY_DERIVATION, P0, L0, P1, L1)
-	copy(ue.KnasInt[:], kint[16:32])
+// GetFiveGSTmsi returns the 5G-S-TMSI of the UE, i.e. the AMF Set ID, the AMF
+// Pointer and the 5G-TMSI of its 5G-GUTI, as a hex string. Empty if the UE
+// has no 5G-GUTI
+func (ue *RealUe) GetFiveGSTmsi() string {
+	// 5G-GUTI string is the PLMN ID followed by the AMF ID (AMF Region ID,
+	// AMF Set ID and AMF Pointer) and the 5G-TMSI, TS 23.003 Section 2.10.1
+	if len(ue.Guti) < 19 {
+		return ""
+	}
+	return ue.Guti[len(ue.Guti)-12:]
 }
 
 func (ue *RealUe) Get5GMMCapability() (capability5GMM *nasType.Capability5GMM) {
@@ -0,0 +1,344 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/omec-project/gnbsim/mockcore"
+	"github.com/omec-project/gnbsim/util/test"
+	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/nas/nasType"
+	"github.com/omec-project/nas/security"
+	"github.com/omec-project/openapi/models"
+)
+
+const testSnName = "5G:mnc093.mcc208.3gppnetwork.org"
+
+// Milenage test sets of TS 35.208 Section 4.3
+type milenageTestSet struct {
+	k, rand, sqn, amf, op, opc string
+	macA, res, ck, ik, ak      string
+	akStar                     string
+}
+
+var (
+	// the AMF has the separation bit set
+	milenageTestSet1 = milenageTestSet{
+		k:      "465b5ce8b199b49faa5f0a2ee238a6bc",
+		rand:   "23553cbe9637a89d218ae64dae47bf35",
+		sqn:    "ff9bb4d0b607",
+		amf:    "b9b9",
+		op:     "cdc202d5123e20f62b6d676ac72cb318",
+		opc:    "cd63cb71954a9f4e48a5994e37a02baf",
+		macA:   "4a9ffac354dfafb3",
+		res:    "a54211d5e3ba50bf",
+		ck:     "b40ba9a3c58b2a05bbf0d987b21bf8cb",
+		ik:     "f769bcd751044604127672711c6d3441",
+		ak:     "aa689c648370",
+		akStar: "451e8beca43b",
+	}
+	// the AMF has the separation bit cleared
+	milenageTestSet3 = milenageTestSet{
+		k:      "fec86ba6eb707ed08905757b1bb44b8f",
+		rand:   "9f7c8d021accf4db213ccff0c7f71a6a",
+		sqn:    "9d0277595ffc",
+		amf:    "725c",
+		op:     "dbc59adcb6f9a0ef735477b7fadf8374",
+		opc:    "1006020f0a478bf6b699f15c062e42b3",
+		macA:   "9cabc3e99baf7281",
+		res:    "8011c48c0c214ed2",
+		ck:     "5dbdbb2954e8f3cde665b046179a5098",
+		ik:     "59a92d3b476a0443487055cf88b2307b",
+		ak:     "33484dc2136b",
+		akStar: "deacdd848cc6",
+	}
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid test vector %q: %v", s, err)
+	}
+	return b
+}
+
+func xorBytes(a, b []byte) []byte {
+	c := make([]byte, len(a))
+	for i := range a {
+		c[i] = a[i] ^ b[i]
+	}
+	return c
+}
+
+// autn returns SQN xor AK || AMF || MAC-A
+func (ts *milenageTestSet) autn(t *testing.T) []byte {
+	autn := xorBytes(decodeHex(t, ts.sqn), decodeHex(t, ts.ak))
+	autn = append(autn, decodeHex(t, ts.amf)...)
+	return append(autn, decodeHex(t, ts.macA)...)
+}
+
+// resStar derives RES* as per TS 33.501 Annex A.4 with the KDF of TS 33.220
+// Annex B.2
+func (ts *milenageTestSet) resStar(t *testing.T) []byte {
+	s := []byte{0x6b}
+	for _, p := range [][]byte{[]byte(testSnName), decodeHex(t, ts.rand), decodeHex(t, ts.res)} {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(p)))
+		s = append(append(s, p...), l...)
+	}
+	h := hmac.New(sha256.New, append(decodeHex(t, ts.ck), decodeHex(t, ts.ik)...))
+	h.Write(s)
+	return h.Sum(nil)[16:]
+}
+
+func newTestUe(ts *milenageTestSet, useOp bool, sqnMs uint64) *RealUe {
+	ue := NewRealUe("imsi-208930100007487", nil,
+		[]uint8{security.AlgCiphering128NEA0}, []uint8{security.AlgIntegrity128NIA2},
+		nil, &models.PlmnId{Mcc: "208", Mnc: "93"}, ts.k, ts.opc, ts.sqn)
+	if useOp {
+		ue.AuthenticationSubs = test.GetAuthSubscription(ts.k, "", ts.op, ts.sqn)
+	} else {
+		ue.AuthenticationSubs = test.GetAuthSubscription(ts.k, ts.opc, "", ts.sqn)
+	}
+	ue.SqnMs = sqnMs
+	return ue
+}
+
+func TestDeriveRESstarAndSetKey(t *testing.T) {
+	sqn1 := sqnToUint64(decodeHex(t, milenageTestSet1.sqn))
+	tests := []struct {
+		name   string
+		ts     *milenageTestSet
+		useOp  bool
+		sqnMs  uint64
+		tamper bool // flips a bit of the MAC of the AUTN
+		cause  uint8
+	}{
+		{
+			name:  "fresh sqn",
+			ts:    &milenageTestSet1,
+			sqnMs: sqn1 - 1,
+		},
+		{
+			name:  "fresh sqn with op",
+			ts:    &milenageTestSet1,
+			useOp: true,
+			sqnMs: sqn1 - SQN_DELTA,
+		},
+		{
+			name:   "mac failure",
+			ts:     &milenageTestSet1,
+			sqnMs:  sqn1 - 1,
+			tamper: true,
+			cause:  nasMessage.Cause5GMMMACFailure,
+		},
+		{
+			name:  "sqn already accepted",
+			ts:    &milenageTestSet1,
+			sqnMs: sqn1,
+			cause: nasMessage.Cause5GMMSynchFailure,
+		},
+		{
+			name:  "sqn too far ahead",
+			ts:    &milenageTestSet1,
+			sqnMs: sqn1 - SQN_DELTA - 1,
+			cause: nasMessage.Cause5GMMSynchFailure,
+		},
+		{
+			name:  "non 5g amf",
+			ts:    &milenageTestSet3,
+			sqnMs: sqnToUint64(decodeHex(t, milenageTestSet3.sqn)) - 1,
+			cause: nasMessage.Cause5GMMNon5GAuthenticationUnacceptable,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ue := newTestUe(tc.ts, tc.useOp, tc.sqnMs)
+			autn := tc.ts.autn(t)
+			if tc.tamper {
+				autn[len(autn)-1] ^= 0x01
+			}
+
+			resStar, err := ue.DeriveRESstarAndSetKey(autn, decodeHex(t, tc.ts.rand), testSnName)
+			if tc.cause == 0 {
+				if err != nil {
+					t.Fatalf("authentication failed: %v", err)
+				}
+				if want := tc.ts.resStar(t); !bytes.Equal(resStar, want) {
+					t.Errorf("res* = %x, want %x", resStar, want)
+				}
+				if want := sqnToUint64(decodeHex(t, tc.ts.sqn)); ue.SqnMs != want {
+					t.Errorf("highest accepted sqn = %012x, want %012x", ue.SqnMs, want)
+				}
+				return
+			}
+
+			var authErr *AuthFailureError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("got error %v, want an AuthFailureError", err)
+			}
+			if authErr.Cause != tc.cause {
+				t.Fatalf("cause = %v, want %v", nasMessage.Cause5GMMToString(authErr.Cause),
+					nasMessage.Cause5GMMToString(tc.cause))
+			}
+			if ue.SqnMs != tc.sqnMs {
+				t.Errorf("highest accepted sqn changed to %012x", ue.SqnMs)
+			}
+			if tc.cause != nasMessage.Cause5GMMSynchFailure {
+				if authErr.Auts != nil {
+					t.Errorf("auts set along with cause %v", nasMessage.Cause5GMMToString(tc.cause))
+				}
+				return
+			}
+
+			// SQN_MS xor AK* || MAC-S
+			if len(authErr.Auts) != 14 {
+				t.Fatalf("auts length = %v, want 14", len(authErr.Auts))
+			}
+			sqnMs := make([]byte, 8)
+			binary.BigEndian.PutUint64(sqnMs, tc.sqnMs)
+			if want := xorBytes(sqnMs[2:], decodeHex(t, tc.ts.akStar)); !bytes.Equal(authErr.Auts[:6], want) {
+				t.Errorf("concealed sqn = %x, want %x", authErr.Auts[:6], want)
+			}
+		})
+	}
+}
+
+// The AUTS must let the mock core recover the highest SQN accepted by the UE
+// and generate a vector the UE then accepts
+func TestAutsResynchronisesMockCore(t *testing.T) {
+	ts := &milenageTestSet1
+	db, err := mockcore.NewSubscriberDb([]*mockcore.SubscriberConfig{{
+		StartImsi:      "208930100007487",
+		UeCount:        1,
+		Key:            ts.k,
+		Opc:            ts.opc,
+		SequenceNumber: ts.sqn,
+	}})
+	if err != nil {
+		t.Fatalf("failed to create subscriber db: %v", err)
+	}
+	sub := db.GetSubscriber("208930100007487")
+
+	sqnMs := sqnToUint64(decodeHex(t, ts.sqn)) + 0x1000
+	ue := newTestUe(ts, false, sqnMs)
+	rand := decodeHex(t, ts.rand)
+	_, err = ue.DeriveRESstarAndSetKey(ts.autn(t), rand, testSnName)
+	var authErr *AuthFailureError
+	if !errors.As(err, &authErr) || authErr.Cause != nasMessage.Cause5GMMSynchFailure {
+		t.Fatalf("got error %v, want a synch failure", err)
+	}
+
+	if err = db.Resynchronise(sub, rand, authErr.Auts); err != nil {
+		t.Fatalf("mock core rejected the auts: %v", err)
+	}
+	if got := sqnToUint64(sub.Sqn); got != sqnMs {
+		t.Fatalf("resynchronised sqn = %012x, want %012x", got, sqnMs)
+	}
+
+	tampered := append([]byte{}, authErr.Auts...)
+	tampered[len(tampered)-1] ^= 0x01
+	if err = db.Resynchronise(sub, rand, tampered); err == nil {
+		t.Errorf("mock core accepted a tampered auts")
+	}
+
+	av, err := db.GenerateAuthVector(sub, testSnName)
+	if err != nil {
+		t.Fatalf("failed to generate auth vector: %v", err)
+	}
+	resStar, err := ue.DeriveRESstarAndSetKey(av.Autn, av.Rand, testSnName)
+	if err != nil {
+		t.Fatalf("authentication failed after resynchronisation: %v", err)
+	}
+	if !bytes.Equal(resStar, av.XresStar) {
+		t.Errorf("res* = %x, want xres* %x", resStar, av.XresStar)
+	}
+}
+
+func TestGenerateAuts(t *testing.T) {
+	ts := &milenageTestSet1
+	db, err := mockcore.NewSubscriberDb([]*mockcore.SubscriberConfig{{
+		StartImsi:      "208930100007487",
+		UeCount:        1,
+		Key:            ts.k,
+		Opc:            ts.opc,
+		SequenceNumber: ts.sqn,
+	}})
+	if err != nil {
+		t.Fatalf("failed to create subscriber db: %v", err)
+	}
+	sub := db.GetSubscriber("208930100007487")
+	rand := decodeHex(t, ts.rand)
+
+	for _, sqnMs := range []uint64{0, 1, 0x0000000000ff, 0xff9bb4d0b607, 0xffffffffffff} {
+		ue := newTestUe(ts, false, sqnMs)
+		auts, err := ue.generateAuts(decodeHex(t, ts.opc), decodeHex(t, ts.k), rand,
+			decodeHex(t, ts.akStar))
+		if err != nil {
+			t.Fatalf("sqn %012x: generateAuts failed: %v", sqnMs, err)
+		}
+		sqn := make([]byte, 8)
+		binary.BigEndian.PutUint64(sqn, sqnMs)
+		if want := xorBytes(sqn[2:], decodeHex(t, ts.akStar)); !bytes.Equal(auts[:6], want) {
+			t.Errorf("sqn %012x: concealed sqn = %x, want %x", sqnMs, auts[:6], want)
+		}
+		if err = db.Resynchronise(sub, rand, auts); err != nil {
+			t.Errorf("sqn %012x: mock core rejected the auts: %v", sqnMs, err)
+		} else if got := sqnToUint64(sub.Sqn); got != sqnMs {
+			t.Errorf("sqn %012x: resynchronised sqn = %012x", sqnMs, got)
+		}
+	}
+}
+
+// The context of a Security Mode Command must not be adopted before its MAC
+// is verified
+func TestNewSecurityContext(t *testing.T) {
+	ue := NewRealUe("imsi-208930100007487", nil,
+		[]uint8{security.AlgCiphering128NEA0, security.AlgCiphering128NEA2},
+		[]uint8{security.AlgIntegrity128NIA1, security.AlgIntegrity128NIA2},
+		nil, &models.PlmnId{Mcc: "208", Mnc: "93"}, milenageTestSet1.k, milenageTestSet1.opc,
+		milenageTestSet1.sqn)
+	ue.Kamf = decodeHex(t, milenageTestSet1.ck+milenageTestSet1.ik)
+	ue.DerivateAlgKey()
+	knasEnc, knasInt := ue.KnasEnc, ue.KnasInt
+
+	replayedCap := &nasType.ReplayedUESecurityCapabilities{}
+	ueSecCap := ue.GetUESecurityCapability()
+	replayedCap.SetLen(ueSecCap.GetLen())
+	copy(replayedCap.Buffer, ueSecCap.Buffer)
+
+	secCtx, err := ue.NewSecurityContext(security.AlgCiphering128NEA2, security.AlgIntegrity128NIA1,
+		replayedCap)
+	if err != nil {
+		t.Fatalf("NewSecurityContext failed: %v", err)
+	}
+	if ue.CipheringAlg != security.AlgCiphering128NEA0 || ue.IntegrityAlg != security.AlgIntegrity128NIA1 ||
+		ue.KnasEnc != knasEnc || ue.KnasInt != knasInt {
+		t.Fatalf("security context changed before SetSecurityContext")
+	}
+
+	ue.SetSecurityContext(secCtx)
+	if ue.CipheringAlg != security.AlgCiphering128NEA2 || ue.IntegrityAlg != security.AlgIntegrity128NIA1 {
+		t.Errorf("algorithms = %v/%v, want NEA2/NIA1", ue.CipheringAlg, ue.IntegrityAlg)
+	}
+	want := &RealUe{Kamf: ue.Kamf, CipheringAlg: ue.CipheringAlg, IntegrityAlg: ue.IntegrityAlg}
+	want.DerivateAlgKey()
+	if ue.KnasEnc != want.KnasEnc || ue.KnasInt != want.KnasInt {
+		t.Errorf("keys of the security context differ from DerivateAlgKey")
+	}
+
+	if _, err = ue.NewSecurityContext(security.AlgCiphering128NEA1, security.AlgIntegrity128NIA1,
+		replayedCap); !errors.Is(err, ErrUeSecurityCapabilitiesMismatch) {
+		t.Errorf("got error %v for an unsupported algorithm, want ErrUeSecurityCapabilitiesMismatch", err)
+	}
+}
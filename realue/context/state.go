@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/omec-project/gnbsim/uestate"
+)
+
+// GetState returns the SQN, 5G-GUTI and NAS security context of the UE so
+// that they can be restored by a later run
+func (ue *RealUe) GetState() *uestate.State {
+	state := &uestate.State{
+		Sqn:  fmt.Sprintf("%012x", ue.SqnMs),
+		Guti: ue.Guti,
+	}
+	if ue.Kamf != nil {
+		state.NgKsi = ue.NgKsi.Ksi
+		state.Kamf = hex.EncodeToString(ue.Kamf)
+		state.CipheringAlg = ue.CipheringAlg
+		state.IntegrityAlg = ue.IntegrityAlg
+		state.KnasEnc = hex.EncodeToString(ue.KnasEnc[:])
+		state.KnasInt = hex.EncodeToString(ue.KnasInt[:])
+		state.ULCount = ue.ULCount.Get()
+		state.DLCount = ue.DLCount.Get()
+	}
+	return state
+}
+
+// SaveState records the state of the UE for later runs. Called from the RealUe
+// routine, or once it has terminated
+func (ue *RealUe) SaveState(registered bool) {
+	state := ue.GetState()
+	state.Registered = registered
+	uestate.Put(ue.Supi, state)
+}
+
+// RestoreState resumes the UE from a state saved by an earlier run. The NAS
+// security context is restored only if the 5G-GUTI is, as the network
+// identifies the context by the 5G-GUTI
+func (ue *RealUe) RestoreState(state *uestate.State) error {
+	var sqn uint64
+	if _, err := fmt.Sscanf(state.Sqn, "%x", &sqn); err != nil {
+		return fmt.Errorf("invalid sqn:%v", state.Sqn)
+	}
+
+	var kamf, knasEnc, knasInt []byte
+	if state.Guti != "" && state.Kamf != "" {
+		var err error
+		if kamf, err = hex.DecodeString(state.Kamf); err != nil {
+			return fmt.Errorf("invalid kamf")
+		}
+		knasEnc, err = hex.DecodeString(state.KnasEnc)
+		if err != nil || len(knasEnc) != len(ue.KnasEnc) {
+			return fmt.Errorf("invalid knasEnc")
+		}
+		knasInt, err = hex.DecodeString(state.KnasInt)
+		if err != nil || len(knasInt) != len(ue.KnasInt) {
+			return fmt.Errorf("invalid knasInt")
+		}
+	}
+
+	ue.SqnMs = sqn
+	ue.Guti = state.Guti
+	if kamf != nil {
+		ue.Kamf = kamf
+		ue.NgKsi.Ksi = state.NgKsi
+		ue.CipheringAlg = state.CipheringAlg
+		ue.IntegrityAlg = state.IntegrityAlg
+		copy(ue.KnasEnc[:], knasEnc)
+		copy(ue.KnasInt[:], knasInt)
+		ue.ULCount.Set(uint16(state.ULCount>>8), uint8(state.ULCount))
+		ue.DLCount.Set(uint16(state.DLCount>>8), uint8(state.DLCount))
+		// UE starts without NG signalling connection
+		ue.Idle = true
+	}
+	return nil
+}
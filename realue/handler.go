@@ -5,6 +5,7 @@
 package realue
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
@@ -31,11 +32,27 @@ const (
 )
 
 func HandleRegRequestEvent(ue *realuectx.RealUe,
-	msg common.InterfaceMessage) (err error) {
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	if msg.RegistrationType == 0 ||
+		msg.RegistrationType == nasMessage.RegistrationType5GSInitialRegistration {
+		// The network drops the PDU sessions of a UE registering afresh
+		releasePduSessionsLocally(ue)
+	}
+	if msg.RegistrationType != 0 {
+		if ue.Guti != "" {
+			return sendGutiRegRequest(ue, msg.RegistrationType)
+		}
+		if msg.RegistrationType != nasMessage.RegistrationType5GSInitialRegistration {
+			return fmt.Errorf("failed to create registration request: guti not allocated")
+		}
+		ue.Log.Infoln("5G-GUTI not allocated, registering with SUCI")
+	}
 
 	ueSecurityCapability := ue.GetUESecurityCapability()
 
-	ue.Suci, err = util.SupiToSuci(ue.Supi, ue.Plmn)
+	ue.Suci, err = util.SupiToSuci(ue.Supi, ue.Plmn, ue.SuciParams)
 	if err != nil {
 		ue.Log.Errorln("SupiToSuci returned:", err)
 		return fmt.Errorf("failed to derive suci")
@@ -48,7 +65,39 @@ func HandleRegRequestEvent(ue *realuectx.RealUe,
 	nasPdu := nasTestpacket.GetRegistrationRequest(nasMessage.RegistrationType5GSInitialRegistration,
 		mobileId5GS, nil, ueSecurityCapability, nil, nil, nil)
 
-	m := formUuMessage(common.REG_REQUEST_EVENT, nasPdu)
+	ue.Idle = false
+	m := formInitialUuMessage(ue, common.REG_REQUEST_EVENT, nasPdu)
+	SendToSimUe(ue, m)
+	ue.Log.Traceln("Sent Registration Request Message to SimUe")
+	return nil
+}
+
+// sendGutiRegRequest sends a Registration Request identifying the UE by its
+// 5G-GUTI. It is integrity protected with the current NAS security context,
+// and ciphered if it updates the registration over an established NAS
+// signalling connection
+func sendGutiRegRequest(ue *realuectx.RealUe, registrationType uint8) (err error) {
+	ue.Log.Traceln("Generating 5G-GUTI Registration Request Message, registration type:",
+		registrationType)
+	nasPdu, err := realue_nas.GetGutiRegistrationRequest(ue, registrationType)
+	if err != nil {
+		return fmt.Errorf("failed to create registration request: %v", err)
+	}
+
+	if ue.Kamf != nil {
+		// TS 24.501 Section 4.4.6 - Protection of Initial NAS signalling messages
+		secHdrType := nas.SecurityHeaderTypeIntegrityProtectedAndCiphered
+		if ue.Idle || registrationType == nasMessage.RegistrationType5GSInitialRegistration {
+			secHdrType = nas.SecurityHeaderTypeIntegrityProtected
+		}
+		nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu, secHdrType, true)
+		if err != nil {
+			return fmt.Errorf("failed to encode with security: %v", err)
+		}
+	}
+
+	ue.Idle = false
+	m := formInitialUuMessage(ue, common.REG_REQUEST_EVENT, nasPdu)
 	SendToSimUe(ue, m)
 	ue.Log.Traceln("Sent Registration Request Message to SimUe")
 	return nil
@@ -66,7 +115,19 @@ func HandleAuthResponseEvent(ue *realuectx.RealUe,
 
 	rand := authReq.GetRANDValue()
 	autn := authReq.GetAUTN()
-	resStat := ue.DeriveRESstarAndSetKey(autn[:], rand[:], SN_NAME)
+	resStat, err := ue.DeriveRESstarAndSetKey(autn[:], rand[:], SN_NAME)
+	var authErr *realuectx.AuthFailureError
+	if errors.As(err, &authErr) {
+		// The network is expected to either send a new Authentication
+		// Request or reject the UE
+		ue.Log.Infoln("Generating Authentication Failure Message:", authErr)
+		nasPdu := nasTestpacket.GetAuthenticationFailure(authErr.Cause, authErr.Auts)
+		m := formUuMessage(common.AUTH_FAILURE_EVENT, nasPdu)
+		SendToSimUe(ue, m)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to derive res*: %v", err)
+	}
 
 	// TODO: Parse Auth Request IEs and update the RealUE Context
 
@@ -80,6 +141,72 @@ func HandleAuthResponseEvent(ue *realuectx.RealUe,
 	return nil
 }
 
+func HandleIdentityResponseEvent(ue *realuectx.RealUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	idType := msg.NasMsg.IdentityRequest.SpareHalfOctetAndIdentityType.GetTypeOfIdentity()
+	ue.Log.Infoln("Identity requested by the network, type of identity:", idType)
+
+	var mobileId []byte
+	switch idType {
+	case nasMessage.MobileIdentity5GSTypeSuci:
+		// A fresh SUCI, as the scheme output of the ECIES profiles must not
+		// be reused
+		mobileId, err = util.SupiToSuci(ue.Supi, ue.Plmn, ue.SuciParams)
+		if err != nil {
+			ue.Log.Errorln("SupiToSuci returned:", err)
+			return fmt.Errorf("failed to derive suci")
+		}
+		ue.Suci = mobileId
+	case nasMessage.MobileIdentity5GSType5gGuti:
+		if ue.Guti != "" {
+			guti := nasConvert.GutiToNas(ue.Guti)
+			mobileId = guti.Octet[:]
+		}
+	case nasMessage.MobileIdentity5GSType5gSTmsi:
+		if ue.Guti != "" {
+			// AMF set id, AMF pointer and 5G-TMSI of the 5G-GUTI
+			guti := nasConvert.GutiToNas(ue.Guti)
+			mobileId = append([]byte{0xf0 | idType}, guti.Octet[5:]...)
+		}
+	case nasMessage.MobileIdentity5GSTypeImei:
+		if ue.Imei != "" {
+			mobileId = util.PeiToMobileIdentity(ue.Imei, idType)
+		}
+	case nasMessage.MobileIdentity5GSTypeImeisv:
+		if ue.ImeiSv != "" {
+			mobileId = util.PeiToMobileIdentity(ue.ImeiSv, idType)
+		}
+	}
+	if mobileId == nil {
+		ue.Log.Warnln("Requested identity not available, type of identity:", idType)
+		mobileId = []byte{nasMessage.MobileIdentity5GSTypeNoIdentity}
+	}
+
+	ue.Log.Traceln("Generating Identity Response Message")
+	nasPdu := nasTestpacket.GetIdentityResponse(nasType.MobileIdentity{
+		Len:    uint16(len(mobileId)),
+		Buffer: mobileId,
+	})
+
+	// The response is protected only if the request was, i.e. once the NAS
+	// security context is established
+	if msg.NasMsg.SecurityHeaderType != nas.SecurityHeaderTypePlainNas {
+		nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
+			nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
+		if err != nil {
+			ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+			return fmt.Errorf("failed to encrypt identity response message")
+		}
+	}
+
+	m := formUuMessage(common.ID_RESPONSE_EVENT, nasPdu)
+	SendToSimUe(ue, m)
+	ue.Log.Traceln("Sent Identity Response Message to SimUe")
+	return nil
+}
+
 func HandleSecModCompleteEvent(ue *realuectx.RealUe,
 	msg common.InterfaceMessage) (err error) {
 
@@ -110,19 +237,27 @@ func HandleSecModCompleteEvent(ue *realuectx.RealUe,
 	return nil
 }
 
+// SendSecurityModeReject sends a Security Mode Reject to the network, without
+// security protection as no security context could be established
+func SendSecurityModeReject(ue *realuectx.RealUe, cause uint8) {
+	nasPdu := nasTestpacket.GetSecurityModeReject(cause)
+	m := formUuMessage(common.SEC_MOD_REJECT_EVENT, nasPdu)
+	SendToSimUe(ue, m)
+	ue.Log.Traceln("Sent Security Mode Reject Message to SimUe")
+}
+
 func HandleRegCompleteEvent(ue *realuectx.RealUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
 	//TODO: Process corresponding Registration Accept first
 	msg := intfcMsg.(*common.UeMessage).NasMsg.RegistrationAccept
 
-	var guti []uint8
+	// A registration update may be accepted without a new 5G-GUTI
 	if msg.GUTI5G != nil {
-		guti = msg.GUTI5G.Octet[:]
+		_, ue.Guti = nasConvert.GutiToString(msg.GUTI5G.Octet[:])
+		publishIdentities(ue)
 	}
 
-	_, ue.Guti = nasConvert.GutiToString(guti)
-
 	ue.Log.Traceln("Generating Registration Complete Message")
 	nasPdu := nasTestpacket.GetRegistrationComplete(nil)
 	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
@@ -153,34 +288,46 @@ func HandleDeregRequestEvent(ue *realuectx.RealUe,
 
 	nasPdu := nasTestpacket.GetDeregistrationRequest(nasMessage.AccessType3GPP,
 		SWITCH_OFF, uint8(ue.NgKsi.Ksi), mobileIdentity5GS)
-	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
-		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
+	// TS 24.501 Section 4.4.6 - An initial NAS message sent from idle state
+	// is not ciphered
+	secHdrType := nas.SecurityHeaderTypeIntegrityProtectedAndCiphered
+	if ue.Idle {
+		secHdrType = nas.SecurityHeaderTypeIntegrityProtected
+	}
+	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu, secHdrType, true)
 	if err != nil {
 		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
 		return fmt.Errorf("failed to encrypt deregistration request message")
 	}
 
-	m := formUuMessage(common.DEREG_REQUEST_UE_ORIG_EVENT, nasPdu)
+	m := formInitialUuMessage(ue, common.DEREG_REQUEST_UE_ORIG_EVENT, nasPdu)
 	SendToSimUe(ue, m)
 	ue.Log.Traceln("Sent UE Initiated Deregistration Request message to SimUe")
 	return nil
 }
 
 func HandlePduSessEstRequestEvent(ue *realuectx.RealUe,
-	msg common.InterfaceMessage) (err error) {
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	if len(msg.PduSessions) == 0 {
+		return fmt.Errorf("pdu session parameters missing")
+	}
+	params := msg.PduSessions[0]
+	if _, found := ue.PduSessions[int64(params.PduSessId)]; found {
+		return fmt.Errorf("pdu session %v already established", params.PduSessId)
+	}
 
-	// sNssai := models.Snssai{
-	// 	Sst: 1,
-	// 	Sd:  "010203",
-	// }
-	nasPdu := nasTestpacket.GetUlNasTransport_PduSessionEstablishmentRequest(10,
-		nasMessage.ULNASTransportRequestTypeInitialRequest, ue.Dnn, ue.SNssai)
+	nasPdu, err := realue_nas.GetPduSessionEstablishmentRequest(params)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session establishment request: %v", err)
+	}
 
 	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
 		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
 	if err != nil {
-		fmt.Println("Failed to encrypt PDU Session Establishment Request Message", err)
-		return
+		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+		return fmt.Errorf("failed to encrypt pdu session establishment request message: %v", err)
 	}
 
 	m := formUuMessage(common.PDU_SESS_EST_REQUEST_EVENT, nasPdu)
@@ -198,37 +345,80 @@ func HandlePduSessEstAcceptEvent(ue *realuectx.RealUe,
 		return fmt.Errorf("invalid NAS Message")
 	}
 
-	var pduAddr net.IP
 	pduSessType := nasConvert.PDUSessionTypeToModels(nasMsg.GetPDUSessionType())
-	if pduSessType == models.PduSessionType_IPV4 {
-		ip := nasMsg.GetPDUAddressInformation()
-		pduAddr = net.IPv4(ip[0], ip[1], ip[2], ip[3])
-	}
-
 	pduSess := realuectx.NewPduSession(ue, int64(nasMsg.PDUSessionID.Octet))
 	pduSess.PduSessType = pduSessType
 	pduSess.SscMode = nasMsg.GetSSCMode()
-	pduSess.PduAddress = pduAddr
+
+	// TS 24.501 Section 9.11.4.10, an IPv6 interface identifier precedes the
+	// IPv4 address of an IPv4v6 PDU session
+	if nasMsg.PDUAddress != nil {
+		info := nasMsg.GetPDUAddressInformation()
+		switch nasMsg.PDUAddress.GetPDUSessionTypeValue() {
+		case nasMessage.PDUSessionTypeIPv4:
+			pduSess.PduAddress = net.IPv4(info[0], info[1], info[2], info[3])
+		case nasMessage.PDUSessionTypeIPv6:
+			pduSess.Ipv6InterfaceId = append([]byte{}, info[:8]...)
+		case nasMessage.PDUSessionTypeIPv4IPv6:
+			pduSess.Ipv6InterfaceId = append([]byte{}, info[:8]...)
+			pduSess.PduAddress = net.IPv4(info[8], info[9], info[10], info[11])
+		}
+	}
+	if (pduSessType == models.PduSessionType_IPV4 ||
+		pduSessType == models.PduSessionType_IPV4_V6) && pduSess.PduAddress == nil {
+		return fmt.Errorf("ipv4 address missing for pdu session type:%v", pduSessType)
+	}
+	if (pduSessType == models.PduSessionType_IPV6 ||
+		pduSessType == models.PduSessionType_IPV4_V6) && !pduSess.HasIpv6() {
+		return fmt.Errorf("ipv6 interface identifier missing for pdu session type:%v",
+			pduSessType)
+	}
+	if nasMsg.DNN != nil {
+		pduSess.Dnn = string(nasMsg.DNN.GetDNN())
+	}
+	if nasMsg.SNSSAI != nil {
+		pduSess.Snssai = nasConvert.SnssaiToModels(nasMsg.SNSSAI)
+	}
 	pduSess.WriteUeChan = ue.ReadChan
 	ue.AddPduSession(int64(pduSess.PduSessId), pduSess)
 	ue.Log.Infoln("PDU Session ID:", pduSess.PduSessId)
 	ue.Log.Infoln("PDU Session Type:", pduSess.PduSessType)
 	ue.Log.Infoln("SSC Mode:", pduSess.SscMode)
-	ue.Log.Infoln("PDU Address:", pduAddr.String())
+	ue.Log.Infof("DNN:%v, S-NSSAI:%v-%v", pduSess.Dnn, pduSess.Snssai.Sst, pduSess.Snssai.Sd)
+	if pduSess.PduAddress != nil {
+		ue.Log.Infoln("PDU Address:", pduSess.PduAddress.String())
+	}
+	if pduSess.HasIpv6() {
+		ue.Log.Infoln("IPv6 Link-Local Address:", pduSess.LinkLocalAddress().String())
+	}
+	if nasMsg.Cause5GSM != nil {
+		// e.g. an IPv4v6 PDU session restricted to a single address family
+		ue.Log.Infoln("5GSM Cause:", nasMsg.Cause5GSM.GetCauseValue())
+	}
+	publishIdentities(ue)
 
 	return nil
 }
 
 func HandlePduSessReleaseRequestEvent(ue *realuectx.RealUe,
-	msg common.InterfaceMessage) (err error) {
+	intfcMsg common.InterfaceMessage) (err error) {
 
-	nasPdu := nasTestpacket.GetUlNasTransport_PduSessionReleaseRequest(10)
+	msg := intfcMsg.(*common.UeMessage)
+	if len(msg.PduSessions) == 0 {
+		return fmt.Errorf("pdu session parameters missing")
+	}
+	pduSessId := msg.PduSessions[0].PduSessId
+	if _, found := ue.PduSessions[int64(pduSessId)]; !found {
+		return fmt.Errorf("pdu session %v not established", pduSessId)
+	}
+
+	nasPdu := nasTestpacket.GetUlNasTransport_PduSessionReleaseRequest(pduSessId)
 
 	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
 		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
 	if err != nil {
-		fmt.Println("Failed to encrypt PDU Session Release Request Message", err)
-		return
+		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+		return fmt.Errorf("failed to encrypt pdu session release request message: %v", err)
 	}
 
 	m := formUuMessage(common.PDU_SESS_REL_REQUEST_EVENT, nasPdu)
@@ -257,6 +447,8 @@ func HandlePduSessReleaseCompleteEvent(ue *realuectx.RealUe,
 	quitMsg := &common.UeMessage{}
 	quitMsg.Event = common.QUIT_EVENT
 	pduSess.ReadCmdChan <- quitMsg
+	delete(ue.PduSessions, int64(pduSessId))
+	publishIdentities(ue)
 
 	nasPdu := nasTestpacket.GetUlNasTransport_PduSessionReleaseComplete(pduSessId,
 		REQUEST_TYPE_EXISTING_PDU_SESS, "", nil)
@@ -264,8 +456,8 @@ func HandlePduSessReleaseCompleteEvent(ue *realuectx.RealUe,
 	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
 		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
 	if err != nil {
-		fmt.Println("Failed to encrypt PDU Session Release Request Message", err)
-		return
+		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+		return fmt.Errorf("failed to encrypt pdu session release complete message: %v", err)
 	}
 
 	m := formUuMessage(common.PDU_SESS_REL_COMPLETE_EVENT, nasPdu)
@@ -273,6 +465,90 @@ func HandlePduSessReleaseCompleteEvent(ue *realuectx.RealUe,
 	return nil
 }
 
+func HandlePduSessModRequestEvent(ue *realuectx.RealUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	if len(msg.PduSessions) == 0 {
+		return fmt.Errorf("pdu session parameters missing")
+	}
+	pduSessId := msg.PduSessions[0].PduSessId
+	if _, found := ue.PduSessions[int64(pduSessId)]; !found {
+		return fmt.Errorf("pdu session %v not established", pduSessId)
+	}
+
+	nasPdu, err := realue_nas.GetPduSessionModificationRequest(pduSessId, pduSessId)
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session modification request: %v", err)
+	}
+
+	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
+		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
+	if err != nil {
+		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+		return fmt.Errorf("failed to encrypt pdu session modification request message: %v", err)
+	}
+
+	m := formUuMessage(common.PDU_SESS_MOD_REQUEST_EVENT, nasPdu)
+	SendToSimUe(ue, m)
+	return nil
+}
+
+// HandlePduSessModCompleteEvent accepts the PDU Session Modification Command
+// received from the network. The command is rejected if the PDU session does
+// not exist in the UE, TS 24.501 Section 6.3.2.4
+func HandlePduSessModCompleteEvent(ue *realuectx.RealUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	nasMsg := msg.NasMsg.PDUSessionModificationCommand
+	if nasMsg == nil {
+		ue.Log.Errorln("PDUSessionModificationCommand is nil")
+		return fmt.Errorf("invalid NAS Message")
+	}
+
+	pduSessId := nasMsg.GetPDUSessionID()
+	pti := nasMsg.GetPTI()
+	ue.Log.Infoln("PDU Session Modification Command, PDU Session ID:", pduSessId,
+		"PTI:", pti)
+
+	event := common.PDU_SESS_MOD_COMPLETE_EVENT
+	var nasPdu []byte
+	if _, found := ue.PduSessions[int64(pduSessId)]; !found {
+		ue.Log.Errorln("Rejecting PDU Session Modification Command, PDU session",
+			pduSessId, "not established")
+		event = common.PDU_SESS_MOD_CMD_REJECT_EVENT
+		nasPdu, err = realue_nas.GetPduSessionModificationCommandReject(pduSessId,
+			pti, nasMessage.Cause5GSMInvalidPDUSessionIdentity)
+	} else {
+		if nasMsg.SessionAMBR != nil {
+			ue.Log.Infof("Session AMBR: %x", nasMsg.SessionAMBR.Octet)
+		}
+		if nasMsg.AuthorizedQosRules != nil {
+			ue.Log.Infof("Authorized QoS Rules: %x", nasMsg.GetQosRule())
+		}
+		if nasMsg.AuthorizedQosFlowDescriptions != nil {
+			ue.Log.Infof("Authorized QoS Flow Descriptions: %x",
+				nasMsg.GetQoSFlowDescriptions())
+		}
+		nasPdu, err = realue_nas.GetPduSessionModificationComplete(pduSessId, pti)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build pdu session modification response: %v", err)
+	}
+
+	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
+		nas.SecurityHeaderTypeIntegrityProtectedAndCiphered, true)
+	if err != nil {
+		ue.Log.Errorln("EncodeNasPduWithSecurity() returned:", err)
+		return fmt.Errorf("failed to encrypt pdu session modification complete message: %v", err)
+	}
+
+	m := formUuMessage(event, nasPdu)
+	SendToSimUe(ue, m)
+	return nil
+}
+
 func HandleDataBearerSetupRequestEvent(ue *realuectx.RealUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
@@ -312,15 +588,48 @@ func HandleDataBearerSetupRequestEvent(ue *realuectx.RealUe,
 	rsp.Event = common.DATA_BEARER_SETUP_RESPONSE_EVENT
 	rsp.DBParams = msg.DBParams
 	rsp.TriggeringEvent = msg.TriggeringEvent
-	ue.WriteSimUeChan <- rsp
+	SendToSimUe(ue, rsp)
 	return nil
 }
 
 func HandleDataPktGenRequestEvent(ue *realuectx.RealUe,
-	msg common.InterfaceMessage) (err error) {
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	cmds := make(map[*realuectx.PduSession]*common.UeMessage)
+	for _, params := range msg.PduSessions {
+		pduSess, found := ue.PduSessions[int64(params.PduSessId)]
+		if !found {
+			// e.g. released by the network
+			ue.Log.Infoln("Skipping PDU Session ID:", params.PduSessId, "not established")
+			continue
+		}
+		cmd := &common.UeMessage{}
+		cmd.Event = common.DATA_PKT_GEN_REQUEST_EVENT
+		cmd.UserDataPktCount = msg.UserDataPktCount
+		cmd.UserDataPktInterval = msg.UserDataPktInterval
+		cmd.MaxUserDataPktLoss = msg.MaxUserDataPktLoss
+		cmd.DefaultAs = params.DefaultAs
+		cmds[pduSess] = cmd
+	}
+	if len(cmds) == 0 && msg.UserDataPktInterval != 0 {
+		// User data sent along with another procedure, e.g. a handover,
+		// there is no user plane to check
+		ue.Log.Infoln("No PDU session established, no user data sent")
+		rsp := &common.UeMessage{}
+		rsp.Event = common.DATA_PKT_GEN_SUCCESS_EVENT
+		SendToSimUe(ue, rsp)
+		return nil
+	}
+	if len(cmds) == 0 {
+		return fmt.Errorf("no pdu session established to send user data on")
+	}
 
-	for _, v := range ue.PduSessions {
-		v.ReadCmdChan <- msg
+	// The outcome is reported once all the PDU sessions are done
+	ue.PendingDataPktGen = len(cmds)
+	ue.DataPktGenErr = nil
+	for pduSess, cmd := range cmds {
+		pduSess.ReadCmdChan <- cmd
 	}
 
 	return nil
@@ -328,21 +637,110 @@ func HandleDataPktGenRequestEvent(ue *realuectx.RealUe,
 
 func HandleDataPktGenSuccessEvent(ue *realuectx.RealUe,
 	msg common.InterfaceMessage) (err error) {
-	ue.WriteSimUeChan <- msg
+	dataPktGenDone(ue, nil)
 	return nil
 }
 
+// HandleDataPktGenFailureEvent handles the user data of a PDU session which
+// did not get through, the failure is reported once all the PDU sessions are
+// done
+func HandleDataPktGenFailureEvent(ue *realuectx.RealUe,
+	msg common.InterfaceMessage) (err error) {
+	ue.Log.Warnln("User data generation failed:", msg.GetErrorMsg())
+	dataPktGenDone(ue, msg.GetErrorMsg())
+	return nil
+}
+
+func dataPktGenDone(ue *realuectx.RealUe, err error) {
+	if err != nil && ue.DataPktGenErr == nil {
+		ue.DataPktGenErr = err
+	}
+	ue.PendingDataPktGen--
+	if ue.PendingDataPktGen > 0 {
+		return
+	}
+
+	rsp := &common.UeMessage{}
+	rsp.Event = common.DATA_PKT_GEN_SUCCESS_EVENT
+	if ue.DataPktGenErr != nil {
+		rsp.Event = common.DATA_PKT_GEN_FAILURE_EVENT
+		rsp.Error = ue.DataPktGenErr
+		ue.DataPktGenErr = nil
+	}
+	// the IPv6 prefixes are learnt by now
+	publishIdentities(ue)
+	SendToSimUe(ue, rsp)
+}
+
 func HandleConnectionReleaseRequestEvent(ue *realuectx.RealUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 	msg := intfcMsg.(*common.UuMessage)
 
+	ue.Idle = true
 	for _, pdusess := range ue.PduSessions {
 		pdusess.ReadCmdChan <- msg
 	}
 
+	if msg.TriggeringEvent == common.CONNECTION_RELEASED_EVENT {
+		// SimUe waits for the outcome of its request
+		rsp := &common.UeMessage{}
+		rsp.Event = common.CONNECTION_RELEASED_EVENT
+		SendToSimUe(ue, rsp)
+	}
 	return nil
 }
 
+// HandleHandoverCommandEvent detaches the PDU sessions from the source gNB,
+// the target gNB sets up the data bearers again once the UE confirmed the
+// handover. Unlike a connection release the UE stays connected
+func HandleHandoverCommandEvent(ue *realuectx.RealUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	for _, pdusess := range ue.PduSessions {
+		pdusess.ReadCmdChan <- intfcMsg
+	}
+	return nil
+}
+
+func HandleDataBearerReleaseRequestEvent(ue *realuectx.RealUe,
+	msg common.InterfaceMessage) (err error) {
+	// The PDU Session Release Command preceding the data bearer release has
+	// been handled by now
+	rsp := &common.UeMessage{}
+	rsp.Event = common.PDU_SESS_RELEASED_EVENT
+	SendToSimUe(ue, rsp)
+	return nil
+}
+
+func releasePduSessionsLocally(ue *realuectx.RealUe) {
+	for id, pduSess := range ue.PduSessions {
+		ue.Log.Infoln("Releasing PDU Session ID:", id, "locally")
+		quitMsg := &common.UeMessage{}
+		quitMsg.Event = common.QUIT_EVENT
+		pduSess.ReadCmdChan <- quitMsg
+		delete(ue.PduSessions, id)
+	}
+	publishIdentities(ue)
+}
+
+// publishIdentities reports the 5G-GUTI and the PDU sessions of the UE to
+// SimUe, it is called whenever they change
+func publishIdentities(ue *realuectx.RealUe) {
+	msg := &common.UeIdentitiesMessage{Guti: ue.Guti}
+	msg.Event = common.UE_IDENTITIES_EVENT
+	for _, pduSess := range ue.PduSessions {
+		msg.PduSessions = append(msg.PduSessions, &common.PduSessionInfo{
+			PduSessId:    pduSess.PduSessId,
+			PduSessType:  pduSess.PduSessType,
+			Dnn:          pduSess.Dnn,
+			Snssai:       pduSess.Snssai,
+			PduAddress:   pduSess.PduAddress,
+			PduAddressV6: pduSess.GetPduAddressV6(),
+		})
+	}
+	SendToSimUe(ue, msg)
+}
+
 func HandleErrorEvent(ue *realuectx.RealUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
@@ -361,12 +759,26 @@ func HandleQuitEvent(ue *realuectx.RealUe, intfcMsg common.InterfaceMessage) (er
 	return nil
 }
 
+// HandleSaveStateEvent records the state of the UE for later runs
+func HandleSaveStateEvent(ue *realuectx.RealUe, intfcMsg common.InterfaceMessage) (err error) {
+	msg := intfcMsg.(*common.SaveStateMessage)
+	ue.SaveState(msg.Registered)
+	close(msg.Done)
+	return nil
+}
+
 func HandleDlInfoTransferEvent(ue *realuectx.RealUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
 	msg := intfcMsg.(*common.UuMessage)
 	for _, pdu := range msg.NasPdus {
 		nasMsg, err := realue_nas.NASDecode(ue, nas.GetSecurityHeaderType(pdu), pdu)
+		if errors.Is(err, realuectx.ErrUeSecurityCapabilitiesMismatch) {
+			ue.Log.Errorln("Rejecting Security Mode Command:", err)
+			// SimUe fails the procedure once the reject is sent
+			SendSecurityModeReject(ue, nasMessage.Cause5GMMUESecurityCapabilitiesMismatch)
+			return nil
+		}
 		if err != nil {
 			ue.Log.Errorln("Failed to decode dowlink NAS Message due to", err)
 			return err
@@ -399,6 +811,9 @@ func HandleDlInfoTransferEvent(ue *realuectx.RealUe,
 		// is N1_EVENT
 		m.Event = common.EventType(msgType) | common.N1_EVENT
 		m.NasMsg = nasMsg
+		if msgType == nas.MsgTypeRegistrationReject || msgType == nas.MsgTypeServiceReject {
+			m.Error = processReject(ue, nasMsg)
+		}
 
 		// Simply notify SimUe about the received nas message. Later SimUe will
 		// asynchrously send next event to RealUE informing about what to do with
@@ -408,6 +823,40 @@ func HandleDlInfoTransferEvent(ue *realuectx.RealUe,
 	return nil
 }
 
+// processReject decodes the 5GMM cause and the T3346 value of a Registration
+// Reject or Service Reject. The UE deletes its 5G-GUTI and NAS security
+// context for the causes requiring it, TS 24.501 Sections 5.5.1.2.5 and
+// 5.6.1.5
+func processReject(ue *realuectx.RealUe, nasMsg *nas.Message) *common.RejectError {
+	rejErr := &common.RejectError{}
+	var t3346 *nasType.T3346Value
+	if rej := nasMsg.RegistrationReject; rej != nil {
+		rejErr.Request = "registration"
+		rejErr.Cause = rej.Cause5GMM.GetCauseValue()
+		t3346 = rej.T3346Value
+	} else {
+		rej := nasMsg.ServiceReject
+		rejErr.Request = "service request"
+		rejErr.Cause = rej.Cause5GMM.GetCauseValue()
+		t3346 = rej.T3346Value
+	}
+	if t3346 != nil {
+		rejErr.T3346 = util.GprsTimer2ToDuration(t3346.GetGPRSTimer2Value())
+	}
+	ue.Log.Errorln("Received reject:", rejErr)
+
+	switch rejErr.Cause {
+	case nasMessage.Cause5GMMIllegalUE, nasMessage.Cause5GMMIllegalME,
+		nasMessage.Cause5GMM5GSServicesNotAllowed, nasMessage.Cause5GMMPLMNNotAllowed,
+		nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork:
+		ue.Log.Infoln("Deleting 5G-GUTI and NAS security context")
+		ue.Guti = ""
+		ue.Kamf = nil
+		publishIdentities(ue)
+	}
+	return rejErr
+}
+
 func HandleServiceRequestEvent(ue *realuectx.RealUe,
 	msg common.InterfaceMessage) (err error) {
 
@@ -415,6 +864,7 @@ func HandleServiceRequestEvent(ue *realuectx.RealUe,
 	if err != nil {
 		return fmt.Errorf("failed to handle service request event: %v", err)
 	}
+	ue.Idle = false
 
 	// TS 24.501 Section 4.4.6 - Protection of Initial NAS signalling messages
 	nasPdu, err = realue_nas.EncodeNasPduWithSecurity(ue, nasPdu,
@@ -423,7 +873,7 @@ func HandleServiceRequestEvent(ue *realuectx.RealUe,
 		return fmt.Errorf("failed to encode with security: %v", err)
 	}
 
-	m := formUuMessage(common.SERVICE_REQUEST_EVENT, nasPdu)
+	m := formInitialUuMessage(ue, common.SERVICE_REQUEST_EVENT, nasPdu)
 	SendToSimUe(ue, m)
 	return nil
 }
@@ -8,15 +8,22 @@ import (
 	"bytes"
 	"fmt"
 
+	"github.com/omec-project/gnbsim/common"
 	realuectx "github.com/omec-project/gnbsim/realue/context"
 	"github.com/omec-project/gnbsim/util/nastestpacket"
 
+	"github.com/omec-project/nas"
 	"github.com/omec-project/nas/nasConvert"
 	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/nas/nasType"
 )
 
 func GetServiceRequest(ue *realuectx.RealUe) ([]byte, error) {
 
+	if ue.Guti == "" {
+		return nil, fmt.Errorf("guti not allocated")
+	}
+
 	nasMsg := nastestpacket.BuildServiceRequest(nasMessage.ServiceTypeData)
 	serviceRequest := nasMsg.GmmMessage.ServiceRequest
 
@@ -26,6 +33,8 @@ func GetServiceRequest(ue *realuectx.RealUe) ([]byte, error) {
 	serviceRequest.SetAMFPointer(guti.GetAMFPointer())
 	serviceRequest.SetTMSI5G(guti.GetTMSI5G())
 	serviceRequest.SetNasKeySetIdentifiler(uint8(ue.NgKsi.Ksi))
+	// The user plane of all the PDU sessions is reactivated
+	serviceRequest.UplinkDataStatus.Buffer = pduSessionStatus(ue)
 
 	data := new(bytes.Buffer)
 	err := nasMsg.GmmMessageEncode(data)
@@ -35,3 +44,118 @@ func GetServiceRequest(ue *realuectx.RealUe) ([]byte, error) {
 
 	return data.Bytes(), nil
 }
+
+// GetGutiRegistrationRequest builds a Registration Request of the given type
+// identifying the UE by its 5G-GUTI. The PDU sessions of the UE are reported
+// in the PDU session status
+func GetGutiRegistrationRequest(ue *realuectx.RealUe, registrationType uint8) ([]byte, error) {
+
+	if ue.Guti == "" {
+		return nil, fmt.Errorf("guti not allocated")
+	}
+
+	guti := nasConvert.GutiToNas(ue.Guti)
+	mobileId5GS := nasType.MobileIdentity5GS{
+		Len:    uint16(len(guti.Octet)),
+		Buffer: guti.Octet[:],
+	}
+	nasMsg := nastestpacket.BuildRegistrationRequest(registrationType, mobileId5GS,
+		ue.GetUESecurityCapability())
+	registrationRequest := nasMsg.GmmMessage.RegistrationRequest
+	if ue.Kamf != nil {
+		registrationRequest.NgksiAndRegistrationType5GS.SetNasKeySetIdentifiler(uint8(ue.NgKsi.Ksi))
+	}
+
+	if len(ue.PduSessions) != 0 {
+		psiStatus := pduSessionStatus(ue)
+		registrationRequest.PDUSessionStatus =
+			nasType.NewPDUSessionStatus(nasMessage.RegistrationRequestPDUSessionStatusType)
+		registrationRequest.PDUSessionStatus.SetLen(uint8(len(psiStatus)))
+		registrationRequest.PDUSessionStatus.Buffer = psiStatus
+	}
+
+	data := new(bytes.Buffer)
+	err := nasMsg.GmmMessageEncode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %v", err)
+	}
+
+	return data.Bytes(), nil
+}
+
+// GetPduSessionEstablishmentRequest builds an UL NAS Transport carrying the
+// PDU Session Establishment Request of the given PDU session
+func GetPduSessionEstablishmentRequest(params *common.PduSessionParams) ([]byte, error) {
+
+	smMsg := nastestpacket.BuildPduSessionEstablishmentRequest(params.PduSessId,
+		params.PduSessId, params.PduSessType, params.SscMode)
+	smPdu := new(bytes.Buffer)
+	err := smMsg.GsmMessageEncode(smPdu)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %v", err)
+	}
+
+	nasMsg := nastestpacket.BuildUlNasTransport(params.PduSessId,
+		nasMessage.ULNASTransportRequestTypeInitialRequest, params.Dnn, params.SNssai,
+		smPdu.Bytes())
+	data := new(bytes.Buffer)
+	err = nasMsg.GmmMessageEncode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %v", err)
+	}
+
+	return data.Bytes(), nil
+}
+
+// GetPduSessionModificationRequest builds an UL NAS Transport carrying the
+// PDU Session Modification Request of the given PDU session
+func GetPduSessionModificationRequest(pduSessId, pti uint8) ([]byte, error) {
+	smMsg := nastestpacket.BuildPduSessionModificationRequest(pduSessId, pti)
+	return getUlNasTransport(pduSessId, smMsg)
+}
+
+// GetPduSessionModificationComplete builds an UL NAS Transport carrying the
+// PDU Session Modification Complete of the given PDU session
+func GetPduSessionModificationComplete(pduSessId, pti uint8) ([]byte, error) {
+	smMsg := nastestpacket.BuildPduSessionModificationComplete(pduSessId, pti)
+	return getUlNasTransport(pduSessId, smMsg)
+}
+
+// GetPduSessionModificationCommandReject builds an UL NAS Transport carrying
+// the PDU Session Modification Command Reject of the given PDU session
+func GetPduSessionModificationCommandReject(pduSessId, pti,
+	cause uint8) ([]byte, error) {
+	smMsg := nastestpacket.BuildPduSessionModificationCommandReject(pduSessId,
+		pti, cause)
+	return getUlNasTransport(pduSessId, smMsg)
+}
+
+// getUlNasTransport builds an UL NAS Transport carrying the given 5GSM
+// message of an existing PDU session
+func getUlNasTransport(pduSessId uint8, smMsg *nas.Message) ([]byte, error) {
+	smPdu := new(bytes.Buffer)
+	err := smMsg.GsmMessageEncode(smPdu)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %v", err)
+	}
+
+	nasMsg := nastestpacket.BuildUlNasTransport(pduSessId, 0, "", nil,
+		smPdu.Bytes())
+	data := new(bytes.Buffer)
+	err = nasMsg.GmmMessageEncode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %v", err)
+	}
+
+	return data.Bytes(), nil
+}
+
+// pduSessionStatus returns the PSI bitmap of the PDU sessions of the UE, as
+// per TS 24.501 Section 9.11.3.44
+func pduSessionStatus(ue *realuectx.RealUe) []uint8 {
+	psiStatus := make([]uint8, 2)
+	for id := range ue.PduSessions {
+		psiStatus[id/8] |= 1 << (id % 8)
+	}
+	return psiStatus
+}
@@ -9,10 +9,14 @@ import (
 	"fmt"
 	"reflect"
 
+	"github.com/omec-project/gnbsim/capture"
+	"github.com/omec-project/gnbsim/metrics"
 	realuectx "github.com/omec-project/gnbsim/realue/context"
+	"github.com/omec-project/gnbsim/util/nassecurity"
 
 	"github.com/omec-project/nas"
 	"github.com/omec-project/nas/nasMessage"
+	"github.com/omec-project/nas/nasType"
 	"github.com/omec-project/nas/security"
 	"github.com/omec-project/ngap/ngapType"
 )
@@ -78,8 +82,18 @@ func NASEncode(ue *realuectx.RealUe, msg *nas.Message, securityContextAvailable
 		return
 	}
 
+	defer func() {
+		if err == nil {
+			countNasMessage(metrics.DIR_SENT, msg)
+		}
+	}()
+
 	if !securityContextAvailable {
-		return msg.PlainNasEncode()
+		payload, err = msg.PlainNasEncode()
+		if err == nil {
+			capture.Nas(payload)
+		}
+		return payload, err
 	} else {
 		needCiphering := false
 		switch msg.SecurityHeader.SecurityHeaderType {
@@ -105,12 +119,13 @@ func NASEncode(ue *realuectx.RealUe, msg *nas.Message, securityContextAvailable
 		if err != nil {
 			return nil, fmt.Errorf("plain nas encode failed: %+v", err)
 		}
+		capture.Nas(payload)
 
 		if needCiphering {
 			ue.Log.Debugf("Encrypt NAS message (algorithm: %+v, DLCount: 0x%0x)", ue.CipheringAlg, ue.DLCount.Get())
 			ue.Log.Tracef("NAS ciphering key: %0x", ue.KnasEnc)
 			// TODO: Support for ue has nas connection in both accessType
-			if err = security.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.ULCount.Get(), security.Bearer3GPP,
+			if err = nassecurity.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.ULCount.Get(), security.Bearer3GPP,
 				security.DirectionUplink, payload); err != nil {
 				return nil, fmt.Errorf("Encrypt error: %+v", err)
 			}
@@ -118,7 +133,7 @@ func NASEncode(ue *realuectx.RealUe, msg *nas.Message, securityContextAvailable
 		// add sequence number
 		payload = append([]byte{ue.ULCount.SQN()}, payload[:]...)
 
-		mac32, err := security.NASMacCalculate(ue.IntegrityAlg, ue.KnasInt, ue.ULCount.Get(),
+		mac32, err := nassecurity.NASMacCalculate(ue.IntegrityAlg, ue.KnasInt, ue.ULCount.Get(),
 			security.Bearer3GPP, security.DirectionUplink, payload)
 		if err != nil {
 			return nil, fmt.Errorf("nas mac calcuate failed: %+v", err)
@@ -146,21 +161,16 @@ func NASDecode(ue *realuectx.RealUe, securityHeaderType uint8, payload []byte) (
 		return
 	}
 
+	defer func() {
+		if err == nil {
+			countNasMessage(metrics.DIR_RECEIVED, msg)
+		}
+	}()
+
 	msg = new(nas.Message)
 	msg.SecurityHeaderType = uint8(nas.GetSecurityHeaderType(payload) & 0x0f)
 	if securityHeaderType == nas.SecurityHeaderTypePlainNas {
-		err = msg.PlainNasDecode(&payload)
-		return
-	} else if ue.IntegrityAlg == security.AlgIntegrity128NIA0 {
-		ue.Log.Debugln("decode payload is ", payload)
-		// remove header
-		payload = payload[3:]
-
-		if err = security.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.DLCount.Get(), security.Bearer3GPP,
-			security.DirectionDownlink, payload); err != nil {
-			return nil, err
-		}
-
+		capture.Nas(payload)
 		err = msg.PlainNasDecode(&payload)
 		return
 	} else { // Security protected NAS message
@@ -172,6 +182,9 @@ func NASDecode(ue *realuectx.RealUe, securityHeaderType uint8, payload []byte) (
 
 		// a security protected NAS message must be integrity protected, and ciphering is optional
 		ciphered := false
+		// the security context a Security Mode Command establishes, adopted once
+		// its MAC is verified
+		var newSecCtx *realuectx.NasSecurityContext
 		switch msg.SecurityHeaderType {
 		case nas.SecurityHeaderTypeIntegrityProtected:
 			ue.Log.Debugln("Security header type: Integrity Protected")
@@ -181,6 +194,11 @@ func NASDecode(ue *realuectx.RealUe, securityHeaderType uint8, payload []byte) (
 		case nas.SecurityHeaderTypeIntegrityProtectedWithNew5gNasSecurityContext:
 			ue.Log.Debugln("Security Header Type Integrity Protected With New 5g Nas Security Context")
 			ue.DLCount.Set(0, 0)
+			// The algorithms of the new security context are carried by the
+			// Security Mode Command itself, which is not ciphered
+			if newSecCtx, err = newSecurityContext(ue, payload[1:]); err != nil {
+				return nil, err
+			}
 		case nas.SecurityHeaderTypeIntegrityProtectedAndCipheredWithNew5gNasSecurityContext:
 			ue.Log.Debugln("Security header type: Integrity Protected And Ciphered With New 5G Security Context")
 			ciphered = true
@@ -194,30 +212,89 @@ func NASDecode(ue *realuectx.RealUe, securityHeaderType uint8, payload []byte) (
 		}
 		ue.DLCount.SetSQN(sequenceNumber)
 
-		ue.Log.Infof("Calculate NAS MAC (algorithm: %+v, DLCount: 0x%0x)", ue.IntegrityAlg, ue.DLCount.Get())
-		ue.Log.Infof("NAS integrity key: %0x", ue.KnasInt)
+		integrityAlg, knasInt := ue.IntegrityAlg, ue.KnasInt
+		if newSecCtx != nil {
+			integrityAlg, knasInt = newSecCtx.IntegrityAlg, newSecCtx.KnasInt
+		}
+		ue.Log.Infof("Calculate NAS MAC (algorithm: %+v, DLCount: 0x%0x)", integrityAlg, ue.DLCount.Get())
+		ue.Log.Infof("NAS integrity key: %0x", knasInt)
 
-		mac32, errNas := security.NASMacCalculate(ue.IntegrityAlg, ue.KnasInt, ue.DLCount.Get(), security.Bearer3GPP,
+		mac32, errNas := nassecurity.NASMacCalculate(integrityAlg, knasInt, ue.DLCount.Get(), security.Bearer3GPP,
 			security.DirectionDownlink, payload)
 		if errNas != nil {
 			return nil, errNas
 		}
 		if !reflect.DeepEqual(mac32, receivedMac32) {
+			if newSecCtx != nil {
+				return nil, fmt.Errorf("security mode command mac verification failed(0x%x != 0x%x)",
+					mac32, receivedMac32)
+			}
 			fmt.Printf("NAS MAC verification failed(0x%x != 0x%x)", mac32, receivedMac32)
 		} else {
 			fmt.Printf("cmac value: 0x%x\n", mac32)
 		}
+		if newSecCtx != nil {
+			ue.SetSecurityContext(newSecCtx)
+		}
 
 		// remove sequece Number
 		payload = payload[1:]
 		if ciphered {
-			if err = security.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.DLCount.Get(), security.Bearer3GPP,
+			if err = nassecurity.NASEncrypt(ue.CipheringAlg, ue.KnasEnc, ue.DLCount.Get(), security.Bearer3GPP,
 				security.DirectionDownlink, payload); err != nil {
 				return nil, err
 			}
 		}
 
+		capture.Nas(payload)
 		err = msg.PlainNasDecode(&payload)
 		return msg, err
 	}
 }
+
+// newSecurityContext returns the security context selected by the network if
+// the plain NAS message is a Security Mode Command, nil otherwise
+func newSecurityContext(ue *realuectx.RealUe, plainNas []byte) (*realuectx.NasSecurityContext, error) {
+	buf := make([]byte, len(plainNas))
+	copy(buf, plainNas)
+	m := nas.NewMessage()
+	if err := m.PlainNasDecode(&buf); err != nil {
+		return nil, err
+	}
+	if m.GmmMessage == nil || m.GmmHeader.GetMessageType() != nas.MsgTypeSecurityModeCommand {
+		return nil, nil
+	}
+	smc := m.GmmMessage.SecurityModeCommand
+	return ue.NewSecurityContext(
+		smc.SelectedNASSecurityAlgorithms.GetTypeOfCipheringAlgorithm(),
+		smc.SelectedNASSecurityAlgorithms.GetTypeOfIntegrityProtectionAlgorithm(),
+		&smc.ReplayedUESecurityCapabilities)
+}
+
+// countNasMessage counts the 5GMM message and, if one is carried within a NAS
+// transport message, the 5GSM message as well
+func countNasMessage(direction string, msg *nas.Message) {
+	if msg == nil || msg.GmmMessage == nil {
+		return
+	}
+	metrics.CountNasMessage(direction, msg.GmmHeader.GetMessageType())
+
+	var payloadType uint8
+	var container *nasType.PayloadContainer
+	switch {
+	case msg.GmmMessage.ULNASTransport != nil:
+		payloadType = msg.GmmMessage.ULNASTransport.GetPayloadContainerType()
+		container = &msg.GmmMessage.ULNASTransport.PayloadContainer
+	case msg.GmmMessage.DLNASTransport != nil:
+		payloadType = msg.GmmMessage.DLNASTransport.GetPayloadContainerType()
+		container = &msg.GmmMessage.DLNASTransport.PayloadContainer
+	default:
+		return
+	}
+
+	// 5GSM message type follows the EPD, PDU session ID and PTI octets
+	contents := container.GetPayloadContainerContents()
+	if payloadType == nasMessage.PayloadContainerTypeN1SMInfo && len(contents) > 3 {
+		metrics.CountNasMessage(direction, contents[3])
+	}
+}
@@ -19,7 +19,15 @@ func Init(ue *realuectx.RealUe) {
 
 func HandleEvents(ue *realuectx.RealUe) (err error) {
 
-	for msg := range ue.ReadChan {
+	for {
+		var msg common.InterfaceMessage
+		select {
+		case msg = <-ue.ReadChan:
+		case <-ue.Ctx.Done():
+			HandleQuitEvent(ue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return nil
+		}
+
 		event := msg.GetEventType()
 		ue.Log.Infoln("Handling:", event)
 
@@ -28,6 +36,8 @@ func HandleEvents(ue *realuectx.RealUe) (err error) {
 			err = HandleRegRequestEvent(ue, msg)
 		case common.AUTH_RESPONSE_EVENT:
 			err = HandleAuthResponseEvent(ue, msg)
+		case common.ID_RESPONSE_EVENT:
+			err = HandleIdentityResponseEvent(ue, msg)
 		case common.SEC_MOD_COMPLETE_EVENT:
 			err = HandleSecModCompleteEvent(ue, msg)
 		case common.REG_COMPLETE_EVENT:
@@ -42,6 +52,10 @@ func HandleEvents(ue *realuectx.RealUe) (err error) {
 			err = HandlePduSessReleaseRequestEvent(ue, msg)
 		case common.PDU_SESS_REL_COMPLETE_EVENT:
 			err = HandlePduSessReleaseCompleteEvent(ue, msg)
+		case common.PDU_SESS_MOD_REQUEST_EVENT:
+			err = HandlePduSessModRequestEvent(ue, msg)
+		case common.PDU_SESS_MOD_COMPLETE_EVENT:
+			err = HandlePduSessModCompleteEvent(ue, msg)
 		case common.PDU_SESS_EST_ACCEPT_EVENT:
 			err = HandlePduSessEstAcceptEvent(ue, msg)
 		case common.DATA_BEARER_SETUP_REQUEST_EVENT:
@@ -50,12 +64,20 @@ func HandleEvents(ue *realuectx.RealUe) (err error) {
 			err = HandleDataPktGenRequestEvent(ue, msg)
 		case common.DATA_PKT_GEN_SUCCESS_EVENT:
 			err = HandleDataPktGenSuccessEvent(ue, msg)
+		case common.DATA_PKT_GEN_FAILURE_EVENT:
+			err = HandleDataPktGenFailureEvent(ue, msg)
 		case common.SERVICE_REQUEST_EVENT:
 			err = HandleServiceRequestEvent(ue, msg)
 		case common.CONNECTION_RELEASE_REQUEST_EVENT:
 			err = HandleConnectionReleaseRequestEvent(ue, msg)
+		case common.DATA_BEARER_RELEASE_REQUEST_EVENT:
+			err = HandleDataBearerReleaseRequestEvent(ue, msg)
+		case common.HANDOVER_COMMAND_EVENT:
+			err = HandleHandoverCommandEvent(ue, msg)
 		case common.DEREG_ACCEPT_UE_TERM_EVENT:
 			err = HandleNwDeregAcceptEvent(ue, msg)
+		case common.SAVE_STATE_EVENT:
+			err = HandleSaveStateEvent(ue, msg)
 		case common.ERROR_EVENT:
 			HandleErrorEvent(ue, msg)
 		case common.QUIT_EVENT:
@@ -74,8 +96,6 @@ func HandleEvents(ue *realuectx.RealUe) (err error) {
 			HandleErrorEvent(ue, msg)
 		}
 	}
-
-	return nil
 }
 
 func formUuMessage(event common.EventType, nasPdu []byte) *common.UuMessage {
@@ -85,9 +105,22 @@ func formUuMessage(event common.EventType, nasPdu []byte) *common.UuMessage {
 	return msg
 }
 
+// formInitialUuMessage forms the message carrying the initial NAS message of
+// a connection, along with the 5G-S-TMSI the gNB selects the AMF with
+func formInitialUuMessage(ue *realuectx.RealUe, event common.EventType,
+	nasPdu []byte) *common.UuMessage {
+	msg := formUuMessage(event, nasPdu)
+	msg.FiveGSTmsi = ue.GetFiveGSTmsi()
+	return msg
+}
+
 func SendToSimUe(ue *realuectx.RealUe,
 	msg common.InterfaceMessage) {
 
 	ue.Log.Traceln("Sending", msg.GetEventType(), "to SimUe")
-	ue.WriteSimUeChan <- msg
+	select {
+	case ue.WriteSimUeChan <- msg:
+	case <-ue.Ctx.Done():
+		ue.Log.Infoln("SimUe terminated, dropping event", msg.GetEventType())
+	}
 }
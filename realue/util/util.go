@@ -7,22 +7,32 @@ package util
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/omec-project/gnbsim/util/suci"
+
+	"github.com/omec-project/nas/nasMessage"
 	"github.com/omec-project/openapi/models"
 	"github.com/yerden/go-util/bcd"
 )
 
 const (
-	SUPI_FORMAT          uint8 = 0x00 // imsi
-	ID_TYPE              uint8 = 0x01 // suci
-	PROTECTION_SCHEME_ID uint8 = 0x00 // null scheme
-	PUBLIC_KEY_ID        uint8 = 0x00
-	SUCI_LEN             uint8 = 22
+	SUPI_FORMAT uint8 = 0x00 // imsi
+	ID_TYPE     uint8 = 0x01 // suci
+	SUCI_LEN    uint8 = 22
 )
 
+// Routing indicator "0", used along with the null scheme unless configured
 var ROUTING_INDICATOR []uint8 = []uint8{0xf0, 0xff}
 
-func SupiToSuci(supi string, plmnid *models.PlmnId) ([]byte, error) {
+// SupiToSuci builds the SUCI of the SUPI. The MSIN is concealed with the
+// protection scheme and home network public key given by params, the null
+// scheme is used if params is nil
+func SupiToSuci(supi string, plmnid *models.PlmnId, params *suci.Params) ([]byte, error) {
+	if params == nil {
+		params = &suci.Params{RoutingIndicator: ROUTING_INDICATOR}
+	}
+
 	index := strings.Index(supi, "-")
 	if index < 0 {
 		return nil, fmt.Errorf(`invalid supi format, should start with "imsi-"`)
@@ -43,10 +53,10 @@ func SupiToSuci(supi string, plmnid *models.PlmnId) ([]byte, error) {
 	// extracting msin from imsi
 	msin := imsi[index:]
 
-	suci := make([]uint8, 0, SUCI_LEN)
+	buf := make([]uint8, 0, SUCI_LEN)
 	// creating octet 4 of 5GS mobile identity info
 	octet := (SUPI_FORMAT << 4) | ID_TYPE
-	suci = append(suci, octet)
+	buf = append(buf, octet)
 
 	enc := bcd.NewEncoder(bcd.Telephony)
 	bcdMcc := make([]byte, bcd.EncodedLen(len(plmnid.Mcc)))
@@ -54,24 +64,85 @@ func SupiToSuci(supi string, plmnid *models.PlmnId) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode mcc in bcd format:%v", err)
 	}
-	suci = append(suci, bcdMcc...)
+	buf = append(buf, bcdMcc...)
 
 	bcdMnc := make([]byte, bcd.EncodedLen(len(plmnid.Mnc)))
 	_, err = enc.Encode(bcdMnc, []byte(plmnid.Mnc))
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode mnc in bcd format:%v", err)
 	}
-	suci = append(suci, bcdMnc...)
-	suci = append(suci, ROUTING_INDICATOR...)
-	suci = append(suci, PROTECTION_SCHEME_ID)
-	suci = append(suci, PUBLIC_KEY_ID)
+	buf = append(buf, bcdMnc...)
+	buf = append(buf, params.RoutingIndicator...)
+	buf = append(buf, params.ProtectionScheme)
+	buf = append(buf, params.HomeNetworkPublicKeyId)
 
 	bcdMsin := make([]byte, bcd.EncodedLen(len(msin)))
 	_, err = enc.Encode(bcdMsin, []byte(msin))
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode msin in bcd format:%v", err)
 	}
-	suci = append(suci, bcdMsin...)
+	schemeOutput, err := suci.Conceal(params.ProtectionScheme,
+		params.HomeNetworkPublicKey, bcdMsin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to conceal msin:%v", err)
+	}
+	buf = append(buf, schemeOutput...)
+
+	return buf, nil
+}
+
+// PeiToMobileIdentity encodes an IMEI or IMEISV in the 5GS mobile identity
+// of type idType, the digits being BCD encoded after the odd/even indicator
+func PeiToMobileIdentity(pei string, idType uint8) []byte {
+	odd := uint8(len(pei) % 2)
+	buf := []byte{(pei[0]-'0')<<4 | odd<<3 | idType}
+	for i := 1; i < len(pei); i += 2 {
+		// filler for the missing last digit
+		high := uint8(0xf)
+		if i+1 < len(pei) {
+			high = pei[i+1] - '0'
+		}
+		buf = append(buf, high<<4|(pei[i]-'0'))
+	}
+	return buf
+}
 
-	return suci, nil
+// GprsTimer3ToDuration returns the value of a GPRS timer 3 IE given its unit
+// and timer value, TS 24.008 Section 10.5.7.4a. The timer is deactivated,
+// i.e. zero, for the units not defined
+func GprsTimer3ToDuration(unit, value uint8) time.Duration {
+	var step time.Duration
+	switch unit {
+	case nasMessage.GPRSTimer3UnitMultiplesOf10Minutes:
+		step = 10 * time.Minute
+	case nasMessage.GPRSTimer3UnitMultiplesOf1Hour:
+		step = time.Hour
+	case nasMessage.GPRSTimer3UnitMultiplesOf10Hours:
+		step = 10 * time.Hour
+	case nasMessage.GPRSTimer3UnitMultiplesOf2Seconds:
+		step = 2 * time.Second
+	case nasMessage.GPRSTimer3UnitMultiplesOf30Seconds:
+		step = 30 * time.Second
+	case nasMessage.GPRSTimer3UnitMultiplesOf1Minute:
+		step = time.Minute
+	}
+	return time.Duration(value) * step
+}
+
+// GprsTimer2ToDuration returns the value of a GPRS timer 2 IE, TS 24.008
+// Section 10.5.7.4. Zero is returned for a deactivated timer
+func GprsTimer2ToDuration(octet uint8) time.Duration {
+	value := time.Duration(octet & 0x1f)
+	switch octet >> 5 {
+	case 0:
+		return value * 2 * time.Second
+	case 2:
+		// decihours
+		return value * 6 * time.Minute
+	case 7:
+		return 0
+	default:
+		// other units are interpreted as multiples of 1 minute
+		return value * time.Minute
+	}
 }
@@ -8,22 +8,32 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/omec-project/gnbsim/common"
+	"github.com/omec-project/gnbsim/metrics"
 	realuectx "github.com/omec-project/gnbsim/realue/context"
 	"github.com/omec-project/gnbsim/util/test"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	ICMP_HEADER_LEN int = 8
 
+	// Echo data of the ICMP and ICMPv6 echo requests
+	ICMP_PAYLOAD string = "8c870d0000000000101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f3031323334353637"
+
 	/*ipv4 package requires ipv4 header length in terms of number of bytes,
 	  however it later converts it into number of 32 bit words
 	*/
 	IPV4_MIN_HEADER_LEN int = 20
+
+	// Time given to the replies of the echo requests sent at an interval to
+	// arrive once the last echo request is sent
+	DATA_PKT_REPLY_WAIT time.Duration = time.Second
 )
 
 func HandleInitEvent(pduSess *realuectx.PduSession,
@@ -36,9 +46,17 @@ func HandleInitEvent(pduSess *realuectx.PduSession,
 
 func SendIcmpEchoRequest(pduSess *realuectx.PduSession) (err error) {
 
+	dst := net.ParseIP(pduSess.DefaultAs)
+	if dst != nil && dst.To4() == nil {
+		return SendIcmpv6EchoRequest(pduSess, dst)
+	}
+	if pduSess.PduAddress == nil {
+		return fmt.Errorf("no ipv4 address assigned to the pdu session")
+	}
+
 	pduSess.Log.Traceln("Sending UL ICMP ping message")
 
-	icmpPayload, err := hex.DecodeString("8c870d0000000000101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f3031323334353637")
+	icmpPayload, err := hex.DecodeString(ICMP_PAYLOAD)
 	if err != nil {
 		pduSess.Log.Errorln("Failed to decode icmp hexString ")
 		return
@@ -84,7 +102,8 @@ func SendIcmpEchoRequest(pduSess *realuectx.PduSession) (err error) {
 	userDataMsg := &common.UserDataMessage{}
 	userDataMsg.Event = common.UL_UE_DATA_TRANSFER_EVENT
 	userDataMsg.Payload = payload
-	pduSess.WriteGnbChan <- userDataMsg
+	pduSess.EchoReqSentAt = time.Now()
+	sendToGnb(pduSess, userDataMsg)
 	pduSess.TxDataPktCount++
 
 	pduSess.Log.Traceln("Sent UL ICMP ping message")
@@ -101,27 +120,41 @@ func HandleIcmpMessage(pduSess *realuectx.PduSession,
 
 	switch icmpMsg.Type {
 	case ipv4.ICMPTypeEchoReply:
-		echpReply := icmpMsg.Body.(*icmp.Echo)
-		if echpReply == nil {
+		echpReply, ok := icmpMsg.Body.(*icmp.Echo)
+		if !ok || echpReply == nil {
 			return fmt.Errorf("icmp echo reply is nil")
 		}
 
 		pduSess.Log.Infof("Received ICMP Echo Reply, ID:%v, Seq:%v",
 			echpReply.ID, echpReply.Seq)
-
-		pduSess.RxDataPktCount++
-		if pduSess.TxDataPktCount < pduSess.ReqDataPktCount {
-			SendIcmpEchoRequest(pduSess)
-		} else {
-			msg := &common.UuMessage{}
-			msg.Event = common.DATA_PKT_GEN_SUCCESS_EVENT
-			pduSess.WriteUeChan <- msg
-			pduSess.Log.Traceln("Sent Data Packet Generation Success Event")
-		}
+		return handleEchoReply(pduSess, echpReply)
 	default:
 		return fmt.Errorf("unsupported icmp message type:%v", icmpMsg.Type)
 	}
+}
+
+func handleEchoReply(pduSess *realuectx.PduSession, echoReply *icmp.Echo) error {
+	if echoReply.Seq == pduSess.SeqNum {
+		metrics.ObserveIcmpRtt(time.Since(pduSess.EchoReqSentAt))
+	}
 
+	pduSess.RxDataPktCount++
+	if pduSess.DataPktTicker != nil {
+		// Echo requests are sent on the ticks
+		if pduSess.TxDataPktCount == pduSess.ReqDataPktCount &&
+			pduSess.RxDataPktCount-pduSess.DataPktBaseRx >=
+				pduSess.TxDataPktCount-pduSess.DataPktBaseTx {
+			endPacedDataPktGen(pduSess)
+		}
+		return nil
+	}
+	if pduSess.TxDataPktCount < pduSess.ReqDataPktCount {
+		return SendIcmpEchoRequest(pduSess)
+	}
+	msg := &common.UuMessage{}
+	msg.Event = common.DATA_PKT_GEN_SUCCESS_EVENT
+	sendToUe(pduSess, msg)
+	pduSess.Log.Traceln("Sent Data Packet Generation Success Event")
 	return nil
 }
 
@@ -137,11 +170,18 @@ func HandleDlMessage(pduSess *realuectx.PduSession,
 	}
 
 	dataMsg := msg.(*common.UserDataMessage)
+	if dataMsg.Event == common.ERROR_INDICATION_EVENT {
+		return dataMsg.Error
+	}
 
 	if dataMsg.Qfi != nil {
 		pduSess.Log.Infoln("Received QFI value in downlink user data packet:", *dataMsg.Qfi)
 	}
 
+	if len(dataMsg.Payload) != 0 && dataMsg.Payload[0]>>4 == ipv6.Version {
+		return HandleIpv6Packet(pduSess, dataMsg.Payload)
+	}
+
 	ipv4Hdr, err := ipv4.ParseHeader(dataMsg.Payload)
 	if err != nil {
 		return fmt.Errorf("failed to parse ipv4 header:%v", err)
@@ -164,21 +204,126 @@ func HandleDlMessage(pduSess *realuectx.PduSession,
 func HandleDataPktGenRequestEvent(pduSess *realuectx.PduSession,
 	intfcMsg common.InterfaceMessage) (err error) {
 	cmd := intfcMsg.(*common.UeMessage)
-	pduSess.ReqDataPktCount = cmd.UserDataPktCount
+	// The PDU session may have sent user data before, e.g. ahead of a
+	// handover
+	pduSess.ReqDataPktCount = pduSess.TxDataPktCount + cmd.UserDataPktCount
 	pduSess.DefaultAs = cmd.DefaultAs
+	pduSess.DataPktInterval = cmd.UserDataPktInterval
+	pduSess.MaxDataPktLoss = cmd.MaxUserDataPktLoss
+	pduSess.DataPktBaseTx = pduSess.TxDataPktCount
+	pduSess.DataPktBaseRx = pduSess.RxDataPktCount
+	pduSess.DataPktReplyWaits = 0
+	stopDataPktTicker(pduSess)
+
+	if pduSess.DefaultAs == "" {
+		return fmt.Errorf("no destination configured for the user data, defaultAsV6 missing")
+	}
+	dst := net.ParseIP(pduSess.DefaultAs)
+	if dst == nil {
+		return fmt.Errorf("invalid destination of the user data:%v", pduSess.DefaultAs)
+	}
+	if dst.To4() == nil && pduSess.GetPduAddressV6() == nil {
+		if !pduSess.HasIpv6() {
+			return fmt.Errorf("no ipv6 address assigned to the pdu session")
+		}
+		// The network advertises the prefix once the PDU session is set up,
+		// the echo requests are sent once the Router Advertisement is received
+		pduSess.Log.Infoln("Waiting for the IPv6 prefix to send user data")
+		pduSess.DataPktGenPending = true
+		startDataPktTicker(pduSess)
+		return SendRouterSolicitation(pduSess)
+	}
+
+	startDataPktTicker(pduSess)
 	err = SendIcmpEchoRequest(pduSess)
 	if err != nil {
+		stopDataPktTicker(pduSess)
 		return fmt.Errorf("failed to send icmp echo req:%v", err)
 	}
 	return nil
 }
 
+// HandleDataPktTick sends the next echo request when the echo requests are
+// sent at an interval. Once all of them are sent, the replies still expected
+// are waited for up to DATA_PKT_REPLY_WAIT
+func HandleDataPktTick(pduSess *realuectx.PduSession) (err error) {
+	if pduSess.DataPktGenPending {
+		// Waiting for the IPv6 prefix
+		return nil
+	}
+	if pduSess.TxDataPktCount < pduSess.ReqDataPktCount {
+		err = SendIcmpEchoRequest(pduSess)
+		if err != nil {
+			stopDataPktTicker(pduSess)
+			return fmt.Errorf("failed to send icmp echo req:%v", err)
+		}
+		return nil
+	}
+
+	pduSess.DataPktReplyWaits++
+	if time.Duration(pduSess.DataPktReplyWaits)*pduSess.DataPktInterval < DATA_PKT_REPLY_WAIT {
+		return nil
+	}
+	endPacedDataPktGen(pduSess)
+	return nil
+}
+
+// endPacedDataPktGen reports the outcome of the echo requests sent at an
+// interval, they fail if more of them than allowed were lost
+func endPacedDataPktGen(pduSess *realuectx.PduSession) {
+	stopDataPktTicker(pduSess)
+
+	sent := pduSess.TxDataPktCount - pduSess.DataPktBaseTx
+	lost := sent - (pduSess.RxDataPktCount - pduSess.DataPktBaseRx)
+	if lost < 0 {
+		lost = 0
+	}
+	pduSess.Log.Infoln("Sent", sent, "echo requests,", lost, "lost")
+
+	msg := &common.UuMessage{}
+	msg.Event = common.DATA_PKT_GEN_SUCCESS_EVENT
+	if lost > pduSess.MaxDataPktLoss {
+		msg.Event = common.DATA_PKT_GEN_FAILURE_EVENT
+		msg.Error = fmt.Errorf("pdu session id:%v, %v of %v echo requests lost, at most %v allowed",
+			pduSess.PduSessId, lost, sent, pduSess.MaxDataPktLoss)
+	}
+	sendToUe(pduSess, msg)
+}
+
+func startDataPktTicker(pduSess *realuectx.PduSession) {
+	if pduSess.DataPktInterval > 0 {
+		pduSess.DataPktTicker = time.NewTicker(pduSess.DataPktInterval)
+	}
+}
+
+func stopDataPktTicker(pduSess *realuectx.PduSession) {
+	if pduSess.DataPktTicker != nil {
+		pduSess.DataPktTicker.Stop()
+		pduSess.DataPktTicker = nil
+	}
+}
+
+// dataPktTick returns the channel of the ticks on which echo requests are
+// sent, nil if they are not sent at an interval
+func dataPktTick(pduSess *realuectx.PduSession) <-chan time.Time {
+	if pduSess.DataPktTicker == nil {
+		return nil
+	}
+	return pduSess.DataPktTicker.C
+}
+
 func HandleConnectionReleaseRequestEvent(pduSess *realuectx.PduSession,
 	intfcMsg common.InterfaceMessage) (err error) {
 
+	// The user plane may not have been activated since the previous release,
+	// e.g. for a registration update
+	if pduSess.WriteGnbChan == nil {
+		return nil
+	}
+
 	userDataMsg := &common.UserDataMessage{}
 	userDataMsg.Event = common.LAST_DATA_PKT_EVENT
-	pduSess.WriteGnbChan <- userDataMsg
+	sendToGnb(pduSess, userDataMsg)
 	// Releasing the reference so as to be freed by Garbage Collector
 	pduSess.WriteGnbChan = nil
 	return nil
@@ -187,10 +332,12 @@ func HandleConnectionReleaseRequestEvent(pduSess *realuectx.PduSession,
 func HandleQuitEvent(pduSess *realuectx.PduSession,
 	intfcMsg common.InterfaceMessage) (err error) {
 
+	stopDataPktTicker(pduSess)
+
 	if pduSess.WriteGnbChan != nil {
 		userDataMsg := &common.UserDataMessage{}
 		userDataMsg.Event = common.LAST_DATA_PKT_EVENT
-		pduSess.WriteGnbChan <- userDataMsg
+		sendToGnb(pduSess, userDataMsg)
 		pduSess.WriteGnbChan = nil
 	}
 
@@ -198,10 +345,16 @@ func HandleQuitEvent(pduSess *realuectx.PduSession,
 	// This ensures that the transmitting go routine is not blocked while
 	// sending data on this channel
 	if pduSess.LastDataPktRecvd != true {
-		for pkt := range pduSess.ReadDlChan {
-			if pkt.GetEventType() == common.LAST_DATA_PKT_EVENT {
-				pduSess.Log.Debugln("Received last downlink data packet")
-				break
+	drain:
+		for {
+			select {
+			case pkt := <-pduSess.ReadDlChan:
+				if pkt.GetEventType() == common.LAST_DATA_PKT_EVENT {
+					pduSess.Log.Debugln("Received last downlink data packet")
+					break drain
+				}
+			case <-pduSess.Ctx.Done():
+				break drain
 			}
 		}
 	}
@@ -211,3 +364,25 @@ func HandleQuitEvent(pduSess *realuectx.PduSession,
 
 	return nil
 }
+
+// sendToGnb writes the uplink message to the gNB unless the UE has terminated.
+// The message is dropped while the PDU session has no user plane, e.g. while
+// the UE is handed over
+func sendToGnb(pduSess *realuectx.PduSession, msg common.InterfaceMessage) {
+	if pduSess.WriteGnbChan == nil {
+		pduSess.Log.Infoln("No user plane, dropping", msg.GetEventType())
+		return
+	}
+	select {
+	case pduSess.WriteGnbChan <- msg:
+	case <-pduSess.Ctx.Done():
+	}
+}
+
+// sendToUe writes the message to the RealUE unless the UE has terminated
+func sendToUe(pduSess *realuectx.PduSession, msg common.InterfaceMessage) {
+	select {
+	case pduSess.WriteUeChan <- msg:
+	case <-pduSess.Ctx.Done():
+	}
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pdusessworker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/omec-project/gnbsim/common"
+	realuectx "github.com/omec-project/gnbsim/realue/context"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	IPV6_NEXT_HEADER_ICMPV6 int = 58
+
+	// Hop limit of the Neighbor Discovery messages, RFC 4861
+	ND_HOP_LIMIT int = 255
+
+	// Router Advertisement fields preceding the options, RFC 4861 Section 4.2
+	RA_FIXED_LEN int = 12
+
+	ND_OPT_PREFIX_INFORMATION uint8 = 3
+	ND_OPT_PREFIX_INFO_LEN    int   = 32
+
+	// TS 23.501 Section 5.8.2.2.3, a /64 prefix is advertised to the UE
+	IPV6_PREFIX_LEN uint8 = 64
+)
+
+// All routers multicast address, destination of the Router Solicitations
+var allRoutersAddr = net.ParseIP("ff02::2")
+
+// SendRouterSolicitation asks the network for the IPv6 prefix of the PDU
+// session in case the Router Advertisement sent by the network after the PDU
+// session establishment was missed, TS 23.501 Section 5.8.2.2.3
+func SendRouterSolicitation(pduSess *realuectx.PduSession) error {
+	if pduSess.WriteGnbChan == nil {
+		return fmt.Errorf("user plane of the pdu session not set up")
+	}
+
+	icmpMsg := &icmp.Message{
+		Type: ipv6.ICMPTypeRouterSolicitation, Code: 0,
+		Body: &icmp.RawBody{Data: make([]byte, 4)}, // reserved
+	}
+	payload, err := buildIpv6Packet(pduSess.LinkLocalAddress(), allRoutersAddr,
+		ND_HOP_LIMIT, icmpMsg)
+	if err != nil {
+		return fmt.Errorf("failed to build router solicitation:%v", err)
+	}
+
+	userDataMsg := &common.UserDataMessage{}
+	userDataMsg.Event = common.UL_UE_DATA_TRANSFER_EVENT
+	userDataMsg.Payload = payload
+	sendToGnb(pduSess, userDataMsg)
+	pduSess.Log.Infoln("Sent Router Solicitation")
+	return nil
+}
+
+func SendIcmpv6EchoRequest(pduSess *realuectx.PduSession, dst net.IP) error {
+	src := pduSess.GetPduAddressV6()
+	if src == nil {
+		return fmt.Errorf("ipv6 prefix of the pdu session not known")
+	}
+
+	pduSess.Log.Traceln("Sending UL ICMPv6 ping message")
+
+	icmpPayload, err := hex.DecodeString(ICMP_PAYLOAD)
+	if err != nil {
+		return fmt.Errorf("failed to decode icmp payload:%v", err)
+	}
+
+	icmpMsg := &icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest, Code: 0,
+		Body: &icmp.Echo{
+			ID: 12394, Seq: pduSess.GetNextSeqNum(),
+			Data: icmpPayload,
+		},
+	}
+	payload, err := buildIpv6Packet(src, dst, 64, icmpMsg)
+	if err != nil {
+		return fmt.Errorf("failed to build icmpv6 echo request:%v", err)
+	}
+
+	userDataMsg := &common.UserDataMessage{}
+	userDataMsg.Event = common.UL_UE_DATA_TRANSFER_EVENT
+	userDataMsg.Payload = payload
+	pduSess.EchoReqSentAt = time.Now()
+	sendToGnb(pduSess, userDataMsg)
+	pduSess.TxDataPktCount++
+
+	pduSess.Log.Traceln("Sent UL ICMPv6 ping message")
+	return nil
+}
+
+func HandleIpv6Packet(pduSess *realuectx.PduSession, pkt []byte) error {
+	ipv6Hdr, err := ipv6.ParseHeader(pkt)
+	if err != nil {
+		return fmt.Errorf("failed to parse ipv6 header:%v", err)
+	}
+	if len(pkt) < ipv6.HeaderLen+ipv6Hdr.PayloadLen {
+		return fmt.Errorf("truncated ipv6 packet")
+	}
+	payload := pkt[ipv6.HeaderLen : ipv6.HeaderLen+ipv6Hdr.PayloadLen]
+
+	switch ipv6Hdr.NextHeader {
+	/* Currently supporting ICMPv6 without extension headers */
+	case IPV6_NEXT_HEADER_ICMPV6:
+		err = HandleIcmpv6Message(pduSess, payload)
+		if err != nil {
+			return fmt.Errorf("failed to handle icmpv6 message:%v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported ipv6 next header:%v", ipv6Hdr.NextHeader)
+	}
+	return nil
+}
+
+func HandleIcmpv6Message(pduSess *realuectx.PduSession, icmpPkt []byte) error {
+	icmpMsg, err := icmp.ParseMessage(IPV6_NEXT_HEADER_ICMPV6, icmpPkt)
+	if err != nil {
+		return fmt.Errorf("failed to parse icmpv6 message:%v", err)
+	}
+
+	switch icmpMsg.Type {
+	case ipv6.ICMPTypeEchoReply:
+		echoReply, ok := icmpMsg.Body.(*icmp.Echo)
+		if !ok || echoReply == nil {
+			return fmt.Errorf("icmpv6 echo reply is nil")
+		}
+
+		pduSess.Log.Infof("Received ICMPv6 Echo Reply, ID:%v, Seq:%v",
+			echoReply.ID, echoReply.Seq)
+		return handleEchoReply(pduSess, echoReply)
+	case ipv6.ICMPTypeRouterAdvertisement:
+		body, ok := icmpMsg.Body.(*icmp.RawBody)
+		if !ok || body == nil {
+			return fmt.Errorf("router advertisement is empty")
+		}
+		prefix, err := parseRouterAdvertisement(body.Data)
+		if err != nil {
+			return fmt.Errorf("invalid router advertisement:%v", err)
+		}
+
+		// the prefix stays the same for the lifetime of the PDU session
+		if pduSess.GetPduAddressV6() != nil {
+			return nil
+		}
+		pduSess.SetIpv6Prefix(prefix)
+		pduSess.Log.Infoln("Received Router Advertisement, IPv6 Address:",
+			pduSess.GetPduAddressV6().String())
+
+		if pduSess.DataPktGenPending {
+			pduSess.DataPktGenPending = false
+			return SendIcmpEchoRequest(pduSess)
+		}
+	default:
+		return fmt.Errorf("unsupported icmpv6 message type:%v", icmpMsg.Type)
+	}
+	return nil
+}
+
+// parseRouterAdvertisement returns the /64 prefix carried by the Prefix
+// Information option of the Router Advertisement
+func parseRouterAdvertisement(body []byte) (net.IP, error) {
+	if len(body) < RA_FIXED_LEN {
+		return nil, fmt.Errorf("message too short")
+	}
+
+	opts := body[RA_FIXED_LEN:]
+	for len(opts) >= 2 {
+		optLen := int(opts[1]) * 8
+		if optLen == 0 || optLen > len(opts) {
+			return nil, fmt.Errorf("malformed option")
+		}
+		if opts[0] == ND_OPT_PREFIX_INFORMATION && optLen == ND_OPT_PREFIX_INFO_LEN {
+			if opts[2] != IPV6_PREFIX_LEN {
+				return nil, fmt.Errorf("unsupported prefix length:%v", opts[2])
+			}
+			prefix := make(net.IP, net.IPv6len)
+			copy(prefix, opts[16:32])
+			return prefix, nil
+		}
+		opts = opts[optLen:]
+	}
+	return nil, fmt.Errorf("prefix information option missing")
+}
+
+// buildIpv6Packet encodes the ICMPv6 message, including its checksum, within
+// an IPv6 packet without extension headers
+func buildIpv6Packet(src, dst net.IP, hopLimit int, icmpMsg *icmp.Message) ([]byte, error) {
+	b, err := icmpMsg.Marshal(icmp.IPv6PseudoHeader(src, dst))
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := make([]byte, ipv6.HeaderLen, ipv6.HeaderLen+len(b))
+	pkt[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(b)))
+	pkt[6] = byte(IPV6_NEXT_HEADER_ICMPV6)
+	pkt[7] = byte(hopLimit)
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+	return append(pkt, b...), nil
+}
@@ -24,6 +24,8 @@ func HandleEvents(pduSess *realuectx.PduSession) {
 		/* Reading Down link packets from gNb*/
 		case msg := <-pduSess.ReadDlChan:
 			err = HandleDlMessage(pduSess, msg)
+		case <-dataPktTick(pduSess):
+			err = HandleDataPktTick(pduSess)
 		/* Reading commands from RealUE control plane*/
 		case msg := <-pduSess.ReadCmdChan:
 			event := msg.GetEventType()
@@ -34,19 +36,25 @@ func HandleEvents(pduSess *realuectx.PduSession) {
 				HandleInitEvent(pduSess, msg)
 			case common.DATA_PKT_GEN_REQUEST_EVENT:
 				err = HandleDataPktGenRequestEvent(pduSess, msg)
-			case common.CONNECTION_RELEASE_REQUEST_EVENT:
+			case common.CONNECTION_RELEASE_REQUEST_EVENT,
+				common.HANDOVER_COMMAND_EVENT:
+				// The user plane resumes through the target gNB once the
+				// UE moved to it
 				err = HandleConnectionReleaseRequestEvent(pduSess, msg)
 			case common.QUIT_EVENT:
 				HandleQuitEvent(pduSess, msg)
 				return
 			}
+		case <-pduSess.Ctx.Done():
+			HandleQuitEvent(pduSess, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return
 		}
 
 		if err != nil {
 			msg := &common.UeMessage{}
 			msg.Error = fmt.Errorf("pdu session failed:%v", err)
 			msg.Event = common.ERROR_EVENT
-			pduSess.WriteUeChan <- msg
+			sendToUe(pduSess, msg)
 			err = nil
 		}
 	}
@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/omec-project/gnbsim/common"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func seconds(sec float64) string {
+	return fmt.Sprintf("%.3f", sec)
+}
+
+// junit maps each procedure executed by a UE to a test case and each profile
+// to a test suite. Profile errors which could not be attributed to any UE are
+// reported as a failed test case of the profile test suite
+func (r *Report) junit() *junitTestSuites {
+	suites := &junitTestSuites{
+		Name: "gnbsim",
+		Time: seconds(r.EndTime.Sub(r.StartTime).Seconds()),
+	}
+
+	for _, prof := range r.Profiles {
+		suite := &junitTestSuite{Name: prof.Name}
+		var total float64
+		for _, ue := range prof.Ues {
+			total += ue.DurationSec
+			for _, proc := range ue.Procedures {
+				tc := &junitTestCase{
+					Name:      ue.Supi + "/" + proc.Name,
+					ClassName: "gnbsim." + prof.Name,
+					Time:      seconds(proc.DurationSec),
+				}
+				if proc.Status != common.STATUS_PASS {
+					tc.Failure = &junitFailure{
+						Message: proc.Error,
+						Type:    proc.Status,
+						Text:    proc.Error,
+					}
+					suite.Failures++
+				}
+				suite.Cases = append(suite.Cases, tc)
+			}
+		}
+
+		if len(prof.Ues) == 0 && prof.Status != common.STATUS_PASS {
+			tc := &junitTestCase{
+				Name:      prof.Name,
+				ClassName: "gnbsim." + prof.Name,
+				Time:      seconds(0),
+				Failure: &junitFailure{
+					Message: "profile failed",
+					Type:    prof.Status,
+				},
+			}
+			for _, err := range prof.Errors {
+				tc.Failure.Text += err + "\n"
+			}
+			suite.Cases = append(suite.Cases, tc)
+			suite.Failures++
+		}
+
+		suite.Tests = len(suite.Cases)
+		suite.Time = seconds(total)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+	return suites
+}
@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package report builds a machine readable report of a gnbsim run from the
+// profile summaries and writes it in JSON and JUnit XML formats
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omec-project/gnbsim/common"
+)
+
+type Report struct {
+	Status    string           `json:"status"`
+	StartTime time.Time        `json:"startTime"`
+	EndTime   time.Time        `json:"endTime"`
+	Profiles  []*ProfileReport `json:"profiles"`
+
+	mu sync.Mutex
+}
+
+type ProfileReport struct {
+	Name          string      `json:"profileName"`
+	Type          string      `json:"profileType"`
+	Status        string      `json:"status"`
+	UePassedCount uint        `json:"uePassedCount"`
+	UeFailedCount uint        `json:"ueFailedCount"`
+	Errors        []string    `json:"errors,omitempty"`
+	Ues           []*UeReport `json:"ues"`
+}
+
+type UeReport struct {
+	Supi         string             `json:"supi"`
+	Status       string             `json:"status"`
+	DurationSec  float64            `json:"durationSec"`
+	Error        string             `json:"error,omitempty"`
+	Guti         string             `json:"guti,omitempty"`
+	PduAddresses []string           `json:"pduAddresses,omitempty"`
+	Procedures   []*ProcedureReport `json:"procedures"`
+}
+
+type ProcedureReport struct {
+	Name        string  `json:"name"`
+	Status      string  `json:"status"`
+	DurationSec float64 `json:"durationSec"`
+	Error       string  `json:"error,omitempty"`
+	Cause       string  `json:"cause,omitempty"`
+}
+
+func NewReport() *Report {
+	return &Report{
+		Status:    common.STATUS_PASS,
+		StartTime: time.Now(),
+		Profiles:  make([]*ProfileReport, 0),
+	}
+}
+
+// AddProfile adds the execution summary of a profile to the report
+func (r *Report) AddProfile(summary *common.SummaryMessage) {
+	prof := NewProfileReport(summary)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Profiles = append(r.Profiles, prof)
+	if prof.Status != common.STATUS_PASS {
+		r.Status = common.STATUS_FAIL
+	}
+}
+
+// NewProfileReport builds the report of a profile from its execution summary
+func NewProfileReport(summary *common.SummaryMessage) *ProfileReport {
+	prof := &ProfileReport{
+		Name:          summary.ProfileName,
+		Type:          summary.ProfileType,
+		Status:        common.STATUS_PASS,
+		UePassedCount: summary.UePassedCount,
+		UeFailedCount: summary.UeFailedCount,
+		Ues:           make([]*UeReport, 0, len(summary.UeResults)),
+	}
+
+	for _, err := range summary.ErrorList {
+		prof.Errors = append(prof.Errors, err.Error())
+	}
+	if summary.Aborted {
+		prof.Status = common.STATUS_ABORTED
+	} else if len(summary.ErrorList) != 0 || summary.UeFailedCount != 0 {
+		prof.Status = common.STATUS_FAIL
+	}
+
+	for _, ueResult := range summary.UeResults {
+		if ueResult == nil {
+			continue
+		}
+		ue := &UeReport{
+			Supi:         ueResult.Supi,
+			Status:       ueResult.Status,
+			DurationSec:  ueResult.Duration.Seconds(),
+			Error:        ueResult.Error,
+			Guti:         ueResult.Guti,
+			PduAddresses: ueResult.PduAddresses,
+			Procedures:   make([]*ProcedureReport, 0, len(ueResult.Procedures)),
+		}
+		for _, procResult := range ueResult.Procedures {
+			ue.Procedures = append(ue.Procedures, &ProcedureReport{
+				Name:        procResult.Name,
+				Status:      procResult.Status,
+				DurationSec: procResult.Duration.Seconds(),
+				Error:       procResult.Error,
+				Cause:       procResult.Cause,
+			})
+		}
+		prof.Ues = append(prof.Ues, ue)
+	}
+	return prof
+}
+
+// Failed returns true if any of the profiles in the report failed
+func (r *Report) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Status != common.STATUS_PASS
+}
+
+// Write writes the report in JSON format to <path>.json and in JUnit XML
+// format to <path>.xml. A ".json" or ".xml" suffix in path is ignored
+func (r *Report) Write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".json"), ".xml")
+	r.EndTime = time.Now()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal json report: %v", err)
+	}
+	if err = ioutil.WriteFile(path+".json", content, 0644); err != nil {
+		return fmt.Errorf("failed to write json report: %v", err)
+	}
+
+	content, err = xml.MarshalIndent(r.junit(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal junit report: %v", err)
+	}
+	content = append([]byte(xml.Header), content...)
+	if err = ioutil.WriteFile(path+".xml", content, 0644); err != nil {
+		return fmt.Errorf("failed to write junit report: %v", err)
+	}
+	return nil
+}
@@ -5,15 +5,17 @@
 package context
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/omec-project/gnbsim/common"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
 	"github.com/omec-project/gnbsim/logger"
 	profctx "github.com/omec-project/gnbsim/profile/context"
 	realuectx "github.com/omec-project/gnbsim/realue/context"
+	"github.com/omec-project/gnbsim/uestate"
 
-	"github.com/omec-project/nas/security"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,12 +26,52 @@ func init() {
 // SimUe controls the flow of messages between RealUe and GnbUe as per the test
 // profile. It is the central entry point for all events
 type SimUe struct {
-	Supi       string
-	GnB        *gnbctx.GNodeB
-	RealUe     *realuectx.RealUe
-	ProfileCtx *profctx.Profile
-	Procedure  common.ProcedureType
-	WaitGrp    sync.WaitGroup
+	Supi         string
+	GnB          *gnbctx.GNodeB
+	RealUe       *realuectx.RealUe
+	ProfileCtx   *profctx.Profile
+	ProfileUeCtx *profctx.ProfileUeContext
+	Procedure    common.ProcedureType
+	WaitGrp      sync.WaitGroup
+
+	// Set once the UE completes the registration procedure and reset once
+	// it is deregistered
+	Registered bool
+
+	// Set while the UE is being released after it was aborted
+	Aborting bool
+
+	// Set from the start of a procedure of the profile until its result is
+	// sent to the profile routine
+	ProcInProgress bool
+
+	// Periodic registration update timer value provided by the network, the
+	// timer runs while the UE is registered and idle. Zero if deactivated
+	T3512      time.Duration
+	t3512Timer *time.Timer
+
+	// Set while the UE runs a periodic registration update on expiry of
+	// T3512. The procedure of the profile, if any, is resumed once the UE
+	// is back to idle
+	PeriodicUpdate     bool
+	SuspendedProcedure common.ProcedureType
+	DeferredProcMsg    *common.ProfileMessage
+
+	// Reject of the service request after which the UE registers again
+	RejectErr *common.RejectError
+
+	// Target gNB of the handover in progress
+	HandoverTarget *gnbctx.GNodeB
+
+	// Outcomes the handover procedure still waits for, the UE moving to the
+	// target gNB and the user data sent through the handover, and the first
+	// failure among them
+	HandoverPending int
+	HandoverErr     error
+
+	// PDU sessions the current procedure applies to. The PDU session
+	// procedures remove the PDU sessions once established or released
+	ProcPduSessions []*common.PduSessionParams
 
 	// SimUe writes messages to Profile routine on this channel
 	WriteProfileChan chan *common.ProfileMessage
@@ -44,33 +86,105 @@ type SimUe struct {
 	// Entities can be RealUe, GnbUe etc.
 	ReadChan chan common.InterfaceMessage
 
+	// Cancelled when the profile aborts the UE
+	Ctx context.Context
+
+	// Cancelled once the SimUe has terminated. RealUe and GnbUe stop waiting
+	// on the SimUe from then on
+	TermCtx   context.Context
+	Terminate context.CancelFunc
+
 	/* logger */
 	Log *logrus.Entry
 }
 
-var SimUeTable map[string]*SimUe
+var (
+	SimUeTable     map[string]*SimUe
+	SimUeTableLock sync.RWMutex
+)
 
-func NewSimUe(supi string, gnb *gnbctx.GNodeB, profile *profctx.Profile, result chan *common.ProfileMessage) *SimUe {
+// NewSimUe creates a UE resuming from the state it had when it last
+// terminated, if any. A UE restarted after a failure starts in the
+// deregistered state instead, it only keeps the SQN of its USIM
+func NewSimUe(supi string, gnb *gnbctx.GNodeB, profile *profctx.Profile, pCtx *profctx.ProfileUeContext,
+	restart bool) *SimUe {
 	simue := SimUe{}
 	simue.GnB = gnb
 	simue.Supi = supi
 	simue.ProfileCtx = profile
+	simue.ProfileUeCtx = pCtx
+	simue.Ctx = pCtx.Context()
+	simue.TermCtx, simue.Terminate = context.WithCancel(context.Background())
 	simue.ReadChan = make(chan common.InterfaceMessage, 5)
-	simue.RealUe = realuectx.NewRealUe(supi,
-		security.AlgCiphering128NEA0, security.AlgIntegrity128NIA2,
-		simue.ReadChan, profile.Plmn, profile.Key, profile.Opc, profile.SeqNum,
-		profile.Dnn, profile.SNssai)
+	simue.RealUe = realuectx.NewRealUe(supi, profile.PSuci,
+		profile.PCipheringAlgs, profile.PIntegrityAlgs,
+		simue.ReadChan, profile.Plmn, profile.Key, profile.Opc, profile.SeqNum)
+	simue.RealUe.Ctx = simue.TermCtx
+	simue.RealUe.Imei, simue.RealUe.ImeiSv = profile.GetPei(supi)
 	simue.WriteRealUeChan = simue.RealUe.ReadChan
-	simue.WriteProfileChan = result
+	simue.WriteProfileChan = pCtx.ReadChan
 
 	simue.Log = logger.SimUeLog.WithField(logger.FieldSupi, supi)
 
+	if state := uestate.Get(supi); state != nil {
+		if restart {
+			state = &uestate.State{Sqn: state.Sqn}
+		}
+		if err := simue.RealUe.RestoreState(state); err != nil {
+			simue.Log.Errorln("Failed to restore UE state:", err)
+		} else {
+			simue.Registered = state.Registered && simue.RealUe.Guti != ""
+			simue.Log.Infof("Restored UE state, registered:%v, guti:%v",
+				simue.Registered, simue.RealUe.Guti)
+		}
+	}
+	pCtx.SetIdentities(simue.RealUe.Guti, []*profctx.PduSessionState{})
+
 	simue.Log.Traceln("Created new SimUe context")
+	SimUeTableLock.Lock()
 	SimUeTable[supi] = &simue
+	SimUeTableLock.Unlock()
 	return &simue
 }
 
+// StartT3512 (re)starts the periodic registration update timer, unless it is
+// deactivated
+func (simue *SimUe) StartT3512() {
+	simue.StopT3512()
+	if simue.T3512 <= 0 {
+		return
+	}
+	simue.Log.Traceln("Starting T3512:", simue.T3512)
+	simue.t3512Timer = time.NewTimer(simue.T3512)
+}
+
+// StopT3512 stops the periodic registration update timer
+func (simue *SimUe) StopT3512() {
+	if simue.t3512Timer != nil {
+		simue.t3512Timer.Stop()
+		simue.t3512Timer = nil
+	}
+}
+
+// T3512Expiry returns the channel on which the expiry of the periodic
+// registration update timer is notified, nil if the timer is not running
+func (simue *SimUe) T3512Expiry() <-chan time.Time {
+	if simue.t3512Timer == nil {
+		return nil
+	}
+	return simue.t3512Timer.C
+}
+
+// SaveState records the state of the UE for later runs. Called once the RealUe
+// routine has terminated, a running UE is asked to save its state through a
+// SAVE_STATE_EVENT instead
+func (simue *SimUe) SaveState() {
+	simue.RealUe.SaveState(simue.Registered)
+}
+
 func GetSimUe(supi string) *SimUe {
+	SimUeTableLock.RLock()
+	defer SimUeTableLock.RUnlock()
 	simue, found := SimUeTable[supi]
 	if found == false {
 		return nil
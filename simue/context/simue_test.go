@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package context
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	profctx "github.com/omec-project/gnbsim/profile/context"
+	"github.com/omec-project/gnbsim/uestate"
+
+	"github.com/omec-project/nas/security"
+	"github.com/omec-project/openapi/models"
+)
+
+const testSupi = "imsi-208930100007487"
+
+// savedState is the state of a registered UE with a NAS security context
+var savedState = uestate.State{
+	Sqn:          "000000000030",
+	Registered:   true,
+	Guti:         "20893cafe0000000001",
+	NgKsi:        1,
+	Kamf:         "b7a1e6e2c1a7d9b8c4f0e1d2a3b4c5d6b7a1e6e2c1a7d9b8c4f0e1d2a3b4c5d6",
+	CipheringAlg: security.AlgCiphering128NEA2,
+	IntegrityAlg: security.AlgIntegrity128NIA2,
+	KnasEnc:      "000102030405060708090a0b0c0d0e0f",
+	KnasInt:      "101112131415161718191a1b1c1d1e1f",
+	ULCount:      5,
+	DLCount:      4,
+}
+
+func newTestSimUe(t *testing.T, restart bool) (*SimUe, *profctx.ProfileUeContext) {
+	profile := &profctx.Profile{
+		Plmn:           &models.PlmnId{Mcc: "208", Mnc: "93"},
+		Key:            "5122250214c33e723a5dd523fc145fc0",
+		Opc:            "981d464c7c52eb6e5036234984ad0bcf",
+		SeqNum:         "000000000001",
+		PCipheringAlgs: []uint8{security.AlgCiphering128NEA2},
+		PIntegrityAlgs: []uint8{security.AlgIntegrity128NIA2},
+	}
+	pCtx := profctx.NewProfileUeContext(context.Background(), testSupi, "")
+	simUe := NewSimUe(testSupi, nil, profile, pCtx, restart)
+	t.Cleanup(func() {
+		SimUeTableLock.Lock()
+		delete(SimUeTable, testSupi)
+		SimUeTableLock.Unlock()
+	})
+	return simUe, pCtx
+}
+
+func TestNewSimUeRestoresState(t *testing.T) {
+	err := uestate.Init(&uestate.Config{Enable: true, File: filepath.Join(t.TempDir(), "ue-state.json")})
+	if err != nil {
+		t.Fatalf("failed to initialize ue state store: %v", err)
+	}
+	state := savedState
+	uestate.Put(testSupi, &state)
+
+	simUe, pCtx := newTestSimUe(t, false)
+	if !simUe.Registered {
+		t.Errorf("restored UE not registered")
+	}
+	if simUe.RealUe.Guti != savedState.Guti || simUe.RealUe.Kamf == nil {
+		t.Errorf("restored UE lacks its 5G-GUTI or security context, guti:%v", simUe.RealUe.Guti)
+	}
+	if simUe.RealUe.SqnMs != 0x30 {
+		t.Errorf("sqn = %012x, want %v", simUe.RealUe.SqnMs, savedState.Sqn)
+	}
+	if guti, _ := pCtx.Identities(); guti != savedState.Guti {
+		t.Errorf("profile ue guti = %v, want %v", guti, savedState.Guti)
+	}
+}
+
+// A UE restarted after a failure starts deregistered, without the 5G-GUTI and
+// security context of the failed UE
+func TestNewSimUeRestartAfterFailure(t *testing.T) {
+	err := uestate.Init(&uestate.Config{Enable: true, File: filepath.Join(t.TempDir(), "ue-state.json")})
+	if err != nil {
+		t.Fatalf("failed to initialize ue state store: %v", err)
+	}
+
+	state := savedState
+	uestate.Put(testSupi, &state)
+	failedUe, pCtx := newTestSimUe(t, false)
+	if !failedUe.Registered {
+		t.Fatalf("failed UE not restored as registered")
+	}
+	// the failed UE saves its state once its routines have terminated
+	failedUe.SaveState()
+
+	simUe := NewSimUe(testSupi, nil, failedUe.ProfileCtx, pCtx, true)
+	if simUe.Registered {
+		t.Errorf("restarted UE registered")
+	}
+	if simUe.RealUe.Guti != "" || simUe.RealUe.Kamf != nil {
+		t.Errorf("restarted UE kept the 5G-GUTI %v or the security context of the failed UE",
+			simUe.RealUe.Guti)
+	}
+	if simUe.RealUe.Idle {
+		t.Errorf("restarted UE in idle state")
+	}
+	if simUe.RealUe.SqnMs != 0x30 {
+		t.Errorf("sqn = %012x, want %v", simUe.RealUe.SqnMs, savedState.Sqn)
+	}
+	if guti, pduSessions := pCtx.Identities(); guti != "" || len(pduSessions) != 0 {
+		t.Errorf("profile ue kept the identities of the failed UE, guti:%v", guti)
+	}
+}
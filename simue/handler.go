@@ -5,52 +5,120 @@
 package simue
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/omec-project/gnbsim/common"
+	"github.com/omec-project/gnbsim/factory"
+	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	profctx "github.com/omec-project/gnbsim/profile/context"
+	realueutil "github.com/omec-project/gnbsim/realue/util"
 	simuectx "github.com/omec-project/gnbsim/simue/context"
+
+	"github.com/omec-project/nas/nasMessage"
 )
 
 func HandleProcedureEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 	msg := intfcMsg.(*common.ProfileMessage)
+	if ue.PeriodicUpdate {
+		ue.Log.Infoln("Periodic Registration Update in progress, deferring procedure", msg.Proc)
+		ue.DeferredProcMsg = msg
+		return nil
+	}
 	ue.Procedure = msg.Proc
+	ue.ProcPduSessions = msg.PduSessions
+	ue.ProcInProgress = true
 	ue.Log.Infoln("Start new procedure ", ue.Procedure)
 	HandleProcedure(ue)
 	return nil
 }
 
-func HandleRegRequestEvent(ue *simuectx.SimUe,
+// HandleT3512ExpiryEvent initiates a periodic registration update if the UE is
+// registered and idle. The timer is restarted if a procedure of the profile is
+// in progress
+func HandleT3512ExpiryEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
-	SendToGnbUe(ue, intfcMsg)
+	ue.StopT3512()
+	if !ue.Registered || ue.WriteGnbUeChan != nil || ue.Aborting {
+		return nil
+	}
+	if ue.ProcInProgress {
+		ue.Log.Infoln("T3512 expired during procedure", ue.Procedure, "restarting it")
+		ue.StartT3512()
+		return nil
+	}
+
+	ue.Log.Infoln("T3512 expired")
+	ue.PeriodicUpdate = true
+	ue.SuspendedProcedure = ue.Procedure
+	ue.Procedure = common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE
+	HandleProcedure(ue)
 	return nil
 }
 
-func HandleRegRejectEvent(ue *simuectx.SimUe,
+// endPeriodicUpdate resumes the procedure of the profile once the UE is back
+// to idle after a periodic registration update
+func endPeriodicUpdate(ue *simuectx.SimUe) {
+	ue.PeriodicUpdate = false
+	ue.Procedure = ue.SuspendedProcedure
+	if msg := ue.DeferredProcMsg; msg != nil {
+		ue.DeferredProcMsg = nil
+		HandleProcedureEvent(ue, msg)
+	}
+}
+
+func HandleRegRequestEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
-	err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.REG_REQUEST_EVENT,
-		intfcMsg.GetEventType())
-	if err != nil {
-		ue.Log.Errorln("CheckCurrentEvent returned:", err)
-		return err
+	msg := intfcMsg.(*common.UuMessage)
+	if ue.WriteGnbUeChan == nil {
+		// UE is in idle state, the request is sent in an Initial UE Message
+		err = ConnectToGnb(ue)
+		if err != nil {
+			return fmt.Errorf("failed to connect gnb %v:", err)
+		}
+	} else if ue.Registered && isRegistrationUpdate(ue.Procedure) {
+		msg.Event = common.UL_INFO_TRANSFER_EVENT
 	}
 
+	SendToGnbUe(ue, msg)
+	ue.Log.Traceln("Sent Registration Request to the network")
 	return nil
 }
 
+func isRegistrationUpdate(proc common.ProcedureType) bool {
+	return proc == common.MOBILITY_REGISTRATION_UPDATE_PROCEDURE ||
+		proc == common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE
+}
+
+func HandleRegRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	ue.Registered = false
+	// The procedure fails with the cause decoded by the RealUe
+	if err = intfcMsg.GetErrorMsg(); err == nil {
+		err = fmt.Errorf("registration rejected")
+	}
+	return err
+}
+
 func HandleAuthRequestEvent(ue *simuectx.SimUe,
 	intfMsg common.InterfaceMessage) (err error) {
 
 	msg := intfMsg.(*common.UeMessage)
 	// checking as per profile if Authentication Request Message is expected
-	// from 5G Core against Registration Request message sent by RealUE
-	err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.REG_REQUEST_EVENT, msg.Event)
-	if err != nil {
-		ue.Log.Errorln("CheckCurrentEvent returned:", err)
-		return err
+	// from 5G Core against Registration Request message sent by RealUE. The
+	// network may or may not authenticate a UE identified by its 5G-GUTI
+	if ue.Procedure == common.REGISTRATION_PROCEDURE {
+		err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.REG_REQUEST_EVENT, msg.Event)
+		if err != nil {
+			ue.Log.Errorln("CheckCurrentEvent returned:", err)
+			return err
+		}
 	}
 	nextEvent, err := ue.ProfileCtx.GetNextEvent(ue.Procedure, msg.Event)
 	if err != nil {
@@ -81,6 +149,48 @@ func HandleAuthResponseEvent(ue *simuectx.SimUe,
 	return nil
 }
 
+func HandleAuthFailureEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+	// The registration goes on if the network authenticates the UE again
+	ue.Log.Infoln("Sent Authentication Failure to the network")
+	return nil
+}
+
+func HandleAuthRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	// The network releases the UE once it has rejected the authentication
+	return fmt.Errorf("authentication rejected by the network")
+}
+
+func HandleIdentityRequestEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	nextEvent, err := ue.ProfileCtx.GetNextEvent(ue.Procedure, msg.Event)
+	if err != nil {
+		ue.Log.Errorln("GetNextEvent returned:", err)
+		return err
+	}
+	msg.Event = nextEvent
+	SendToRealUe(ue, msg)
+	return nil
+}
+
+func HandleIdentityResponseEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+	ue.Log.Traceln("Sent Identity Response to the network")
+	return nil
+}
+
 func HandleSecModCommandEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
@@ -116,6 +226,16 @@ func HandleSecModCompleteEvent(ue *simuectx.SimUe,
 	return nil
 }
 
+func HandleSecModRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+	ue.Log.Traceln("Sent Security Mode Reject to the network")
+	return fmt.Errorf("security mode command rejected, ue security capabilities mismatch")
+}
+
 func HandleRegAcceptEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
@@ -126,6 +246,12 @@ func HandleRegAcceptEvent(ue *simuectx.SimUe,
 		ue.Log.Errorln("GetNextEvent returned:", err)
 		return err
 	}
+
+	ue.T3512 = DEFAULT_T3512
+	if t3512 := msg.NasMsg.RegistrationAccept.T3512Value; t3512 != nil {
+		ue.T3512 = realueutil.GprsTimer3ToDuration(t3512.GetUnit(), t3512.GetTimerValue())
+	}
+	ue.Log.Infoln("T3512 value:", ue.T3512)
 	msg.Event = nextEvent
 	SendToRealUe(ue, msg)
 	return nil
@@ -144,6 +270,25 @@ func HandleRegCompleteEvent(ue *simuectx.SimUe,
 	msg.Event = common.UL_INFO_TRANSFER_EVENT
 	SendToGnbUe(ue, msg)
 	ue.Log.Traceln("Sent Registration Complete to the network")
+	ue.Registered = true
+
+	if rejErr := ue.RejectErr; rejErr != nil {
+		// The rejected service request completes once the UE is registered
+		// again. The reject is reported along with the result
+		ue.RejectErr = nil
+		ue.Procedure = common.UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE
+		SendToProfile(ue, common.PROC_PASS_EVENT, rejErr)
+		return nil
+	}
+
+	if ue.PeriodicUpdate {
+		// No follow-on request pending, the NAS signalling connection is
+		// released
+		m := &common.UeMessage{}
+		m.Event = common.TRIGGER_AN_RELEASE_EVENT
+		SendToGnbUe(ue, m)
+		return nil
+	}
 
 	//Current Procedure is complete. Move to next one
 	SendProcedureResult(ue)
@@ -154,6 +299,17 @@ func HandleDeregRequestEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
 	msg := intfcMsg.(*common.UuMessage)
+	if ue.WriteGnbUeChan == nil {
+		// UE is in idle state, the request is sent in an Initial UE Message
+		err = ConnectToGnb(ue)
+		if err != nil {
+			return fmt.Errorf("failed to connect gnb %v:", err)
+		}
+		SendToGnbUe(ue, msg)
+		ue.Log.Traceln("Sent Deregistration Request to the network")
+		return nil
+	}
+
 	msg.Event = common.UL_INFO_TRANSFER_EVENT
 	SendToGnbUe(ue, msg)
 	ue.Log.Traceln("Sent Deregistration Request to the network")
@@ -249,6 +405,119 @@ func HandlePduSessReleaseCompleteEvent(ue *simuectx.SimUe,
 	return nil
 }
 
+func HandlePduSessModRequestEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+	return nil
+}
+
+func HandlePduSessModRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.PDU_SESS_MOD_REQUEST_EVENT, msg.Event)
+	if err != nil {
+		ue.Log.Errorln("CheckCurrentEvent returned:", err)
+		return err
+	}
+
+	cause := msg.NasMsg.PDUSessionModificationReject.GetCauseValue()
+	return fmt.Errorf("pdu session modification rejected, 5gsm cause:%v", cause)
+}
+
+func HandlePduSessModCommandEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UeMessage)
+	pduSessId := msg.NasMsg.PDUSessionModificationCommand.GetPDUSessionID()
+	if !isPduSessModification(ue.Procedure) || !removeProcPduSession(ue, pduSessId) {
+		// The network may modify any PDU session at any time, the command
+		// is answered without affecting the current procedure
+		ue.Log.Infoln("Received unsolicited PDU Session Modification Command")
+		msg.Event = common.PDU_SESS_MOD_COMPLETE_EVENT
+		SendToRealUe(ue, msg)
+		return nil
+	}
+
+	if ue.Procedure == common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE {
+		err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.PDU_SESS_MOD_REQUEST_EVENT, msg.Event)
+		if err != nil {
+			ue.Log.Errorln("CheckCurrentEvent returned:", err)
+			return err
+		}
+	}
+	nextEvent, err := ue.ProfileCtx.GetNextEvent(ue.Procedure, msg.Event)
+	if err != nil {
+		ue.Log.Errorln("GetNextEvent returned:", err)
+		return err
+	}
+	ue.Log.Infoln("Next Event:", nextEvent)
+	msg.Event = nextEvent
+	SendToRealUe(ue, msg)
+	return nil
+}
+
+func HandlePduSessModCompleteEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+
+	if !isPduSessModification(ue.Procedure) {
+		return nil
+	}
+	if len(ue.ProcPduSessions) != 0 {
+		// PDU sessions are modified one after the other on request of the
+		// UE, the network may modify the remaining ones at any time
+		if ue.Procedure == common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE {
+			requestPduSession(ue, common.PDU_SESS_MOD_REQUEST_EVENT)
+		}
+		return nil
+	}
+
+	//Current Procedure is complete. Move to next one
+	SendProcedureResult(ue)
+	return nil
+}
+
+func HandlePduSessModCmdRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	msg.Event = common.UL_INFO_TRANSFER_EVENT
+	SendToGnbUe(ue, msg)
+
+	if !isPduSessModification(ue.Procedure) {
+		return nil
+	}
+	return fmt.Errorf("pdu session modification command rejected")
+}
+
+func isPduSessModification(proc common.ProcedureType) bool {
+	return proc == common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE ||
+		proc == common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE
+}
+
+// removeProcPduSession removes the PDU session from the PDU sessions the
+// current procedure applies to, returns false if not found
+func removeProcPduSession(ue *simuectx.SimUe, pduSessId uint8) bool {
+	for i, pduSess := range ue.ProcPduSessions {
+		if pduSess.PduSessId != pduSessId {
+			continue
+		}
+		// The PDU sessions are shared with the profile, not modified in place
+		sessions := make([]*common.PduSessionParams, 0, len(ue.ProcPduSessions)-1)
+		sessions = append(sessions, ue.ProcPduSessions[:i]...)
+		ue.ProcPduSessions = append(sessions, ue.ProcPduSessions[i+1:]...)
+		return true
+	}
+	return false
+}
+
 func HandleDlInfoTransferEvent(ue *simuectx.SimUe,
 	msg common.InterfaceMessage) (err error) {
 
@@ -268,6 +537,21 @@ func HandleDataBearerSetupResponseEvent(ue *simuectx.SimUe,
 
 	SendToGnbUe(ue, msg)
 
+	rsp := msg.(*common.UuMessage)
+	if ue.Procedure == common.N2_HANDOVER_PROCEDURE &&
+		rsp.TriggeringEvent == common.HANDOVER_CONFIRM_EVENT {
+		handoverStepDone(ue, nil)
+		return nil
+	}
+
+	if ue.Procedure == common.PDU_SESSION_ESTABLISHMENT_PROCEDURE &&
+		len(ue.ProcPduSessions) > 1 {
+		// PDU sessions are established one after the other
+		ue.ProcPduSessions = ue.ProcPduSessions[1:]
+		requestPduSession(ue, common.PDU_SESS_EST_REQUEST_EVENT)
+		return nil
+	}
+
 	//Current Procedure is complete. Move to next one
 	SendProcedureResult(ue)
 	return nil
@@ -279,15 +563,76 @@ func HandleDataBearerReleaseRequestEvent(ue *simuectx.SimUe,
 	// PDU Session Resource Release Complete over N2, However the PDU Sesson
 	// routines in the RealUE will be terminated while processing PDU Session
 	// Release Complete which will also release the communication links
-	// (go channels) with the gNB
+	// (go channels) with the gNB. The RealUe may not have handled the PDU
+	// Session Release Command yet, the procedure completes once it did
+	SendToRealUe(ue, msg)
+	return nil
+}
+
+func HandlePduSessReleasedEvent(ue *simuectx.SimUe,
+	msg common.InterfaceMessage) (err error) {
+	if ue.Procedure == common.UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE &&
+		len(ue.ProcPduSessions) > 1 {
+		ue.ProcPduSessions = ue.ProcPduSessions[1:]
+		requestPduSession(ue, common.PDU_SESS_REL_REQUEST_EVENT)
+		return nil
+	}
+
 	//Current Procedure is complete. Move to next one
 	SendProcedureResult(ue)
 	return nil
 }
 
+// HandleUeIdentitiesEvent records the 5G-GUTI and the PDU sessions reported by
+// RealUe
+func HandleUeIdentitiesEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+	msg := intfcMsg.(*common.UeIdentitiesMessage)
+	pduSessions := make([]*profctx.PduSessionState, 0, len(msg.PduSessions))
+	for _, pduSess := range msg.PduSessions {
+		pduSessState := &profctx.PduSessionState{
+			PduSessId:   pduSess.PduSessId,
+			PduSessType: string(pduSess.PduSessType),
+			Dnn:         pduSess.Dnn,
+		}
+		if pduSess.Snssai.Sst != 0 {
+			pduSessState.SNssai = fmt.Sprintf("%v-%v", pduSess.Snssai.Sst,
+				pduSess.Snssai.Sd)
+		}
+		if pduSess.PduAddress != nil {
+			pduSessState.PduAddress = pduSess.PduAddress.String()
+		}
+		if pduSess.PduAddressV6 != nil {
+			pduSessState.PduAddressV6 = pduSess.PduAddressV6.String()
+		}
+		pduSessions = append(pduSessions, pduSessState)
+	}
+	sort.Slice(pduSessions, func(i, j int) bool {
+		return pduSessions[i].PduSessId < pduSessions[j].PduSessId
+	})
+	ue.ProfileUeCtx.SetIdentities(msg.Guti, pduSessions)
+	return nil
+}
+
+// requestPduSession asks the RealUe to establish, modify or release the
+// first PDU session of the current procedure
+func requestPduSession(ue *simuectx.SimUe, event common.EventType) {
+	pduSess := ue.ProcPduSessions[0]
+	ue.Log.Infoln("PDU Session ID:", pduSess.PduSessId, "DNN:", pduSess.Dnn)
+	msg := &common.UeMessage{}
+	msg.Event = event
+	msg.PduSessions = ue.ProcPduSessions[:1]
+	SendToRealUe(ue, msg)
+}
+
 func HandleDataPktGenSuccessEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
+	if ue.Procedure == common.N2_HANDOVER_PROCEDURE {
+		handoverStepDone(ue, nil)
+		return nil
+	}
+
 	//Current Procedure is complete. Move to next one
 	SendProcedureResult(ue)
 	return nil
@@ -297,6 +642,11 @@ func HandleDataPktGenFailureEvent(ue *simuectx.SimUe,
 	msg common.InterfaceMessage) (err error) {
 
 	ue.Log.Traceln("HandleDataPktGenFailureEvent")
+	if ue.Procedure == common.N2_HANDOVER_PROCEDURE {
+		handoverStepDone(ue, fmt.Errorf("user plane interrupted by the handover: %v",
+			msg.GetErrorMsg()))
+		return nil
+	}
 	SendToProfile(ue, common.PROC_FAIL_EVENT, msg.GetErrorMsg())
 	return nil
 }
@@ -315,6 +665,28 @@ func HandleServiceRequestEvent(ue *simuectx.SimUe,
 	return nil
 }
 
+func HandleServiceRejectEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	var rejErr *common.RejectError
+	if !errors.As(intfcMsg.GetErrorMsg(), &rejErr) {
+		return fmt.Errorf("service request rejected")
+	}
+
+	switch rejErr.Cause {
+	case nasMessage.Cause5GMMImplicitlyDeregistered,
+		nasMessage.Cause5GMMUEIdentityCannotBeDerivedByTheNetwork:
+		ue.Registered = false
+		if ue.ProfileCtx.ReRegisterOnReject {
+			// The UE registers again once the network releases it
+			ue.Log.Infoln("UE deregistered by the network, registering again")
+			ue.RejectErr = rejErr
+			return nil
+		}
+	}
+	return rejErr
+}
+
 func HandleServiceAcceptEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 
@@ -332,17 +704,39 @@ func HandleConnectionReleaseRequestEvent(ue *simuectx.SimUe,
 	intfcMsg common.InterfaceMessage) (err error) {
 	msg := intfcMsg.(*common.UuMessage)
 
+	if msg.TriggeringEvent == common.AMF_ASSOC_LOST_EVENT ||
+		msg.TriggeringEvent == common.NG_RESET_EVENT {
+		return handleConnectionLost(ue, msg)
+	}
+
 	if ue.Procedure == common.AN_RELEASE_PROCEDURE {
 		err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.TRIGGER_AN_RELEASE_EVENT,
 			common.CONNECTION_RELEASE_REQUEST_EVENT)
 		if err != nil {
 			return err
 		}
+	} else if ue.Procedure == common.NG_RESET_PROCEDURE &&
+		msg.TriggeringEvent == common.TRIGGER_NG_RESET_EVENT {
+		err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure, common.TRIGGER_NG_RESET_EVENT,
+			common.CONNECTION_RELEASE_REQUEST_EVENT)
+		if err != nil {
+			return err
+		}
+	} else if ue.ProcInProgress && (isRegistration(ue.Procedure) ||
+		ue.Procedure == common.UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE) {
+		// Network gave up on the request, e.g. after rejecting it. The
+		// reject may still be in process at the RealUe, which reports back
+		// once it handled the release
+		ue.WriteGnbUeChan = nil
+		msg.TriggeringEvent = common.CONNECTION_RELEASED_EVENT
+		SendToRealUe(ue, msg)
+		return nil
 	}
 
 	ue.WriteGnbUeChan = nil
 
 	if msg.TriggeringEvent == common.DEREG_REQUEST_UE_ORIG_EVENT {
+		ue.Registered = false
 		/*
 			msg := &common.UeMessage{}
 			msg.Event = common.QUIT_EVENT
@@ -354,12 +748,142 @@ func HandleConnectionReleaseRequestEvent(ue *simuectx.SimUe,
 		return nil
 	}
 	SendToRealUe(ue, msg)
+	if ue.Registered {
+		ue.StartT3512()
+	}
+	if ue.PeriodicUpdate {
+		endPeriodicUpdate(ue)
+		return nil
+	}
 	//Current Procedure is complete. Move to next one
 	SendProcedureResult(ue)
 
 	return nil
 }
 
+// handleConnectionLost moves the UE to idle state once the gNB released the
+// connection of the UE locally, having lost the association with the AMF or
+// after an NG Reset. The procedure in progress fails
+func handleConnectionLost(ue *simuectx.SimUe, msg *common.UuMessage) error {
+	ue.WriteGnbUeChan = nil
+	if ue.ProcInProgress {
+		return fmt.Errorf("connection lost during %v: %v", ue.Procedure, msg.Error)
+	}
+
+	ue.Log.Warnln("Connection lost:", msg.Error)
+	SendToRealUe(ue, msg)
+	if ue.Registered {
+		ue.StartT3512()
+	}
+	if ue.PeriodicUpdate {
+		endPeriodicUpdate(ue)
+	}
+	return nil
+}
+
+func HandleConnectionReleasedEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	if !ue.ProcInProgress {
+		// Procedure already failed with the reject of the network
+		return nil
+	}
+	if ue.RejectErr != nil {
+		ue.Procedure = common.GUTI_REGISTRATION_PROCEDURE
+		HandleProcedure(ue)
+		return nil
+	}
+	return fmt.Errorf("connection released during %v", ue.Procedure)
+}
+
+// HandleHandoverCommandEvent moves the UE to the target gNB and confirms the
+// handover to it
+func HandleHandoverCommandEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	err = ue.ProfileCtx.CheckCurrentEvent(ue.Procedure,
+		common.TRIGGER_HANDOVER_EVENT, msg.GetEventType())
+	if err != nil {
+		ue.Log.Errorln("CheckCurrentEvent returned:", err)
+		return err
+	}
+
+	ue.WriteGnbUeChan = msg.CommChan
+	ue.GnB = ue.HandoverTarget
+	ue.HandoverTarget = nil
+	ue.Log.Infoln("Moved to target gNodeB:", ue.GnB.GnbName)
+	SendToRealUe(ue, msg)
+
+	rsp := &common.UuMessage{}
+	rsp.Event = common.HANDOVER_CONFIRM_EVENT
+	SendToGnbUe(ue, rsp)
+	return nil
+}
+
+// HandleHandoverFailureEvent fails the handover procedure, the UE stays
+// connected to the source gNB
+func HandleHandoverFailureEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	ue.HandoverTarget = nil
+	handoverStepDone(ue, fmt.Errorf("handover failed: %v", intfcMsg.GetErrorMsg()))
+	return nil
+}
+
+// handoverStepDone records one of the outcomes the handover procedure waits
+// for. The result of the procedure is sent to the profile once the UE moved
+// to the target gNB, or the handover failed, and the user data sent through
+// the handover is done
+func handoverStepDone(ue *simuectx.SimUe, err error) {
+	if err != nil && ue.HandoverErr == nil {
+		ue.HandoverErr = err
+	}
+	ue.HandoverPending--
+	if ue.HandoverPending > 0 {
+		return
+	}
+
+	if ue.HandoverErr != nil {
+		SendToProfile(ue, common.PROC_FAIL_EVENT, ue.HandoverErr)
+		ue.HandoverErr = nil
+		return
+	}
+	SendProcedureResult(ue)
+}
+
+// getHandoverTarget returns the gNB the UE is handed over to. A UE that has
+// already moved to the target gNB of the profile is handed back to the gNB
+// of the profile
+func getHandoverTarget(ue *simuectx.SimUe) (*gnbctx.GNodeB, error) {
+	name := ue.ProfileCtx.TargetGnbName
+	if name == "" {
+		return nil, fmt.Errorf("no target gnb configured")
+	}
+	if ue.GnB.GnbName == name {
+		name = ue.ProfileCtx.GnbName
+	}
+	return factory.AppConfig.Configuration.GetGNodeB(name)
+}
+
+// HandleErrorIndicationEvent fails the procedure in progress, the network
+// having reported an error in a message exchanged for it
+func HandleErrorIndicationEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+
+	msg := intfcMsg.(*common.UuMessage)
+	if ue.ProcInProgress {
+		return fmt.Errorf("%v failed: %v", ue.Procedure, msg.Error)
+	}
+	ue.Log.Warnln("Ignoring", msg.Error)
+	return nil
+}
+
+func isRegistration(proc common.ProcedureType) bool {
+	return proc == common.REGISTRATION_PROCEDURE ||
+		proc == common.GUTI_REGISTRATION_PROCEDURE || isRegistrationUpdate(proc)
+}
+
 func HandleNwDeregRequestEvent(ue *simuectx.SimUe, intfcMsg common.InterfaceMessage) (err error) {
 
 	msg := intfcMsg.(*common.UeMessage)
@@ -391,6 +915,7 @@ func HandleNwDeregAcceptEvent(ue *simuectx.SimUe, intfcMsg common.InterfaceMessa
 	msg.Event = common.UL_INFO_TRANSFER_EVENT
 	SendToGnbUe(ue, msg)
 	ue.Log.Traceln("Sent Dereg Accept to the network")
+	ue.Registered = false
 	return nil
 }
 
@@ -406,18 +931,63 @@ func HandleErrorEvent(ue *simuectx.SimUe,
 	return nil
 }
 
+// HandleSaveStateEvent forwards the request to record the state of the UE to
+// RealUe, along with the registration state
+func HandleSaveStateEvent(ue *simuectx.SimUe,
+	intfcMsg common.InterfaceMessage) (err error) {
+	msg := intfcMsg.(*common.SaveStateMessage)
+	msg.Registered = ue.Registered
+	SendToRealUe(ue, msg)
+	return nil
+}
+
 func HandleQuitEvent(ue *simuectx.SimUe,
 	msg common.InterfaceMessage) (err error) {
+	ue.StopT3512()
 	if ue.WriteGnbUeChan != nil {
 		SendToGnbUe(ue, msg)
 	}
 	SendToRealUe(ue, msg)
 	ue.WriteRealUeChan = nil
+	// Unblocks the RealUe and gNB UE contexts still trying to reach the SimUe
+	ue.Terminate()
 	ue.WaitGrp.Wait()
+	ue.SaveState()
 	ue.Log.Infoln("Sim UE terminated")
 	return nil
 }
 
+// HandleAbort starts releasing the UE once its profile aborts it. A registered
+// UE is deregistered if the profile asks for it, otherwise the NG signalling
+// connection of the UE is released. Returns false if the UE is not known to
+// the network, hence there is nothing to wait for
+func HandleAbort(ue *simuectx.SimUe) bool {
+	ue.Aborting = true
+	ue.PeriodicUpdate = false
+
+	if ue.Registered && ue.ProfileCtx.DeregisterOnAbort {
+		ue.Log.Infoln("UE aborted, deregistering it")
+		ue.Procedure = common.UE_INITIATED_DEREGISTRATION_PROCEDURE
+		msg := &common.UeMessage{}
+		msg.Event = common.DEREG_REQUEST_UE_ORIG_EVENT
+		SendToRealUe(ue, msg)
+		return true
+	}
+
+	// UE has an NG signalling connection once it has started a procedure
+	if ue.WriteGnbUeChan != nil && ue.Procedure != 0 {
+		ue.Log.Infoln("UE aborted, releasing its NG signalling connection")
+		ue.Procedure = common.AN_RELEASE_PROCEDURE
+		msg := &common.UeMessage{}
+		msg.Event = common.TRIGGER_AN_RELEASE_EVENT
+		SendToGnbUe(ue, msg)
+		return true
+	}
+
+	ue.Log.Infoln("UE aborted")
+	return false
+}
+
 // TODO : accept result, 1. pass or 2. Fail (with error)
 func SendProcedureResult(ue *simuectx.SimUe) {
 	ue.Log.Traceln("Sending Procedure Result to Profile : PASS")
@@ -426,37 +996,76 @@ func SendProcedureResult(ue *simuectx.SimUe) {
 }
 
 func HandleProcedure(ue *simuectx.SimUe) {
+	switch ue.Procedure {
+	case common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+		common.UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE,
+		common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE,
+		common.USER_DATA_PKT_GENERATION_PROCEDURE, common.AN_RELEASE_PROCEDURE,
+		common.NG_RESET_PROCEDURE, common.N2_HANDOVER_PROCEDURE:
+		if ue.WriteGnbUeChan == nil {
+			SendToProfile(ue, common.PROC_FAIL_EVENT,
+				fmt.Errorf("procedure not allowed in idle state"))
+			return
+		}
+	case common.MOBILITY_REGISTRATION_UPDATE_PROCEDURE,
+		common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE:
+		if !ue.Registered {
+			SendToProfile(ue, common.PROC_FAIL_EVENT, fmt.Errorf("ue not registered"))
+			return
+		}
+	}
+	switch ue.Procedure {
+	case common.PDU_SESSION_ESTABLISHMENT_PROCEDURE,
+		common.UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE,
+		common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE,
+		common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE,
+		common.USER_DATA_PKT_GENERATION_PROCEDURE:
+		if len(ue.ProcPduSessions) == 0 {
+			SendToProfile(ue, common.PROC_FAIL_EVENT, fmt.Errorf("no pdu session selected"))
+			return
+		}
+	}
+
 	switch ue.Procedure {
 	case common.REGISTRATION_PROCEDURE:
 		ue.Log.Infoln("Initiating Registration Procedure")
+		// An initial registration replaces the registration restored from
+		// an earlier run, if any
+		ue.Registered = false
 		msg := &common.UeMessage{}
 		msg.Event = common.REG_REQUEST_EVENT
 		SendToRealUe(ue, msg)
-	case common.PDU_SESSION_ESTABLISHMENT_PROCEDURE:
-		ue.Log.Infoln("Initiating UE Requested PDU Session Establishment Procedure")
+	case common.GUTI_REGISTRATION_PROCEDURE:
+		ue.Log.Infoln("Initiating 5G-GUTI Registration Procedure")
+		ue.Registered = false
 		msg := &common.UeMessage{}
-		msg.Event = common.PDU_SESS_EST_REQUEST_EVENT
+		msg.Event = common.REG_REQUEST_EVENT
+		msg.RegistrationType = nasMessage.RegistrationType5GSInitialRegistration
 		SendToRealUe(ue, msg)
-	case common.UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE:
-		ue.Log.Infoln("Initiating UE Requested PDU Session Release Procedure")
+	case common.MOBILITY_REGISTRATION_UPDATE_PROCEDURE:
+		ue.Log.Infoln("Initiating Mobility Registration Update Procedure")
 		msg := &common.UeMessage{}
-		msg.Event = common.PDU_SESS_REL_REQUEST_EVENT
+		msg.Event = common.REG_REQUEST_EVENT
+		msg.RegistrationType = nasMessage.RegistrationType5GSMobilityRegistrationUpdating
 		SendToRealUe(ue, msg)
-	case common.USER_DATA_PKT_GENERATION_PROCEDURE:
-		ue.Log.Infoln("Initiating User Data Packet Generation Procedure")
+	case common.PERIODIC_REGISTRATION_UPDATE_PROCEDURE:
+		ue.Log.Infoln("Initiating Periodic Registration Update Procedure")
 		msg := &common.UeMessage{}
-		msg.UserDataPktCount = ue.ProfileCtx.DataPktCount
-		msg.DefaultAs = ue.ProfileCtx.DefaultAs
-		msg.Event = common.DATA_PKT_GEN_REQUEST_EVENT
-
-		/* TODO: Solve timing issue. Currently UE may start sending user data
-		 * before gnb has successfuly sent PDU Session Resource Setup Response
-		 * or before 5g core has processed it
-		 */
-		ue.Log.Infoln("Please wait, initiating uplink user data in 3 seconds ...")
-		time.Sleep(3 * time.Second)
-
+		msg.Event = common.REG_REQUEST_EVENT
+		msg.RegistrationType = nasMessage.RegistrationType5GSPeriodicRegistrationUpdating
 		SendToRealUe(ue, msg)
+	case common.PDU_SESSION_ESTABLISHMENT_PROCEDURE:
+		ue.Log.Infoln("Initiating UE Requested PDU Session Establishment Procedure")
+		requestPduSession(ue, common.PDU_SESS_EST_REQUEST_EVENT)
+	case common.UE_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE:
+		ue.Log.Infoln("Initiating UE Requested PDU Session Release Procedure")
+		requestPduSession(ue, common.PDU_SESS_REL_REQUEST_EVENT)
+	case common.UE_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE:
+		ue.Log.Infoln("Initiating UE Requested PDU Session Modification Procedure")
+		requestPduSession(ue, common.PDU_SESS_MOD_REQUEST_EVENT)
+	case common.USER_DATA_PKT_GENERATION_PROCEDURE:
+		ue.Log.Infoln("Initiating User Data Packet Generation Procedure")
+		requestUserData(ue)
 	case common.UE_INITIATED_DEREGISTRATION_PROCEDURE:
 		ue.Log.Infoln("Initiating UE Initiated Deregistration Procedure")
 		msg := &common.UeMessage{}
@@ -467,6 +1076,29 @@ func HandleProcedure(ue *simuectx.SimUe) {
 		msg := &common.UeMessage{}
 		msg.Event = common.TRIGGER_AN_RELEASE_EVENT
 		SendToGnbUe(ue, msg)
+	case common.NG_RESET_PROCEDURE:
+		ue.Log.Infoln("Initiating NG Reset Procedure")
+		msg := &common.UeMessage{}
+		msg.Event = common.TRIGGER_NG_RESET_EVENT
+		SendToGnbUe(ue, msg)
+	case common.N2_HANDOVER_PROCEDURE:
+		ue.Log.Infoln("Initiating N2 Handover Procedure")
+		target, err := getHandoverTarget(ue)
+		if err != nil {
+			SendToProfile(ue, common.PROC_FAIL_EVENT, err)
+			return
+		}
+		ue.HandoverTarget = target
+		ue.HandoverErr = nil
+		ue.HandoverPending = 1
+		if len(ue.ProcPduSessions) != 0 {
+			// User data keeps flowing while the UE moves to the target gNB
+			ue.HandoverPending++
+			requestHandoverUserData(ue)
+		}
+		msg := &gnbctx.HandoverMessage{TargetGnb: target}
+		msg.Event = common.TRIGGER_HANDOVER_EVENT
+		SendToGnbUe(ue, msg)
 	case common.UE_TRIGGERED_SERVICE_REQUEST_PROCEDURE:
 		ue.Log.Infoln("Initiating UE Triggered Service Request Procedure")
 		msg := &common.UeMessage{}
@@ -476,5 +1108,42 @@ func HandleProcedure(ue *simuectx.SimUe) {
 		ue.Log.Infoln("Waiting for N/W Triggered De-registration Procedure")
 	case common.NW_REQUESTED_PDU_SESSION_RELEASE_PROCEDURE:
 		ue.Log.Infoln("Waiting for N/W Requested PDU Session Release Procedure")
+	case common.NW_REQUESTED_PDU_SESSION_MODIFICATION_PROCEDURE:
+		ue.Log.Infoln("Waiting for N/W Requested PDU Session Modification Procedure")
 	}
 }
+
+// requestHandoverUserData asks the RealUe to send echo requests at a fixed
+// pace on the PDU sessions of the current procedure, through the handover
+// which is triggered once the first of them went through the source gNB
+func requestHandoverUserData(ue *simuectx.SimUe) {
+	msg := &common.UeMessage{}
+	msg.UserDataPktCount = HANDOVER_DATA_PKT_COUNT
+	msg.UserDataPktInterval = HANDOVER_DATA_PKT_INTERVAL
+	msg.MaxUserDataPktLoss = HANDOVER_MAX_DATA_PKT_LOSS
+	msg.PduSessions = ue.ProcPduSessions
+	msg.Event = common.DATA_PKT_GEN_REQUEST_EVENT
+	SendToRealUe(ue, msg)
+
+	ue.Log.Infoln("Sending user data through the handover, every",
+		HANDOVER_DATA_PKT_INTERVAL)
+	time.Sleep(time.Duration(HANDOVER_DATA_PKT_LEAD) * HANDOVER_DATA_PKT_INTERVAL)
+}
+
+// requestUserData asks the RealUe to send user data on the PDU sessions of
+// the current procedure
+func requestUserData(ue *simuectx.SimUe) {
+	msg := &common.UeMessage{}
+	msg.UserDataPktCount = ue.ProfileCtx.DataPktCount
+	msg.PduSessions = ue.ProcPduSessions
+	msg.Event = common.DATA_PKT_GEN_REQUEST_EVENT
+
+	/* TODO: Solve timing issue. Currently UE may start sending user data
+	 * before gnb has successfuly sent PDU Session Resource Setup Response
+	 * or before 5g core has processed it
+	 */
+	ue.Log.Infoln("Please wait, initiating uplink user data in 3 seconds ...")
+	time.Sleep(3 * time.Second)
+
+	SendToRealUe(ue, msg)
+}
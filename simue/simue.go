@@ -5,31 +5,59 @@
 package simue
 
 import (
+	"errors"
 	"fmt"
+	"time"
+
 	"github.com/omec-project/gnbsim/common"
 	"github.com/omec-project/gnbsim/gnodeb"
 	gnbctx "github.com/omec-project/gnbsim/gnodeb/context"
+	"github.com/omec-project/gnbsim/metrics"
 	profctx "github.com/omec-project/gnbsim/profile/context"
 	"github.com/omec-project/gnbsim/profile/util"
 	"github.com/omec-project/gnbsim/realue"
 	simuectx "github.com/omec-project/gnbsim/simue/context"
-	"time"
 )
 
-func InitUE(imsiStr string, gnb *gnbctx.GNodeB, profile *profctx.Profile, result chan *common.ProfileMessage) chan common.InterfaceMessage {
-	simUe := simuectx.NewSimUe(imsiStr, gnb, profile, result)
+const (
+	// Time given to an aborted UE to be deregistered or released by the network
+	RELEASE_TIMEOUT time.Duration = 5 * time.Second
+
+	// T3512 value used when the network does not provide it, TS 24.501
+	// Section 10.2
+	DEFAULT_T3512 time.Duration = 54 * time.Minute
+
+	// Echo requests sent through an N2 handover to check the continuity of
+	// the user plane, at most HANDOVER_MAX_DATA_PKT_LOSS of them may be lost
+	// while the UE moves to the target gNB. The handover is triggered once
+	// HANDOVER_DATA_PKT_LEAD of them have been sent through the source gNB
+	HANDOVER_DATA_PKT_COUNT    int           = 30
+	HANDOVER_DATA_PKT_INTERVAL time.Duration = 100 * time.Millisecond
+	HANDOVER_DATA_PKT_LEAD     int           = 5
+	HANDOVER_MAX_DATA_PKT_LOSS int           = 5
+)
+
+func InitUE(imsiStr string, gnb *gnbctx.GNodeB, profile *profctx.Profile, pCtx *profctx.ProfileUeContext,
+	restart bool) chan common.InterfaceMessage {
+	simUe := simuectx.NewSimUe(imsiStr, gnb, profile, pCtx, restart)
 	Init(simUe) // Initialize simUE, realUE & wait for events
 	return simUe.ReadChan
 }
 
 func Init(simUe *simuectx.SimUe) {
 
-	err := ConnectToGnb(simUe)
-	if err != nil {
-		err = fmt.Errorf("failed to connect to gnodeb: %v", err)
-		simUe.Log.Infoln("Sent Profile Fail Event to Profile routine****: ", err)
-		SendToProfile(simUe, common.PROC_FAIL_EVENT, err)
-		return
+	// A UE restored as registered starts in idle state, it connects to the
+	// gNodeB with its first initial NAS message
+	if !simUe.Registered {
+		err := ConnectToGnb(simUe)
+		if err != nil {
+			err = fmt.Errorf("failed to connect to gnodeb: %v", err)
+			simUe.Log.Infoln("Sent Profile Fail Event to Profile routine****: ", err)
+			// Profile routine reads the result once it runs the first procedure
+			go SendToProfile(simUe, common.PROC_FAIL_EVENT, err)
+			simUe.Terminate()
+			return
+		}
 	}
 
 	simUe.WaitGrp.Add(1)
@@ -38,7 +66,11 @@ func Init(simUe *simuectx.SimUe) {
 		realue.Init(simUe.RealUe)
 	}()
 
-	go HandleEvents(simUe)
+	simUe.ProfileCtx.SimUeWaitGrp.Add(1)
+	go func() {
+		defer simUe.ProfileCtx.SimUeWaitGrp.Done()
+		HandleEvents(simUe)
+	}()
 	simUe.Log.Infoln("SIM UE Init complete")
 }
 
@@ -50,7 +82,7 @@ func ConnectToGnb(simUe *simuectx.SimUe) error {
 
 	var err error
 	gNb := simUe.GnB
-	simUe.WriteGnbUeChan, err = gnodeb.RequestConnection(gNb, &uemsg)
+	simUe.WriteGnbUeChan, err = gnodeb.RequestConnection(simUe.TermCtx, gNb, &uemsg)
 	if err != nil {
 		simUe.Log.Infof("ERROR -- connecting to gNodeB, Name:%v, IP:%v, Port:%v", gNb.GnbName,
 			gNb.GnbN2Ip, gNb.GnbN2Port)
@@ -59,30 +91,73 @@ func ConnectToGnb(simUe *simuectx.SimUe) error {
 
 	simUe.Log.Infof("Connected to gNodeB, Name:%v, IP:%v, Port:%v", gNb.GnbName,
 		gNb.GnbN2Ip, gNb.GnbN2Port)
+	// T3512 is stopped once the UE leaves idle state
+	simUe.StopT3512()
 	return nil
 }
 
 func HandleEvents(ue *simuectx.SimUe) {
 	var err error
-	for msg := range ue.ReadChan {
+	var releaseTimer <-chan time.Time
+	abortChan := ue.Ctx.Done()
+	defer ue.Terminate()
+
+	for {
+		var msg common.InterfaceMessage
+		select {
+		case msg = <-ue.ReadChan:
+		case <-abortChan:
+			// The UE keeps handling events until the network releases it
+			abortChan = nil
+			if !HandleAbort(ue) {
+				HandleQuitEvent(ue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+				return
+			}
+			releaseTimer = time.After(RELEASE_TIMEOUT)
+			continue
+		case <-releaseTimer:
+			ue.Log.Warnln("Timed out waiting for the network to release the UE")
+			HandleQuitEvent(ue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return
+		case <-ue.T3512Expiry():
+			msg = &common.DefaultMessage{Event: common.T3512_EXPIRY_EVENT}
+		}
+
 		event := msg.GetEventType()
 		ue.Log.Infoln("Handling event:", event)
+		ue.ProfileUeCtx.SetLastEvent(event)
 
 		switch event {
 		case common.PROC_START_EVENT:
 			err = HandleProcedureEvent(ue, msg)
+		case common.T3512_EXPIRY_EVENT:
+			err = HandleT3512ExpiryEvent(ue, msg)
+		case common.SAVE_STATE_EVENT:
+			err = HandleSaveStateEvent(ue, msg)
 		case common.REG_REQUEST_EVENT:
 			err = HandleRegRequestEvent(ue, msg)
 		case common.REG_REJECT_EVENT:
 			err = HandleRegRejectEvent(ue, msg)
+		case common.SERVICE_REJECT_EVENT:
+			err = HandleServiceRejectEvent(ue, msg)
 		case common.AUTH_REQUEST_EVENT:
 			err = HandleAuthRequestEvent(ue, msg)
 		case common.AUTH_RESPONSE_EVENT:
 			err = HandleAuthResponseEvent(ue, msg)
+		case common.AUTH_FAILURE_EVENT:
+			err = HandleAuthFailureEvent(ue, msg)
+		case common.AUTH_REJECT_EVENT:
+			err = HandleAuthRejectEvent(ue, msg)
+		case common.ID_REQUEST_EVENT:
+			err = HandleIdentityRequestEvent(ue, msg)
+		case common.ID_RESPONSE_EVENT:
+			err = HandleIdentityResponseEvent(ue, msg)
 		case common.SEC_MOD_COMMAND_EVENT:
 			err = HandleSecModCommandEvent(ue, msg)
 		case common.SEC_MOD_COMPLETE_EVENT:
 			err = HandleSecModCompleteEvent(ue, msg)
+		case common.SEC_MOD_REJECT_EVENT:
+			err = HandleSecModRejectEvent(ue, msg)
 		case common.REG_ACCEPT_EVENT:
 			err = HandleRegAcceptEvent(ue, msg)
 		case common.REG_COMPLETE_EVENT:
@@ -101,6 +176,16 @@ func HandleEvents(ue *simuectx.SimUe) {
 			err = HandlePduSessEstAcceptEvent(ue, msg)
 		case common.PDU_SESS_EST_REJECT_EVENT:
 			err = HandlePduSessEstRejectEvent(ue, msg)
+		case common.PDU_SESS_MOD_REQUEST_EVENT:
+			err = HandlePduSessModRequestEvent(ue, msg)
+		case common.PDU_SESS_MOD_REJECT_EVENT:
+			err = HandlePduSessModRejectEvent(ue, msg)
+		case common.PDU_SESS_MOD_COMMAND_EVENT:
+			err = HandlePduSessModCommandEvent(ue, msg)
+		case common.PDU_SESS_MOD_COMPLETE_EVENT:
+			err = HandlePduSessModCompleteEvent(ue, msg)
+		case common.PDU_SESS_MOD_CMD_REJECT_EVENT:
+			err = HandlePduSessModCmdRejectEvent(ue, msg)
 		case common.PDU_SESS_REL_COMPLETE_EVENT:
 			err = HandlePduSessReleaseCompleteEvent(ue, msg)
 		case common.DL_INFO_TRANSFER_EVENT:
@@ -111,6 +196,10 @@ func HandleEvents(ue *simuectx.SimUe) {
 			err = HandleDataBearerSetupResponseEvent(ue, msg)
 		case common.DATA_BEARER_RELEASE_REQUEST_EVENT:
 			err = HandleDataBearerReleaseRequestEvent(ue, msg)
+		case common.PDU_SESS_RELEASED_EVENT:
+			err = HandlePduSessReleasedEvent(ue, msg)
+		case common.UE_IDENTITIES_EVENT:
+			err = HandleUeIdentitiesEvent(ue, msg)
 		case common.DATA_PKT_GEN_SUCCESS_EVENT:
 			err = HandleDataPktGenSuccessEvent(ue, msg)
 		case common.DATA_PKT_GEN_FAILURE_EVENT:
@@ -119,12 +208,20 @@ func HandleEvents(ue *simuectx.SimUe) {
 			err = HandleServiceRequestEvent(ue, msg)
 		case common.SERVICE_ACCEPT_EVENT:
 			err = HandleServiceAcceptEvent(ue, msg)
+		case common.CONNECTION_RELEASED_EVENT:
+			err = HandleConnectionReleasedEvent(ue, msg)
 		case common.CONNECTION_RELEASE_REQUEST_EVENT:
 			err = HandleConnectionReleaseRequestEvent(ue, msg)
 		case common.DEREG_REQUEST_UE_TERM_EVENT:
 			err = HandleNwDeregRequestEvent(ue, msg)
 		case common.DEREG_ACCEPT_UE_TERM_EVENT:
 			err = HandleNwDeregAcceptEvent(ue, msg)
+		case common.ERROR_INDICATION_EVENT:
+			err = HandleErrorIndicationEvent(ue, msg)
+		case common.HANDOVER_COMMAND_EVENT:
+			err = HandleHandoverCommandEvent(ue, msg)
+		case common.HANDOVER_FAILURE_EVENT:
+			err = HandleHandoverFailureEvent(ue, msg)
 		case common.ERROR_EVENT:
 			ue.Log.Warnln("Event:", event, " received error")
 			HandleErrorEvent(ue, msg)
@@ -145,9 +242,13 @@ func HandleEvents(ue *simuectx.SimUe) {
 			HandleErrorEvent(ue, msg)
 			return
 		}
-	}
 
-	return
+		if ue.Aborting && ue.WriteGnbUeChan == nil {
+			ue.Log.Infoln("Aborted UE released by the network")
+			HandleQuitEvent(ue, &common.DefaultMessage{Event: common.QUIT_EVENT})
+			return
+		}
+	}
 }
 
 func SendToRealUe(ue *simuectx.SimUe, msg common.InterfaceMessage) {
@@ -167,53 +268,239 @@ func SendToProfile(ue *simuectx.SimUe, event common.EventType, errMsg error) {
 	msg.Supi = ue.Supi
 	msg.Proc = ue.Procedure
 	msg.Error = errMsg
-	ue.WriteProfileChan <- msg
-	ue.Log.Traceln("Sent ", event, "to Profile routine")
+	ue.ProcInProgress = false
+	// Profile routine stops waiting on the UE once it is aborted
+	select {
+	case ue.WriteProfileChan <- msg:
+		ue.Log.Traceln("Sent ", event, "to Profile routine")
+	case <-ue.Ctx.Done():
+		ue.Log.Traceln("UE aborted, dropped", event, "to Profile routine")
+	}
+}
+
+func RunProcedure(simUe *simuectx.SimUe, procedure common.ProcedureType,
+	pduSessions []*common.PduSessionParams) {
+	util.SendToSimUe(simUe, common.PROC_START_EVENT, procedure, pduSessions)
 }
 
-func RunProcedure(simUe *simuectx.SimUe, procedure common.ProcedureType) {
-	util.SendToSimUe(simUe, common.PROC_START_EVENT, procedure)
+// RestartUE replaces a UE which failed a procedure by a new one in the
+// deregistered state, so that the profile can go on with the UE
+func RestartUE(simUe *simuectx.SimUe) {
+	pCtx := simUe.ProfileUeCtx
+	simUe.Log.Infoln("Restarting UE")
+
+	// The failed UE may still be running, e.g. after a procedure timeout.
+	// Late results it sends are dropped
+	quitChan := simUe.ReadChan
+	for done := false; !done; {
+		select {
+		case quitChan <- &common.DefaultMessage{Event: common.QUIT_EVENT}:
+			quitChan = nil
+		case <-pCtx.ReadChan:
+		case <-simUe.TermCtx.Done():
+			done = true
+		}
+	}
+	simUe.WaitGrp.Wait()
+
+	pCtx.WriteSimChan = InitUE(simUe.Supi, simUe.GnB, simUe.ProfileCtx, pCtx, true)
+}
+
+// saveUeState has the UE record its state for later runs. The UE may remain
+// running once its profile is done, and its state is only accessed by its own
+// routines
+func saveUeState(simUe *simuectx.SimUe) {
+	msg := &common.SaveStateMessage{Done: make(chan struct{})}
+	msg.Event = common.SAVE_STATE_EVENT
+	reqChan := simUe.ReadChan
+	for {
+		select {
+		case reqChan <- msg:
+			reqChan = nil
+		case <-msg.Done:
+			return
+		case <-simUe.ProfileUeCtx.ReadChan:
+			// late results of the UE are dropped
+		case <-simUe.TermCtx.Done():
+			// the state is saved once the UE routines have terminated
+			return
+		}
+	}
 }
 
 func ImsiStateMachine(profile *profctx.Profile, pCtx *profctx.ProfileUeContext, imsiStr string, summaryChan chan common.InterfaceMessage) error {
 	var no_more_proc bool
 	var proc_fail bool
+	var aborted bool
 	var err error
+	// set while the UE backs off after a reject of the network
+	var backoffUntil time.Time
+
+	ueResult := &common.UeResult{Supi: imsiStr}
+	pCtx.Result = ueResult
+	ueStartTime := time.Now()
+	pCtx.SetStatus(common.STATUS_RUNNING)
+	defer func() {
+		ueResult.Duration = time.Since(ueStartTime)
+		ueResult.Status = common.STATUS_PASS
+		if aborted {
+			ueResult.Status = common.STATUS_ABORTED
+			ueResult.Error = err.Error()
+		} else if err != nil {
+			ueResult.Status = common.STATUS_FAIL
+			ueResult.Error = err.Error()
+		}
+		pCtx.SetFinished(ueResult)
+	}()
+
+	// UE may have been aborted before it could be started
+	select {
+	case <-pCtx.Context().Done():
+		aborted = true
+		err = fmt.Errorf("imsi:%v, aborted", imsiStr)
+		return err
+	default:
+	}
 
 	procedure := profile.GetNextProcedure(pCtx, 0)
 	for {
+		// UE may have been aborted while waiting for the next step
+		if pCtx.Context().Err() != nil {
+			err = fmt.Errorf("imsi:%v, aborted", imsiStr)
+			aborted = true
+			break
+		}
+		if wait := time.Until(backoffUntil); wait > 0 && procedure != common.UE_INITIATED_DEREGISTRATION_PROCEDURE {
+			pCtx.Log.Infoln("Backing off for T3346, remaining:", wait)
+			select {
+			case <-time.After(wait):
+			case <-pCtx.Context().Done():
+				err = fmt.Errorf("imsi:%v, aborted", imsiStr)
+				aborted = true
+			}
+			if aborted {
+				break
+			}
+		}
 		// select procedure to execute for imsi
 		simUe := simuectx.GetSimUe(imsiStr)
 		//if simUe == nil {
 		// pass readChan to simUe
 		//}
 		pCtx.Log.Infoln("Execute procedure ", procedure)
+		pCtx.SetCurrentProcedure(procedure)
 		// proc result -  success, fail or timeout
-		timeout := time.Duration(profile.PerUserTimeout) * time.Second
+		timeout := profile.GetProcedureTimeout(pCtx)
 		ticker := time.NewTicker(timeout)
+		startTime := time.Now()
+		metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_STARTED)
 		//Ask simUe to just run procedure and return result
-		go RunProcedure(simUe, procedure)
+		go RunProcedure(simUe, procedure, profile.GetPduSessions(pCtx))
+		procResult := &common.ProcedureResult{Name: procedure.String()}
+		ueResult.Procedures = append(ueResult.Procedures, procResult)
 		pCtx.Log.Infoln("Waiting for procedure result from imsiStateMachine")
+		// set when the procedure did not go as the step expected
+		var stepFailed bool
+		// set when the UE has to be restarted before the next procedure
+		var ueFailed bool
 		select {
 		case <-ticker.C:
+			procResult.Duration = time.Since(startTime)
 			err = fmt.Errorf("imsi:%v, profile timeout", imsiStr)
+			metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_TIMED_OUT)
+			procResult.Status = common.STATUS_TIMEOUT
+			procResult.Error = err.Error()
 			pCtx.Log.Infoln("Procedure Result: FAIL,", err)
+			stepFailed = true
+			ueFailed = true
+		case <-pCtx.Context().Done():
+			procResult.Duration = time.Since(startTime)
+			err = fmt.Errorf("imsi:%v, procedure:%v, aborted", imsiStr, procedure)
+			metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_ABORTED)
+			procResult.Status = common.STATUS_ABORTED
+			procResult.Error = err.Error()
+			pCtx.Log.Infoln("Procedure Result: ABORTED")
+			aborted = true
 			proc_fail = true
 		case msg := <-pCtx.ReadChan:
+			procResult.Duration = time.Since(startTime)
 			pCtx.Log.Infoln("imsiStateMachine received result ")
+			var rejErr *common.RejectError
+			if errors.As(msg.Error, &rejErr) {
+				procResult.Cause = rejErr.CauseString()
+				if profile.HonourT3346 && rejErr.T3346 > 0 {
+					backoffUntil = time.Now().Add(rejErr.T3346)
+				}
+				if msg.Event == common.PROC_PASS_EVENT {
+					pCtx.Log.Infoln("Procedure recovered from reject:", rejErr)
+				}
+			}
 			switch msg.Event {
 			case common.PROC_PASS_EVENT:
 				pCtx.Log.Infoln("Procedure Result: PASS, imsi:", msg.Supi)
+				metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_PASSED)
+				if profile.LatencyRecorder != nil {
+					profile.LatencyRecorder.Record(procedure, procResult.Duration)
+				}
+				updateUeIdentities(pCtx, ueResult)
+				if profile.ExpectFailure(pCtx) {
+					err = fmt.Errorf("imsi:%v, procedure:%v, passed while failure was expected",
+						msg.Supi, msg.Proc)
+					procResult.Status = common.STATUS_FAIL
+					procResult.Error = err.Error()
+					pCtx.Log.Infoln("Result: FAIL,", err)
+					stepFailed = true
+					break
+				}
+				procResult.Status = common.STATUS_PASS
 				procedure = profile.GetNextProcedure(pCtx, simUe.Procedure)
 				if procedure == 0 {
 					no_more_proc = true
 				}
 			case common.PROC_FAIL_EVENT:
 				err = fmt.Errorf("imsi:%v, procedure:%v, error:%v", msg.Supi, msg.Proc, msg.Error)
+				procResult.Error = fmt.Sprint(msg.Error)
+				ueFailed = true
+				// An expected failure counts as a pass
+				if profile.ExpectFailure(pCtx) {
+					pCtx.Log.Infoln("Result: PASS, expected failure,", err)
+					metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_PASSED)
+					if profile.LatencyRecorder != nil {
+						profile.LatencyRecorder.Record(procedure, procResult.Duration)
+					}
+					err = nil
+					procResult.Status = common.STATUS_PASS
+					procedure = profile.GetNextProcedure(pCtx, simUe.Procedure)
+					if procedure == 0 {
+						no_more_proc = true
+					}
+					break
+				}
+				metrics.CountProcedure(profile.Name, procedure.String(), metrics.PROC_FAILED)
+				if profile.LatencyRecorder != nil {
+					profile.LatencyRecorder.RecordFailure(procedure, procResult.Duration)
+				}
+				procResult.Status = common.STATUS_FAIL
 				pCtx.Log.Infoln("Result: FAIL,", err)
+				stepFailed = true
+			}
+		}
+		if stepFailed {
+			var found bool
+			procedure, found = profile.GetFailureProcedure(pCtx)
+			if !found {
 				proc_fail = true
+			} else {
+				pCtx.Log.Infoln("Recovering from failure:", err)
+				err = nil
+				if procedure == 0 {
+					no_more_proc = true
+				}
 			}
 		}
+		if ueFailed && !proc_fail && !no_more_proc {
+			RestartUE(simUe)
+		}
 		ticker.Stop()
 		if no_more_proc == true {
 			pCtx.Log.Infoln("imsiStateMachine no more proc to execute")
@@ -227,9 +514,46 @@ func ImsiStateMachine(profile *profctx.Profile, pCtx *profctx.ProfileUeContext,
 			select {
 			case msg := <-pCtx.TrigEventsChan:
 				pCtx.Log.Infoln("imsiStateMachine received trigger : ", msg)
+			case <-pCtx.Context().Done():
+				pCtx.Log.Infoln("imsiStateMachine aborted while waiting for user trigger")
+				err = fmt.Errorf("imsi:%v, aborted", imsiStr)
+				aborted = true
+			}
+			if aborted {
+				break
 			}
 		}
 	}
 	pCtx.Log.Infoln("imsiStateMachine ended")
+	if simUe := simuectx.GetSimUe(imsiStr); simUe != nil {
+		saveUeState(simUe)
+	}
 	return err
 }
+
+// updateUeIdentities records the GUTI and the PDU addresses acquired by the UE
+// so far, as last reported by RealUe
+func updateUeIdentities(pCtx *profctx.ProfileUeContext, result *common.UeResult) {
+	guti, pduSessions := pCtx.Identities()
+	if guti != "" {
+		result.Guti = guti
+	}
+	for _, pduSess := range pduSessions {
+		// the IPv6 address is known once the Router Advertisement is received
+		for _, addr := range []string{pduSess.PduAddress, pduSess.PduAddressV6} {
+			if addr == "" {
+				continue
+			}
+			found := false
+			for _, a := range result.PduAddresses {
+				if a == addr {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result.PduAddresses = append(result.PduAddresses, addr)
+			}
+		}
+	}
+}
@@ -11,4 +11,5 @@ type Transport interface {
 	SendToPeer(peer TransportPeer, pkt []byte) (err error)
 	ReceiveFromPeer(peer TransportPeer)
 	CheckTransportParam(peer TransportPeer, pkt []byte) error
+	Close() error
 }
@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package uestate keeps the state of the UEs across runs in a JSON file keyed
+// by SUPI, so that UEs resume with the SQN, 5G-GUTI and NAS security context
+// they had when the previous run ended, as a real device does after a reboot
+package uestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/omec-project/gnbsim/logger"
+)
+
+type Config struct {
+	Enable bool   `yaml:"enable" json:"enable"`
+	File   string `yaml:"file" json:"file"`
+}
+
+// State of a UE when it last terminated. Keys are hex strings
+type State struct {
+	Sqn          string    `json:"sqn"` // highest SQN accepted from the network
+	Registered   bool      `json:"registered"`
+	Guti         string    `json:"guti,omitempty"`
+	NgKsi        int32     `json:"ngKsi"`
+	Kamf         string    `json:"kamf,omitempty"`
+	CipheringAlg uint8     `json:"cipheringAlg"`
+	IntegrityAlg uint8     `json:"integrityAlg"`
+	KnasEnc      string    `json:"knasEnc,omitempty"`
+	KnasInt      string    `json:"knasInt,omitempty"`
+	ULCount      uint32    `json:"ulCount"`
+	DLCount      uint32    `json:"dlCount"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+var (
+	file   string
+	states map[string]*State
+
+	// guards file and states
+	mu sync.Mutex
+)
+
+// Init loads the states saved by the previous runs. The store remains
+// disabled if cfg is nil or not enabled
+func Init(cfg *Config) error {
+	if cfg == nil || !cfg.Enable {
+		return nil
+	}
+	if cfg.File == "" {
+		return fmt.Errorf("ue state file not configured")
+	}
+
+	loaded := make(map[string]*State)
+	content, err := ioutil.ReadFile(cfg.File)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %v: %v", cfg.File, err)
+	}
+	if len(content) != 0 {
+		if err = json.Unmarshal(content, &loaded); err != nil {
+			return fmt.Errorf("failed to unmarshal %v: %v", cfg.File, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	file = cfg.File
+	states = loaded
+	logger.AppLog.Infof("Loaded the state of %v UEs from: %v", len(states), file)
+	return nil
+}
+
+// Get returns the last saved state of the UE, nil if unknown or if the store
+// is disabled
+func Get(supi string) *State {
+	mu.Lock()
+	defer mu.Unlock()
+	if state, found := states[supi]; found {
+		copied := *state
+		return &copied
+	}
+	return nil
+}
+
+// Put records the state of the UE, written to the file once gnbsim is done.
+// Nothing is done if the store is disabled
+func Put(supi string, state *State) {
+	mu.Lock()
+	defer mu.Unlock()
+	if states == nil {
+		return
+	}
+	state.UpdatedAt = time.Now()
+	states[supi] = state
+}
+
+// Close writes the states of all the UEs to the file
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if states == nil {
+		return
+	}
+	if err := write(); err != nil {
+		logger.AppLog.Errorln("Failed to save ue states:", err)
+		return
+	}
+	logger.AppLog.Infof("Saved the state of %v UEs to: %v", len(states), file)
+}
+
+func write() error {
+	content, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal ue states: %v", err)
+	}
+
+	// Written to a temporary file first so that a crash does not leave a
+	// truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %v: %v", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package nassecurity provides the 5G NAS ciphering and integrity algorithms.
+// NEA1/NIA1 and NEA2/NIA2 are provided by the nas library, NEA3/NIA3 are
+// implemented here on top of ZUC as the library does not support them
+package nassecurity
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/omec-project/nas/security"
+)
+
+var cipheringAlgNames = map[uint8]string{
+	security.AlgCiphering128NEA0: "NEA0",
+	security.AlgCiphering128NEA1: "NEA1",
+	security.AlgCiphering128NEA2: "NEA2",
+	security.AlgCiphering128NEA3: "NEA3",
+}
+
+var integrityAlgNames = map[uint8]string{
+	security.AlgIntegrity128NIA0: "NIA0",
+	security.AlgIntegrity128NIA1: "NIA1",
+	security.AlgIntegrity128NIA2: "NIA2",
+	security.AlgIntegrity128NIA3: "NIA3",
+}
+
+// CipheringAlgName returns the name of a ciphering algorithm, e.g. NEA2
+func CipheringAlgName(alg uint8) string {
+	if name, found := cipheringAlgNames[alg]; found {
+		return name
+	}
+	return fmt.Sprintf("NEA(%v)", alg)
+}
+
+// IntegrityAlgName returns the name of an integrity algorithm, e.g. NIA2
+func IntegrityAlgName(alg uint8) string {
+	if name, found := integrityAlgNames[alg]; found {
+		return name
+	}
+	return fmt.Sprintf("NIA(%v)", alg)
+}
+
+// ParseCipheringAlgs converts a list of ciphering algorithm names to their
+// identities
+func ParseCipheringAlgs(names []string) ([]uint8, error) {
+	return parseAlgs(names, cipheringAlgNames)
+}
+
+// ParseIntegrityAlgs converts a list of integrity algorithm names to their
+// identities
+func ParseIntegrityAlgs(names []string) ([]uint8, error) {
+	return parseAlgs(names, integrityAlgNames)
+}
+
+func parseAlgs(names []string, algNames map[uint8]string) ([]uint8, error) {
+	var algs []uint8
+	for _, name := range names {
+		found := false
+		for alg, algName := range algNames {
+			if strings.EqualFold(name, algName) {
+				for _, a := range algs {
+					if a == alg {
+						return nil, fmt.Errorf("duplicate algorithm:%v", name)
+					}
+				}
+				algs = append(algs, alg)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown algorithm:%v", name)
+		}
+	}
+	return algs, nil
+}
+
+// NASEncrypt ciphers or deciphers the payload in place as per TS 33.501
+// Annex D
+func NASEncrypt(alg uint8, knasEnc [16]byte, count uint32, bearer uint8,
+	direction uint8, payload []byte) error {
+	if alg != security.AlgCiphering128NEA1 && alg != security.AlgCiphering128NEA3 {
+		return security.NASEncrypt(alg, knasEnc, count, bearer, direction, payload)
+	}
+	if bearer > 0x1f {
+		return fmt.Errorf("bearer is beyond 5 bits")
+	}
+	if direction > 1 {
+		return fmt.Errorf("direction is beyond 1 bit")
+	}
+	if payload == nil {
+		return fmt.Errorf("nas payload is nil")
+	}
+	if alg == security.AlgCiphering128NEA1 {
+		return nea1(knasEnc, count, bearer, direction, payload)
+	}
+	eea3(knasEnc, count, bearer, direction, payload)
+	return nil
+}
+
+// nea1 ciphers the payload in place with the NEA1 of the nas library. The
+// library clears the last word of the key stream when the length is a multiple
+// of 32 bits, leaving the last 4 octets in clear, hence an extra octet is then
+// ciphered and dropped
+func nea1(knasEnc [16]byte, count uint32, bearer, direction uint8, payload []byte) error {
+	ibs := payload
+	if len(payload)%4 == 0 {
+		ibs = make([]byte, len(payload)+1)
+		copy(ibs, payload)
+	}
+	obs, err := security.NEA1(knasEnc, count, uint32(bearer), uint32(direction), ibs, uint32(len(ibs))*8)
+	if err != nil {
+		return err
+	}
+	copy(payload, obs)
+	return nil
+}
+
+// NASMacCalculate returns the 32 bit MAC of the message as per TS 33.501
+// Annex D. The MAC of NIA0 is made of zeros
+func NASMacCalculate(alg uint8, knasInt [16]uint8, count uint32,
+	bearer uint8, direction uint8, msg []byte) ([]byte, error) {
+	switch alg {
+	case security.AlgIntegrity128NIA0:
+		if msg == nil {
+			return nil, fmt.Errorf("nas payload is nil")
+		}
+		return make([]byte, 4), nil
+	case security.AlgIntegrity128NIA3:
+		if bearer > 0x1f {
+			return nil, fmt.Errorf("bearer is beyond 5 bits")
+		}
+		if direction > 1 {
+			return nil, fmt.Errorf("direction is beyond 1 bit")
+		}
+		if msg == nil {
+			return nil, fmt.Errorf("nas payload is nil")
+		}
+		mac := eia3(knasInt, count, bearer, direction, msg, len(msg)*8)
+		return []byte{byte(mac >> 24), byte(mac >> 16), byte(mac >> 8), byte(mac)}, nil
+	default:
+		return security.NASMacCalculate(alg, knasInt, count, bearer, direction, msg)
+	}
+}
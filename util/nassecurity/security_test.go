@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package nassecurity
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/omec-project/nas/security"
+)
+
+// Test vectors of the 128-EEA1/2 and 128-EIA1/2 algorithms of TS 33.401
+// Annex C, reused by the NEA and NIA algorithms of TS 33.501 Annex D
+
+func TestNASEncrypt(t *testing.T) {
+	tests := []struct {
+		name       string
+		alg        uint8
+		key        string
+		count      uint32
+		bearer     uint8
+		direction  uint8
+		length     int
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			name:       "NEA1 test set 1",
+			alg:        security.AlgCiphering128NEA1,
+			key:        "d3c5d592 327fb11c 4035c668 0af8c6d1",
+			count:      0x398a59b4,
+			bearer:     0x15,
+			direction:  1,
+			length:     253,
+			plaintext:  "981ba682 4c1bfb1a b4854720 29b71d80 8ce33e2c c3c0b5fc 1f3de8a6 dc66b1f0",
+			ciphertext: "5d5bfe75 eb04f68c e0a12377 ea00b37d 47c6a0ba 06309155 086a859c 4341b378",
+		},
+		{
+			name:       "NEA1 test set 3",
+			alg:        security.AlgCiphering128NEA1,
+			key:        "5acb1d64 4c0d5120 4ea5f145 1010d852",
+			count:      0xfa556b26,
+			bearer:     0x03,
+			direction:  1,
+			length:     120,
+			plaintext:  "ad9c441f 890b38c4 57a49d42 1407e8",
+			ciphertext: "ba0f3130 0334c56b 52a7497c bac046",
+		},
+		{
+			name:       "NEA2 test set 1",
+			alg:        security.AlgCiphering128NEA2,
+			key:        "d3c5d592 327fb11c 4035c668 0af8c6d1",
+			count:      0x398a59b4,
+			bearer:     0x15,
+			direction:  1,
+			length:     253,
+			plaintext:  "981ba682 4c1bfb1a b4854720 29b71d80 8ce33e2c c3c0b5fc 1f3de8a6 dc66b1f0",
+			ciphertext: "e9fed8a6 3d155304 d71df20b f3e82214 b20ed7da d2f233dc 3c22d7bd eeed8e78",
+		},
+		{
+			name:       "NEA3 test set 1",
+			alg:        security.AlgCiphering128NEA3,
+			key:        "173d14ba 5003731d 7a600494 70f00a29",
+			count:      0x66035492,
+			bearer:     0xf,
+			direction:  0,
+			length:     193,
+			plaintext:  "6cf65340 735552ab 0c9752fa 6f9025fe 0bd675d9 005875b2 00000000",
+			ciphertext: "a6c85fc6 6afb8533 aafc2518 dfe78494 0ee1e4b0 30238cc8 00000000",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := decodeHex(t, tc.plaintext)
+			err := NASEncrypt(tc.alg, decodeKey(t, tc.key), tc.count, tc.bearer, tc.direction, payload)
+			if err != nil {
+				t.Fatalf("NASEncrypt failed: %v", err)
+			}
+			got := maskBits(payload, tc.length)
+			want := maskBits(decodeHex(t, tc.ciphertext), tc.length)
+			if !bytes.Equal(got, want) {
+				t.Errorf("ciphertext = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestNASMacCalculate(t *testing.T) {
+	tests := []struct {
+		name      string
+		alg       uint8
+		key       string
+		count     uint32
+		bearer    uint8
+		direction uint8
+		msg       string
+		mac       string
+	}{
+		{
+			name:      "NIA0",
+			alg:       security.AlgIntegrity128NIA0,
+			key:       "d3c5d592 327fb11c 4035c668 0af8c6d1",
+			count:     0x398a59b4,
+			bearer:    0x1a,
+			direction: 1,
+			msg:       "484583d5 afe082ae",
+			mac:       "00000000",
+		},
+		{
+			name:      "NIA1 test set 1",
+			alg:       security.AlgIntegrity128NIA1,
+			key:       "2bd6459f 82c5b300 952c4910 4881ff48",
+			count:     0x38a6f056,
+			bearer:    0x1f,
+			direction: 0,
+			msg:       "33323462 63393861 373479",
+			mac:       "731f1165",
+		},
+		{
+			name:      "NIA2 test set 1",
+			alg:       security.AlgIntegrity128NIA2,
+			key:       "d3c5d592 327fb11c 4035c668 0af8c6d1",
+			count:     0x398a59b4,
+			bearer:    0x1a,
+			direction: 1,
+			msg:       "484583d5 afe082ae",
+			mac:       "b93787e6",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mac, err := NASMacCalculate(tc.alg, decodeKey(t, tc.key), tc.count, tc.bearer, tc.direction,
+				decodeHex(t, tc.msg))
+			if err != nil {
+				t.Fatalf("NASMacCalculate failed: %v", err)
+			}
+			if want := decodeHex(t, tc.mac); !bytes.Equal(mac, want) {
+				t.Errorf("mac = %x, want %x", mac, want)
+			}
+		})
+	}
+}
+
+func TestNASSecurityInvalidParameters(t *testing.T) {
+	var key [16]byte
+	if err := NASEncrypt(security.AlgCiphering128NEA3, key, 0, 0x20, 0, []byte{0}); err == nil {
+		t.Errorf("NEA3 accepted a bearer beyond 5 bits")
+	}
+	if err := NASEncrypt(security.AlgCiphering128NEA3, key, 0, 0, 2, []byte{0}); err == nil {
+		t.Errorf("NEA3 accepted a direction beyond 1 bit")
+	}
+	if _, err := NASMacCalculate(security.AlgIntegrity128NIA3, key, 0, 0x20, 0, []byte{0}); err == nil {
+		t.Errorf("NIA3 accepted a bearer beyond 5 bits")
+	}
+	if _, err := NASMacCalculate(security.AlgIntegrity128NIA3, key, 0, 0, 0, nil); err == nil {
+		t.Errorf("NIA3 accepted a nil message")
+	}
+}
@@ -0,0 +1,201 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package nassecurity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Test vectors of the ETSI/SAGE specification of the 3GPP confidentiality and
+// integrity algorithms 128-EEA3 & 128-EIA3, document 3: implementor's test data
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid test vector %q: %v", s, err)
+	}
+	return b
+}
+
+func decodeKey(t *testing.T, s string) (key [16]byte) {
+	t.Helper()
+	copy(key[:], decodeHex(t, s))
+	return
+}
+
+// maskBits clears the bits of the octets beyond the first length bits
+func maskBits(b []byte, length int) []byte {
+	b = append([]byte(nil), b[:(length+7)/8]...)
+	if length%8 != 0 {
+		b[len(b)-1] &= byte(0xff << uint(8-length%8))
+	}
+	return b
+}
+
+func TestZucKeystream(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		iv    string
+		words map[int]uint32 // expected words of the key stream, by index
+	}{
+		{
+			name:  "test set 1",
+			key:   "00000000 00000000 00000000 00000000",
+			iv:    "00000000 00000000 00000000 00000000",
+			words: map[int]uint32{0: 0x27bede74, 1: 0x018082da},
+		},
+		{
+			name:  "test set 2",
+			key:   "ffffffff ffffffff ffffffff ffffffff",
+			iv:    "ffffffff ffffffff ffffffff ffffffff",
+			words: map[int]uint32{0: 0x0657cfa0, 1: 0x7096398b},
+		},
+		{
+			name:  "test set 3",
+			key:   "3d4c4be9 6a82fdae b58f641d b17b455b",
+			iv:    "84319aa8 de6915ca 1f6bda6b fbd8c766",
+			words: map[int]uint32{0: 0x14f1c272, 1: 0x3279c419},
+		},
+		{
+			name:  "test set 4",
+			key:   "4d320bfa d4c285bf d6b8bd00 f39d8b41",
+			iv:    "52959dab a0bf176e ce2dc315 049eb574",
+			words: map[int]uint32{0: 0xed4400e7, 1: 0x0633e5c5, 1999: 0x7a574cdb},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			n := 0
+			for i := range tc.words {
+				if i >= n {
+					n = i + 1
+				}
+			}
+			z := newZuc(decodeKey(t, tc.key), decodeKey(t, tc.iv))
+			for i := 0; i < n; i++ {
+				k := z.keyword()
+				if want, found := tc.words[i]; found && k != want {
+					t.Errorf("z%v = %08x, want %08x", i+1, k, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEea3(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		count      uint32
+		bearer     uint8
+		direction  uint8
+		length     int
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			name:       "test set 1",
+			key:        "173d14ba 5003731d 7a600494 70f00a29",
+			count:      0x66035492,
+			bearer:     0xf,
+			direction:  0,
+			length:     193,
+			plaintext:  "6cf65340 735552ab 0c9752fa 6f9025fe 0bd675d9 005875b2 00000000",
+			ciphertext: "a6c85fc6 6afb8533 aafc2518 dfe78494 0ee1e4b0 30238cc8 00000000",
+		},
+		{
+			name:      "test set 2",
+			key:       "e5bd3ea0 eb55ade8 66c6ac58 bd54302a",
+			count:     0x00056823,
+			bearer:    0x18,
+			direction: 1,
+			length:    800,
+			plaintext: "14a8ef69 3d678507 bbe7270a 7f67ff50 06c3525b 9807e467 c4e56000 ba338f5d " +
+				"42955903 67518222 46c80d3b 38f07f4b e2d8ff58 05f51322 29bde93b bbdcaf38 " +
+				"2bf1ee97 2fbf9977 bada8945 847a2a6c 9ad34a66 7554e04d 1f7fa2c3 3241bd8f " +
+				"01ba220d",
+			ciphertext: "131d43e0 dea1be5c 5a1bfd97 1d852cbf 712d7b4f 57961fea 3208afa8 bca433f4 " +
+				"56ad09c7 417e58bc 69cf8866 d1353f74 865e8078 1d202dfb 3ecff7fc bc3b190f " +
+				"e82a204e d0e350fc 0f6f2613 b2f2bca6 df5a473a 57a4a00d 985ebad8 80d6f238 " +
+				"64a07b01",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := decodeHex(t, tc.plaintext)
+			eea3(decodeKey(t, tc.key), tc.count, tc.bearer, tc.direction, payload)
+			got := maskBits(payload, tc.length)
+			want := maskBits(decodeHex(t, tc.ciphertext), tc.length)
+			if !bytes.Equal(got, want) {
+				t.Errorf("ciphertext = %x, want %x", got, want)
+			}
+			// deciphering is the same operation
+			eea3(decodeKey(t, tc.key), tc.count, tc.bearer, tc.direction, payload)
+			if got, want := maskBits(payload, tc.length), maskBits(decodeHex(t, tc.plaintext), tc.length); !bytes.Equal(got, want) {
+				t.Errorf("deciphered = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestEia3(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		count     uint32
+		bearer    uint8
+		direction uint8
+		length    int
+		msg       string
+		mac       uint32
+	}{
+		{
+			name:      "test set 1",
+			key:       "00000000 00000000 00000000 00000000",
+			count:     0,
+			bearer:    0,
+			direction: 0,
+			length:    1,
+			msg:       "00000000",
+			mac:       0xc8a9595e,
+		},
+		{
+			name:      "test set 2",
+			key:       "47054125 561eb2dd a94059da 05097850",
+			count:     0x561eb2dd,
+			bearer:    0x14,
+			direction: 0,
+			length:    90,
+			msg:       "00000000 00000000 00000000",
+			mac:       0x6719a088,
+		},
+		{
+			name:      "test set 3",
+			key:       "c9e6cec4 607c72db 000aefa8 8385ab0a",
+			count:     0xa94059da,
+			bearer:    0xa,
+			direction: 1,
+			length:    577,
+			msg: "983b41d4 7d780c9e 1ad11d7e b70391b1 de0b35da 2dc62f83 e7b78d63 06ca0ea0 " +
+				"7e941b7b e91348f9 fcb170e2 217fecd9 7f9f68ad b16e5d7d 21e569d2 80ed775c " +
+				"ebde3f40 93c53881 00000000",
+			mac: 0xfae8ff0b,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mac := eia3(decodeKey(t, tc.key), tc.count, tc.bearer, tc.direction,
+				decodeHex(t, tc.msg), tc.length)
+			if mac != tc.mac {
+				t.Errorf("mac = %08x, want %08x", mac, tc.mac)
+			}
+		})
+	}
+}
@@ -6,8 +6,10 @@ package nastestpacket
 
 import (
 	"github.com/omec-project/nas"
+	"github.com/omec-project/nas/nasConvert"
 	"github.com/omec-project/nas/nasMessage"
 	"github.com/omec-project/nas/nasType"
+	"github.com/omec-project/openapi/models"
 )
 
 func BuildServiceRequest(serviceType uint8) *nas.Message {
@@ -43,3 +45,155 @@ func BuildServiceRequest(serviceType uint8) *nas.Message {
 	m.GmmMessage.ServiceRequest = serviceRequest
 	return m
 }
+
+func BuildRegistrationRequest(registrationType uint8,
+	mobileIdentity nasType.MobileIdentity5GS,
+	ueSecurityCapability *nasType.UESecurityCapability) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeRegistrationRequest)
+
+	registrationRequest := nasMessage.NewRegistrationRequest(0)
+	registrationRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	registrationRequest.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	registrationRequest.SpareHalfOctetAndSecurityHeaderType.SetSpareHalfOctet(0x00)
+	registrationRequest.RegistrationRequestMessageIdentity.SetMessageType(nas.MsgTypeRegistrationRequest)
+	registrationRequest.NgksiAndRegistrationType5GS.SetTSC(nasMessage.TypeOfSecurityContextFlagNative)
+	registrationRequest.NgksiAndRegistrationType5GS.SetNasKeySetIdentifiler(0x7)
+	registrationRequest.NgksiAndRegistrationType5GS.SetRegistrationType5GS(registrationType)
+	registrationRequest.MobileIdentity5GS = mobileIdentity
+	registrationRequest.UESecurityCapability = ueSecurityCapability
+
+	m.GmmMessage.RegistrationRequest = registrationRequest
+	return m
+}
+
+func BuildPduSessionEstablishmentRequest(pduSessionId, pti, pduSessionType,
+	sscMode uint8) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionEstablishmentRequest)
+
+	pduSessionEstablishmentRequest := nasMessage.NewPDUSessionEstablishmentRequest(0)
+	pduSessionEstablishmentRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pduSessionEstablishmentRequest.SetMessageType(nas.MsgTypePDUSessionEstablishmentRequest)
+	pduSessionEstablishmentRequest.SetPDUSessionID(pduSessionId)
+	pduSessionEstablishmentRequest.SetPTI(pti)
+	pduSessionEstablishmentRequest.IntegrityProtectionMaximumDataRate.
+		SetMaximumDataRatePerUEForUserPlaneIntegrityProtectionForDownLink(0xff)
+	pduSessionEstablishmentRequest.IntegrityProtectionMaximumDataRate.
+		SetMaximumDataRatePerUEForUserPlaneIntegrityProtectionForUpLink(0xff)
+
+	pduSessionEstablishmentRequest.PDUSessionType =
+		nasType.NewPDUSessionType(nasMessage.PDUSessionEstablishmentRequestPDUSessionTypeType)
+	pduSessionEstablishmentRequest.PDUSessionType.SetPDUSessionTypeValue(pduSessionType)
+
+	pduSessionEstablishmentRequest.SSCMode =
+		nasType.NewSSCMode(nasMessage.PDUSessionEstablishmentRequestSSCModeType)
+	pduSessionEstablishmentRequest.SSCMode.SetSSCMode(sscMode)
+
+	pduSessionEstablishmentRequest.ExtendedProtocolConfigurationOptions =
+		nasType.NewExtendedProtocolConfigurationOptions(
+			nasMessage.PDUSessionEstablishmentRequestExtendedProtocolConfigurationOptionsType)
+	protocolConfigurationOptions := nasConvert.NewProtocolConfigurationOptions()
+	protocolConfigurationOptions.AddIPAddressAllocationViaNASSignallingUL()
+	protocolConfigurationOptions.AddDNSServerIPv4AddressRequest()
+	protocolConfigurationOptions.AddDNSServerIPv6AddressRequest()
+	pcoContents := protocolConfigurationOptions.Marshal()
+	pduSessionEstablishmentRequest.ExtendedProtocolConfigurationOptions.SetLen(uint16(len(pcoContents)))
+	pduSessionEstablishmentRequest.ExtendedProtocolConfigurationOptions.
+		SetExtendedProtocolConfigurationOptionsContents(pcoContents)
+
+	m.GsmMessage.PDUSessionEstablishmentRequest = pduSessionEstablishmentRequest
+	return m
+}
+
+func BuildPduSessionModificationRequest(pduSessionId, pti uint8) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionModificationRequest)
+
+	pduSessionModificationRequest := nasMessage.NewPDUSessionModificationRequest(0)
+	pduSessionModificationRequest.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pduSessionModificationRequest.SetMessageType(nas.MsgTypePDUSessionModificationRequest)
+	pduSessionModificationRequest.SetPDUSessionID(pduSessionId)
+	pduSessionModificationRequest.SetPTI(pti)
+
+	m.GsmMessage.PDUSessionModificationRequest = pduSessionModificationRequest
+	return m
+}
+
+func BuildPduSessionModificationComplete(pduSessionId, pti uint8) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionModificationComplete)
+
+	pduSessionModificationComplete := nasMessage.NewPDUSessionModificationComplete(0)
+	pduSessionModificationComplete.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pduSessionModificationComplete.SetMessageType(nas.MsgTypePDUSessionModificationComplete)
+	pduSessionModificationComplete.SetPDUSessionID(pduSessionId)
+	pduSessionModificationComplete.SetPTI(pti)
+
+	m.GsmMessage.PDUSessionModificationComplete = pduSessionModificationComplete
+	return m
+}
+
+func BuildPduSessionModificationCommandReject(pduSessionId, pti,
+	cause uint8) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GsmMessage = nas.NewGsmMessage()
+	m.GsmHeader.SetMessageType(nas.MsgTypePDUSessionModificationCommandReject)
+
+	pduSessionModificationCommandReject := nasMessage.NewPDUSessionModificationCommandReject(0)
+	pduSessionModificationCommandReject.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSSessionManagementMessage)
+	pduSessionModificationCommandReject.SetMessageType(nas.MsgTypePDUSessionModificationCommandReject)
+	pduSessionModificationCommandReject.SetPDUSessionID(pduSessionId)
+	pduSessionModificationCommandReject.SetPTI(pti)
+	pduSessionModificationCommandReject.SetCauseValue(cause)
+
+	m.GsmMessage.PDUSessionModificationCommandReject = pduSessionModificationCommandReject
+	return m
+}
+
+// BuildUlNasTransport builds an UL NAS Transport carrying the given 5GSM
+// message for the PDU session. The request type is not included if zero
+func BuildUlNasTransport(pduSessionId, requestType uint8, dnn string,
+	sNssai *models.Snssai, smPdu []byte) *nas.Message {
+
+	m := nas.NewMessage()
+	m.GmmMessage = nas.NewGmmMessage()
+	m.GmmHeader.SetMessageType(nas.MsgTypeULNASTransport)
+
+	ulNasTransport := nasMessage.NewULNASTransport(0)
+	ulNasTransport.SpareHalfOctetAndSecurityHeaderType.SetSecurityHeaderType(nas.SecurityHeaderTypePlainNas)
+	ulNasTransport.SetMessageType(nas.MsgTypeULNASTransport)
+	ulNasTransport.SetExtendedProtocolDiscriminator(nasMessage.Epd5GSMobilityManagementMessage)
+	ulNasTransport.PduSessionID2Value = nasType.NewPduSessionID2Value(nasMessage.ULNASTransportPduSessionID2ValueType)
+	ulNasTransport.PduSessionID2Value.SetPduSessionID2Value(pduSessionId)
+	if requestType != 0 {
+		ulNasTransport.RequestType = nasType.NewRequestType(nasMessage.ULNASTransportRequestTypeType)
+		ulNasTransport.RequestType.SetRequestTypeValue(requestType)
+	}
+	if dnn != "" {
+		ulNasTransport.DNN = nasType.NewDNN(nasMessage.ULNASTransportDNNType)
+		ulNasTransport.DNN.SetDNN([]byte(dnn))
+	}
+	if sNssai != nil {
+		snssai := nasConvert.SnssaiToNas(*sNssai)
+		ulNasTransport.SNSSAI = nasType.NewSNSSAI(nasMessage.ULNASTransportSNSSAIType)
+		ulNasTransport.SNSSAI.SetLen(snssai[0])
+		copy(ulNasTransport.SNSSAI.Octet[:], snssai[1:])
+	}
+
+	ulNasTransport.SpareHalfOctetAndPayloadContainerType.SetPayloadContainerType(nasMessage.PayloadContainerTypeN1SMInfo)
+	ulNasTransport.PayloadContainer.SetLen(uint16(len(smPdu)))
+	ulNasTransport.PayloadContainer.SetPayloadContainerContents(smPdu)
+
+	m.GmmMessage.ULNASTransport = ulNasTransport
+	return m
+}
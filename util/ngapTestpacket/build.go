@@ -1026,7 +1026,8 @@ func BuildPathSwitchRequest(sourceAmfUeNgapID, ranUeNgapID int64) (pdu ngapType.
 	return pdu
 }
 
-func BuildHandoverRequestAcknowledge(amfUeNgapID, ranUeNgapID int64) (pdu ngapType.NGAPPDU) {
+func BuildHandoverRequestAcknowledge(pduSessions []*PduSession, amfUeNgapID, ranUeNgapID int64,
+	ipv4 string, rrcContainer []byte) (pdu ngapType.NGAPPDU) {
 
 	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
 	pdu.SuccessfulOutcome = new(ngapType.SuccessfulOutcome)
@@ -1074,12 +1075,20 @@ func BuildHandoverRequestAcknowledge(amfUeNgapID, ranUeNgapID int64) (pdu ngapTy
 
 	pDUSessionResourceAdmittedList := ie.Value.PDUSessionResourceAdmittedList
 
-	//PDU SessionResource Admittedy Item
-	pDUSessionResourceAdmittedItem := ngapType.PDUSessionResourceAdmittedItem{}
-	pDUSessionResourceAdmittedItem.PDUSessionID.Value = 10
-	pDUSessionResourceAdmittedItem.HandoverRequestAcknowledgeTransfer = GetHandoverRequestAcknowledgeTransfer()
+	var failedPduSessions []*PduSession
+	for _, pduSess := range pduSessions {
+		if !pduSess.Success {
+			failedPduSessions = append(failedPduSessions, pduSess)
+			continue
+		}
+		//PDU SessionResource Admittedy Item
+		pDUSessionResourceAdmittedItem := ngapType.PDUSessionResourceAdmittedItem{}
+		pDUSessionResourceAdmittedItem.PDUSessionID.Value = pduSess.PduSessId
+		pDUSessionResourceAdmittedItem.HandoverRequestAcknowledgeTransfer =
+			GetHandoverRequestAcknowledgeTransfer(pduSess, ipv4)
 
-	pDUSessionResourceAdmittedList.List = append(pDUSessionResourceAdmittedList.List, pDUSessionResourceAdmittedItem)
+		pDUSessionResourceAdmittedList.List = append(pDUSessionResourceAdmittedList.List, pDUSessionResourceAdmittedItem)
+	}
 
 	handoverRequestAcknowledgeIEs.List = append(handoverRequestAcknowledgeIEs.List, ie)
 
@@ -1092,16 +1101,21 @@ func BuildHandoverRequestAcknowledge(amfUeNgapID, ranUeNgapID int64) (pdu ngapTy
 
 	pDUSessionResourceFailedToSetupListHOAck := ie.Value.PDUSessionResourceFailedToSetupListHOAck
 
-	//PDU Session Resource Failed to setup Item
-	pDUSessionResourceFailedToSetupItemHOAck := ngapType.PDUSessionResourceFailedToSetupItemHOAck{}
-	pDUSessionResourceFailedToSetupItemHOAck.PDUSessionID.Value = 11
-	pDUSessionResourceFailedToSetupItemHOAck.HandoverResourceAllocationUnsuccessfulTransfer =
-		GetHandoverResourceAllocationUnsuccessfulTransfer()
+	for _, pduSess := range failedPduSessions {
+		//PDU Session Resource Failed to setup Item
+		pDUSessionResourceFailedToSetupItemHOAck := ngapType.PDUSessionResourceFailedToSetupItemHOAck{}
+		pDUSessionResourceFailedToSetupItemHOAck.PDUSessionID.Value = pduSess.PduSessId
+		pDUSessionResourceFailedToSetupItemHOAck.HandoverResourceAllocationUnsuccessfulTransfer =
+			GetHandoverResourceAllocationUnsuccessfulTransfer()
 
-	pDUSessionResourceFailedToSetupListHOAck.List =
-		append(pDUSessionResourceFailedToSetupListHOAck.List, pDUSessionResourceFailedToSetupItemHOAck)
+		pDUSessionResourceFailedToSetupListHOAck.List =
+			append(pDUSessionResourceFailedToSetupListHOAck.List, pDUSessionResourceFailedToSetupItemHOAck)
+	}
 
-	handoverRequestAcknowledgeIEs.List = append(handoverRequestAcknowledgeIEs.List, ie)
+	// optional, present only if some PDU sessions could not be set up
+	if len(pDUSessionResourceFailedToSetupListHOAck.List) != 0 {
+		handoverRequestAcknowledgeIEs.List = append(handoverRequestAcknowledgeIEs.List, ie)
+	}
 
 	//Target To Source TransparentContainer
 	ie = ngapType.HandoverRequestAcknowledgeIEs{}
@@ -1111,7 +1125,7 @@ func BuildHandoverRequestAcknowledge(amfUeNgapID, ranUeNgapID int64) (pdu ngapTy
 	ie.Value.TargetToSourceTransparentContainer = new(ngapType.TargetToSourceTransparentContainer)
 
 	targetToSourceTransparentContainer := ie.Value.TargetToSourceTransparentContainer
-	targetToSourceTransparentContainer.Value = aper.OctetString("\x00\x01\x00\x00")
+	targetToSourceTransparentContainer.Value = GetTargetToSourceTransparentTransfer(rrcContainer)
 
 	handoverRequestAcknowledgeIEs.List = append(handoverRequestAcknowledgeIEs.List, ie)
 
@@ -1663,7 +1677,7 @@ func BuildPDUSessionResourceSetupResponseForPaging(pduSessions []*PduSession, am
 	return pdu
 }
 
-func BuildPDUSessionResourceModifyResponse(amfUeNgapID, ranUeNgapID int64) (pdu ngapType.NGAPPDU) {
+func BuildPDUSessionResourceModifyResponse(pduSessions []*PduSession, amfUeNgapID, ranUeNgapID int64) (pdu ngapType.NGAPPDU) {
 
 	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
 	pdu.SuccessfulOutcome = new(ngapType.SuccessfulOutcome)
@@ -1702,71 +1716,54 @@ func BuildPDUSessionResourceModifyResponse(amfUeNgapID, ranUeNgapID int64) (pdu
 
 	pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
 
-	// PDU Session Resource Modify Response List
-	ie = ngapType.PDUSessionResourceModifyResponseIEs{}
-	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceModifyListModRes
-	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
-	ie.Value.Present = ngapType.PDUSessionResourceModifyResponseIEsPresentPDUSessionResourceModifyListModRes
-	ie.Value.PDUSessionResourceModifyListModRes = new(ngapType.PDUSessionResourceModifyListModRes)
-
-	pDUSessionResourceModifyListModRes := ie.Value.PDUSessionResourceModifyListModRes
+	pDUSessionResourceModifyListModRes := new(ngapType.PDUSessionResourceModifyListModRes)
+	pDUSessionResourceFailedToModifyListModRes := new(ngapType.PDUSessionResourceFailedToModifyListModRes)
+	for _, pduSess := range pduSessions {
+		if !pduSess.Success {
+			// PDU Session Resource Failed to Modify Item in PDU Session Resource Failed to Modify List
+			pDUSessionResourceFailedToModifyItem := ngapType.PDUSessionResourceFailedToModifyItemModRes{}
+			pDUSessionResourceFailedToModifyItem.PDUSessionID.Value = pduSess.PduSessId
+			pDUSessionResourceFailedToModifyItem.PDUSessionResourceModifyUnsuccessfulTransfer =
+				GetPDUSessionResourceModifyUnsuccessfulTransfer()
+
+			pDUSessionResourceFailedToModifyListModRes.List =
+				append(pDUSessionResourceFailedToModifyListModRes.List, pDUSessionResourceFailedToModifyItem)
+			continue
+		}
 
-	// PDU Session Resource Modify Response Item in PDU Session Resource Modify Response List
-	pDUSessionResourceModifyResponseItem := ngapType.PDUSessionResourceModifyItemModRes{}
-	pDUSessionResourceModifyResponseItem.PDUSessionID.Value = 10
-	// transfer := GetPDUSessionResourceModifyResponseTransfer()
+		// PDU Session Resource Modify Response Item in PDU Session Resource Modify Response List
+		pDUSessionResourceModifyResponseItem := ngapType.PDUSessionResourceModifyItemModRes{}
+		pDUSessionResourceModifyResponseItem.PDUSessionID.Value = pduSess.PduSessId
+		pDUSessionResourceModifyResponseItem.PDUSessionResourceModifyResponseTransfer =
+			GetPDUSessionResourceModifyResponseTransfer(pduSess)
 
-	pDUSessionResourceModifyResponseItem.PDUSessionResourceModifyResponseTransfer =
-		GetPDUSessionResourceModifyResponseTransfer()
+		pDUSessionResourceModifyListModRes.List =
+			append(pDUSessionResourceModifyListModRes.List, pDUSessionResourceModifyResponseItem)
+	}
 
-	pDUSessionResourceModifyListModRes.List =
-		append(pDUSessionResourceModifyListModRes.List, pDUSessionResourceModifyResponseItem)
+	// PDU Session Resource Modify Response List
+	if len(pDUSessionResourceModifyListModRes.List) != 0 {
+		ie = ngapType.PDUSessionResourceModifyResponseIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceModifyListModRes
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.PDUSessionResourceModifyResponseIEsPresentPDUSessionResourceModifyListModRes
+		ie.Value.PDUSessionResourceModifyListModRes = pDUSessionResourceModifyListModRes
 
-	pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
+		pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
+	}
 
 	// PDU Session Resource Failed to Modify List
-	ie = ngapType.PDUSessionResourceModifyResponseIEs{}
-	ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceFailedToModifyListModRes
-	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
-	ie.Value.Present = ngapType.PDUSessionResourceModifyResponseIEsPresentPDUSessionResourceFailedToModifyListModRes
-	ie.Value.PDUSessionResourceFailedToModifyListModRes = new(ngapType.PDUSessionResourceFailedToModifyListModRes)
-
-	pDUSessionResourceFailedToModifyListModRes := ie.Value.PDUSessionResourceFailedToModifyListModRes
-
-	// PDU Session Resource Failed to Modify Item in PDU Session Resource Failed to Modify List
-	pDUSessionResourceFailedToModifyItem := ngapType.PDUSessionResourceFailedToModifyItemModRes{}
-	pDUSessionResourceFailedToModifyItem.PDUSessionID.Value = 10
-	pDUSessionResourceFailedToModifyItem.PDUSessionResourceModifyUnsuccessfulTransfer =
-		GetPDUSessionResourceModifyUnsuccessfulTransfer()
-
-	pDUSessionResourceFailedToModifyListModRes.List =
-		append(pDUSessionResourceFailedToModifyListModRes.List, pDUSessionResourceFailedToModifyItem)
-
-	pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
-
-	// User Location Information (optional)
-	ie = ngapType.PDUSessionResourceModifyResponseIEs{}
-	ie.Id.Value = ngapType.ProtocolIEIDUserLocationInformation
-	ie.Criticality.Value = ngapType.CriticalityPresentIgnore
-	ie.Value.Present = ngapType.PDUSessionResourceModifyResponseIEsPresentUserLocationInformation
-	ie.Value.UserLocationInformation = new(ngapType.UserLocationInformation)
-
-	userLocationInformation := ie.Value.UserLocationInformation
-	userLocationInformation.Present = ngapType.UserLocationInformationPresentUserLocationInformationNR
-	userLocationInformation.UserLocationInformationNR = new(ngapType.UserLocationInformationNR)
+	if len(pDUSessionResourceFailedToModifyListModRes.List) != 0 {
+		ie = ngapType.PDUSessionResourceModifyResponseIEs{}
+		ie.Id.Value = ngapType.ProtocolIEIDPDUSessionResourceFailedToModifyListModRes
+		ie.Criticality.Value = ngapType.CriticalityPresentIgnore
+		ie.Value.Present = ngapType.PDUSessionResourceModifyResponseIEsPresentPDUSessionResourceFailedToModifyListModRes
+		ie.Value.PDUSessionResourceFailedToModifyListModRes = pDUSessionResourceFailedToModifyListModRes
 
-	userLocationInformationNR := userLocationInformation.UserLocationInformationNR
-	userLocationInformationNR.NRCGI.PLMNIdentity.Value = aper.OctetString("\x02\xf8\x39")
-	userLocationInformationNR.NRCGI.NRCellIdentity.Value = aper.BitString{
-		Bytes:     []byte{0x00, 0x00, 0x00, 0x00, 0x20},
-		BitLength: 36,
+		pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
 	}
 
-	userLocationInformationNR.TAI.PLMNIdentity.Value = aper.OctetString("\x02\xf8\x39")
-	userLocationInformationNR.TAI.TAC.Value = aper.OctetString("\x00\x00\x11")
-
-	pDUSessionResourceModifyResponseIEs.List = append(pDUSessionResourceModifyResponseIEs.List, ie)
-
+	// User Location Information (optional)
 	// Criticality Diagnostics (optional)
 	return pdu
 }
@@ -2137,19 +2134,19 @@ func BuildHandoverNotify(amfUeNgapID int64, ranUeNgapID int64) (pdu ngapType.NGA
 	ie.Value.UserLocationInformation = new(ngapType.UserLocationInformation)
 
 	userLocationInformation := ie.Value.UserLocationInformation
-	userLocationInformation.Present = ngapType.UserLocationInformationPresentUserLocationInformationEUTRA
-	userLocationInformation.UserLocationInformationEUTRA = new(ngapType.UserLocationInformationEUTRA)
-
-	userLocationInformationEUTRA := userLocationInformation.UserLocationInformationEUTRA
-	userLocationInformationEUTRA.TAI.PLMNIdentity.Value = aper.OctetString("\x30\x33\x99")
-	userLocationInformationEUTRA.TAI.TAC.Value = aper.OctetString("\x30\x33\x99")
+	userLocationInformation.Present = ngapType.UserLocationInformationPresentUserLocationInformationNR
+	userLocationInformation.UserLocationInformationNR = new(ngapType.UserLocationInformationNR)
 
-	userLocationInformationEUTRA.EUTRACGI.PLMNIdentity.Value = aper.OctetString("\x30\x33\x99")
-	userLocationInformationEUTRA.EUTRACGI.EUTRACellIdentity.Value = aper.BitString{
-		Bytes:     []byte{0x24, 0x16, 0x08, 0xFF},
-		BitLength: 28,
+	userLocationInformationNR := userLocationInformation.UserLocationInformationNR
+	userLocationInformationNR.NRCGI.PLMNIdentity.Value = TestPlmn.Value
+	userLocationInformationNR.NRCGI.NRCellIdentity.Value = aper.BitString{
+		Bytes:     []byte{0x00, 0x00, 0x00, 0x00, 0x10},
+		BitLength: 36,
 	}
 
+	userLocationInformationNR.TAI.PLMNIdentity.Value = TestPlmn.Value
+	userLocationInformationNR.TAI.TAC.Value = aper.OctetString("\x00\x00\x01")
+
 	handoverNotifyIEs.List = append(handoverNotifyIEs.List, ie)
 
 	return pdu
@@ -3030,8 +3027,8 @@ func BuildAMFConfigurationUpdate(amfName string, guamiList []ngapType.ServedGUAM
 	return pdu
 }
 
-func BuildHandoverRequired(
-	amfUeNgapID, ranUeNgapID int64, targetGNBID []byte, targetCellID []byte) (pdu ngapType.NGAPPDU) {
+func BuildHandoverRequired(pduSessions []*PduSession, amfUeNgapID, ranUeNgapID int64,
+	targetGNBID aper.BitString, targetCellID aper.BitString, rrcContainer []byte) (pdu ngapType.NGAPPDU) {
 
 	pdu.Present = ngapType.NGAPPDUPresentInitiatingMessage
 	pdu.InitiatingMessage = new(ngapType.InitiatingMessage)
@@ -3119,10 +3116,7 @@ func BuildHandoverRequired(
 
 	gNBID := globalRANNodeID.GlobalGNBID.GNBID.GNBID
 
-	*gNBID = aper.BitString{
-		Bytes:     targetGNBID,
-		BitLength: uint64(len(targetGNBID) * 8),
-	}
+	*gNBID = targetGNBID
 	globalRANNodeID.GlobalGNBID.PLMNIdentity.Value = aper.OctetString("\x02\xf8\x39")
 
 	targetRANNodeID.SelectedTAI.PLMNIdentity.Value = aper.OctetString("\x02\xf8\x39")
@@ -3141,14 +3135,19 @@ func BuildHandoverRequired(
 
 	pDUSessionResourceListHORqd := ie.Value.PDUSessionResourceListHORqd
 
-	//PDU Session Resource Item (in PDU Session Resource List)
-	pDUSessionResourceItem := ngapType.PDUSessionResourceItemHORqd{}
-	pDUSessionResourceItem.PDUSessionID.Value = 10
-	pDUSessionResourceItem.HandoverRequiredTransfer = GetHandoverRequiredTransfer()
+	for _, pduSess := range pduSessions {
+		//PDU Session Resource Item (in PDU Session Resource List)
+		pDUSessionResourceItem := ngapType.PDUSessionResourceItemHORqd{}
+		pDUSessionResourceItem.PDUSessionID.Value = pduSess.PduSessId
+		pDUSessionResourceItem.HandoverRequiredTransfer = GetHandoverRequiredTransfer()
 
-	pDUSessionResourceListHORqd.List = append(pDUSessionResourceListHORqd.List, pDUSessionResourceItem)
+		pDUSessionResourceListHORqd.List = append(pDUSessionResourceListHORqd.List, pDUSessionResourceItem)
+	}
 
-	handoverRequiredIEs.List = append(handoverRequiredIEs.List, ie)
+	// optional, present only if the UE has PDU sessions to hand over
+	if len(pDUSessionResourceListHORqd.List) != 0 {
+		handoverRequiredIEs.List = append(handoverRequiredIEs.List, ie)
+	}
 
 	//Source to Target Transparent Container
 	ie = ngapType.HandoverRequiredIEs{}
@@ -3157,7 +3156,8 @@ func BuildHandoverRequired(
 	ie.Value.Present = ngapType.HandoverRequiredIEsPresentSourceToTargetTransparentContainer
 	ie.Value.SourceToTargetTransparentContainer = new(ngapType.SourceToTargetTransparentContainer)
 
-	ie.Value.SourceToTargetTransparentContainer.Value = GetSourceToTargetTransparentTransfer(targetGNBID, targetCellID)
+	ie.Value.SourceToTargetTransparentContainer.Value =
+		GetSourceToTargetTransparentTransfer(pduSessions, targetCellID, rrcContainer)
 
 	handoverRequiredIEs.List = append(handoverRequiredIEs.List, ie)
 
@@ -3276,19 +3276,43 @@ func buildPDUSessionResourceSetupResponseTransfer(pduSession *PduSession,
 	return data
 }
 
-func buildPDUSessionResourceModifyResponseTransfer() (data ngapType.PDUSessionResourceModifyResponseTransfer) {
+func buildPDUSessionResourceModifyResponseTransfer(pduSession *PduSession) (data ngapType.PDUSessionResourceModifyResponseTransfer) {
 
 	// Qos Flow Add or Modify Response List
-	data.QosFlowAddOrModifyResponseList = new(ngapType.QosFlowAddOrModifyResponseList)
-	qosFlowAddOrModifyResponseList := data.QosFlowAddOrModifyResponseList
-
-	qosFlowAddOrModifyResponseItem := ngapType.QosFlowAddOrModifyResponseItem{
-		QosFlowIdentifier: ngapType.QosFlowIdentifier{
-			Value: 1,
-		},
+	if len(pduSession.SuccessQfiList) != 0 {
+		data.QosFlowAddOrModifyResponseList = new(ngapType.QosFlowAddOrModifyResponseList)
+		qosFlowAddOrModifyResponseList := data.QosFlowAddOrModifyResponseList
+
+		for _, qfi := range pduSession.SuccessQfiList {
+			qosFlowAddOrModifyResponseItem := ngapType.QosFlowAddOrModifyResponseItem{
+				QosFlowIdentifier: ngapType.QosFlowIdentifier{
+					Value: qfi,
+				},
+			}
+			qosFlowAddOrModifyResponseList.List = append(qosFlowAddOrModifyResponseList.List, qosFlowAddOrModifyResponseItem)
+		}
 	}
 
-	qosFlowAddOrModifyResponseList.List = append(qosFlowAddOrModifyResponseList.List, qosFlowAddOrModifyResponseItem)
+	// Qos Flow Failed to Add or Modify List
+	if len(pduSession.FailedQfiList) != 0 {
+		data.QosFlowFailedToAddOrModifyList = new(ngapType.QosFlowListWithCause)
+		qosFlowFailedToAddOrModifyList := data.QosFlowFailedToAddOrModifyList
+
+		for _, qfi := range pduSession.FailedQfiList {
+			qosFlowWithCauseItem := ngapType.QosFlowWithCauseItem{
+				QosFlowIdentifier: ngapType.QosFlowIdentifier{
+					Value: qfi,
+				},
+				Cause: ngapType.Cause{
+					Present: ngapType.CausePresentRadioNetwork,
+					RadioNetwork: &ngapType.CauseRadioNetwork{
+						Value: ngapType.CauseRadioNetworkPresentUnspecified,
+					},
+				},
+			}
+			qosFlowFailedToAddOrModifyList.List = append(qosFlowFailedToAddOrModifyList.List, qosFlowWithCauseItem)
+		}
+	}
 
 	return data
 }
@@ -3459,24 +3483,28 @@ func buildPathSwitchRequestSetupFailedTransfer() (data ngapType.PathSwitchReques
 	return data
 }
 
-func buildHandoverRequestAcknowledgeTransfer() (data ngapType.HandoverRequestAcknowledgeTransfer) {
+func buildHandoverRequestAcknowledgeTransfer(pduSession *PduSession,
+	ipv4 string) (data ngapType.HandoverRequestAcknowledgeTransfer) {
 
 	// DL NG-U UP TNL information
 	upTransportLayerInformation := &data.DLNGUUPTNLInformation
 	upTransportLayerInformation.Present = ngapType.UPTransportLayerInformationPresentGTPTunnel
 	upTransportLayerInformation.GTPTunnel = new(ngapType.GTPTunnel)
-	upTransportLayerInformation.GTPTunnel.GTPTEID.Value = aper.OctetString("\x00\x00\x00\x01")
-	upTransportLayerInformation.GTPTunnel.TransportLayerAddress = ngapConvert.IPAddressToNgap("10.200.200.2", "")
+	teidOct := make([]byte, 4)
+	binary.BigEndian.PutUint32(teidOct, pduSession.Teid)
+	upTransportLayerInformation.GTPTunnel.GTPTEID.Value = teidOct
+	upTransportLayerInformation.GTPTunnel.TransportLayerAddress = ngapConvert.IPAddressToNgap(ipv4, "")
 
 	// Qos Flow Setup Response List
-	qosFlowSetupResponseItem := ngapType.QosFlowItemWithDataForwarding{
-		QosFlowIdentifier: ngapType.QosFlowIdentifier{
-			Value: 1,
-		},
+	for _, qfi := range pduSession.SuccessQfiList {
+		qosFlowSetupResponseItem := ngapType.QosFlowItemWithDataForwarding{
+			QosFlowIdentifier: ngapType.QosFlowIdentifier{
+				Value: qfi,
+			},
+		}
+		data.QosFlowSetupResponseList.List = append(data.QosFlowSetupResponseList.List, qosFlowSetupResponseItem)
 	}
 
-	data.QosFlowSetupResponseList.List = append(data.QosFlowSetupResponseList.List, qosFlowSetupResponseItem)
-
 	return data
 }
 
@@ -3499,29 +3527,32 @@ func buildHandoverRequiredTransfer() (data ngapType.HandoverRequiredTransfer) {
 	return data
 }
 
-func buildSourceToTargetTransparentTransfer(
-	targetGNBID []byte, targetCellID []byte) (data ngapType.SourceNGRANNodeToTargetNGRANNodeTransparentContainer) {
+func buildSourceToTargetTransparentTransfer(pduSessions []*PduSession, targetCellID aper.BitString,
+	rrcContainer []byte) (data ngapType.SourceNGRANNodeToTargetNGRANNodeTransparentContainer) {
 
 	// RRC Container
-	data.RRCContainer.Value = aper.OctetString("\x00\x00\x11")
+	data.RRCContainer.Value = rrcContainer
 
 	// PDU Session Resource Information List
-	data.PDUSessionResourceInformationList = new(ngapType.PDUSessionResourceInformationList)
-	infoItem := ngapType.PDUSessionResourceInformationItem{}
-	infoItem.PDUSessionID.Value = 10
-	qosItem := ngapType.QosFlowInformationItem{}
-	qosItem.QosFlowIdentifier.Value = 1
-	infoItem.QosFlowInformationList.List = append(infoItem.QosFlowInformationList.List, qosItem)
-	data.PDUSessionResourceInformationList.List = append(data.PDUSessionResourceInformationList.List, infoItem)
+	if len(pduSessions) != 0 {
+		data.PDUSessionResourceInformationList = new(ngapType.PDUSessionResourceInformationList)
+	}
+	for _, pduSess := range pduSessions {
+		infoItem := ngapType.PDUSessionResourceInformationItem{}
+		infoItem.PDUSessionID.Value = pduSess.PduSessId
+		for _, qfi := range pduSess.SuccessQfiList {
+			qosItem := ngapType.QosFlowInformationItem{}
+			qosItem.QosFlowIdentifier.Value = qfi
+			infoItem.QosFlowInformationList.List = append(infoItem.QosFlowInformationList.List, qosItem)
+		}
+		data.PDUSessionResourceInformationList.List = append(data.PDUSessionResourceInformationList.List, infoItem)
+	}
 
 	// Target Cell ID
-	data.TargetCellID.Present = ngapType.TargetIDPresentTargetRANNodeID
+	data.TargetCellID.Present = ngapType.NGRANCGIPresentNRCGI
 	data.TargetCellID.NRCGI = new(ngapType.NRCGI)
 	data.TargetCellID.NRCGI.PLMNIdentity = TestPlmn
-	data.TargetCellID.NRCGI.NRCellIdentity.Value = aper.BitString{
-		Bytes:     append(targetGNBID, targetCellID...),
-		BitLength: 36,
-	}
+	data.TargetCellID.NRCGI.NRCellIdentity.Value = targetCellID
 
 	// UE History Information
 	lastVisitedCellItem := ngapType.LastVisitedCellItem{}
@@ -3552,8 +3583,8 @@ func GetPDUSessionResourceSetupResponseTransfer(pduSession *PduSession, ipv4 str
 	return encodeData
 }
 
-func GetPDUSessionResourceModifyResponseTransfer() []byte {
-	data := buildPDUSessionResourceModifyResponseTransfer()
+func GetPDUSessionResourceModifyResponseTransfer(pduSession *PduSession) []byte {
+	data := buildPDUSessionResourceModifyResponseTransfer(pduSession)
 	encodeData, err := aper.MarshalWithParams(data, "valueExt")
 	if err != nil {
 		fatal.Fatalf("aper MarshalWithParams error in GetPDUSessionResourceModifyResponseTransfer: %+v", err)
@@ -3660,8 +3691,8 @@ func GetPDUSessionResourceNotifyReleasedTransfer() []byte {
 	return encodeData
 }
 
-func GetHandoverRequestAcknowledgeTransfer() []byte {
-	data := buildHandoverRequestAcknowledgeTransfer()
+func GetHandoverRequestAcknowledgeTransfer(pduSession *PduSession, ipv4 string) []byte {
+	data := buildHandoverRequestAcknowledgeTransfer(pduSession, ipv4)
 	encodeData, err := aper.MarshalWithParams(data, "valueExt")
 	if err != nil {
 		fatal.Fatalf("aper MarshalWithParams error in GetHandoverRequestAcknowledgeTransfer: %+v", err)
@@ -3687,8 +3718,9 @@ func GetHandoverRequiredTransfer() []byte {
 	return encodeData
 }
 
-func GetSourceToTargetTransparentTransfer(targetGNBID []byte, targetCellID []byte) []byte {
-	data := buildSourceToTargetTransparentTransfer(targetGNBID, targetCellID)
+func GetSourceToTargetTransparentTransfer(pduSessions []*PduSession, targetCellID aper.BitString,
+	rrcContainer []byte) []byte {
+	data := buildSourceToTargetTransparentTransfer(pduSessions, targetCellID, rrcContainer)
 	encodeData, err := aper.MarshalWithParams(data, "valueExt")
 	if err != nil {
 		fatal.Fatalf("aper MarshalWithParams error in GetSourceToTargetTransparentTransfer: %+v", err)
@@ -3696,6 +3728,16 @@ func GetSourceToTargetTransparentTransfer(targetGNBID []byte, targetCellID []byt
 	return encodeData
 }
 
+func GetTargetToSourceTransparentTransfer(rrcContainer []byte) []byte {
+	data := ngapType.TargetNGRANNodeToSourceNGRANNodeTransparentContainer{}
+	data.RRCContainer.Value = rrcContainer
+	encodeData, err := aper.MarshalWithParams(data, "valueExt")
+	if err != nil {
+		fatal.Fatalf("aper MarshalWithParams error in GetTargetToSourceTransparentTransfer: %+v", err)
+	}
+	return encodeData
+}
+
 func BuildInitialContextSetupResponseForRegistraionTest(amfUeNgapID, ranUeNgapID int64) (pdu ngapType.NGAPPDU) {
 
 	pdu.Present = ngapType.NGAPPDUPresentSuccessfulOutcome
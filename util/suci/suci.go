@@ -0,0 +1,287 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package suci conceals the MSIN of a SUPI into the scheme output of a SUCI
+// and reveals it back, as per TS 33.501 Annex C. Besides the null scheme, the
+// ECIES Profile A (X25519) and Profile B (secp256r1) are supported
+package suci
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Protection scheme identifiers
+const (
+	NULL_SCHEME uint8 = 0x00
+	PROFILE_A   uint8 = 0x01
+	PROFILE_B   uint8 = 0x02
+)
+
+const (
+	ENC_KEY_LEN int = 16 // AES-128-CTR key
+	ICB_LEN     int = 16 // AES-128-CTR initial counter block
+	MAC_KEY_LEN int = 32 // HMAC-SHA-256 key
+	MAC_LEN     int = 8  // truncated HMAC-SHA-256 tag
+
+	PROFILE_A_PUB_KEY_LEN int = 32 // X25519 public key
+	PROFILE_B_PUB_KEY_LEN int = 33 // compressed secp256r1 public key
+	PRIVATE_KEY_LEN       int = 32
+)
+
+var schemeNames = map[uint8]string{
+	NULL_SCHEME: "null",
+	PROFILE_A:   "profileA",
+	PROFILE_B:   "profileB",
+}
+
+// Params holds what the UE needs to compute its SUCI
+type Params struct {
+	RoutingIndicator       []byte // BCD encoded, 2 octets
+	ProtectionScheme       uint8
+	HomeNetworkPublicKeyId uint8
+	HomeNetworkPublicKey   []byte
+}
+
+// ProtectionSchemeName returns the name of a protection scheme, e.g. profileA
+func ProtectionSchemeName(scheme uint8) string {
+	if name, found := schemeNames[scheme]; found {
+		return name
+	}
+	return fmt.Sprintf("scheme(%v)", scheme)
+}
+
+// ParseProtectionScheme converts the name of a protection scheme to its
+// identifier, null if the name is empty
+func ParseProtectionScheme(name string) (uint8, error) {
+	if name == "" {
+		return NULL_SCHEME, nil
+	}
+	for scheme, schemeName := range schemeNames {
+		if strings.EqualFold(name, schemeName) {
+			return scheme, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown protection scheme:%v", name)
+}
+
+// EncodeRoutingIndicator encodes a routing indicator of 1 to 4 digits in the
+// 2 octets BCD form carried by the SUCI, unused digits are set to 0xf
+func EncodeRoutingIndicator(ri string) ([]byte, error) {
+	if len(ri) == 0 || len(ri) > 4 {
+		return nil, fmt.Errorf("routing indicator should have 1 to 4 digits")
+	}
+	digits := []byte{0xf, 0xf, 0xf, 0xf}
+	for i, c := range ri {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("routing indicator should have only digits")
+		}
+		digits[i] = byte(c - '0')
+	}
+	return []byte{digits[1]<<4 | digits[0], digits[3]<<4 | digits[2]}, nil
+}
+
+// ValidatePublicKey checks the home network public key matches the protection
+// scheme. Profile B keys may be either compressed or uncompressed
+func ValidatePublicKey(scheme uint8, key []byte) error {
+	switch scheme {
+	case NULL_SCHEME:
+		return nil
+	case PROFILE_A:
+		if len(key) != PROFILE_A_PUB_KEY_LEN {
+			return fmt.Errorf("profile A public key should be %v octets long", PROFILE_A_PUB_KEY_LEN)
+		}
+		return nil
+	case PROFILE_B:
+		if x, _ := unmarshalP256(key); x == nil {
+			return fmt.Errorf("invalid profile B public key")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported protection scheme:%v", scheme)
+	}
+}
+
+// Conceal returns the scheme output carrying the BCD encoded MSIN. With the
+// ECIES profiles it is made of the ephemeral public key of the UE, the
+// ciphered MSIN and the MAC tag
+func Conceal(scheme uint8, hnPublicKey []byte, msin []byte) ([]byte, error) {
+	var ephPublicKey, sharedKey []byte
+	switch scheme {
+	case NULL_SCHEME:
+		return append([]byte{}, msin...), nil
+	case PROFILE_A:
+		ephPrivateKey, err := ephemeralPrivateKey(scheme)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key:%v", err)
+		}
+		ephPublicKey, err = curve25519.X25519(ephPrivateKey, curve25519.Basepoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key:%v", err)
+		}
+		sharedKey, err = curve25519.X25519(ephPrivateKey, hnPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive shared key:%v", err)
+		}
+	case PROFILE_B:
+		hx, hy := unmarshalP256(hnPublicKey)
+		if hx == nil {
+			return nil, fmt.Errorf("invalid profile B public key")
+		}
+		curve := elliptic.P256()
+		ephPrivateKey, err := ephemeralPrivateKey(scheme)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key:%v", err)
+		}
+		x, y := curve.ScalarBaseMult(ephPrivateKey)
+		ephPublicKey = elliptic.MarshalCompressed(curve, x, y)
+		sx, _ := curve.ScalarMult(hx, hy, ephPrivateKey)
+		sharedKey = sx.FillBytes(make([]byte, PRIVATE_KEY_LEN))
+	default:
+		return nil, fmt.Errorf("unsupported protection scheme:%v", scheme)
+	}
+
+	encKey, icb, macKey := deriveKeys(sharedKey, ephPublicKey)
+	cipherText, err := aesCtr(encKey, icb, msin)
+	if err != nil {
+		return nil, err
+	}
+
+	output := append(ephPublicKey, cipherText...)
+	return append(output, macTag(macKey, cipherText)...), nil
+}
+
+// Reveal returns the BCD encoded MSIN carried by the scheme output, after
+// checking its MAC tag
+func Reveal(scheme uint8, hnPrivateKey []byte, output []byte) ([]byte, error) {
+	var ephKeyLen int
+	switch scheme {
+	case NULL_SCHEME:
+		return append([]byte{}, output...), nil
+	case PROFILE_A:
+		ephKeyLen = PROFILE_A_PUB_KEY_LEN
+	case PROFILE_B:
+		ephKeyLen = PROFILE_B_PUB_KEY_LEN
+	default:
+		return nil, fmt.Errorf("unsupported protection scheme:%v", scheme)
+	}
+	if len(output) <= ephKeyLen+MAC_LEN {
+		return nil, fmt.Errorf("scheme output too short")
+	}
+	if len(hnPrivateKey) != PRIVATE_KEY_LEN {
+		return nil, fmt.Errorf("private key should be %v octets long", PRIVATE_KEY_LEN)
+	}
+
+	ephPublicKey := output[:ephKeyLen]
+	cipherText := output[ephKeyLen : len(output)-MAC_LEN]
+	mac := output[len(output)-MAC_LEN:]
+
+	var sharedKey []byte
+	if scheme == PROFILE_A {
+		var err error
+		sharedKey, err = curve25519.X25519(hnPrivateKey, ephPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive shared key:%v", err)
+		}
+	} else {
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), ephPublicKey)
+		if x == nil {
+			return nil, fmt.Errorf("invalid ephemeral public key")
+		}
+		sx, _ := elliptic.P256().ScalarMult(x, y, hnPrivateKey)
+		sharedKey = sx.FillBytes(make([]byte, PRIVATE_KEY_LEN))
+	}
+
+	encKey, icb, macKey := deriveKeys(sharedKey, ephPublicKey)
+	if !hmac.Equal(mac, macTag(macKey, cipherText)) {
+		return nil, fmt.Errorf("mac tag mismatch")
+	}
+	return aesCtr(encKey, icb, cipherText)
+}
+
+// PublicKey returns the public key matching a home network private key, the
+// compressed form for Profile B
+func PublicKey(scheme uint8, privateKey []byte) ([]byte, error) {
+	if len(privateKey) != PRIVATE_KEY_LEN {
+		return nil, fmt.Errorf("private key should be %v octets long", PRIVATE_KEY_LEN)
+	}
+	switch scheme {
+	case PROFILE_A:
+		return curve25519.X25519(privateKey, curve25519.Basepoint)
+	case PROFILE_B:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(privateKey)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, fmt.Errorf("invalid profile B private key")
+		}
+		x, y := curve.ScalarBaseMult(privateKey)
+		return elliptic.MarshalCompressed(curve, x, y), nil
+	default:
+		return nil, fmt.Errorf("unsupported protection scheme:%v", scheme)
+	}
+}
+
+// ephemeralPrivateKey generates a fresh ephemeral private key of the UE for
+// each SUCI, the tests replace it to check the known scheme outputs
+var ephemeralPrivateKey = func(scheme uint8) ([]byte, error) {
+	if scheme == PROFILE_B {
+		key, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+		return key, err
+	}
+	key := make([]byte, PRIVATE_KEY_LEN)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func unmarshalP256(key []byte) (x, y *big.Int) {
+	if len(key) == PROFILE_B_PUB_KEY_LEN {
+		return elliptic.UnmarshalCompressed(elliptic.P256(), key)
+	}
+	return elliptic.Unmarshal(elliptic.P256(), key)
+}
+
+// deriveKeys runs the ANSI-X9.63 KDF with SHA-256, the ephemeral public key
+// being the shared info
+func deriveKeys(sharedKey, ephPublicKey []byte) (encKey, icb, macKey []byte) {
+	var k []byte
+	counter := make([]byte, 4)
+	for i := uint32(1); len(k) < ENC_KEY_LEN+ICB_LEN+MAC_KEY_LEN; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h := sha256.New()
+		h.Write(sharedKey)
+		h.Write(counter)
+		h.Write(ephPublicKey)
+		k = h.Sum(k)
+	}
+	return k[:ENC_KEY_LEN], k[ENC_KEY_LEN : ENC_KEY_LEN+ICB_LEN],
+		k[ENC_KEY_LEN+ICB_LEN : ENC_KEY_LEN+ICB_LEN+MAC_KEY_LEN]
+}
+
+func aesCtr(key, icb, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aes cipher:%v", err)
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, icb).XORKeyStream(out, in)
+	return out, nil
+}
+
+func macTag(macKey, cipherText []byte) []byte {
+	h := hmac.New(sha256.New, macKey)
+	h.Write(cipherText)
+	return h.Sum(nil)[:MAC_LEN]
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package suci
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid test vector %q: %v", s, err)
+	}
+	return b
+}
+
+// Test vectors of TS 33.501 Annex C.4, the MSIN 0000002110 of the IMSI
+// 274012000002110 (BCD encoded 00012080f6)
+var suciTests = []struct {
+	name          string
+	scheme        uint8
+	hnPrivateKey  string
+	hnPublicKey   string
+	ephPrivateKey string
+	msin          string
+	output        string
+}{
+	{
+		name:          "profile A",
+		scheme:        PROFILE_A,
+		hnPrivateKey:  "c53c22208b61860b06c62e5406a7b330c2b577aa5558981510d128247d38bd1d",
+		hnPublicKey:   "5a8d38864820197c3394b92613b20b91633cbd897119273bf8e4a6f4eec0a650",
+		ephPrivateKey: "c80949f13ebe61af4ebdbd293ea4f942696b9e815d7e8f0096bbf6ed7de62256",
+		msin:          "00012080f6",
+		output: "b2e92f836055a255837debf850b528997ce0201cb82adfe4be1f587d07d8457d" +
+			"cb02352410" + "cddd9e730ef3fa87",
+	},
+	{
+		name:          "profile B",
+		scheme:        PROFILE_B,
+		hnPrivateKey:  "f1ab1074477ebcc7f554ea1c5fc368b1616730155e0041ac447d6301975fecda",
+		hnPublicKey:   "0272da71976234ce833a6907425867b82e074d44ef907dfb4b3e21c1c2256ebcd1",
+		ephPrivateKey: "99798858a1dc6a2c68637149a4b1dbfd1fdff5addd62a2142f06699ed7602529",
+		msin:          "00012080f6",
+		output: "039aab8376597021e855679a9778ea0b67396e68c66df32c0f41e9acca2da9b9d1" +
+			"46a33fc271" + "6ac7dae96aa30a4d",
+	},
+}
+
+// withEphemeralKey makes Conceal use the given ephemeral private key
+func withEphemeralKey(t *testing.T, key []byte) {
+	generate := ephemeralPrivateKey
+	ephemeralPrivateKey = func(uint8) ([]byte, error) {
+		return key, nil
+	}
+	t.Cleanup(func() { ephemeralPrivateKey = generate })
+}
+
+func TestConceal(t *testing.T) {
+	for _, tc := range suciTests {
+		t.Run(tc.name, func(t *testing.T) {
+			withEphemeralKey(t, decodeHex(t, tc.ephPrivateKey))
+			output, err := Conceal(tc.scheme, decodeHex(t, tc.hnPublicKey), decodeHex(t, tc.msin))
+			if err != nil {
+				t.Fatalf("Conceal failed: %v", err)
+			}
+			if want := decodeHex(t, tc.output); !bytes.Equal(output, want) {
+				t.Errorf("scheme output = %x, want %x", output, want)
+			}
+		})
+	}
+}
+
+func TestReveal(t *testing.T) {
+	for _, tc := range suciTests {
+		t.Run(tc.name, func(t *testing.T) {
+			msin, err := Reveal(tc.scheme, decodeHex(t, tc.hnPrivateKey), decodeHex(t, tc.output))
+			if err != nil {
+				t.Fatalf("Reveal failed: %v", err)
+			}
+			if want := decodeHex(t, tc.msin); !bytes.Equal(msin, want) {
+				t.Errorf("msin = %x, want %x", msin, want)
+			}
+		})
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	for _, tc := range suciTests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := PublicKey(tc.scheme, decodeHex(t, tc.hnPrivateKey))
+			if err != nil {
+				t.Fatalf("PublicKey failed: %v", err)
+			}
+			if want := decodeHex(t, tc.hnPublicKey); !bytes.Equal(key, want) {
+				t.Errorf("public key = %x, want %x", key, want)
+			}
+		})
+	}
+}
+
+func TestConcealRevealRoundTrip(t *testing.T) {
+	msin := decodeHex(t, "1032547698")
+	for _, tc := range suciTests {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := Conceal(tc.scheme, decodeHex(t, tc.hnPublicKey), msin)
+			if err != nil {
+				t.Fatalf("Conceal failed: %v", err)
+			}
+			got, err := Reveal(tc.scheme, decodeHex(t, tc.hnPrivateKey), output)
+			if err != nil {
+				t.Fatalf("Reveal failed: %v", err)
+			}
+			if !bytes.Equal(got, msin) {
+				t.Errorf("msin = %x, want %x", got, msin)
+			}
+		})
+	}
+	t.Run("null scheme", func(t *testing.T) {
+		output, err := Conceal(NULL_SCHEME, nil, msin)
+		if err != nil {
+			t.Fatalf("Conceal failed: %v", err)
+		}
+		got, err := Reveal(NULL_SCHEME, nil, output)
+		if err != nil {
+			t.Fatalf("Reveal failed: %v", err)
+		}
+		if !bytes.Equal(got, msin) {
+			t.Errorf("msin = %x, want %x", got, msin)
+		}
+	})
+}
+
+func TestRevealRejects(t *testing.T) {
+	for _, tc := range suciTests {
+		t.Run(tc.name+" tampered mac", func(t *testing.T) {
+			output := decodeHex(t, tc.output)
+			output[len(output)-1] ^= 0x01
+			if _, err := Reveal(tc.scheme, decodeHex(t, tc.hnPrivateKey), output); err == nil {
+				t.Errorf("Reveal accepted a tampered mac tag")
+			}
+		})
+		t.Run(tc.name+" tampered cipher text", func(t *testing.T) {
+			output := decodeHex(t, tc.output)
+			output[len(output)-MAC_LEN-1] ^= 0x01
+			if _, err := Reveal(tc.scheme, decodeHex(t, tc.hnPrivateKey), output); err == nil {
+				t.Errorf("Reveal accepted a tampered cipher text")
+			}
+		})
+		t.Run(tc.name+" short output", func(t *testing.T) {
+			output := decodeHex(t, tc.output)
+			// ephemeral public key and mac tag without cipher text
+			output = append(output[:len(output)-MAC_LEN-5], output[len(output)-MAC_LEN:]...)
+			if _, err := Reveal(tc.scheme, decodeHex(t, tc.hnPrivateKey), output); err == nil {
+				t.Errorf("Reveal accepted a scheme output without cipher text")
+			}
+		})
+	}
+}
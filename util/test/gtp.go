@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
 
 	"github.com/omec-project/gnbsim/logger"
 )
@@ -23,7 +24,8 @@ const (
 	FLAG_OPTIONAL          uint8 = (FLAG_EXT_HEADER | FLAG_SEQ_NUM | FLAG_NPDU_NUM)
 
 	/* GTPv1 Message Types Spec 3GPP TS-29281 */
-	TYPE_GPDU uint8 = 0xff
+	TYPE_ERROR_INDICATION uint8 = 0x1a
+	TYPE_GPDU             uint8 = 0xff
 
 	/* GTPv1 IE Types Spec 3GPP TS-29281 */
 	TEID_DATA_IE      uint8 = 0x10
@@ -36,6 +38,8 @@ const (
 	fields */
 	OPT_GTPU_HEADER_LENGTH uint16 = 4
 
+	/* GTPv1 Extension Header Types Spec 3GPP TS-29281 */
+	UDP_PORT_EXT_HEADER_TYPE           uint8 = 0x40
 	PDU_SESS_CONTAINER_EXT_HEADER_TYPE uint8 = 0x85
 )
 
@@ -53,9 +57,17 @@ type GtpHdrOpt struct {
 	NextHdrType uint8  //Next Extenstion Header Type
 }
 
+// GtpExtHdr is a GTP-U Extension Header, TS 29.281 Section 5.2
+type GtpExtHdr struct {
+	Type    uint8   //Extension Header Type, given by the preceding header
+	Content []uint8 //Extension Header Content, excluding the Length and
+	// Next Extension Header Type octets
+}
+
 type GtpPdu struct {
 	Hdr     *GtpHdr
 	OptHdr  *GtpHdrOpt
+	ExtHdrs []*GtpExtHdr //Extension Headers, in the order of the chain
 	Payload []uint8
 }
 
@@ -155,10 +167,61 @@ func DecodeGTPv1Header(pkt []byte) (gtpPdu *GtpPdu, err error) {
 		return
 	}
 
+	if (gtpPdu.Hdr.Flags & FLAG_EXT_HEADER) != 0 {
+		gtpPdu.ExtHdrs, payloadStart, err = decodeExtHeaders(pkt,
+			gtpPdu.OptHdr.NextHdrType, payloadStart)
+		if err != nil {
+			return
+		}
+	}
+
 	gtpPdu.Payload = pkt[payloadStart:payloadEnd]
 	return
 }
 
+// decodeExtHeaders walks the Extension Header chain starting at offset, and
+// returns the offset of the octet following the last Extension Header
+func decodeExtHeaders(pkt []byte, nextHdrType uint8, offset uint16) (
+	extHdrs []*GtpExtHdr, payloadStart uint16, err error) {
+
+	payloadStart = offset
+	for nextHdrType != 0 {
+		if int(payloadStart) >= len(pkt) {
+			err = fmt.Errorf("missing extension header of type:%v", nextHdrType)
+			return
+		}
+
+		// First octet is Extension Header Length in 4 octets units
+		octetCount := uint16(pkt[payloadStart]) * 4
+		if octetCount == 0 || int(payloadStart+octetCount) > len(pkt) {
+			err = fmt.Errorf("invalid extension header length value:%v",
+				pkt[payloadStart])
+			return
+		}
+
+		extHdr := &GtpExtHdr{Type: nextHdrType}
+		extHdr.Content = pkt[payloadStart+1 : payloadStart+octetCount-1]
+		extHdrs = append(extHdrs, extHdr)
+		logger.GtpLog.Traceln("Extension header type:", extHdr.Type,
+			"length:", octetCount)
+
+		// Last octet of Extension header is Next Extension Header Type
+		nextHdrType = pkt[payloadStart+octetCount-1]
+		payloadStart += octetCount
+	}
+	return
+}
+
+// GetExtHeader returns the first Extension Header of the given type, if any
+func (gtpPdu *GtpPdu) GetExtHeader(extHdrType uint8) *GtpExtHdr {
+	for _, extHdr := range gtpPdu.ExtHdrs {
+		if extHdr.Type == extHdrType {
+			return extHdr
+		}
+	}
+	return nil
+}
+
 func BuildPduSessContainerExtHeader(qfi uint8) []uint8 {
 	pdu := BuildUlPduSessInformation(qfi)
 
@@ -237,3 +300,74 @@ func BuildGpduMessage(payload []byte, teID uint32) ([]byte, error) {
 	b = append(b, payload...)
 	return b, nil
 }
+
+// BuildErrorIndication builds the Error Indication reporting a G-PDU received
+// for an unknown TEID, along with the address the G-PDU was sent to
+// (TS 29.281 Section 7.3.1)
+func BuildErrorIndication(teID uint32, peerAddr net.IP) ([]byte, error) {
+	addr := peerAddr.To4()
+	if addr == nil {
+		addr = peerAddr.To16()
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("invalid gtp-u peer address:%v", peerAddr)
+	}
+
+	var ies bytes.Buffer
+	ies.WriteByte(TEID_DATA_IE)
+	binary.Write(&ies, binary.BigEndian, teID)
+	ies.WriteByte(GTPU_PEER_ADDR_IE)
+	binary.Write(&ies, binary.BigEndian, uint16(len(addr)))
+	ies.Write(addr)
+
+	/* The sequence number is present, the TEID of the header is 0 */
+	b, err := BuildGTPv1Header(false, true, false, 0, 0, 0,
+		TYPE_ERROR_INDICATION, uint16(ies.Len()), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, ies.Bytes()...), nil
+}
+
+// DecodeErrorIndication returns the TEID and the GTP-U peer address reported
+// by the Error Indication. The payload is the one of the decoded GtpPdu, which
+// excludes the Extension Headers such as the UDP Port one
+func DecodeErrorIndication(payload []byte) (teID uint32, peerAddr net.IP,
+	err error) {
+
+	var teidFound bool
+	for len(payload) != 0 {
+		switch payload[0] {
+		case TEID_DATA_IE:
+			if len(payload) < 5 {
+				err = fmt.Errorf("incomplete teid data i ie")
+				return
+			}
+			teID = binary.BigEndian.Uint32(payload[1:5])
+			teidFound = true
+			payload = payload[5:]
+		case GTPU_PEER_ADDR_IE:
+			if len(payload) < 3 {
+				err = fmt.Errorf("incomplete gtp-u peer address ie")
+				return
+			}
+			ieLen := int(binary.BigEndian.Uint16(payload[1:3]))
+			if len(payload) < 3+ieLen || (ieLen != net.IPv4len && ieLen != net.IPv6len) {
+				err = fmt.Errorf("invalid gtp-u peer address ie length:%v", ieLen)
+				return
+			}
+			peerAddr = net.IP(payload[3 : 3+ieLen])
+			payload = payload[3+ieLen:]
+		default:
+			// Private Extension IE, ignored along with the IEs following it
+			logger.GtpLog.Traceln("Ignoring IE type:", payload[0])
+			payload = nil
+		}
+	}
+
+	if !teidFound || peerAddr == nil {
+		err = fmt.Errorf("mandatory ie missing in error indication")
+	}
+	return
+}
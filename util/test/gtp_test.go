@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2021 Open Networking Foundation <info@opennetworking.org>
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid test vector %q: %v", s, err)
+	}
+	return b
+}
+
+// Error Indication carrying the UDP Port Extension Header, TS 29.281 Section
+// 5.2.2.1, followed by the TEID Data I and GTP-U Peer Address IEs
+func TestDecodeErrorIndicationWithExtHeader(t *testing.T) {
+	pkt := decodeHex(t, "361a0014 00000000 00000040 01086800"+
+		"1012345678 850004c0a80101")
+
+	gtpPdu, err := DecodeGTPv1Header(pkt)
+	if err != nil {
+		t.Fatalf("DecodeGTPv1Header() returned: %v", err)
+	}
+	if len(gtpPdu.ExtHdrs) != 1 || gtpPdu.ExtHdrs[0].Type != UDP_PORT_EXT_HEADER_TYPE ||
+		!bytes.Equal(gtpPdu.ExtHdrs[0].Content, []byte{0x08, 0x68}) {
+		t.Errorf("unexpected extension headers: %+v", gtpPdu.ExtHdrs)
+	}
+
+	teid, peerAddr, err := DecodeErrorIndication(gtpPdu.Payload)
+	if err != nil {
+		t.Fatalf("DecodeErrorIndication() returned: %v", err)
+	}
+	if teid != 0x12345678 || !peerAddr.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("teid = %#x, peer address = %v", teid, peerAddr)
+	}
+}
+
+func TestDecodeErrorIndication(t *testing.T) {
+	pkt, err := BuildErrorIndication(7, net.ParseIP("2001:db8::1"))
+	if err != nil {
+		t.Fatalf("BuildErrorIndication() returned: %v", err)
+	}
+	gtpPdu, err := DecodeGTPv1Header(pkt)
+	if err != nil {
+		t.Fatalf("DecodeGTPv1Header() returned: %v", err)
+	}
+	teid, peerAddr, err := DecodeErrorIndication(gtpPdu.Payload)
+	if err != nil {
+		t.Fatalf("DecodeErrorIndication() returned: %v", err)
+	}
+	if teid != 7 || !peerAddr.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("teid = %v, peer address = %v", teid, peerAddr)
+	}
+}
+
+// Downlink G-PDU carrying the PDU Session Container with QFI 9, chained to the
+// UDP Port Extension Header
+func TestDecodeGTPv1HeaderExtHeaderChain(t *testing.T) {
+	pkt := decodeHex(t, "34ff0010 00000001 00000085 01000940 01086800 deadbeef")
+
+	gtpPdu, err := DecodeGTPv1Header(pkt)
+	if err != nil {
+		t.Fatalf("DecodeGTPv1Header() returned: %v", err)
+	}
+	if len(gtpPdu.ExtHdrs) != 2 {
+		t.Fatalf("decoded %v extension headers, want 2", len(gtpPdu.ExtHdrs))
+	}
+	if gtpPdu.GetExtHeader(UDP_PORT_EXT_HEADER_TYPE) == nil {
+		t.Errorf("udp port extension header not found")
+	}
+	extHdr := gtpPdu.GetExtHeader(PDU_SESS_CONTAINER_EXT_HEADER_TYPE)
+	if extHdr == nil {
+		t.Fatalf("pdu session container extension header not found")
+	}
+	qfi, err := DecodeDlPduSessInformation(extHdr.Content)
+	if err != nil || qfi != 9 {
+		t.Errorf("qfi = %v, err = %v", qfi, err)
+	}
+	if !bytes.Equal(gtpPdu.Payload, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("payload = %x", gtpPdu.Payload)
+	}
+}
+
+func TestDecodeGTPv1HeaderInvalidExtHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  string
+	}{
+		{"zero length", "34ff0008 00000001 00000040 00086800"},
+		{"length beyond packet", "34ff0008 00000001 00000040 02086800"},
+		{"missing next header", "34ff0008 00000001 00000040 01086840"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeGTPv1Header(decodeHex(t, tc.pkt))
+			if err == nil {
+				t.Errorf("DecodeGTPv1Header() accepted an invalid extension header chain")
+			}
+		})
+	}
+}
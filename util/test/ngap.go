@@ -6,6 +6,8 @@
 package test
 
 import (
+	"fmt"
+
 	"github.com/omec-project/gnbsim/logger"
 
 	"github.com/omec-project/aper"
@@ -35,3 +37,21 @@ func PrintAndGetCause(cause *ngapType.Cause) (present int, value aper.Enumerated
 	}
 	return
 }
+
+// CauseString returns the cause group and value, e.g. RadioNetwork[14]
+func CauseString(cause *ngapType.Cause) string {
+	switch cause.Present {
+	case ngapType.CausePresentRadioNetwork:
+		return fmt.Sprintf("RadioNetwork[%d]", cause.RadioNetwork.Value)
+	case ngapType.CausePresentTransport:
+		return fmt.Sprintf("Transport[%d]", cause.Transport.Value)
+	case ngapType.CausePresentProtocol:
+		return fmt.Sprintf("Protocol[%d]", cause.Protocol.Value)
+	case ngapType.CausePresentNas:
+		return fmt.Sprintf("Nas[%d]", cause.Nas.Value)
+	case ngapType.CausePresentMisc:
+		return fmt.Sprintf("Misc[%d]", cause.Misc.Value)
+	default:
+		return fmt.Sprintf("Invalid[%d]", cause.Present)
+	}
+}
@@ -5,6 +5,7 @@
 package test
 
 import (
+	"github.com/omec-project/aper"
 	"github.com/omec-project/gnbsim/util/ngapTestpacket"
 	"github.com/omec-project/ngap"
 )
@@ -71,6 +72,12 @@ func GetPDUSessionResourceReleaseResponse(amfUeNgapID int64, ranUeNgapID int64)
 	message := ngapTestpacket.BuildPDUSessionResourceReleaseResponseForReleaseTest(amfUeNgapID, ranUeNgapID)
 	return ngap.Encoder(message)
 }
+func GetPDUSessionResourceModifyResponse(pduSessions []*ngapTestpacket.PduSession,
+	amfUeNgapID int64, ranUeNgapID int64) ([]byte, error) {
+	message := ngapTestpacket.BuildPDUSessionResourceModifyResponse(pduSessions,
+		amfUeNgapID, ranUeNgapID)
+	return ngap.Encoder(message)
+}
 func GetPathSwitchRequest(amfUeNgapID int64, ranUeNgapID int64) ([]byte, error) {
 	message := ngapTestpacket.BuildPathSwitchRequest(amfUeNgapID, ranUeNgapID)
 	message.InitiatingMessage.Value.PathSwitchRequest.ProtocolIEs.List =
@@ -78,14 +85,18 @@ func GetPathSwitchRequest(amfUeNgapID int64, ranUeNgapID int64) ([]byte, error)
 	return ngap.Encoder(message)
 }
 
-func GetHandoverRequired(
-	amfUeNgapID int64, ranUeNgapID int64, targetGNBID []byte, targetCellID []byte) ([]byte, error) {
-	message := ngapTestpacket.BuildHandoverRequired(amfUeNgapID, ranUeNgapID, targetGNBID, targetCellID)
+func GetHandoverRequired(pduSessions []*ngapTestpacket.PduSession, amfUeNgapID int64,
+	ranUeNgapID int64, targetGNBID aper.BitString, targetCellID aper.BitString,
+	rrcContainer []byte) ([]byte, error) {
+	message := ngapTestpacket.BuildHandoverRequired(pduSessions, amfUeNgapID, ranUeNgapID,
+		targetGNBID, targetCellID, rrcContainer)
 	return ngap.Encoder(message)
 }
 
-func GetHandoverRequestAcknowledge(amfUeNgapID int64, ranUeNgapID int64) ([]byte, error) {
-	message := ngapTestpacket.BuildHandoverRequestAcknowledge(amfUeNgapID, ranUeNgapID)
+func GetHandoverRequestAcknowledge(pduSessions []*ngapTestpacket.PduSession,
+	amfUeNgapID int64, ranUeNgapID int64, ipv4 string, rrcContainer []byte) ([]byte, error) {
+	message := ngapTestpacket.BuildHandoverRequestAcknowledge(pduSessions,
+		amfUeNgapID, ranUeNgapID, ipv4, rrcContainer)
 	return ngap.Encoder(message)
 }
 